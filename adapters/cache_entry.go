@@ -0,0 +1,366 @@
+package adapters
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheEntryVersion is the version written by Set. Entries stored before
+// versioning was introduced have no "v" field and are read as version 0.
+const cacheEntryVersion = 1
+
+// hash fields of a versioned cache entry
+const (
+	entryVersionField = "v"
+	entryDataField    = "entry"
+	// entryVaryField replaces entryDataField on the base key of a response
+	// that varies, it lists the Vary header names selecting the variant key
+	entryVaryField = "vary"
+)
+
+// cacheEntry is the in-memory form of a cached response, independent of the
+// version it was stored with.
+type cacheEntry struct {
+	Version    uint8
+	Method     string
+	URL        string
+	StoredAt   time.Time
+	Status     string
+	StatusCode int
+	Proto      string
+	ProtoMajor int
+	ProtoMinor int
+	Header     http.Header
+	Trailer    http.Header
+	// VaryKeys are the canonical header names listed in the response Vary
+	// header, VaryValues the request values they had when the entry was stored.
+	VaryKeys   []string
+	VaryValues http.Header
+	Body       []byte
+}
+
+func newCacheEntry(req *http.Request, res *http.Response, storedAt time.Time) (*cacheEntry, error) {
+	if req == nil {
+		return nil, errors.New("newCacheEntry(*http.Request = nil)")
+	}
+	if res == nil {
+		return nil, errors.New("newCacheEntry(*http.Response = nil)")
+	}
+	var body []byte
+	if res.Body != nil {
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = b
+		// the body is done with, closing it tells the filters wrapping it,
+		// e.g. the upstream pool counting the requests in flight
+		res.Body.Close()
+		// Reset the response body so it can be read again
+		res.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+	}
+
+	varyKeys := varyHeaderKeys(res.Header)
+	varyValues := http.Header{}
+	for _, k := range varyKeys {
+		if vv := req.Header.Values(k); len(vv) > 0 {
+			varyValues[k] = append([]string(nil), vv...)
+		}
+	}
+
+	return &cacheEntry{
+		Version:    cacheEntryVersion,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		StoredAt:   storedAt,
+		Status:     res.Status,
+		StatusCode: res.StatusCode,
+		Proto:      res.Proto,
+		ProtoMajor: res.ProtoMajor,
+		ProtoMinor: res.ProtoMinor,
+		Header:     res.Header.Clone(),
+		Trailer:    res.Trailer.Clone(),
+		VaryKeys:   varyKeys,
+		VaryValues: varyValues,
+		Body:       body,
+	}, nil
+}
+
+// varyHeaderKeys returns the sorted, canonicalized field names of the Vary header.
+func varyHeaderKeys(h http.Header) []string {
+	var keys []string
+	seen := map[string]bool{}
+	for _, v := range h.Values("Vary") {
+		for _, k := range strings.Split(v, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if k == "" || seen[k] {
+				continue
+			}
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// matches reports whether req selects this entry according to its Vary keys.
+func (e *cacheEntry) matches(req *http.Request) bool {
+	for _, k := range e.VaryKeys {
+		if k == "*" {
+			return false
+		}
+		if strings.Join(req.Header.Values(k), ",") != strings.Join(e.VaryValues.Values(k), ",") {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *cacheEntry) toHttpResponse(now time.Time) *http.Response {
+	header := e.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if !e.StoredAt.IsZero() {
+		age := now.Sub(e.StoredAt)
+		if age < 0 {
+			age = 0
+		}
+		header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	}
+	return &http.Response{
+		Status:        e.Status,
+		StatusCode:    e.StatusCode,
+		Header:        header,
+		Trailer:       e.Trailer.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewBuffer(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Proto:         e.Proto,
+		ProtoMajor:    e.ProtoMajor,
+		ProtoMinor:    e.ProtoMinor,
+	}
+}
+
+// MarshalBinary encodes the entry with the current version layout:
+//
+//	version(1 byte) method url storedAt(varint unix nano) status statusCode
+//	proto protoMajor protoMinor header trailer varyKeys varyValues body
+//
+// strings and byte slices are uvarint length prefixed, headers are a uvarint
+// count of keys each followed by its uvarint counted values.
+func (e *cacheEntry) MarshalBinary() ([]byte, error) {
+	w := &entryWriter{}
+	w.buf = append(w.buf, cacheEntryVersion)
+	w.string(e.Method)
+	w.string(e.URL)
+	var storedAt int64
+	if !e.StoredAt.IsZero() {
+		storedAt = e.StoredAt.UnixNano()
+	}
+	w.varint(storedAt)
+	w.string(e.Status)
+	w.varint(int64(e.StatusCode))
+	w.string(e.Proto)
+	w.varint(int64(e.ProtoMajor))
+	w.varint(int64(e.ProtoMinor))
+	w.header(e.Header)
+	w.header(e.Trailer)
+	w.strings(e.VaryKeys)
+	w.header(e.VaryValues)
+	w.bytes(e.Body)
+	return w.buf, nil
+}
+
+// UnmarshalBinary decodes an entry written by MarshalBinary of any known version.
+func (e *cacheEntry) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("cacheEntry.UnmarshalBinary() : empty data")
+	}
+	switch data[0] {
+	case 1:
+		return e.unmarshalV1(data[1:])
+	default:
+		return fmt.Errorf("cacheEntry.UnmarshalBinary() : unsupported entry version %d", data[0])
+	}
+}
+
+func (e *cacheEntry) unmarshalV1(data []byte) error {
+	r := &entryReader{buf: data}
+	*e = cacheEntry{Version: 1}
+	e.Method = r.string()
+	e.URL = r.string()
+	if storedAt := r.varint(); storedAt != 0 {
+		e.StoredAt = time.Unix(0, storedAt)
+	}
+	e.Status = r.string()
+	e.StatusCode = int(r.varint())
+	e.Proto = r.string()
+	e.ProtoMajor = int(r.varint())
+	e.ProtoMinor = int(r.varint())
+	e.Header = r.header()
+	e.Trailer = r.header()
+	e.VaryKeys = r.strings()
+	e.VaryValues = r.header()
+	e.Body = r.bytes()
+	if r.err != nil {
+		return fmt.Errorf("cacheEntry.UnmarshalBinary() : corrupted v1 entry : %w", r.err)
+	}
+	return nil
+}
+
+// cacheEntryFromLegacy converts an entry stored before versioning (v0), whose
+// fields are spread over the redis hash and whose header is JSON encoded.
+func cacheEntryFromLegacy(legacy cacheHttpResponse) (*cacheEntry, error) {
+	header, err := JSONToHeader(legacy.HeaderJSON)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheEntry{
+		Version:    0,
+		Status:     legacy.Status,
+		StatusCode: legacy.StatusCode,
+		Proto:      legacy.Proto,
+		ProtoMajor: legacy.ProtoMajor,
+		ProtoMinor: legacy.ProtoMinor,
+		Header:     header,
+		Body:       legacy.Body,
+	}, nil
+}
+
+type entryWriter struct {
+	buf []byte
+}
+
+func (w *entryWriter) uvarint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+func (w *entryWriter) varint(v int64) {
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+func (w *entryWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *entryWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *entryWriter) strings(ss []string) {
+	w.uvarint(uint64(len(ss)))
+	for _, s := range ss {
+		w.string(s)
+	}
+}
+
+func (w *entryWriter) header(h http.Header) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w.uvarint(uint64(len(keys)))
+	for _, k := range keys {
+		w.string(k)
+		w.strings(h[k])
+	}
+}
+
+// entryReader decodes the primitives written by entryWriter, the first
+// error sticks and zero values are returned from then on.
+type entryReader struct {
+	buf []byte
+	err error
+}
+
+var errShortEntry = errors.New("unexpected end of entry")
+
+func (r *entryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errShortEntry
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *entryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errShortEntry
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *entryReader) bytes() []byte {
+	l := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if uint64(len(r.buf)) < l {
+		r.err = errShortEntry
+		return nil
+	}
+	b := make([]byte, l)
+	copy(b, r.buf[:l])
+	r.buf = r.buf[l:]
+	return b
+}
+
+func (r *entryReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *entryReader) strings() []string {
+	n := r.uvarint()
+	if r.err != nil || n == 0 {
+		return nil
+	}
+	if n > uint64(len(r.buf)) {
+		r.err = errShortEntry
+		return nil
+	}
+	ss := make([]string, 0, n)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		ss = append(ss, r.string())
+	}
+	return ss
+}
+
+func (r *entryReader) header() http.Header {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.buf)) {
+		r.err = errShortEntry
+		return nil
+	}
+	h := make(http.Header, n)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		k := r.string()
+		h[k] = r.strings()
+	}
+	return h
+}
@@ -0,0 +1,162 @@
+package adapters
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheEntryBinaryRoundTrip(t *testing.T) {
+	storedAt := time.Unix(1700000000, 42)
+	req := mustNewRequest("GET", "http://example.com/api?x=1", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res := &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+			"Vary":         []string{"accept-encoding, Accept-Language"},
+			"Set-Cookie":   []string{"a=1", "b=2"},
+		},
+		Trailer:    http.Header{"X-Checksum": []string{"abc"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"message":"Hello, World!"}`)),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+
+	entry, err := newCacheEntry(req, res, storedAt)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Accept-Encoding", "Accept-Language"}, entry.VaryKeys)
+
+	data, err := entry.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, byte(cacheEntryVersion), data[0])
+
+	var decoded cacheEntry
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, "GET", decoded.Method)
+	assert.Equal(t, "http://example.com/api?x=1", decoded.URL)
+	assert.True(t, storedAt.Equal(decoded.StoredAt))
+	assert.Equal(t, entry.Status, decoded.Status)
+	assert.Equal(t, entry.StatusCode, decoded.StatusCode)
+	assert.Equal(t, entry.Header, decoded.Header)
+	assert.Equal(t, entry.Trailer, decoded.Trailer)
+	assert.Equal(t, entry.VaryKeys, decoded.VaryKeys)
+	assert.Equal(t, http.Header{"Accept-Encoding": []string{"gzip"}}, decoded.VaryValues)
+	assert.Equal(t, []byte(`{"message":"Hello, World!"}`), decoded.Body)
+
+	// the response body is still readable after building the entry
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, decoded.Body, body)
+}
+
+func TestCacheEntryUnmarshalBinaryErrors(t *testing.T) {
+	entry := &cacheEntry{Method: "GET", URL: "http://example.com", Body: []byte("body")}
+	data, err := entry.MarshalBinary()
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		errMsg string
+	}{
+		{name: "Empty data", data: nil, errMsg: "empty data"},
+		{name: "Unknown version", data: append([]byte{99}, data[1:]...), errMsg: "unsupported entry version 99"},
+		{name: "Truncated entry", data: data[:len(data)-2], errMsg: "corrupted v1 entry"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var decoded cacheEntry
+			err := decoded.UnmarshalBinary(tt.data)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
+
+func TestCacheEntryMatches(t *testing.T) {
+	entry := &cacheEntry{
+		VaryKeys:   []string{"Accept-Encoding"},
+		VaryValues: http.Header{"Accept-Encoding": []string{"gzip"}},
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{name: "Same value", header: http.Header{"Accept-Encoding": []string{"gzip"}}, want: true},
+		{name: "Other value", header: http.Header{"Accept-Encoding": []string{"br"}}, want: false},
+		{name: "Missing header", header: http.Header{}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := mustNewRequest("GET", "http://example.com", nil)
+			req.Header = tt.header
+			assert.Equal(t, tt.want, entry.matches(req))
+		})
+	}
+
+	star := &cacheEntry{VaryKeys: []string{"*"}}
+	assert.False(t, star.matches(mustNewRequest("GET", "http://example.com", nil)))
+}
+
+func TestCacheEntryFromLegacy(t *testing.T) {
+	legacy := cacheHttpResponse{
+		Status:     "200 OK",
+		StatusCode: 200,
+		HeaderJSON: `{"Content-Type":["text/plain"]}`,
+		Body:       []byte("hello"),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+
+	entry, err := cacheEntryFromLegacy(legacy)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0), entry.Version)
+	assert.True(t, entry.matches(mustNewRequest("GET", "http://example.com", nil)))
+
+	res := entry.toHttpResponse(time.Now())
+	assert.Equal(t, "text/plain", res.Header.Get("Content-Type"))
+	assert.Empty(t, res.Header.Get("Age"))
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, []byte("hello"), body)
+}
+
+func TestCacheEntryToHttpResponseAge(t *testing.T) {
+	now := time.Now()
+	entry := &cacheEntry{StatusCode: 200, StoredAt: now.Add(-90 * time.Second), Header: http.Header{}}
+	res := entry.toHttpResponse(now)
+	assert.Equal(t, "90", res.Header.Get("Age"))
+	assert.Empty(t, entry.Header.Get("Age"), "the stored header must not be modified")
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (cr *closeRecorder) Close() error {
+	cr.closed = true
+	return nil
+}
+
+func TestNewCacheEntryClosesBody(t *testing.T) {
+	upstreamBody := &closeRecorder{Reader: bytes.NewBufferString("hello")}
+	res := &http.Response{StatusCode: 200, Header: http.Header{}, Body: upstreamBody}
+	_, err := newCacheEntry(mustNewRequest("GET", "http://example.com", nil), res, time.Now())
+	assert.NoError(t, err)
+	assert.True(t, upstreamBody.closed, "the upstream body is closed once read")
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, []byte("hello"), body)
+}
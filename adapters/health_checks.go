@@ -0,0 +1,107 @@
+package adapters
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// redisPingCheck is ready while the cache backend answers PING.
+type redisPingCheck struct {
+	adapter *redisCacheAdapter
+}
+
+func NewRedisPingCheck(adapter *redisCacheAdapter) (*redisPingCheck, error) {
+	if adapter == nil {
+		return nil, errors.New("redisCacheAdapter = <nil>")
+	}
+	return &redisPingCheck{adapter: adapter}, nil
+}
+
+func (c *redisPingCheck) Name() string {
+	return "redis"
+}
+
+func (c *redisPingCheck) Check(ctx context.Context) error {
+	client, err := c.adapter.GetClient()
+	if err != nil {
+		return err
+	}
+	return client.Ping(ctx).Err()
+}
+
+// tcpReachabilityCheck is ready while a TCP connection to addr can be opened,
+// e.g. to an upstream proxy.
+type tcpReachabilityCheck struct {
+	name string
+	addr string
+}
+
+func NewTCPReachabilityCheck(name, addr string) (*tcpReachabilityCheck, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid address %q : %v", addr, err)
+	}
+	if name == "" {
+		name = "upstream:" + addr
+	}
+	return &tcpReachabilityCheck{name: name, addr: addr}, nil
+}
+
+func (c *tcpReachabilityCheck) Name() string {
+	return c.name
+}
+
+func (c *tcpReachabilityCheck) Check(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// tlsCertCheck is ready while the certificate served by the listener is
+// valid for at least minValidity. The files are read on every check so a
+// renewed certificate is picked up.
+type tlsCertCheck struct {
+	crtFilePath string
+	keyFilePath string
+	minValidity time.Duration
+	now         func() time.Time
+}
+
+func NewTLSCertCheck(crtFilePath, keyFilePath string, minValidity time.Duration) (*tlsCertCheck, error) {
+	if crtFilePath == "" || keyFilePath == "" {
+		return nil, errors.New("invalid arg : empty certificate or key path")
+	}
+	return &tlsCertCheck{crtFilePath: crtFilePath, keyFilePath: keyFilePath, minValidity: minValidity, now: time.Now}, nil
+}
+
+func (c *tlsCertCheck) Name() string {
+	return "tls_cert"
+}
+
+func (c *tlsCertCheck) Check(ctx context.Context) error {
+	pair, err := tls.LoadX509KeyPair(c.crtFilePath, c.keyFilePath)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	now := c.now()
+	switch {
+	case now.Before(leaf.NotBefore):
+		return fmt.Errorf("certificate not valid before %s", leaf.NotBefore.UTC().Format(time.RFC3339))
+	case now.After(leaf.NotAfter):
+		return fmt.Errorf("certificate expired at %s", leaf.NotAfter.UTC().Format(time.RFC3339))
+	case leaf.NotAfter.Sub(now) < c.minValidity:
+		return fmt.Errorf("certificate expires at %s, in less than %s", leaf.NotAfter.UTC().Format(time.RFC3339), c.minValidity)
+	}
+	return nil
+}
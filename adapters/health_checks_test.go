@@ -0,0 +1,101 @@
+package adapters
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/LamineKouissi/LHP/config"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisPingCheck(t *testing.T) {
+	mr := miniredis.RunT(t)
+	adapter, _ := NewRedisCacheAdapterFromConfig(config.RedisConfig{Addr: mr.Addr()})
+	check, err := NewRedisPingCheck(adapter)
+	assert.NoError(t, err)
+	assert.Equal(t, "redis", check.Name())
+	assert.NoError(t, check.Check(context.Background()))
+
+	mr.Close()
+	assert.Error(t, check.Check(context.Background()))
+}
+
+func TestTCPReachabilityCheck(t *testing.T) {
+	_, err := NewTCPReachabilityCheck("", "no-port")
+	assert.Error(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	check, _ := NewTCPReachabilityCheck("", ln.Addr().String())
+	assert.Equal(t, "upstream:"+ln.Addr().String(), check.Name())
+	assert.NoError(t, check.Check(context.Background()))
+
+	ln.Close()
+	assert.Error(t, check.Check(context.Background()))
+}
+
+// writeTestCert writes a self-signed certificate valid from notBefore to notAfter.
+func writeTestCert(t *testing.T, notBefore, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "proxy.test"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	crt, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	assert.NoError(t, os.WriteFile(crt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return crt, keyFile
+}
+
+func TestTLSCertCheck(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		notBefore   time.Time
+		notAfter    time.Time
+		minValidity time.Duration
+		wantErr     string
+	}{
+		{name: "Valid", notBefore: now.Add(-time.Hour), notAfter: now.Add(30 * 24 * time.Hour), minValidity: 24 * time.Hour},
+		{name: "Expired", notBefore: now.Add(-48 * time.Hour), notAfter: now.Add(-time.Hour), wantErr: "certificate expired"},
+		{name: "Not yet valid", notBefore: now.Add(time.Hour), notAfter: now.Add(48 * time.Hour), wantErr: "not valid before"},
+		{name: "Expires soon", notBefore: now.Add(-time.Hour), notAfter: now.Add(time.Hour), minValidity: 24 * time.Hour, wantErr: "in less than 24h0m0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crt, key := writeTestCert(t, tt.notBefore, tt.notAfter)
+			check, err := NewTLSCertCheck(crt, key, tt.minValidity)
+			assert.NoError(t, err)
+			err = check.Check(context.Background())
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.wantErr)
+			}
+		})
+	}
+
+	check, _ := NewTLSCertCheck("missing.crt", "missing.key", 0)
+	assert.Error(t, check.Check(context.Background()))
+}
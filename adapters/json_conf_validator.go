@@ -2,7 +2,9 @@ package adapters
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 
 	config "github.com/LamineKouissi/LHP/config"
 	"github.com/xeipuuv/gojsonschema"
@@ -24,6 +26,38 @@ func (jv *jsonValidator) ValidateConfig() (*config.ProxyConfig, error) {
 			"$schema": "http://json-schema.org/draft-07/schema#",
 			"type": "object",
 			"properties": {
+				"mode": { "type": "string", "enum": ["forward", "reverse"] },
+				"upstream_pools": {
+				"type": "object",
+				"additionalProperties": {
+					"type": "object",
+					"properties": {
+					"targets": { "type": "array", "minItems": 1, "items": { "type": "string" } },
+					"balancer": { "type": "string", "enum": ["round_robin", "least_conn", "consistent_hash"] },
+					"hash_key": { "type": "string" },
+					"health_check": {
+						"type": "object",
+						"properties": {
+						"path": { "type": "string" },
+						"interval": { "type": "string" },
+						"timeout": { "type": "string" },
+						"healthy_threshold": { "type": "integer", "minimum": 0 },
+						"unhealthy_threshold": { "type": "integer", "minimum": 0 }
+						},
+						"required": ["path"]
+					},
+					"outlier_detection": {
+						"type": "object",
+						"properties": {
+						"consecutive_failures": { "type": "integer", "minimum": 0 },
+						"ejection_time": { "type": "string" },
+						"max_ejection_percent": { "type": "integer", "minimum": 0, "maximum": 100 }
+						}
+					}
+					},
+					"required": ["targets"]
+				}
+				},
 				"listen_address": {
 				"type": "string"
 				},
@@ -45,17 +79,245 @@ func (jv *jsonValidator) ValidateConfig() (*config.ProxyConfig, error) {
 				"tunnelling_enabled": {
 				"type": "boolean"
 				},
+				"cache": {
+				"type": "object",
+				"properties": {
+					"default": { "$ref": "#/definitions/cache_policy" },
+					"breaker": {
+					"type": "object",
+					"properties": {
+						"failure_threshold": { "type": "integer", "minimum": 0 },
+						"open_timeout": { "type": "string" },
+						"half_open_probes": { "type": "integer", "minimum": 0 }
+					}
+					}
+				}
+				},
+				"upstream": {
+				"type": "object",
+				"properties": {
+					"dial_timeout": { "type": "string" },
+					"keep_alive": { "type": "string" },
+					"tls_handshake_timeout": { "type": "string" },
+					"response_header_timeout": { "type": "string" },
+					"idle_conn_timeout": { "type": "string" },
+					"request_timeout": { "type": "string" },
+					"max_idle_conns": { "type": "integer", "minimum": 0 },
+					"max_idle_conns_per_host": { "type": "integer", "minimum": 0 },
+					"max_conns_per_host": { "type": "integer", "minimum": 0 },
+					"http2": { "type": "boolean" },
+					"retry": {
+					"type": "object",
+					"properties": {
+						"enabled": { "type": "boolean" },
+						"max_attempts": { "type": "integer", "minimum": 0 },
+						"initial_backoff": { "type": "string" },
+						"max_backoff": { "type": "string" },
+						"retry_on": { "type": "array", "items": { "type": "integer", "minimum": 500, "maximum": 599 } },
+						"budget_ratio": { "type": "number", "minimum": 0 },
+						"budget_min_per_second": { "type": "integer", "minimum": 0 }
+					}
+					},
+					"tls": {
+					"type": "object",
+					"additionalProperties": {
+						"type": "object",
+						"properties": {
+						"ca_files": { "type": "array", "items": { "type": "string" } },
+						"system_roots": { "type": "boolean" },
+						"cert_file": { "type": "string" },
+						"key_file": { "type": "string" },
+						"min_version": { "type": "string", "enum": ["1.0", "1.1", "1.2", "1.3"] },
+						"cipher_suites": { "type": "array", "items": { "type": "string" } },
+						"server_name": { "type": "string" },
+						"pinned_spki": { "type": "array", "items": { "type": "string" } }
+						}
+					}
+					}
+				}
+				},
+				"acl": {
+				"type": "object",
+				"properties": {
+					"default": { "type": "string", "enum": ["allow", "deny"] },
+					"rules": {
+					"type": "array",
+					"items": {
+						"type": "object",
+						"properties": {
+						"name": { "type": "string" },
+						"action": { "type": "string", "enum": ["allow", "deny"] },
+						"domains": { "type": "array", "items": { "type": "string" } },
+						"cidrs": { "type": "array", "items": { "type": "string" } },
+						"ports": { "type": "array", "items": { "type": "integer", "minimum": 1, "maximum": 65535 } },
+						"methods": { "type": "array", "items": { "type": "string" } },
+						"users": { "type": "array", "items": { "type": "string" } },
+						"groups": { "type": "array", "items": { "type": "string" } }
+						},
+						"required": ["action"]
+					}
+					},
+					"ssrf_protection": {
+					"type": "object",
+					"properties": {
+						"enabled": { "type": "boolean" },
+						"allow_cidrs": { "type": "array", "items": { "type": "string" } }
+					}
+					}
+				}
+				},
+				"headers": { "$ref": "#/definitions/header_rules" },
+				"forwarding": {
+				"type": "object",
+				"properties": {
+					"via_pseudonym": { "type": "string", "pattern": "^[!#$%&'*+.^_|~0-9A-Za-z-]+$" },
+					"trusted_proxies": { "type": "array", "items": { "type": "string" } },
+					"trust_all_proxies": { "type": "boolean" },
+					"privacy": { "type": "boolean" }
+				}
+				},
+				"rate_limit": {
+				"type": "object",
+				"properties": {
+					"store": { "type": "string", "enum": ["memory", "redis"] },
+					"limits": { "type": "array", "items": { "$ref": "#/definitions/rate_limit" } }
+				}
+				},
+				"connect": {
+				"type": "object",
+				"properties": {
+					"allowed_ports": { "type": "array", "minItems": 1, "items": { "type": "integer", "minimum": 1, "maximum": 65535 } },
+					"port_exceptions": {
+					"type": "array",
+					"items": {
+						"type": "object",
+						"properties": {
+						"users": { "type": "array", "items": { "type": "string" } },
+						"groups": { "type": "array", "items": { "type": "string" } },
+						"ports": { "type": "array", "items": { "type": "integer", "minimum": 1, "maximum": 65535 } }
+						}
+					}
+					},
+					"max_tunnels": { "type": "integer", "minimum": 0 },
+					"max_tunnels_per_user": { "type": "integer", "minimum": 0 },
+					"bandwidth_per_tunnel": { "type": "integer", "minimum": 0 },
+					"bandwidth_per_user": { "type": "integer", "minimum": 0 },
+					"idle_timeout": { "type": "string" }
+				}
+				},
+				"error_pages": {
+				"type": "object",
+				"properties": {
+					"template": { "type": "string" },
+					"templates": {
+					"type": "object",
+					"propertyNames": { "pattern": "^[45][0-9][0-9]$" },
+					"additionalProperties": { "type": "string" }
+					}
+				}
+				},
+				"tracing": {
+				"type": "object",
+				"properties": {
+					"enabled": { "type": "boolean" },
+					"endpoint": { "type": "string" },
+					"service_name": { "type": "string" },
+					"headers": { "type": "object", "additionalProperties": { "type": "string" } },
+					"batch_size": { "type": "integer", "minimum": 0 },
+					"flush_interval": { "type": "string" }
+				}
+				},
+				"admin": {
+				"type": "object",
+				"properties": {
+					"enabled": { "type": "boolean" },
+					"listen_address": { "type": "string" },
+					"token": { "type": "string" },
+					"health": {
+					"type": "object",
+					"properties": {
+						"check_timeout": { "type": "string" },
+						"cert_min_validity": { "type": "string" },
+						"upstreams": { "type": "array", "items": { "type": "string" } }
+					}
+					}
+				}
+				},
+				"access_log": {
+				"type": "object",
+				"properties": {
+					"enabled": { "type": "boolean" },
+					"format": { "type": "string", "enum": ["json", "combined"] },
+					"output": { "type": "string", "enum": ["stdout", "file", "syslog"] },
+					"file": {
+					"type": "object",
+					"properties": {
+						"path": { "type": "string" },
+						"max_size_mb": { "type": "integer", "minimum": 0 },
+						"max_backups": { "type": "integer", "minimum": 0 }
+					}
+					},
+					"syslog": {
+					"type": "object",
+					"properties": {
+						"network": { "type": "string" },
+						"address": { "type": "string" },
+						"tag": { "type": "string" }
+					}
+					}
+				}
+				},
+				"redis": {
+				"type": "object",
+				"properties": {
+					"addr": { "type": "string" },
+					"addrs": { "type": "array", "items": { "type": "string" } },
+					"username": { "type": "string" },
+					"password": { "type": "string" },
+					"db": { "type": "integer", "minimum": 0 },
+					"master_name": { "type": "string" },
+					"sentinel_username": { "type": "string" },
+					"sentinel_password": { "type": "string" },
+					"cluster_mode": { "type": "boolean" },
+					"read_only": { "type": "boolean" },
+					"route_by_latency": { "type": "boolean" },
+					"tls": {
+					"type": "object",
+					"properties": {
+						"enabled": { "type": "boolean" },
+						"ca_file": { "type": "string" },
+						"cert_file": { "type": "string" },
+						"key_file": { "type": "string" },
+						"server_name": { "type": "string" },
+						"insecure_skip_verify": { "type": "boolean" }
+					}
+					},
+					"pool_size": { "type": "integer", "minimum": 0 },
+					"min_idle_conns": { "type": "integer", "minimum": 0 },
+					"max_idle_conns": { "type": "integer", "minimum": 0 },
+					"dial_timeout": { "type": "string" },
+					"read_timeout": { "type": "string" },
+					"write_timeout": { "type": "string" },
+					"pool_timeout": { "type": "string" }
+				}
+				},
 				"routes": {
 				"type": "array",
 				"items": {
 					"type": "object",
 					"properties": {
+					"name": {
+						"type": "string"
+					},
+					"host": {
+						"type": "string"
+					},
 					"path": {
 						"type": "string"
 					},
 					"method": {
 						"type": "string",
-						"enum": ["GET", "POST", "PUT", "DELETE"]
+						"enum": ["GET", "POST", "PUT", "DELETE", "ANY"]
 					},
 					"filter_chain": {
 						"type": "array",
@@ -65,13 +327,63 @@ func (jv *jsonValidator) ValidateConfig() (*config.ProxyConfig, error) {
 					},
 					"connector": {
 						"type": "string"
-					}
+					},
+					"cache": { "$ref": "#/definitions/cache_policy" },
+					"upstream": { "type": "string" },
+					"rate_limits": { "type": "array", "items": { "$ref": "#/definitions/rate_limit" } },
+					"headers": { "$ref": "#/definitions/header_rules" }
 					},
 					"required": ["path", "method", "filter_chain", "connector"]
 				}
 				}
 			},
-			"required": ["listen_address", "tls_enabled", "tls_cert", "tunnelling_enabled", "routes"]
+			"required": ["listen_address", "tls_enabled", "tls_cert", "tunnelling_enabled", "routes"],
+			"definitions": {
+				"header_rules": {
+				"type": "object",
+				"properties": {
+					"request": { "type": "array", "items": { "$ref": "#/definitions/header_rule" } },
+					"response": { "type": "array", "items": { "$ref": "#/definitions/header_rule" } }
+				}
+				},
+				"header_rule": {
+				"type": "object",
+				"properties": {
+					"action": { "type": "string", "enum": ["add", "set", "remove", "rename"] },
+					"name": { "type": "string", "minLength": 1 },
+					"value": { "type": "string" },
+					"new_name": { "type": "string", "minLength": 1 },
+					"host": { "type": "string" },
+					"path": { "type": "string" },
+					"statuses": { "type": "array", "items": { "type": "integer", "minimum": 100, "maximum": 599 } }
+				},
+				"required": ["action", "name"]
+				},
+				"rate_limit": {
+				"type": "object",
+				"properties": {
+					"key": { "type": "string", "enum": ["client_ip", "principal", "host"] },
+					"requests": { "type": "integer", "minimum": 1 },
+					"per": { "type": "string" },
+					"burst": { "type": "integer", "minimum": 0 }
+				},
+				"required": ["key", "requests"]
+				},
+				"cache_policy": {
+				"type": "object",
+				"properties": {
+					"enabled": { "type": "boolean" },
+					"ttl": { "type": "string" },
+					"min_ttl": { "type": "string" },
+					"max_ttl": { "type": "string" },
+					"ignore_origin_headers": { "type": "boolean" },
+					"strip_query_params": { "type": "array", "items": { "type": "string" } },
+					"sort_query_params": { "type": "boolean" },
+					"key_headers": { "type": "array", "items": { "type": "string" } },
+					"max_object_size": { "type": "integer", "minimum": 0 }
+				}
+				}
+			}
 		}`)
 
 	// Load the configuration data
@@ -99,5 +411,60 @@ func (jv *jsonValidator) ValidateConfig() (*config.ProxyConfig, error) {
 		return nil, fmt.Errorf("error parsing config: %v", err)
 	}
 
+	if err := checkPrincipalSettings(&config); err != nil {
+		return nil, fmt.Errorf("config validation failed: %v", err)
+	}
+
 	return &config, nil
 }
+
+// checkPrincipalSettings rejects the settings matching on the authenticated
+// principal: the proxy does not authenticate its clients yet, so they would
+// never match and be silently ignored.
+func checkPrincipalSettings(cfg *config.ProxyConfig) error {
+	for i, rule := range cfg.ACL.Rules {
+		if len(rule.Users) > 0 || len(rule.Groups) > 0 {
+			return fmt.Errorf("acl rule %d : users and groups need client authentication, which is not supported", i)
+		}
+	}
+	if len(cfg.Connect.PortExceptions) > 0 {
+		return errors.New("connect port_exceptions : users and groups need client authentication, which is not supported")
+	}
+	if err := checkPrincipalRateLimits("rate_limit", cfg.RateLimit.Limits); err != nil {
+		return err
+	}
+	if err := checkPrincipalHeaderRules("headers", &cfg.Headers); err != nil {
+		return err
+	}
+	for i, route := range cfg.Routes {
+		name := fmt.Sprintf("route %d", i)
+		if err := checkPrincipalRateLimits(name+" rate_limits", route.RateLimits); err != nil {
+			return err
+		}
+		if err := checkPrincipalHeaderRules(name+" headers", route.Headers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkPrincipalRateLimits(where string, limits []config.RateLimitRuleConfig) error {
+	for i, rl := range limits {
+		if rl.Key == "principal" {
+			return fmt.Errorf("%s %d : the principal key needs client authentication, which is not supported", where, i)
+		}
+	}
+	return nil
+}
+
+func checkPrincipalHeaderRules(where string, hrc *config.HeaderRulesConfig) error {
+	if hrc == nil {
+		return nil
+	}
+	for _, rule := range append(append([]config.HeaderRuleConfig{}, hrc.Request...), hrc.Response...) {
+		if strings.Contains(rule.Value, "${principal}") {
+			return fmt.Errorf("%s %s : ${principal} needs client authentication, which is not supported", where, rule.Name)
+		}
+	}
+	return nil
+}
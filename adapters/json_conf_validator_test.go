@@ -0,0 +1,169 @@
+package adapters
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LamineKouissi/LHP/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const validProxyConfig = `{
+	"listen_address": ":7000",
+	"tls_enabled": true,
+	"tls_cert": {"key": "server.key", "crt": "server.crt"},
+	"tunnelling_enabled": true,
+	"cache": {
+		"default": {"ttl": "1m"},
+		"breaker": {"failure_threshold": 3, "open_timeout": "10s"}
+	},
+	"routes": [
+		{
+			"name": "api",
+			"host": "*.example.com",
+			"path": "/api/",
+			"method": "GET",
+			"filter_chain": ["cache", "transformer"],
+			"connector": "https",
+			"cache": {
+				"enabled": true,
+				"min_ttl": "30s",
+				"max_ttl": "1h",
+				"strip_query_params": ["utm_source"],
+				"sort_query_params": true,
+				"key_headers": ["Accept-Language"],
+				"max_object_size": 1048576
+			}
+		}
+	]
+}`
+
+func TestJsonValidatorValidateConfig(t *testing.T) {
+	t.Run("Valid config", func(t *testing.T) {
+		jv, _ := NewjsonValidator([]byte(validProxyConfig))
+		cfg, err := jv.ValidateConfig()
+		assert.NoError(t, err)
+		assert.Equal(t, ":7000", cfg.ListenAddress)
+		assert.Equal(t, config.Duration(time.Minute), cfg.Cache.Default.TTL)
+		assert.Equal(t, 3, cfg.Cache.Breaker.FailureThreshold)
+		if assert.Len(t, cfg.Routes, 1) {
+			route := cfg.Routes[0]
+			assert.Equal(t, "api", route.Name)
+			assert.Equal(t, "*.example.com", route.Host)
+			assert.True(t, *route.Cache.Enabled)
+			assert.Equal(t, config.Duration(time.Hour), route.Cache.MaxTTL)
+			assert.Equal(t, []string{"utm_source"}, route.Cache.StripQueryParams)
+			assert.Equal(t, int64(1048576), route.Cache.MaxObjectSize)
+		}
+	})
+
+	t.Run("Missing required field", func(t *testing.T) {
+		jv, _ := NewjsonValidator([]byte(`{"listen_address": ":7000"}`))
+		cfg, err := jv.ValidateConfig()
+		assert.Error(t, err)
+		assert.Nil(t, cfg)
+		assert.Contains(t, err.Error(), "config validation failed")
+	})
+
+	t.Run("Invalid cache policy", func(t *testing.T) {
+		jv, _ := NewjsonValidator([]byte(`{
+			"listen_address": ":7000", "tls_enabled": false, "tls_cert": {"key": "", "crt": ""},
+			"tunnelling_enabled": false,
+			"routes": [{"path": "/", "method": "GET", "filter_chain": [], "connector": "https",
+				"cache": {"max_object_size": -1}}]
+		}`))
+		_, err := jv.ValidateConfig()
+		assert.Error(t, err)
+	})
+
+	t.Run("Invalid duration", func(t *testing.T) {
+		jv, _ := NewjsonValidator([]byte(`{
+			"listen_address": ":7000", "tls_enabled": false, "tls_cert": {"key": "", "crt": ""},
+			"tunnelling_enabled": false, "routes": [],
+			"cache": {"default": {"ttl": "forever"}}
+		}`))
+		_, err := jv.ValidateConfig()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "error parsing config")
+	})
+
+	t.Run("Header rules", func(t *testing.T) {
+		jv, _ := NewjsonValidator([]byte(`{
+			"listen_address": ":7000", "tls_enabled": false, "tls_cert": {"key": "", "crt": ""},
+			"tunnelling_enabled": false,
+			"headers": {"request": [{"action": "set", "name": "X-Request-Id", "value": "${request_id}"}]},
+			"routes": [{"path": "/", "method": "GET", "filter_chain": [], "connector": "https",
+				"headers": {"response": [{"action": "remove", "name": "Server", "statuses": [404]}]}}]
+		}`))
+		cfg, err := jv.ValidateConfig()
+		if assert.NoError(t, err) {
+			assert.Equal(t, "${request_id}", cfg.Headers.Request[0].Value)
+			assert.Equal(t, []int{404}, cfg.Routes[0].Headers.Response[0].Statuses)
+		}
+
+		jv, _ = NewjsonValidator([]byte(`{
+			"listen_address": ":7000", "tls_enabled": false, "tls_cert": {"key": "", "crt": ""},
+			"tunnelling_enabled": false, "routes": [],
+			"headers": {"request": [{"action": "append", "name": "X-A"}]}
+		}`))
+		_, err = jv.ValidateConfig()
+		assert.Error(t, err)
+	})
+
+	t.Run("Forwarding", func(t *testing.T) {
+		jv, _ := NewjsonValidator([]byte(`{
+			"listen_address": ":7000", "tls_enabled": false, "tls_cert": {"key": "", "crt": ""},
+			"tunnelling_enabled": false, "routes": [],
+			"forwarding": {"via_pseudonym": "proxy-a", "trusted_proxies": [], "trust_all_proxies": true, "privacy": true}
+		}`))
+		cfg, err := jv.ValidateConfig()
+		if assert.NoError(t, err) {
+			assert.Equal(t, "proxy-a", cfg.Forwarding.ViaPseudonym)
+			assert.True(t, cfg.Forwarding.TrustAllProxies)
+			assert.True(t, cfg.Forwarding.Privacy)
+		}
+
+		jv, _ = NewjsonValidator([]byte(`{
+			"listen_address": ":7000", "tls_enabled": false, "tls_cert": {"key": "", "crt": ""},
+			"tunnelling_enabled": false, "routes": [],
+			"forwarding": {"via_pseudonym": "proxy a"}
+		}`))
+		_, err = jv.ValidateConfig()
+		assert.Error(t, err)
+	})
+
+	t.Run("Principal settings", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			settings string
+		}{
+			{"ACL users", `"acl": {"rules": [{"action": "allow", "users": ["alice"]}]}`},
+			{"ACL groups", `"acl": {"rules": [{"action": "allow", "groups": ["admins"]}]}`},
+			{"Port exceptions", `"connect": {"port_exceptions": [{"users": ["alice"], "ports": [22]}]}`},
+			{"Rate limit key", `"rate_limit": {"limits": [{"key": "principal", "requests": 10}]}`},
+			{"Header template", `"headers": {"response": [{"action": "set", "name": "X-User", "value": "${principal}"}]}`},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				jv, _ := NewjsonValidator([]byte(`{
+					"listen_address": ":7000", "tls_enabled": false, "tls_cert": {"key": "", "crt": ""},
+					"tunnelling_enabled": false, "routes": [], ` + tt.settings + `
+				}`))
+				cfg, err := jv.ValidateConfig()
+				assert.Nil(t, cfg)
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), "client authentication")
+				}
+			})
+		}
+
+		jv, _ := NewjsonValidator([]byte(`{
+			"listen_address": ":7000", "tls_enabled": false, "tls_cert": {"key": "", "crt": ""},
+			"tunnelling_enabled": false,
+			"routes": [{"path": "/", "method": "GET", "filter_chain": [], "connector": "https",
+				"rate_limits": [{"key": "principal", "requests": 10}]}]
+		}`))
+		_, err := jv.ValidateConfig()
+		assert.Error(t, err, "a route's rate limits are checked as well")
+	})
+}
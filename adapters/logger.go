@@ -1 +1,209 @@
 package adapters
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/LamineKouissi/LHP/util"
+)
+
+// access log formats
+const (
+	AccessLogFormatJSON     = "json"
+	AccessLogFormatCombined = "combined"
+)
+
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+type accessLogAdapter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// NewAccessLogAdapter writes access log records to w, one line per record,
+// either as JSON or in the Combined Log Format.
+func NewAccessLogAdapter(format string, w io.Writer) (*accessLogAdapter, error) {
+	if w == nil {
+		return nil, fmt.Errorf("access log writer = <nil>")
+	}
+	if format == "" {
+		format = AccessLogFormatJSON
+	}
+	if format != AccessLogFormatJSON && format != AccessLogFormatCombined {
+		return nil, fmt.Errorf("unknown access log format : %q", format)
+	}
+	return &accessLogAdapter{w: w, format: format}, nil
+}
+
+func (a *accessLogAdapter) LogAccess(rec filters.AccessLogRecord) {
+	var line []byte
+	var err error
+	if a.format == AccessLogFormatCombined {
+		line = []byte(formatCombined(rec))
+	} else {
+		line, err = formatJSON(rec)
+		if err != nil {
+			util.Errorln("accessLogAdapter.LogAccess(){formatJSON()}: ", err)
+			return
+		}
+	}
+	a.write(line)
+}
+
+func (a *accessLogAdapter) LogTunnel(rec filters.TunnelLogRecord) {
+	var line []byte
+	var err error
+	if a.format == AccessLogFormatCombined {
+		line = []byte(formatTunnelCombined(rec))
+	} else {
+		line, err = formatTunnelJSON(rec)
+		if err != nil {
+			util.Errorln("accessLogAdapter.LogTunnel(){formatTunnelJSON()}: ", err)
+			return
+		}
+	}
+	a.write(line)
+}
+
+func (a *accessLogAdapter) write(line []byte) {
+	line = append(line, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(line); err != nil {
+		util.Errorln("accessLogAdapter.write(){w.Write()}: ", err)
+	}
+}
+
+type jsonAccessLogRecord struct {
+	Time              string  `json:"time"`
+	RequestID         string  `json:"request_id"`
+	TraceID           string  `json:"trace_id,omitempty"`
+	ClientIP          string  `json:"client_ip"`
+	Principal         string  `json:"principal,omitempty"`
+	Method            string  `json:"method"`
+	URL               string  `json:"url"`
+	Host              string  `json:"host"`
+	Proto             string  `json:"proto"`
+	Status            int     `json:"status"`
+	BytesIn           int64   `json:"bytes_in"`
+	BytesOut          int64   `json:"bytes_out"`
+	DurationMs        float64 `json:"duration_ms"`
+	UpstreamLatencyMs float64 `json:"upstream_latency_ms"`
+	CacheStatus       string  `json:"cache_status,omitempty"`
+	Route             string  `json:"route,omitempty"`
+	UserAgent         string  `json:"user_agent,omitempty"`
+	Referer           string  `json:"referer,omitempty"`
+	Error             string  `json:"error,omitempty"`
+}
+
+func formatJSON(rec filters.AccessLogRecord) ([]byte, error) {
+	return json.Marshal(jsonAccessLogRecord{
+		Time:              rec.Time.UTC().Format(time.RFC3339Nano),
+		RequestID:         rec.RequestID,
+		TraceID:           rec.TraceID,
+		ClientIP:          rec.ClientIP,
+		Principal:         rec.Principal,
+		Method:            rec.Method,
+		URL:               rec.URL,
+		Host:              rec.Host,
+		Proto:             rec.Proto,
+		Status:            rec.Status,
+		BytesIn:           rec.BytesIn,
+		BytesOut:          rec.BytesOut,
+		DurationMs:        durationMs(rec.Duration),
+		UpstreamLatencyMs: durationMs(rec.UpstreamLatency),
+		CacheStatus:       rec.CacheStatus,
+		Route:             rec.Route,
+		UserAgent:         rec.UserAgent,
+		Referer:           rec.Referer,
+		Error:             rec.Error,
+	})
+}
+
+type jsonTunnelLogRecord struct {
+	Type          string  `json:"type"`
+	Time          string  `json:"time"`
+	RequestID     string  `json:"request_id"`
+	ClientIP      string  `json:"client_ip"`
+	Principal     string  `json:"principal,omitempty"`
+	Target        string  `json:"target"`
+	DurationMs    float64 `json:"duration_ms"`
+	BytesUpstream int64   `json:"bytes_upstream"`
+	BytesClient   int64   `json:"bytes_client"`
+	CloseReason   string  `json:"close_reason"`
+	Error         string  `json:"error,omitempty"`
+}
+
+func formatTunnelJSON(rec filters.TunnelLogRecord) ([]byte, error) {
+	return json.Marshal(jsonTunnelLogRecord{
+		Type:          "tunnel",
+		Time:          rec.Time.UTC().Format(time.RFC3339Nano),
+		RequestID:     rec.RequestID,
+		ClientIP:      rec.ClientIP,
+		Principal:     rec.Principal,
+		Target:        rec.Target,
+		DurationMs:    durationMs(rec.Duration),
+		BytesUpstream: rec.BytesUpstream,
+		BytesClient:   rec.BytesClient,
+		CloseReason:   rec.CloseReason,
+		Error:         rec.Error,
+	})
+}
+
+// formatTunnelCombined renders a tunnel as a CONNECT request in the Combined
+// Log Format, followed by the bytes sent upstream, the duration and the close reason.
+func formatTunnelCombined(rec filters.TunnelLogRecord) string {
+	return fmt.Sprintf(`%s - %s [%s] "CONNECT %s HTTP/1.1" 200 %d "-" "-" %d %.3f %s`,
+		clfField(rec.ClientIP),
+		clfField(rec.Principal),
+		rec.Time.Format(clfTimeFormat),
+		rec.Target,
+		rec.BytesClient,
+		rec.BytesUpstream,
+		rec.Duration.Seconds(),
+		clfField(rec.CloseReason),
+	)
+}
+
+// formatCombined renders rec in the Apache Combined Log Format.
+func formatCombined(rec filters.AccessLogRecord) string {
+	bytesOut := "-"
+	if rec.BytesOut > 0 {
+		bytesOut = strconv.FormatInt(rec.BytesOut, 10)
+	}
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s "%s" "%s"`,
+		clfField(rec.ClientIP),
+		clfField(rec.Principal),
+		rec.Time.Format(clfTimeFormat),
+		rec.Method, rec.URL, rec.Proto,
+		rec.Status,
+		bytesOut,
+		clfQuote(rec.Referer),
+		clfQuote(rec.UserAgent),
+	)
+}
+
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(s, " ", "_")
+}
+
+func clfQuote(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(s, `"`, `\"`)
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
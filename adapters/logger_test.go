@@ -0,0 +1,120 @@
+package adapters
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+var testAccessLogRecord = filters.AccessLogRecord{
+	Time:            time.Date(2024, time.March, 2, 10, 4, 5, 0, time.UTC),
+	RequestID:       "0123456789abcdef",
+	ClientIP:        "192.0.2.1",
+	Principal:       "alice",
+	Method:          "GET",
+	URL:             "http://example.com/a?b=1",
+	Host:            "example.com",
+	Proto:           "HTTP/1.1",
+	Status:          200,
+	BytesOut:        512,
+	Duration:        1500 * time.Microsecond,
+	UpstreamLatency: time.Millisecond,
+	CacheStatus:     filters.CacheStatusHit,
+	Route:           "api",
+	UserAgent:       `curl/8.0 "x"`,
+}
+
+func TestAccessLogAdapter(t *testing.T) {
+	_, err := NewAccessLogAdapter("xml", &bytes.Buffer{})
+	assert.Error(t, err)
+	_, err = NewAccessLogAdapter("", nil)
+	assert.Error(t, err)
+
+	t.Run("JSON", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		a, err := NewAccessLogAdapter("", buf)
+		assert.NoError(t, err)
+		a.LogAccess(testAccessLogRecord)
+
+		var got map[string]interface{}
+		assert.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+		assert.Equal(t, "2024-03-02T10:04:05Z", got["time"])
+		assert.Equal(t, "alice", got["principal"])
+		assert.Equal(t, "HIT", got["cache_status"])
+		assert.Equal(t, "api", got["route"])
+		assert.Equal(t, 1.5, got["duration_ms"])
+		assert.Equal(t, float64(512), got["bytes_out"])
+		assert.NotContains(t, got, "error")
+	})
+
+	t.Run("Combined", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		a, err := NewAccessLogAdapter(AccessLogFormatCombined, buf)
+		assert.NoError(t, err)
+		a.LogAccess(testAccessLogRecord)
+		assert.Equal(t,
+			`192.0.2.1 - alice [02/Mar/2024:10:04:05 +0000] "GET http://example.com/a?b=1 HTTP/1.1" 200 512 "-" "curl/8.0 \"x\""`+"\n",
+			buf.String())
+	})
+}
+
+func TestRotatingFileWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rw, err := NewRotatingFileWriter(path, 10, 2)
+	assert.NoError(t, err)
+	defer rw.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := rw.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+
+	read := func(p string) string {
+		b, err := ioutil.ReadFile(p)
+		assert.NoError(t, err)
+		return string(b)
+	}
+	assert.Equal(t, "fourth\n", read(path))
+	assert.Equal(t, "third\n", read(path+".1"))
+	assert.Equal(t, "second\n", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "only maxBackups files are kept")
+}
+
+func TestAccessLogAdapterLogTunnel(t *testing.T) {
+	rec := filters.TunnelLogRecord{
+		Time:          time.Date(2024, time.March, 2, 10, 4, 5, 0, time.UTC),
+		RequestID:     "0123456789abcdef",
+		ClientIP:      "192.0.2.1",
+		Target:        "example.com:443",
+		Duration:      2 * time.Second,
+		BytesUpstream: 100,
+		BytesClient:   2000,
+		CloseReason:   filters.TunnelClosedClientEOF,
+	}
+
+	buf := &bytes.Buffer{}
+	a, _ := NewAccessLogAdapter(AccessLogFormatJSON, buf)
+	a.LogTunnel(rec)
+	var got map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	assert.Equal(t, "tunnel", got["type"])
+	assert.Equal(t, "example.com:443", got["target"])
+	assert.Equal(t, float64(100), got["bytes_upstream"])
+	assert.Equal(t, float64(2000), got["bytes_client"])
+	assert.Equal(t, "client_eof", got["close_reason"])
+
+	buf.Reset()
+	a, _ = NewAccessLogAdapter(AccessLogFormatCombined, buf)
+	a.LogTunnel(rec)
+	assert.Equal(t,
+		`192.0.2.1 - - [02/Mar/2024:10:04:05 +0000] "CONNECT example.com:443 HTTP/1.1" 200 2000 "-" "-" 100 2.000 client_eof`+"\n",
+		buf.String())
+}
@@ -0,0 +1,286 @@
+package adapters
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/LamineKouissi/LHP/util"
+)
+
+// default batching of the OTLP exporter
+const (
+	DefaultOTLPBatchSize     = 512
+	DefaultOTLPFlushInterval = 5 * time.Second
+	otlpMaxQueueSize         = 8192
+	otlpScopeName            = "github.com/LamineKouissi/LHP"
+)
+
+// otlpHTTPExporter batches finished spans and posts them to an OTLP/HTTP
+// collector using the JSON encoding (POST <endpoint>, e.g. http://localhost:4318/v1/traces).
+type otlpHTTPExporter struct {
+	endpoint    string
+	serviceName string
+	headers     map[string]string
+	client      *http.Client
+	batchSize   int
+
+	mu      sync.Mutex
+	queue   []filters.SpanData
+	dropped int
+
+	flushCh chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func NewOTLPHTTPExporter(endpoint, serviceName string, headers map[string]string, batchSize int, flushInterval time.Duration) (*otlpHTTPExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint : %q", endpoint)
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultOTLPBatchSize
+	}
+	if flushInterval <= 0 {
+		flushInterval = DefaultOTLPFlushInterval
+	}
+	e := &otlpHTTPExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		headers:     headers,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		batchSize:   batchSize,
+		flushCh:     make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go e.run(flushInterval)
+	return e, nil
+}
+
+// ExportSpan queues span, spans are dropped while the queue is full.
+func (e *otlpHTTPExporter) ExportSpan(span filters.SpanData) {
+	e.mu.Lock()
+	if len(e.queue) >= otlpMaxQueueSize {
+		e.dropped++
+		e.mu.Unlock()
+		return
+	}
+	e.queue = append(e.queue, span)
+	full := len(e.queue) >= e.batchSize
+	e.mu.Unlock()
+
+	if full {
+		select {
+		case e.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Flush sends the queued spans now.
+func (e *otlpHTTPExporter) Flush() error {
+	for {
+		e.mu.Lock()
+		n := len(e.queue)
+		if n > e.batchSize {
+			n = e.batchSize
+		}
+		batch := e.queue[:n:n]
+		e.queue = e.queue[n:]
+		dropped := e.dropped
+		e.dropped = 0
+		e.mu.Unlock()
+
+		if dropped > 0 {
+			util.Warnln("otlpHTTPExporter : dropped", dropped, "spans, the export queue was full")
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := e.send(batch); err != nil {
+			return err
+		}
+	}
+}
+
+// Shutdown stops the background flushes and sends the remaining spans.
+func (e *otlpHTTPExporter) Shutdown() error {
+	e.once.Do(func() { close(e.done) })
+	<-e.stopped
+	return e.Flush()
+}
+
+func (e *otlpHTTPExporter) run(flushInterval time.Duration) {
+	defer close(e.stopped)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		case <-e.flushCh:
+		}
+		if err := e.Flush(); err != nil {
+			util.Errorln("otlpHTTPExporter.run(){e.Flush()}: ", err)
+		}
+	}
+}
+
+func (e *otlpHTTPExporter) send(batch []filters.SpanData) error {
+	body, err := json.Marshal(e.tracesRequest(batch))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	res, err := e.client.Do(req)
+	if err != nil {
+		return errors.Join(errors.New("OTLP export failed"), err)
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP export failed : collector returned %s", res.Status)
+	}
+	return nil
+}
+
+// OTLP/JSON payload, see opentelemetry-proto ExportTraceServiceRequest
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+// OTLP status codes
+const (
+	otlpStatusUnset = 0
+	otlpStatusError = 2
+)
+
+func (e *otlpHTTPExporter) tracesRequest(batch []filters.SpanData) otlpTracesRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, sd := range batch {
+		span := otlpSpan{
+			TraceID:           sd.SpanContext.TraceIDString(),
+			SpanID:            sd.SpanContext.SpanIDString(),
+			TraceState:        sd.SpanContext.TraceState,
+			Name:              sd.Name,
+			Kind:              int(sd.Kind),
+			StartTimeUnixNano: strconv.FormatInt(sd.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sd.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(sd.Attributes),
+			Status:            otlpStatus{Code: otlpStatusUnset},
+		}
+		if sd.HasParent() {
+			span.ParentSpanID = hex.EncodeToString(sd.ParentSpanID[:])
+		}
+		if sd.Error != "" {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: sd.Error}
+		}
+		spans = append(spans, span)
+	}
+	return otlpTracesRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes(map[string]interface{}{"service.name": e.serviceName})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: otlpScopeName}, Spans: spans}},
+	}}}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		var v otlpAnyValue
+		switch val := attrs[k].(type) {
+		case string:
+			v.StringValue = &val
+		case bool:
+			v.BoolValue = &val
+		case int:
+			s := strconv.Itoa(val)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(val, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &val
+		default:
+			s := fmt.Sprint(val)
+			v.StringValue = &s
+		}
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: v})
+	}
+	return kvs
+}
@@ -0,0 +1,111 @@
+package adapters
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+type otlpStubReceiver struct {
+	mu       sync.Mutex
+	requests []otlpTracesRequest
+	headers  []http.Header
+}
+
+func (r *otlpStubReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	var tr otlpTracesRequest
+	if req.URL.Path != "/v1/traces" || json.Unmarshal(body, &tr) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	r.requests = append(r.requests, tr)
+	r.headers = append(r.headers, req.Header.Clone())
+	r.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func testSpanData(name string) filters.SpanData {
+	sc, _ := filters.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	start := time.Unix(1700000000, 0)
+	return filters.SpanData{
+		Name:         name,
+		Kind:         filters.SpanKindServer,
+		SpanContext:  sc,
+		ParentSpanID: [8]byte{1},
+		Start:        start,
+		End:          start.Add(time.Second),
+		Attributes:   map[string]interface{}{"http.response.status_code": 200, "url.full": "http://example.com/"},
+		Error:        "upstream timeout",
+	}
+}
+
+func TestOTLPHTTPExporter(t *testing.T) {
+	_, err := NewOTLPHTTPExporter("localhost:4318", "lhp", nil, 0, 0)
+	assert.Error(t, err)
+
+	receiver := &otlpStubReceiver{}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	t.Run("Flush on shutdown", func(t *testing.T) {
+		exp, err := NewOTLPHTTPExporter(srv.URL+"/v1/traces", "lhp", map[string]string{"Authorization": "Bearer t"}, 0, time.Hour)
+		assert.NoError(t, err)
+		exp.ExportSpan(testSpanData("HTTP GET"))
+		assert.NoError(t, exp.Shutdown())
+
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		if assert.Len(t, receiver.requests, 1) {
+			assert.Equal(t, "Bearer t", receiver.headers[0].Get("Authorization"))
+			rs := receiver.requests[0].ResourceSpans[0]
+			assert.Equal(t, "service.name", rs.Resource.Attributes[0].Key)
+			assert.Equal(t, "lhp", *rs.Resource.Attributes[0].Value.StringValue)
+			span := rs.ScopeSpans[0].Spans[0]
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.TraceID)
+			assert.Equal(t, "00f067aa0ba902b7", span.SpanID)
+			assert.Equal(t, "0100000000000000", span.ParentSpanID)
+			assert.Equal(t, 2, span.Kind)
+			assert.Equal(t, "1700000000000000000", span.StartTimeUnixNano)
+			assert.Equal(t, otlpStatusError, span.Status.Code)
+			assert.Equal(t, "http.response.status_code", span.Attributes[0].Key)
+			assert.Equal(t, "200", *span.Attributes[0].Value.IntValue)
+		}
+	})
+
+	t.Run("Flush when the batch is full", func(t *testing.T) {
+		receiver.mu.Lock()
+		receiver.requests = nil
+		receiver.mu.Unlock()
+
+		exp, _ := NewOTLPHTTPExporter(srv.URL+"/v1/traces", "lhp", nil, 2, time.Hour)
+		defer exp.Shutdown()
+		exp.ExportSpan(testSpanData("a"))
+		exp.ExportSpan(testSpanData("b"))
+
+		received := func() bool {
+			receiver.mu.Lock()
+			defer receiver.mu.Unlock()
+			return len(receiver.requests) == 1 && len(receiver.requests[0].ResourceSpans[0].ScopeSpans[0].Spans) == 2
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for !received() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.True(t, received(), "the full batch is sent without waiting for the flush interval")
+	})
+
+	t.Run("Collector error", func(t *testing.T) {
+		exp, _ := NewOTLPHTTPExporter(srv.URL+"/wrong", "lhp", nil, 0, time.Hour)
+		exp.ExportSpan(testSpanData("a"))
+		assert.Error(t, exp.Shutdown())
+	})
+}
@@ -3,22 +3,27 @@ package adapters
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/LamineKouissi/LHP/config"
 	"github.com/LamineKouissi/LHP/filters"
 	"github.com/LamineKouissi/LHP/util"
 	"github.com/redis/go-redis/v9"
 )
 
 type redisCacheAdapter struct {
-	client *redis.Client
+	client redis.UniversalClient
 }
 
 func NewRedisCacheAdapter(addr, usr, pass, DBnum string) (*redisCacheAdapter, error) {
@@ -30,16 +35,105 @@ func NewRedisCacheAdapter(addr, usr, pass, DBnum string) (*redisCacheAdapter, er
 	cl := redis.NewClient(opt)
 	return &redisCacheAdapter{client: cl}, nil
 }
-func (r *redisCacheAdapter) GetClient() (*redis.Client, error) {
-	return r.client, nil
+
+// NewRedisCacheAdapterFromConfig builds a single node, Sentinel (MasterName
+// set) or Cluster (ClusterMode set) client from cfg.
+func NewRedisCacheAdapterFromConfig(cfg config.RedisConfig) (*redisCacheAdapter, error) {
+	addrs := cfg.Addrs
+	if len(addrs) == 0 && cfg.Addr != "" {
+		addrs = []string{cfg.Addr}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("invalid redis config : empty addr")
+	}
+	if cfg.MasterName != "" && cfg.ClusterMode {
+		return nil, errors.New("invalid redis config : master_name and cluster_mode are exclusive")
+	}
+	opt := &redis.UniversalOptions{
+		Addrs:            addrs,
+		Username:         cfg.Username,
+		Password:         cfg.Password,
+		DB:               cfg.DB,
+		MasterName:       cfg.MasterName,
+		SentinelUsername: cfg.SentinelUsername,
+		SentinelPassword: cfg.SentinelPassword,
+		ReadOnly:         cfg.ReadOnly,
+		RouteByLatency:   cfg.RouteByLatency,
+		PoolSize:         cfg.PoolSize,
+		MinIdleConns:     cfg.MinIdleConns,
+		MaxIdleConns:     cfg.MaxIdleConns,
+		DialTimeout:      time.Duration(cfg.DialTimeout),
+		ReadTimeout:      time.Duration(cfg.ReadTimeout),
+		WriteTimeout:     time.Duration(cfg.WriteTimeout),
+		PoolTimeout:      time.Duration(cfg.PoolTimeout),
+	}
+	if cfg.TLS.Enabled {
+		tlsConfig, err := redisTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		opt.TLSConfig = tlsConfig
+	}
+
+	var cl redis.UniversalClient
+	switch {
+	case cfg.MasterName != "":
+		cl = redis.NewFailoverClient(opt.Failover())
+	case cfg.ClusterMode:
+		if cfg.DB != 0 {
+			return nil, errors.New("invalid redis config : cluster mode only supports db 0")
+		}
+		cl = redis.NewClusterClient(opt.Cluster())
+	default:
+		if len(addrs) > 1 {
+			return nil, errors.New("invalid redis config : several addrs require master_name or cluster_mode")
+		}
+		cl = redis.NewClient(opt.Simple())
+	}
+	return &redisCacheAdapter{client: cl}, nil
 }
 
-type cachedBody []byte
+// NewRedisCacheAdapterWithClient wraps an already configured client of any kind.
+func NewRedisCacheAdapterWithClient(client redis.UniversalClient) (*redisCacheAdapter, error) {
+	if client == nil {
+		return nil, errors.New("redis.UniversalClient = <nil>")
+	}
+	return &redisCacheAdapter{client: client}, nil
+}
 
-func (cb cachedBody) MarshalBinary() ([]byte, error) {
-	return cb, nil
+func redisTLSConfig(cfg config.RedisTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if cfg.CAFile != "" {
+		caPem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading redis CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificate found in redis CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading redis client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+func (r *redisCacheAdapter) GetClient() (redis.UniversalClient, error) {
+	return r.client, nil
 }
 
+// cacheHttpResponse is the unversioned (v0) layout, one hash field per
+// response attribute. It is only kept to read entries written before the
+// versioned format.
 type cacheHttpResponse struct {
 	Status     string `redis:"status"`
 	StatusCode int    `redis:"status_code"`
@@ -54,138 +148,217 @@ func (r *redisCacheAdapter) Get(ctx context.Context, req *http.Request) (*http.R
 
 	k, err := r.getKey(req)
 	if err != nil {
-		log.Println("err : redisCacheAdapter.Get(){getKey()} : ", err)
+		util.Errorln("redisCacheAdapter.Get(){getKey()} : ", err)
 		return nil, err
 	}
-	var cachedRes cacheHttpResponse
-	err = r.client.HGetAll(ctx, k).Scan(&cachedRes)
-	fmt.Println("cachedRes : ", cachedRes)
-
+	cmd, fields, err := r.hGetAll(ctx, k)
 	if err != nil {
-		log.Println("err : redisCacheAdapter.Get(){r.client.HGetAll(ctx, k).Scan()} : ", err)
-		switch {
-		case err == redis.Nil:
-			return nil, filters.ErrCacheMiss{Msg: "key does not exist"}
-		default:
-			return nil, errors.Join(errors.New("redis Get() failed"), err)
+		return nil, err
+	}
+	if vary, ok := fields[entryVaryField]; ok {
+		// the response varies, the base key only lists the Vary header names
+		k = variantKey(k, strings.Split(vary, ","), req.Header)
+		cmd, fields, err = r.hGetAll(ctx, k)
+		if err != nil {
+			return nil, err
 		}
 	}
-	isEmpty, err := util.IsStructEmpty(cachedRes)
+
+	entry, err := r.decodeEntry(cmd, fields)
 	if err != nil {
-		log.Println("err : redisCacheAdapter.Get(){IsStructEmpty(cachedRes)} : ", err)
+		util.Errorln("redisCacheAdapter.Get(){decodeEntry()} : ", err)
 		return nil, err
 	}
-	if isEmpty {
-		log.Println("err : redisCacheAdapter.Get(){r.client.HGetAll(ctx, k).Scan()} : ", "Empty cachedRes")
-		return nil, filters.ErrCacheMiss{Msg: "key does not exist"}
+	if !entry.matches(req) {
+		return nil, filters.ErrCacheMiss{Msg: "no variant matches the request"}
 	}
 
-	// Parse the JSON header
-	httpHeader, err := JSONToHeader(cachedRes.HeaderJSON)
+	return entry.toHttpResponse(time.Now()), nil
+}
+
+func (r *redisCacheAdapter) hGetAll(ctx context.Context, k string) (*redis.MapStringStringCmd, map[string]string, error) {
+	cmd := r.client.HGetAll(ctx, k)
+	fields, err := cmd.Result()
 	if err != nil {
-		log.Println("err : redisCacheAdapter.Get(){JSONToHeader()} : ", err)
-		return nil, err
+		util.Errorln("redisCacheAdapter.Get(){r.client.HGetAll(ctx, k)} : ", err)
+		switch {
+		case err == redis.Nil:
+			return nil, nil, filters.ErrCacheMiss{Msg: "key does not exist"}
+		default:
+			return nil, nil, errors.Join(errors.New("redis Get() failed"), err)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, nil, filters.ErrCacheMiss{Msg: "key does not exist"}
 	}
+	return cmd, fields, nil
+}
 
-	res := &http.Response{
-		Status:     cachedRes.Status,
-		StatusCode: cachedRes.StatusCode,
-		Header:     httpHeader,
-		Body:       ioutil.NopCloser(bytes.NewBuffer([]byte(cachedRes.Body))),
-		Proto:      cachedRes.Proto,
-		ProtoMajor: cachedRes.ProtoMajor,
-		ProtoMinor: cachedRes.ProtoMinor,
+// decodeEntry reads a stored entry whatever version it was written with.
+func (r *redisCacheAdapter) decodeEntry(cmd *redis.MapStringStringCmd, fields map[string]string) (*cacheEntry, error) {
+	v, ok := fields[entryVersionField]
+	if !ok {
+		var legacy cacheHttpResponse
+		if err := cmd.Scan(&legacy); err != nil {
+			return nil, err
+		}
+		return cacheEntryFromLegacy(legacy)
 	}
 
-	return res, nil
+	version, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache entry version %q", v)
+	}
+	data := []byte(fields[entryDataField])
+	if len(data) == 0 || int(data[0]) != version {
+		return nil, fmt.Errorf("cache entry version mismatch : field %d", version)
+	}
+	var entry cacheEntry
+	if err := entry.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return &entry, nil
 }
 
 func (r *redisCacheAdapter) Set(ctx context.Context, req *http.Request, res *http.Response, expr time.Duration) error {
 	k, err := r.getKey(req)
 	if err != nil {
-		log.Println("err : redisCacheAdapter.Set(...){getKey(...)} : ", err)
+		util.Errorln("redisCacheAdapter.Set(...){getKey(...)} : ", err)
 		return err
 	}
-	fmt.Println("key : ", k)
 	if expr == 0 {
 		expr, err = r.getExprDur(res)
 		if err != nil || expr <= 0 {
 			expr = time.Duration(5 * time.Minute)
 		}
 	}
-	fmt.Println("Experation : ", expr)
-	cacheHttpRes, err := r.getCacheHttpRes(res)
+	util.Debugln("redisCacheAdapter.Set() key :", k, "expiration :", expr)
+	entry, err := newCacheEntry(req, res, time.Now())
 	if err != nil {
-		log.Println("err : redisCacheAdapter.Set(...){r.getValue(...)} : ", err)
+		util.Errorln("redisCacheAdapter.Set(...){newCacheEntry(...)} : ", err)
 		return err
 	}
-	r.client.Expire(ctx, k, expr)
-	err = r.client.HSet(ctx, k, cacheHttpRes).Err()
-
+	if !entry.matches(req) {
+		// "Vary: *" never matches a later request, storing it is pointless
+		return nil
+	}
+	data, err := entry.MarshalBinary()
 	if err != nil {
-		log.Println("err : redisCacheAdapter.Set(...){r.client.HSet(...).Err()} : ", err)
+		util.Errorln("redisCacheAdapter.Set(...){entry.MarshalBinary()} : ", err)
+		return err
+	}
+	// replace the whole hash and set its TTL in one MULTI/EXEC, so no
+	// reader sees a half written entry and no entry is left without expiry.
+	// The base key and its variants share a hash tag, hence a cluster slot.
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, k)
+		if len(entry.VaryKeys) == 0 {
+			pipe.HSet(ctx, k, entryVersionField, cacheEntryVersion, entryDataField, data)
+			pipe.Expire(ctx, k, expr)
+			return nil
+		}
+		pipe.HSet(ctx, k, entryVersionField, cacheEntryVersion, entryVaryField, strings.Join(entry.VaryKeys, ","))
+		pipe.Expire(ctx, k, expr)
+		vk := variantKey(k, entry.VaryKeys, entry.VaryValues)
+		pipe.Del(ctx, vk)
+		pipe.HSet(ctx, vk, entryVersionField, cacheEntryVersion, entryDataField, data)
+		pipe.Expire(ctx, vk, expr)
+		return nil
+	})
+	if err != nil {
+		util.Errorln("redisCacheAdapter.Set(...){r.client.TxPipelined(...)} : ", err)
 		return errors.Join(errors.New("redis Set(...) failed"), err)
 	}
 	return nil
 }
 
+// Delete removes the cached response of req along with all its Vary variants.
 func (r *redisCacheAdapter) Delete(ctx context.Context, req *http.Request) error {
-	return errors.New("redisCacheAdapter.Delete() : no implementation")
+	k, err := r.getKey(req)
+	if err != nil {
+		return err
+	}
+	keys := []string{k}
+	err = r.scanKeys(ctx, escapeKeyPattern(k)+":*", func(vk string) error {
+		keys = append(keys, vk)
+		return nil
+	})
+	if err != nil {
+		return errors.Join(errors.New("redis Delete() failed"), err)
+	}
+	// the base key and its variants share a hash tag, so one DEL covers them in cluster mode too
+	if err := r.client.Del(ctx, keys...).Err(); err != nil {
+		util.Errorln("redisCacheAdapter.Delete(){r.client.Del(...)} : ", err)
+		return errors.Join(errors.New("redis Delete() failed"), err)
+	}
+	return nil
 }
 
-func (cm *redisCacheAdapter) getKey(req *http.Request) (string, error) {
-	if req == nil {
-		return "", errors.New("getKey(*http.Request = nil)")
+// PurgeAll removes every cached response and returns the number of keys deleted.
+func (r *redisCacheAdapter) PurgeAll(ctx context.Context) (int64, error) {
+	var deleted int64
+	err := r.scanKeys(ctx, "cache:*", func(k string) error {
+		n, err := r.client.Del(ctx, k).Result()
+		deleted += n
+		return err
+	})
+	if err != nil {
+		util.Errorln("redisCacheAdapter.PurgeAll(){r.scanKeys(...)} : ", err)
+		return deleted, errors.Join(errors.New("redis PurgeAll() failed"), err)
 	}
-	k := "cache:" + req.Method + ":" + req.URL.String()
-	return k, nil
+	return deleted, nil
 }
 
-func (cm *redisCacheAdapter) getCacheHttpRes(res *http.Response) (*cacheHttpResponse, error) {
-	// Read the response body
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
+// scanKeys calls fn for each key matching pattern, on every master in cluster mode.
+func (r *redisCacheAdapter) scanKeys(ctx context.Context, pattern string, fn func(k string) error) error {
+	var mu sync.Mutex
+	scan := func(ctx context.Context, c redis.Cmdable) error {
+		iter := c.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			// cluster masters are scanned concurrently
+			mu.Lock()
+			err := fn(iter.Val())
+			mu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		return iter.Err()
 	}
-	// Reset the response body so it can be read again
-	res.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-	jsonFormatHeader, err := headerToJSON(res.Header)
-	if err != nil {
-		return nil, err
+	if cc, ok := r.client.(*redis.ClusterClient); ok {
+		return cc.ForEachMaster(ctx, func(ctx context.Context, c *redis.Client) error {
+			return scan(ctx, c)
+		})
 	}
-
-	resToBeCached := cacheHttpResponse{
-		Status:     res.Status,
-		StatusCode: res.StatusCode,
-		Proto:      res.Proto,
-		ProtoMajor: res.ProtoMajor,
-		ProtoMinor: res.ProtoMinor,
-		HeaderJSON: jsonFormatHeader,
-		Body:       body,
-	}
-	return &resToBeCached, nil
+	return scan(ctx, r.client)
 }
 
-func headerToJSON(header http.Header) (string, error) {
-	if header == nil {
-		return "{}", nil
-	}
+var keyPatternReplacer = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
 
-	// Create a map to hold the header data
-	headerMap := make(map[string][]string)
+// escapeKeyPattern escapes the glob characters of k for a SCAN MATCH pattern.
+func escapeKeyPattern(k string) string {
+	return keyPatternReplacer.Replace(k)
+}
 
-	// Copy the header data into the map
-	for key, values := range header {
-		headerMap[key] = values
+// getKey returns the base key of req. The method and URL are wrapped in a
+// redis hash tag so that the base key and all its variant keys hash to the
+// same cluster slot and can be written in a single transaction.
+func (cm *redisCacheAdapter) getKey(req *http.Request) (string, error) {
+	if req == nil {
+		return "", errors.New("getKey(*http.Request = nil)")
 	}
+	k := "cache:{" + req.Method + ":" + req.URL.String() + "}"
+	return k, nil
+}
 
-	// Marshal the map to JSON
-	jsonBytes, err := json.Marshal(headerMap)
-	if err != nil {
-		return "", err
+// variantKey returns the key of the variant selected by the values of the
+// varyKeys headers in h.
+func variantKey(baseKey string, varyKeys []string, h http.Header) string {
+	hash := fnv.New64a()
+	for _, k := range varyKeys {
+		hash.Write([]byte(k + ":" + strings.Join(h.Values(k), ",") + "\n"))
 	}
-
-	return string(jsonBytes), nil
+	return baseKey + ":" + strconv.FormatUint(hash.Sum64(), 16)
 }
 
 func (cm *redisCacheAdapter) getExprDur(res *http.Response) (time.Duration, error) {
@@ -229,24 +402,6 @@ func (cm *redisCacheAdapter) extractMaxAge(cacheControl string) int {
 	return 0
 }
 
-func (cm *redisCacheAdapter) getHttpRes(cacheHttpRes cacheHttpResponse) (*http.Response, error) {
-	header, err := JSONToHeader(cacheHttpRes.HeaderJSON)
-	if err != nil {
-
-		return nil, err
-	}
-
-	return &http.Response{
-		Status:     cacheHttpRes.Status,
-		StatusCode: cacheHttpRes.StatusCode,
-		Header:     header,
-		Body:       ioutil.NopCloser(bytes.NewBuffer([]byte(cacheHttpRes.Body))),
-		Proto:      cacheHttpRes.Proto,
-		ProtoMajor: cacheHttpRes.ProtoMajor,
-		ProtoMinor: cacheHttpRes.ProtoMinor,
-	}, nil
-}
-
 func JSONToHeader(stringStringJSON string) (http.Header, error) {
 	var header http.Header
 	err := json.Unmarshal([]byte(stringStringJSON), &header)
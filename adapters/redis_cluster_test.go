@@ -0,0 +1,239 @@
+package adapters
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/LamineKouissi/LHP/config"
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func newVaryResponse(body string) *http.Response {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Header: http.Header{
+			"Content-Type": []string{"text/plain"},
+			"Vary":         []string{"Accept-Language"},
+		},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+}
+
+func requestWithLanguage(lang string) *http.Request {
+	req := mustNewRequest("GET", "http://example.com/greeting", nil)
+	req.Header.Set("Accept-Language", lang)
+	return req
+}
+
+// testVariants stores two variants of one URL and reads them back.
+func testVariants(t *testing.T, adapter *redisCacheAdapter) {
+	ctx := context.Background()
+
+	assert.NoError(t, adapter.Set(ctx, requestWithLanguage("en"), newVaryResponse("hello"), time.Minute))
+	assert.NoError(t, adapter.Set(ctx, requestWithLanguage("fr"), newVaryResponse("bonjour"), time.Minute))
+
+	for lang, want := range map[string]string{"en": "hello", "fr": "bonjour"} {
+		res, err := adapter.Get(ctx, requestWithLanguage(lang))
+		if assert.NoError(t, err, lang) {
+			body, _ := ioutil.ReadAll(res.Body)
+			assert.Equal(t, want, string(body))
+		}
+	}
+
+	_, err := adapter.Get(ctx, requestWithLanguage("de"))
+	assert.IsType(t, filters.ErrCacheMiss{}, err)
+}
+
+func TestRedisCacheAdapterSingleNode(t *testing.T) {
+	mr := miniredis.RunT(t)
+	adapter, err := NewRedisCacheAdapterFromConfig(config.RedisConfig{Addr: mr.Addr()})
+	assert.NoError(t, err)
+	_, ok := adapter.client.(*redis.Client)
+	assert.True(t, ok)
+
+	testVariants(t, adapter)
+
+	base, _ := adapter.getKey(requestWithLanguage("en"))
+	assert.Equal(t, "Accept-Language", mr.HGet(base, entryVaryField))
+	for _, k := range mr.Keys() {
+		assert.Equal(t, time.Minute, mr.TTL(k), k)
+	}
+
+	// entries expire
+	mr.FastForward(2 * time.Minute)
+	_, err = adapter.Get(context.Background(), requestWithLanguage("en"))
+	assert.IsType(t, filters.ErrCacheMiss{}, err)
+}
+
+func TestRedisCacheAdapterCluster(t *testing.T) {
+	mr := miniredis.RunT(t)
+	adapter, err := NewRedisCacheAdapterFromConfig(config.RedisConfig{
+		Addrs:       []string{mr.Addr()},
+		ClusterMode: true,
+	})
+	assert.NoError(t, err)
+	cluster, ok := adapter.client.(*redis.ClusterClient)
+	assert.True(t, ok)
+
+	testVariants(t, adapter)
+
+	// the base key and every variant key land on one slot
+	ctx := context.Background()
+	base, _ := adapter.getKey(requestWithLanguage("en"))
+	baseSlot, err := cluster.ClusterKeySlot(ctx, base).Result()
+	assert.NoError(t, err)
+	assert.Len(t, mr.Keys(), 3)
+	for _, k := range mr.Keys() {
+		slot, err := cluster.ClusterKeySlot(ctx, k).Result()
+		assert.NoError(t, err)
+		assert.Equal(t, baseSlot, slot, k)
+	}
+}
+
+func TestNewRedisCacheAdapterFromConfigModes(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.RedisConfig
+		check   func(t *testing.T, client redis.UniversalClient)
+		wantErr bool
+	}{
+		{
+			name: "Sentinel failover",
+			cfg: config.RedisConfig{
+				Addrs:            []string{"sentinel1:26379", "sentinel2:26379"},
+				MasterName:       "mymaster",
+				SentinelPassword: "secret",
+			},
+			check: func(t *testing.T, client redis.UniversalClient) {
+				_, ok := client.(*redis.Client)
+				assert.True(t, ok)
+			},
+		},
+		{
+			name: "Cluster with a single seed",
+			cfg:  config.RedisConfig{Addr: "node1:7000", ClusterMode: true},
+			check: func(t *testing.T, client redis.UniversalClient) {
+				_, ok := client.(*redis.ClusterClient)
+				assert.True(t, ok)
+			},
+		},
+		{
+			name:    "Sentinel and cluster together",
+			cfg:     config.RedisConfig{Addrs: []string{"a:1"}, MasterName: "m", ClusterMode: true},
+			wantErr: true,
+		},
+		{
+			name:    "Cluster with a db",
+			cfg:     config.RedisConfig{Addrs: []string{"a:1"}, ClusterMode: true, DB: 1},
+			wantErr: true,
+		},
+		{
+			name:    "Several addrs without a mode",
+			cfg:     config.RedisConfig{Addrs: []string{"a:1", "b:2"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter, err := NewRedisCacheAdapterFromConfig(tt.cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Nil(t, adapter)
+				return
+			}
+			assert.NoError(t, err)
+			tt.check(t, adapter.client)
+		})
+	}
+}
+
+func TestNewRedisCacheAdapterWithClient(t *testing.T) {
+	_, err := NewRedisCacheAdapterWithClient(nil)
+	assert.Error(t, err)
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	adapter, err := NewRedisCacheAdapterWithClient(client)
+	assert.NoError(t, err)
+	got, err := adapter.GetClient()
+	assert.NoError(t, err)
+	assert.Equal(t, "PONG", got.Ping(context.Background()).Val())
+}
+
+func TestRedisCacheAdapterDeleteAndPurge(t *testing.T) {
+	for _, clusterMode := range []bool{false, true} {
+		mr := miniredis.RunT(t)
+		adapter, err := NewRedisCacheAdapterFromConfig(config.RedisConfig{Addrs: []string{mr.Addr()}, ClusterMode: clusterMode})
+		assert.NoError(t, err)
+		ctx := context.Background()
+
+		testVariants(t, adapter)
+		other := mustNewRequest("GET", "http://example.com/a?q=[x]*", nil)
+		assert.NoError(t, adapter.Set(ctx, other, newVaryResponse("other"), time.Minute))
+		assert.NoError(t, mr.Set("unrelated", "kept"))
+
+		// Delete removes the base key and every variant
+		assert.NoError(t, adapter.Delete(ctx, requestWithLanguage("en")))
+		for _, lang := range []string{"en", "fr"} {
+			_, err := adapter.Get(ctx, requestWithLanguage(lang))
+			assert.IsType(t, filters.ErrCacheMiss{}, err, lang)
+		}
+		assert.Len(t, mr.Keys(), 3, "only the other URL and the unrelated key are left")
+
+		deleted, err := adapter.PurgeAll(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), deleted)
+		assert.Equal(t, []string{"unrelated"}, mr.Keys())
+	}
+}
+
+type filterFunc func(ctx context.Context, req *http.Request, res *http.Response) error
+
+func (f filterFunc) Process(ctx context.Context, req *http.Request, res *http.Response) error {
+	return f(ctx, req, res)
+}
+
+// a cached miss releases the upstream target it was sent to, as an uncached response does
+func TestCacheMissReleasesUpstreamTarget(t *testing.T) {
+	mr := miniredis.RunT(t)
+	adapter, err := NewRedisCacheAdapterFromConfig(config.RedisConfig{Addr: mr.Addr()})
+	assert.NoError(t, err)
+
+	balancer, _ := filters.NewBalancer(filters.BalancerLeastConn, "")
+	pool, err := filters.NewUpstreamPool("api", []string{"http://10.0.0.1:8080"}, balancer)
+	assert.NoError(t, err)
+	poolFilter, _ := filters.NewUpstreamPoolFilter([]*filters.UpstreamPool{pool})
+	assert.NoError(t, poolFilter.SetRoutePools(map[string]string{"api": "api"}))
+	poolFilter.SetNextFilter(filterFunc(func(ctx context.Context, req *http.Request, res *http.Response) error {
+		*res = http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=60"}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString("hello")),
+		}
+		return nil
+	}))
+	cacheFilter, _ := filters.NewCacheMgrFilter(adapter)
+	cacheFilter.SetNextFilter(poolFilter)
+
+	for _, path := range []string{"/cached", "/cached", "/other"} {
+		res := &http.Response{}
+		ctx := filters.WithRoute(context.Background(), "api")
+		assert.NoError(t, cacheFilter.Process(ctx, mustNewRequest("GET", "http://example.com"+path, nil), res))
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, "hello", string(body), path)
+		assert.Equal(t, int64(0), pool.Targets()[0].Active(), path)
+	}
+}
@@ -0,0 +1,70 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/redis/go-redis/v9"
+)
+
+// tokenBucketScript takes a token of the bucket KEYS[1], a hash of its
+// tokens and the time they were counted at, in microseconds of the redis
+// clock so that the instances agree. ARGV: capacity, tokens per second and
+// the expiry of the bucket in milliseconds. It returns {allowed, wait in ms}.
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1])
+local ts = tonumber(b[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+tokens = math.min(capacity, tokens + math.max(0, now - ts) / 1000000 * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return {allowed, wait}
+`)
+
+// RedisRateLimitStore keeps the token buckets in redis, so the limits are
+// shared by the instances of the proxy using the same redis.
+type RedisRateLimitStore struct {
+	client redis.UniversalClient
+}
+
+func NewRedisRateLimitStore(client redis.UniversalClient) (*RedisRateLimitStore, error) {
+	if client == nil {
+		return nil, errors.New("redis.UniversalClient = <nil>")
+	}
+	return &RedisRateLimitStore{client: client}, nil
+}
+
+func (rs *RedisRateLimitStore) Take(ctx context.Context, key string, limit filters.RateLimit) (bool, time.Duration, error) {
+	capacity, rate := limit.Capacity(), limit.Rate()
+	// a bucket untouched until it is full again is the same as no bucket
+	expiry := int64(float64(capacity)/rate*1000) + 1000
+	res, err := tokenBucketScript.Run(ctx, rs.client, []string{"ratelimit:" + key},
+		capacity, strconv.FormatFloat(rate, 'f', -1, 64), expiry).Int64Slice()
+	if err != nil {
+		return false, 0, errors.Join(errors.New("redis rate limit script failed"), err)
+	}
+	if len(res) != 2 {
+		return false, 0, fmt.Errorf("redis rate limit script returned %v", res)
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
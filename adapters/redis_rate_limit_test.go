@@ -0,0 +1,48 @@
+package adapters
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisRateLimitStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	now := time.Unix(1700000000, 0)
+	mr.SetTime(now)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	store, err := NewRedisRateLimitStore(client)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	limit := filters.RateLimit{Key: filters.RateLimitKeyClientIP, Requests: 2, Per: time.Second}
+
+	for i := 0; i < 2; i++ {
+		allowed, _, err := store.Take(ctx, "r/0/client_ip=192.0.2.1", limit)
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+	}
+	allowed, retryAfter, err := store.Take(ctx, "r/0/client_ip=192.0.2.1", limit)
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+	// another key has its own bucket
+	allowed, _, err = store.Take(ctx, "r/0/client_ip=192.0.2.2", limit)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	mr.SetTime(now.Add(500 * time.Millisecond))
+	allowed, _, err = store.Take(ctx, "r/0/client_ip=192.0.2.1", limit)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	assert.True(t, mr.Exists("ratelimit:r/0/client_ip=192.0.2.1"))
+
+	_, err = NewRedisRateLimitStore(nil)
+	assert.Error(t, err)
+}
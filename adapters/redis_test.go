@@ -10,8 +10,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/LamineKouissi/LHP/config"
 	"github.com/LamineKouissi/LHP/filters"
 	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -78,7 +80,7 @@ func TestRedisCacheAdapterGet(t *testing.T) {
 	t.Run("Redis error", func(t *testing.T) {
 		//mocking redis to simulate HGetAll() withe an err
 		req, _ := http.NewRequest("GET", "http://example.com/error", nil)
-		cacheKey := "cache:GET:http://example.com/error"
+		cacheKey := "cache:{GET:http://example.com/error}"
 		db, mock := redismock.NewClientMock()
 		mockedAdapter := &redisCacheAdapter{
 			client: db,
@@ -95,7 +97,7 @@ func TestRedisCacheAdapterGet(t *testing.T) {
 	t.Run("Invalid JSON header", func(t *testing.T) {
 		//mocking redis to simulate HGetAll() with invalid JSON header
 		req, _ := http.NewRequest("GET", "http://example.com/invalidheader", nil)
-		cacheKey := "cache:GET:http://example.com/invalidheader"
+		cacheKey := "cache:{GET:http://example.com/invalidheader}"
 		db, mock := redismock.NewClientMock()
 		mockedAdapter := &redisCacheAdapter{
 			client: db,
@@ -118,6 +120,88 @@ func TestRedisCacheAdapterGet(t *testing.T) {
 		assert.Contains(t, err.Error(), "unexpected end of JSON input")
 	})
 
+	t.Run("Versioned entry", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "http://example.com/versioned", nil)
+		cacheKey := "cache:{GET:http://example.com/versioned}"
+		db, mock := redismock.NewClientMock()
+		mockedAdapter := &redisCacheAdapter{
+			client: db,
+		}
+		entry := &cacheEntry{
+			Method:     "GET",
+			URL:        "http://example.com/versioned",
+			StoredAt:   time.Now().Add(-10 * time.Second),
+			Status:     "200 OK",
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Trailer:    http.Header{"X-Checksum": []string{"abc"}},
+			Body:       []byte(`{"message":"Hello, World!"}`),
+		}
+		data, _ := entry.MarshalBinary()
+		mock.ExpectHGetAll(cacheKey).SetVal(map[string]string{
+			"v":     "1",
+			"entry": string(data),
+		})
+
+		res, err := mockedAdapter.Get(ctx, req)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+		assert.Equal(t, "abc", res.Trailer.Get("X-Checksum"))
+		assert.NotEmpty(t, res.Header.Get("Age"))
+		body, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, entry.Body, body)
+	})
+
+	t.Run("Legacy unversioned entry", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "http://example.com/legacy", nil)
+		cacheKey := "cache:{GET:http://example.com/legacy}"
+		db, mock := redismock.NewClientMock()
+		mockedAdapter := &redisCacheAdapter{
+			client: db,
+		}
+		mock.ExpectHGetAll(cacheKey).SetVal(map[string]string{
+			"status":      "200 OK",
+			"status_code": "200",
+			"header":      `{"Content-Type":["text/plain"]}`,
+			"body":        "hello",
+			"proto":       "HTTP/1.1",
+			"proto_major": "1",
+			"proto_minor": "1",
+		})
+
+		res, err := mockedAdapter.Get(ctx, req)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "200 OK", res.Status)
+		assert.Equal(t, "text/plain", res.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, []byte("hello"), body)
+	})
+
+	t.Run("Vary mismatch", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "http://example.com/vary", nil)
+		req.Header.Set("Accept-Language", "fr")
+		cacheKey := "cache:{GET:http://example.com/vary}"
+		db, mock := redismock.NewClientMock()
+		mockedAdapter := &redisCacheAdapter{
+			client: db,
+		}
+		entry := &cacheEntry{
+			StatusCode: 200,
+			VaryKeys:   []string{"Accept-Language"},
+			VaryValues: http.Header{"Accept-Language": []string{"en"}},
+		}
+		data, _ := entry.MarshalBinary()
+		mock.ExpectHGetAll(cacheKey).SetVal(map[string]string{"v": "1", "entry": string(data)})
+
+		res, err := mockedAdapter.Get(ctx, req)
+
+		assert.Nil(t, res)
+		assert.IsType(t, filters.ErrCacheMiss{}, err)
+	})
+
 	t.Run("Nil request", func(t *testing.T) {
 		res, err := adapter.Get(ctx, nil)
 		assert.Error(t, err)
@@ -216,6 +300,93 @@ func TestRedisCacheAdapterSet(t *testing.T) {
 	}
 }
 
+func TestRedisCacheAdapterSetIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	cacheKey := "cache:{GET:http://example.com/atomic}"
+	db, mock := redismock.NewClientMock()
+	mockedAdapter := &redisCacheAdapter{
+		client: db,
+	}
+	inputResponse := &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Header:     http.Header{"Cache-Control": []string{"max-age=60"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString("hello")),
+	}
+
+	mock.ExpectTxPipeline()
+	mock.ExpectDel(cacheKey).SetVal(1)
+	mock.CustomMatch(func(expected, actual []interface{}) error {
+		// the encoded entry embeds the store time, only check the layout
+		if len(actual) != 6 || actual[0] != "hset" || actual[1] != cacheKey || actual[2] != "v" || actual[4] != "entry" {
+			return errors.New("unexpected hset args")
+		}
+		return nil
+	}).ExpectHSet(cacheKey, "v", cacheEntryVersion, "entry", []byte(nil)).SetVal(2)
+	mock.ExpectExpire(cacheKey, time.Minute).SetVal(true)
+	mock.ExpectTxPipelineExec()
+
+	err := mockedAdapter.Set(ctx, mustNewRequest("GET", "http://example.com/atomic", nil), inputResponse, 0)
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRedisCacheAdapterSetExecError(t *testing.T) {
+	ctx := context.Background()
+	cacheKey := "cache:{GET:http://example.com/execerror}"
+	db, mock := redismock.NewClientMock()
+	mockedAdapter := &redisCacheAdapter{
+		client: db,
+	}
+
+	mock.ExpectTxPipeline()
+	mock.ExpectDel(cacheKey).SetErr(assert.AnError)
+
+	err := mockedAdapter.Set(ctx, mustNewRequest("GET", "http://example.com/execerror", nil), &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(bytes.NewBufferString("hello")),
+	}, time.Minute)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "redis Set(...) failed")
+}
+
+func TestNewRedisCacheAdapterFromConfig(t *testing.T) {
+	adapter, err := NewRedisCacheAdapterFromConfig(config.RedisConfig{
+		Addr:        "redis.internal:6380",
+		Username:    "usr",
+		Password:    "pass",
+		DB:          2,
+		PoolSize:    20,
+		DialTimeout: config.Duration(3 * time.Second),
+		ReadTimeout: config.Duration(time.Second),
+		TLS:         config.RedisTLSConfig{Enabled: true, ServerName: "redis.internal"},
+	})
+	assert.NoError(t, err)
+
+	opt := adapter.client.(*redis.Client).Options()
+	assert.Equal(t, "redis.internal:6380", opt.Addr)
+	assert.Equal(t, "usr", opt.Username)
+	assert.Equal(t, "pass", opt.Password)
+	assert.Equal(t, 2, opt.DB)
+	assert.Equal(t, 20, opt.PoolSize)
+	assert.Equal(t, 3*time.Second, opt.DialTimeout)
+	assert.Equal(t, time.Second, opt.ReadTimeout)
+	assert.NotNil(t, opt.TLSConfig)
+	assert.Equal(t, "redis.internal", opt.TLSConfig.ServerName)
+
+	_, err = NewRedisCacheAdapterFromConfig(config.RedisConfig{})
+	assert.Error(t, err)
+
+	_, err = NewRedisCacheAdapterFromConfig(config.RedisConfig{
+		Addr: "localhost:6379",
+		TLS:  config.RedisTLSConfig{Enabled: true, CAFile: "does/not/exist.pem"},
+	})
+	assert.Error(t, err)
+}
+
 func TestRedisSet(t *testing.T) {
 
 	adapter, err := NewRedisCacheAdapter("localhost:6379", "", "", "0")
@@ -236,122 +407,6 @@ func TestRedisSet(t *testing.T) {
 
 }
 
-func TestGetCacheHttpRes(t *testing.T) {
-	adapter := &redisCacheAdapter{}
-
-	tests := []struct {
-		name           string
-		inputResponse  *http.Response
-		expectedOutput *cacheHttpResponse
-		expectError    bool
-	}{
-		{
-			name: "Simple response",
-			inputResponse: &http.Response{
-				Status:     "200 OK",
-				StatusCode: 200,
-				Header:     http.Header{"Content-Type": []string{"application/json"}},
-				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"message":"Hello, World!"}`)),
-				Proto:      "HTTP/1.1",
-				ProtoMajor: 1,
-				ProtoMinor: 1,
-			},
-			expectedOutput: &cacheHttpResponse{
-				Status:     "200 OK",
-				StatusCode: 200,
-				HeaderJSON: `{"Content-Type":["application/json"]}`,
-				Body:       []byte(`{"message":"Hello, World!"}`),
-				Proto:      "HTTP/1.1",
-				ProtoMajor: 1,
-				ProtoMinor: 1,
-			},
-			expectError: false,
-		},
-		{
-			name: "Response with multiple headers",
-			inputResponse: &http.Response{
-				Status:     "200 OK",
-				StatusCode: 200,
-				Header: http.Header{
-					"Content-Type":    []string{"application/json"},
-					"X-Request-ID":    []string{"123456"},
-					"X-Response-Time": []string{"100ms"},
-				},
-				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"data":"Some data"}`)),
-				Proto:      "HTTP/2.0",
-				ProtoMajor: 2,
-				ProtoMinor: 0,
-			},
-			expectedOutput: &cacheHttpResponse{
-				Status:     "200 OK",
-				StatusCode: 200,
-				HeaderJSON: `{"Content-Type":["application/json"],"X-Request-ID":["123456"],"X-Response-Time":["100ms"]}`,
-				Body:       []byte(`{"data":"Some data"}`),
-				Proto:      "HTTP/2.0",
-				ProtoMajor: 2,
-				ProtoMinor: 0,
-			},
-			expectError: false,
-		},
-		{
-			name: "Response with empty body",
-			inputResponse: &http.Response{
-				Status:     "204 No Content",
-				StatusCode: 204,
-				Header:     http.Header{"Content-Length": []string{"0"}},
-				Body:       ioutil.NopCloser(bytes.NewBufferString("")),
-				Proto:      "HTTP/1.1",
-				ProtoMajor: 1,
-				ProtoMinor: 1,
-			},
-			expectedOutput: &cacheHttpResponse{
-				Status:     "204 No Content",
-				StatusCode: 204,
-				HeaderJSON: `{"Content-Length":["0"]}`,
-				Body:       []byte(``),
-				Proto:      "HTTP/1.1",
-				ProtoMajor: 1,
-				ProtoMinor: 1,
-			},
-			expectError: false,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result, err := adapter.getCacheHttpRes(tt.inputResponse)
-
-			if tt.expectError {
-				assert.Error(t, err)
-				assert.Nil(t, result)
-			} else {
-				assert.NoError(t, err)
-				assert.NotNil(t, result)
-
-				assert.Equal(t, tt.expectedOutput.Status, result.Status)
-				assert.Equal(t, tt.expectedOutput.StatusCode, result.StatusCode)
-				assert.Equal(t, tt.expectedOutput.Body, result.Body)
-				assert.Equal(t, tt.expectedOutput.Proto, result.Proto)
-				assert.Equal(t, tt.expectedOutput.ProtoMajor, result.ProtoMajor)
-				assert.Equal(t, tt.expectedOutput.ProtoMinor, result.ProtoMinor)
-
-				// Compare HeaderJSON by unmarshaling and comparing the resulting maps
-				var expectedHeader, resultHeader map[string][]string
-				err = json.Unmarshal([]byte(tt.expectedOutput.HeaderJSON), &expectedHeader)
-				assert.NoError(t, err)
-				err = json.Unmarshal([]byte(result.HeaderJSON), &resultHeader)
-				assert.NoError(t, err)
-				assert.Equal(t, expectedHeader, resultHeader)
-
-				// Verify that the original response body can still be read
-				bodyBytes, err := ioutil.ReadAll(tt.inputResponse.Body)
-				assert.NoError(t, err)
-				assert.Equal(t, tt.expectedOutput.Body, bodyBytes)
-			}
-		})
-	}
-}
-
 func TestJSONToHeader(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -417,62 +472,6 @@ func TestJSONToHeader(t *testing.T) {
 		})
 	}
 }
-func TestHeaderToJSON(t *testing.T) {
-	tests := []struct {
-		name          string
-		header        http.Header
-		expectedJSON  string
-		expectedError bool
-	}{
-		{
-			name: "Simple header",
-			header: http.Header{
-				"Content-Type": []string{"application/json"},
-				"X-Request-ID": []string{"123456"},
-			},
-			expectedJSON:  `{"Content-Type":["application/json"],"X-Request-ID":["123456"]}`,
-			expectedError: false,
-		},
-		{
-			name: "Header with multiple values",
-			header: http.Header{
-				"Set-Cookie": []string{"session=abc123", "user=john"},
-			},
-			expectedJSON:  `{"Set-Cookie":["session=abc123","user=john"]}`,
-			expectedError: false,
-		},
-		{
-			name:          "Nil header",
-			header:        nil,
-			expectedJSON:  "{}",
-			expectedError: false,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			jsonStr, err := headerToJSON(tt.header)
-
-			if tt.expectedError {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
-				assert.JSONEq(t, tt.expectedJSON, jsonStr)
-
-				// Verify that we can unmarshal the JSON back into a map
-				var headerMap map[string][]string
-				err = json.Unmarshal([]byte(jsonStr), &headerMap)
-				assert.NoError(t, err)
-
-				// Compare the original header with the unmarshaled map
-				for key, values := range tt.header {
-					assert.Equal(t, values, headerMap[key])
-				}
-			}
-		})
-	}
-}
-
 func TestRedisCacheAdapter_GetClient(t *testing.T) {
 	rdAdapter, _ := NewRedisCacheAdapter("localhost:6379", "", "", "0")
 	client, err := rdAdapter.GetClient()
@@ -492,13 +491,13 @@ func TestGetKey(t *testing.T) {
 		{
 			name:        "Valid GET request",
 			request:     mustNewRequest("GET", "http://example.com/path", nil),
-			expectedKey: "cache:GET:http://example.com/path",
+			expectedKey: "cache:{GET:http://example.com/path}",
 			expectError: false,
 		},
 		{
 			name:        "Valid POST request",
 			request:     mustNewRequest("POST", "http://example.com/api?param=value", nil),
-			expectedKey: "cache:POST:http://example.com/api?param=value",
+			expectedKey: "cache:{POST:http://example.com/api?param=value}",
 			expectError: false,
 		},
 		{
@@ -0,0 +1,97 @@
+package adapters
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFileWriter appends to a file and rotates it once it grows past
+// maxSize bytes: path -> path.1 -> path.2 ... keeping maxBackups old files.
+type rotatingFileWriter struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func NewRotatingFileWriter(path string, maxSize int64, maxBackups int) (*rotatingFileWriter, error) {
+	if path == "" {
+		return nil, errors.New("empty log file path")
+	}
+	if maxSize < 0 || maxBackups < 0 {
+		return nil, fmt.Errorf("invalid rotation settings : maxSize=%d maxBackups=%d", maxSize, maxBackups)
+	}
+	rw := &rotatingFileWriter{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rw.open(); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+func (rw *rotatingFileWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.file == nil {
+		return 0, errors.New("log file is closed")
+	}
+	if rw.maxSize > 0 && rw.size > 0 && rw.size+int64(len(p)) > rw.maxSize {
+		if err := rw.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rw.file.Write(p)
+	rw.size += int64(n)
+	return n, err
+}
+
+func (rw *rotatingFileWriter) Close() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.file == nil {
+		return nil
+	}
+	err := rw.file.Close()
+	rw.file = nil
+	return err
+}
+
+func (rw *rotatingFileWriter) open() error {
+	f, err := os.OpenFile(rw.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rw.file, rw.size = f, info.Size()
+	return nil
+}
+
+func (rw *rotatingFileWriter) rotate() error {
+	if err := rw.file.Close(); err != nil {
+		return err
+	}
+	rw.file = nil
+	if rw.maxBackups == 0 {
+		if err := os.Remove(rw.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return rw.open()
+	}
+	for i := rw.maxBackups - 1; i >= 1; i-- {
+		src := fmt.Sprintf("%s.%d", rw.path, i)
+		if err := os.Rename(src, fmt.Sprintf("%s.%d", rw.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(rw.path, rw.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return rw.open()
+}
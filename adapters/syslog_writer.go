@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+
+package adapters
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// NewSyslogWriter connects to the syslog daemon at addr over network
+// ("udp", "tcp", or "" for the local daemon) and logs with the given tag.
+func NewSyslogWriter(network, addr, tag string) (io.WriteCloser, error) {
+	return syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+}
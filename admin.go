@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/LamineKouissi/LHP/adapters"
+	"github.com/LamineKouissi/LHP/config"
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/LamineKouissi/LHP/routers"
+	"github.com/LamineKouissi/LHP/util"
+)
+
+const redactedSecret = "REDACTED"
+
+// addReadinessChecks adds checks and the configured upstream checks to the
+// readiness probe of ar.
+func addReadinessChecks(ar *routers.AdminRouter, hc config.HealthConfig, checks ...routers.ReadinessCheck) error {
+	if hc.CheckTimeout > 0 {
+		if err := ar.SetReadinessCheckTimeout(time.Duration(hc.CheckTimeout)); err != nil {
+			return err
+		}
+	}
+	for _, addr := range hc.Upstreams {
+		check, err := adapters.NewTCPReachabilityCheck("", addr)
+		if err != nil {
+			return err
+		}
+		checks = append(checks, check)
+	}
+	for _, check := range checks {
+		if err := ar.AddReadinessCheck(check); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newAdminRouter builds the admin router with its public /metrics and the
+// management endpoints wired to the proxy components.
+func newAdminRouter(adminConfig config.AdminConfig, cachePurger routers.CachePurger) (*routers.AdminRouter, error) {
+	token := adminConfig.Token
+	if token == "" {
+		token = os.Getenv("ADMIN_TOKEN")
+	}
+	ar, err := routers.NewAdminRouter(token)
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range []func() error{
+		func() error { return ar.Handle("/metrics", metrics) },
+		func() error { return ar.SetConfigSource(func() interface{} { return effectiveConfig() }) },
+		func() error { return ar.SetRoutesSource(func() interface{} { return routesInfo() }) },
+		func() error { return ar.SetTunnelManager(httpsRoute) },
+		func() error { return ar.SetCachePurger(cachePurger) },
+		func() error { return ar.SetReloader(reloadProxyConfig) },
+	} {
+		if err := set(); err != nil {
+			return nil, err
+		}
+	}
+	return ar, nil
+}
+
+// effectiveConfig is the running config, defaults and env variables
+// included, with its secrets redacted.
+func effectiveConfig() config.ProxyConfig {
+	proxyConfigMu.RLock()
+	var cfg config.ProxyConfig
+	if proxyConfig != nil {
+		cfg = *proxyConfig
+	}
+	proxyConfigMu.RUnlock()
+
+	if cfg.ListenAddress == "" {
+		cfg.ListenAddress = ":7000"
+	}
+	cfg.Redis = redisConfig
+	if cfg.Redis.Password != "" {
+		cfg.Redis.Password = redactedSecret
+	}
+	if cfg.Redis.SentinelPassword != "" {
+		cfg.Redis.SentinelPassword = redactedSecret
+	}
+	if addr, ok := adminAddressFromConfig(cfg.Admin); ok {
+		cfg.Admin.ListenAddress = addr
+	}
+	if cfg.Admin.Token != "" {
+		cfg.Admin.Token = redactedSecret
+	}
+	if len(cfg.Tracing.Headers) > 0 {
+		headers := map[string]string{}
+		for k := range cfg.Tracing.Headers {
+			headers[k] = redactedSecret
+		}
+		cfg.Tracing.Headers = headers
+	}
+	return cfg
+}
+
+type routeInfo struct {
+	Name        string   `json:"name"`
+	Host        string   `json:"host,omitempty"`
+	PathPrefix  string   `json:"path,omitempty"`
+	Method      string   `json:"method,omitempty"`
+	FilterChain []string `json:"filter_chain,omitempty"`
+	Connector   string   `json:"connector,omitempty"`
+	Upstream    string   `json:"upstream,omitempty"`
+	CachePolicy bool     `json:"cache_policy"`
+}
+
+// routesInfo lists the routes requests are matched against and the filter
+// chain they go through.
+func routesInfo() interface{} {
+	proxyConfigMu.RLock()
+	var routeConfigs []config.RouteConfig
+	if proxyConfig != nil {
+		routeConfigs = proxyConfig.Routes
+	}
+	proxyConfigMu.RUnlock()
+
+	routeMatchers := httpRoute.RouteMatchers()
+	infos := make([]routeInfo, 0, len(routeMatchers))
+	for i, rm := range routeMatchers {
+		ri := routeInfo{Name: rm.Name, Host: rm.Host, PathPrefix: rm.PathPrefix, Method: rm.Method}
+		if i < len(routeConfigs) {
+			ri.FilterChain = routeConfigs[i].FilterChain
+			ri.Connector = routeConfigs[i].Connector
+			ri.Upstream = routeConfigs[i].Upstream
+			ri.CachePolicy = routeConfigs[i].Cache != nil
+		}
+		infos = append(infos, ri)
+	}
+	return map[string]interface{}{
+		"http_filter_chain": httpFilterNames,
+		"routes":            infos,
+	}
+}
+
+// reloadMu serializes the config reloads
+var reloadMu sync.Mutex
+
+// reloadProxyConfig reloads the PROXY_CONFIG file and applies the routes,
+// cache policies, rate limits, header rules and forwarding settings; the
+// listeners, TLS, redis, admin and tracing settings only change on restart.
+func reloadProxyConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	cfg, err := loadProxyConfig(os.Getenv("PROXY_CONFIG"))
+	if err != nil {
+		return err
+	}
+	if cfg == nil {
+		return errors.New("no config file to reload : PROXY_CONFIG is not set")
+	}
+	return applyReloadedConfig(cfg)
+}
+
+// reloadSettings are the settings a reload applies, all of them built and
+// checked before any is applied so that a bad config changes nothing.
+type reloadSettings struct {
+	routeMatchers  []filters.RouteMatcher
+	routePools     map[string]string
+	defaultLimits  []filters.RateLimit
+	routeLimits    map[string][]filters.RateLimit
+	headerDefaults filters.HeaderRules
+	headerRoutes   map[string]filters.HeaderRules
+	forwarding     filters.Forwarding
+	cache          cacheSettings
+}
+
+func reloadSettingsFromConfig(cfg *config.ProxyConfig) (reloadSettings, error) {
+	var rs reloadSettings
+	rs.routeMatchers = routeMatchersFromConfig(cfg.Routes)
+
+	rs.routePools = routePoolsFromConfig(cfg.Routes, rs.routeMatchers)
+	if poolFilter != nil {
+		if err := poolFilter.ValidateRoutePools(rs.routePools); err != nil {
+			return rs, err
+		}
+	} else if len(rs.routePools) > 0 {
+		return rs, errors.New("no upstream pools to route to : upstream_pools changes need a restart")
+	}
+
+	rs.defaultLimits, rs.routeLimits = rateLimitsFromConfig(cfg.RateLimit, cfg.Routes, rs.routeMatchers)
+	if rateLimitFilter != nil {
+		if err := filters.ValidateRateLimits(rs.defaultLimits, rs.routeLimits); err != nil {
+			return rs, err
+		}
+	} else if len(rs.defaultLimits) > 0 || len(rs.routeLimits) > 0 {
+		return rs, errors.New("no rate limit filter : enabling rate limits needs a restart")
+	}
+
+	rs.headerDefaults, rs.headerRoutes = headerRulesFromConfig(cfg.Headers, cfg.Routes, rs.routeMatchers)
+	if err := filters.ValidateHeaderRules(rs.headerDefaults, rs.headerRoutes); err != nil {
+		return rs, err
+	}
+
+	forwarding, err := forwardingFromConfig(cfg.Forwarding)
+	if err != nil {
+		return rs, err
+	}
+	if err := forwarding.Validate(); err != nil {
+		return rs, err
+	}
+	rs.forwarding = forwarding
+
+	rs.cache, err = cacheSettingsFromConfig(cfg.Cache, rs.routeMatchers, cfg.Routes)
+	return rs, err
+}
+
+// apply sets the checked settings, the setters fail on nothing left to check.
+func (rs reloadSettings) apply() error {
+	if poolFilter != nil {
+		if err := poolFilter.SetRoutePools(rs.routePools); err != nil {
+			return err
+		}
+	}
+	if rateLimitFilter != nil {
+		if err := rateLimitFilter.SetLimits(rs.defaultLimits, rs.routeLimits); err != nil {
+			return err
+		}
+	}
+	if err := transformerFilter.SetHeaderRules(rs.headerDefaults, rs.headerRoutes); err != nil {
+		return err
+	}
+	if err := transformerFilter.SetForwarding(rs.forwarding); err != nil {
+		return err
+	}
+	if err := rs.cache.apply(cacheFilter); err != nil {
+		return err
+	}
+	httpRoute.SetRouteMatchers(rs.routeMatchers)
+	return nil
+}
+
+// applyReloadedConfig applies the reloadable settings of cfg, or none of
+// them when one is invalid.
+func applyReloadedConfig(cfg *config.ProxyConfig) error {
+	rs, err := reloadSettingsFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+	if err := rs.apply(); err != nil {
+		return err
+	}
+
+	proxyConfigMu.Lock()
+	proxyConfig = reloadedConfig(proxyConfig, cfg)
+	proxyConfigMu.Unlock()
+	util.Infoln("config reloaded : routes, cache policies, rate limits, header rules and forwarding applied, other changes need a restart")
+	return nil
+}
+
+// reloadedConfig is the running config with the sections a reload applies
+// taken from cfg, the others keep what is in effect until a restart.
+func reloadedConfig(running, cfg *config.ProxyConfig) *config.ProxyConfig {
+	var merged config.ProxyConfig
+	if running != nil {
+		merged = *running
+	}
+	merged.Routes = cfg.Routes
+	merged.Cache = cfg.Cache
+	// the store only changes on restart
+	merged.RateLimit.Limits = cfg.RateLimit.Limits
+	merged.Headers = cfg.Headers
+	merged.Forwarding = cfg.Forwarding
+	return &merged
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LamineKouissi/LHP/config"
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyReloadedConfig(t *testing.T) {
+	running, runningCache, runningMatchers := proxyConfig, cacheFilter, httpRoute.RouteMatchers()
+	t.Cleanup(func() {
+		proxyConfig, cacheFilter = running, runningCache
+		httpRoute.SetRouteMatchers(runningMatchers)
+	})
+	breaker, _ := filters.NewCircuitBreaker(filters.DefaultBreakerFailureThreshold, filters.DefaultBreakerOpenTimeout, filters.DefaultBreakerHalfOpenProbes)
+	rc := &recordingCacheFilter{breaker: breaker}
+	cacheFilter = rc
+	proxyConfig = &config.ProxyConfig{ListenAddress: ":7000", ACL: config.ACLConfig{Default: "allow"}}
+
+	enabled := true
+	cfg := &config.ProxyConfig{
+		ListenAddress: ":9000",
+		ACL:           config.ACLConfig{Default: "deny"},
+		Routes:        []config.RouteConfig{{Name: "api", Path: "/api/", Cache: &config.CachePolicyConfig{Enabled: &enabled}}},
+	}
+	assert.NoError(t, applyReloadedConfig(cfg))
+	assert.Equal(t, []filters.RouteMatcher{{Name: "api", PathPrefix: "/api/"}}, httpRoute.RouteMatchers())
+	assert.Contains(t, rc.routePolicies, "api")
+	assert.Equal(t, cfg.Routes, proxyConfig.Routes)
+	assert.Equal(t, ":7000", proxyConfig.ListenAddress, "the listeners change on restart")
+	assert.Equal(t, "allow", proxyConfig.ACL.Default, "the ACL changes on restart")
+
+	tests := []struct {
+		name string
+		cfg  config.ProxyConfig
+	}{
+		{
+			name: "Invalid breaker",
+			cfg:  config.ProxyConfig{Cache: config.CacheConfig{Breaker: config.CircuitBreakerConfig{FailureThreshold: -1}}},
+		},
+		{
+			name: "Rate limits without the filter",
+			cfg:  config.ProxyConfig{RateLimit: config.RateLimitConfig{Limits: []config.RateLimitRuleConfig{{Key: "host", Requests: 1, Per: config.Duration(time.Second)}}}},
+		},
+		{
+			name: "Pools without the filter",
+			cfg:  config.ProxyConfig{Routes: []config.RouteConfig{{Name: "web", Upstream: "web"}}},
+		},
+		{
+			name: "Invalid header rule",
+			cfg:  config.ProxyConfig{Headers: config.HeaderRulesConfig{Request: []config.HeaderRuleConfig{{Action: "append", Name: "X-A"}}}},
+		},
+		{
+			name: "Invalid Via pseudonym",
+			cfg:  config.ProxyConfig{Forwarding: config.ForwardingConfig{ViaPseudonym: "proxy a"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Routes = append(cfg.Routes, config.RouteConfig{Name: "new", Path: "/new/", Cache: &config.CachePolicyConfig{}})
+			assert.Error(t, applyReloadedConfig(&cfg))
+			assert.Equal(t, []filters.RouteMatcher{{Name: "api", PathPrefix: "/api/"}}, httpRoute.RouteMatchers())
+			assert.NotContains(t, rc.routePolicies, "new")
+			assert.Contains(t, rc.routePolicies, "api", "the cache policies are still in effect")
+			assert.True(t, breaker.SameSettings(rc.breaker))
+			assert.Equal(t, "api", proxyConfig.Routes[0].Name)
+		})
+	}
+}
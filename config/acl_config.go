@@ -0,0 +1,33 @@
+package config
+
+// ACLConfig restricts the targets the clients reach, over HTTP and CONNECT.
+// The first rule matching a request decides, Default (allow or deny) when
+// none matches, see filters.ACL.
+type ACLConfig struct {
+	Default        string                `json:"default"`
+	Rules          []ACLRuleConfig       `json:"rules"`
+	SSRFProtection *SSRFProtectionConfig `json:"ssrf_protection"`
+}
+
+// ACLRuleConfig matches the requests meeting all its non-empty conditions.
+// Domains are exact or "*.example.com" host names, CIDRs are IP ranges or
+// addresses the target resolves to. Users and Groups are rejected at load
+// while the proxy does not authenticate its clients.
+type ACLRuleConfig struct {
+	Name    string   `json:"name"`
+	Action  string   `json:"action"`
+	Domains []string `json:"domains"`
+	CIDRs   []string `json:"cidrs"`
+	Ports   []int    `json:"ports"`
+	Methods []string `json:"methods"`
+	Users   []string `json:"users"`
+	Groups  []string `json:"groups"`
+}
+
+// SSRFProtectionConfig denies the targets resolving to private, loopback,
+// link-local and cloud metadata addresses, but for AllowCIDRs, e.g. the
+// ranges of the upstream pools' targets.
+type SSRFProtectionConfig struct {
+	Enabled    bool     `json:"enabled"`
+	AllowCIDRs []string `json:"allow_cidrs"`
+}
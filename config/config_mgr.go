@@ -1,8 +1,10 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"time"
 )
 
 type configValidator interface {
@@ -28,11 +30,26 @@ func (cm *configMgr) LoadConfig(configPath string) ([]byte, error) {
 
 // change ProxyConfig and the corresponding adapters to be config.format .(json, .yaml, etc) agnostic
 type ProxyConfig struct {
-	ListenAddress     string        `json:"listen_address"`
-	TLSEnabled        bool          `json:"tls_enabled"`
-	TLSCert           TLSCertConfig `json:"tls_cert"`
-	TunnellingEnabled bool          `json:"tunnelling_enabled"`
-	Routes            []RouteConfig `json:"routes"`
+	// Mode is forward (the default) or reverse, see UpstreamPoolConfig
+	Mode              string                        `json:"mode"`
+	ListenAddress     string                        `json:"listen_address"`
+	TLSEnabled        bool                          `json:"tls_enabled"`
+	TLSCert           TLSCertConfig                 `json:"tls_cert"`
+	TunnellingEnabled bool                          `json:"tunnelling_enabled"`
+	Routes            []RouteConfig                 `json:"routes"`
+	Redis             RedisConfig                   `json:"redis"`
+	Cache             CacheConfig                   `json:"cache"`
+	AccessLog         AccessLogConfig               `json:"access_log"`
+	Admin             AdminConfig                   `json:"admin"`
+	Tracing           TracingConfig                 `json:"tracing"`
+	ErrorPages        ErrorPagesConfig              `json:"error_pages"`
+	Upstream          UpstreamConfig                `json:"upstream"`
+	UpstreamPools     map[string]UpstreamPoolConfig `json:"upstream_pools"`
+	ACL               ACLConfig                     `json:"acl"`
+	Connect           ConnectConfig                 `json:"connect"`
+	RateLimit         RateLimitConfig               `json:"rate_limit"`
+	Headers           HeaderRulesConfig             `json:"headers"`
+	Forwarding        ForwardingConfig              `json:"forwarding"`
 }
 
 type TLSCertConfig struct {
@@ -41,8 +58,35 @@ type TLSCertConfig struct {
 }
 
 type RouteConfig struct {
-	Path        string   `json:"path"`
-	Method      string   `json:"method"`
-	FilterChain []string `json:"filter_chain"`
-	Connector   string   `json:"connector"`
+	Name        string             `json:"name"`
+	Host        string             `json:"host"`
+	Path        string             `json:"path"`
+	Method      string             `json:"method"`
+	FilterChain []string           `json:"filter_chain"`
+	Connector   string             `json:"connector"`
+	Cache       *CachePolicyConfig `json:"cache"`
+	// Upstream names the upstream pool the route's requests are sent to
+	Upstream   string                `json:"upstream"`
+	RateLimits []RateLimitRuleConfig `json:"rate_limits"`
+	Headers    *HeaderRulesConfig    `json:"headers"`
+}
+
+// Duration is a time.Duration read from config files as a Go duration string ("5s", "1m30s").
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("invalid duration %s : expected a string like \"5s\"", b)
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(dur)
+	return nil
 }
@@ -0,0 +1,25 @@
+package config
+
+// ConnectConfig sets the CONNECT tunnels. AllowedPorts are the ports every
+// client may tunnel to, 443 and 8443 when empty; PortExceptions let some
+// users and groups reach more. The quotas cap the open tunnels, overall and
+// per user, and their bandwidth in bytes per second, per tunnel and per user;
+// IdleTimeout closes the tunnels without traffic. Zero values mean no limit.
+type ConnectConfig struct {
+	AllowedPorts       []int                 `json:"allowed_ports"`
+	PortExceptions     []PortExceptionConfig `json:"port_exceptions"`
+	MaxTunnels         int                   `json:"max_tunnels"`
+	MaxTunnelsPerUser  int                   `json:"max_tunnels_per_user"`
+	BandwidthPerTunnel int64                 `json:"bandwidth_per_tunnel"`
+	BandwidthPerUser   int64                 `json:"bandwidth_per_user"`
+	IdleTimeout        Duration              `json:"idle_timeout"`
+}
+
+// PortExceptionConfig lets Users and the members of Groups tunnel to Ports,
+// to any port when Ports is empty. They are rejected at load while the proxy
+// does not authenticate its clients.
+type PortExceptionConfig struct {
+	Users  []string `json:"users"`
+	Groups []string `json:"groups"`
+	Ports  []int    `json:"ports"`
+}
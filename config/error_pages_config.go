@@ -0,0 +1,10 @@
+package config
+
+// ErrorPagesConfig sets the HTML templates failed requests are answered
+// with: Template is the path of the default page, Templates maps a status
+// ("502", "504", ...) to the path of its own page. The templates are Go
+// html/template files executed with routes.ErrorPageData.
+type ErrorPagesConfig struct {
+	Template  string            `json:"template"`
+	Templates map[string]string `json:"templates"`
+}
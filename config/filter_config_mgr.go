@@ -1 +1,29 @@
 package config
+
+// CacheConfig configures the cache filter, Default applies to the requests
+// of routes without their own cache policy.
+type CacheConfig struct {
+	Default *CachePolicyConfig   `json:"default"`
+	Breaker CircuitBreakerConfig `json:"breaker"`
+}
+
+type CachePolicyConfig struct {
+	// Enabled defaults to true when omitted
+	Enabled             *bool    `json:"enabled"`
+	TTL                 Duration `json:"ttl"`
+	MinTTL              Duration `json:"min_ttl"`
+	MaxTTL              Duration `json:"max_ttl"`
+	IgnoreOriginHeaders bool     `json:"ignore_origin_headers"`
+	StripQueryParams    []string `json:"strip_query_params"`
+	SortQueryParams     bool     `json:"sort_query_params"`
+	KeyHeaders          []string `json:"key_headers"`
+	MaxObjectSize       int64    `json:"max_object_size"`
+}
+
+// CircuitBreakerConfig configures the breaker around the cache backend, zero
+// values keep the filter defaults.
+type CircuitBreakerConfig struct {
+	FailureThreshold int      `json:"failure_threshold"`
+	OpenTimeout      Duration `json:"open_timeout"`
+	HalfOpenProbes   int      `json:"half_open_probes"`
+}
@@ -0,0 +1,15 @@
+package config
+
+// ForwardingConfig sets the Forwarded, X-Forwarded-* and Via headers.
+// ViaPseudonym names the proxy in Via, its host name by default; it must
+// differ between the proxies of a chain for loops to be detected.
+// TrustedProxies (IPs or CIDRs) are the clients whose forwarding headers are
+// kept, the others' are removed, every client's by default. TrustAllProxies
+// keeps every client's instead, for a proxy only reachable through trusted
+// hops. Privacy leaves the client IPs out.
+type ForwardingConfig struct {
+	ViaPseudonym    string   `json:"via_pseudonym"`
+	TrustedProxies  []string `json:"trusted_proxies"`
+	TrustAllProxies bool     `json:"trust_all_proxies"`
+	Privacy         bool     `json:"privacy"`
+}
@@ -0,0 +1,25 @@
+package config
+
+// HeaderRulesConfig lists the header rules applied in order to the requests
+// sent upstream and to their responses. The top level rules are the
+// defaults, the routes with their own (RouteConfig.Headers) do not get them.
+type HeaderRulesConfig struct {
+	Request  []HeaderRuleConfig `json:"request"`
+	Response []HeaderRuleConfig `json:"response"`
+}
+
+// HeaderRuleConfig adds, sets, removes or renames (to NewName) the header
+// Name. Value may hold ${client_ip}, ${principal}, ${request_id}, ${time},
+// ${host}, ${path} and ${method}, ${principal} being rejected at load while
+// the proxy does not authenticate its clients. The rule only applies to the requests to
+// Host under Path and, for response rules, to the responses with one of
+// Statuses.
+type HeaderRuleConfig struct {
+	Action   string `json:"action"`
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	NewName  string `json:"new_name"`
+	Host     string `json:"host"`
+	Path     string `json:"path"`
+	Statuses []int  `json:"statuses"`
+}
@@ -0,0 +1,25 @@
+package config
+
+// AccessLogConfig configures the access log filter. Output is "stdout"
+// (default), "file" or "syslog", Format is "json" (default) or "combined".
+type AccessLogConfig struct {
+	// Enabled defaults to true when omitted
+	Enabled *bool                 `json:"enabled"`
+	Format  string                `json:"format"`
+	Output  string                `json:"output"`
+	File    AccessLogFileConfig   `json:"file"`
+	Syslog  AccessLogSyslogConfig `json:"syslog"`
+}
+
+type AccessLogFileConfig struct {
+	Path       string `json:"path"`
+	MaxSizeMB  int    `json:"max_size_mb"`
+	MaxBackups int    `json:"max_backups"`
+}
+
+type AccessLogSyslogConfig struct {
+	// Network and Address are empty for the local syslog daemon
+	Network string `json:"network"`
+	Address string `json:"address"`
+	Tag     string `json:"tag"`
+}
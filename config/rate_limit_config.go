@@ -0,0 +1,21 @@
+package config
+
+// RateLimitConfig sets the default rate limits, the routes with their own
+// (RouteConfig.RateLimits) do not get them. Store is memory, the default,
+// for limits per instance, or redis for limits shared by the instances
+// using the same redis.
+type RateLimitConfig struct {
+	Store  string                `json:"store"`
+	Limits []RateLimitRuleConfig `json:"limits"`
+}
+
+// RateLimitRuleConfig lets Requests through per Per (a second by default),
+// in bursts of up to Burst, for each client_ip, principal or host as Key.
+// The principal key is rejected at load while the proxy does not
+// authenticate its clients.
+type RateLimitRuleConfig struct {
+	Key      string   `json:"key"`
+	Requests int      `json:"requests"`
+	Per      Duration `json:"per"`
+	Burst    int      `json:"burst"`
+}
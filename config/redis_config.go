@@ -0,0 +1,150 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedisConfig holds the connection options of the redis cache backend.
+// Setting MasterName selects Sentinel failover with Addrs as the sentinels,
+// ClusterMode selects Redis Cluster with Addrs as the seed nodes.
+type RedisConfig struct {
+	Addr             string         `json:"addr"`
+	Addrs            []string       `json:"addrs"`
+	Username         string         `json:"username"`
+	Password         string         `json:"password"`
+	DB               int            `json:"db"`
+	MasterName       string         `json:"master_name"`
+	SentinelUsername string         `json:"sentinel_username"`
+	SentinelPassword string         `json:"sentinel_password"`
+	ClusterMode      bool           `json:"cluster_mode"`
+	ReadOnly         bool           `json:"read_only"`
+	RouteByLatency   bool           `json:"route_by_latency"`
+	TLS              RedisTLSConfig `json:"tls"`
+	PoolSize         int            `json:"pool_size"`
+	MinIdleConns     int            `json:"min_idle_conns"`
+	MaxIdleConns     int            `json:"max_idle_conns"`
+	DialTimeout      Duration       `json:"dial_timeout"`
+	ReadTimeout      Duration       `json:"read_timeout"`
+	WriteTimeout     Duration       `json:"write_timeout"`
+	PoolTimeout      Duration       `json:"pool_timeout"`
+}
+
+type RedisTLSConfig struct {
+	Enabled            bool   `json:"enabled"`
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+const defaultRedisAddr = "localhost:6379"
+
+// RedisConfigFromEnv reads the REDIS_* env variables, unset variables keep
+// the go-redis defaults.
+func RedisConfigFromEnv() (RedisConfig, error) {
+	cfg := RedisConfig{
+		Addr:             os.Getenv("REDIS_ADDR"),
+		Username:         os.Getenv("REDIS_USERNAME"),
+		Password:         os.Getenv("REDIS_PASSWORD"),
+		MasterName:       os.Getenv("REDIS_MASTER_NAME"),
+		SentinelUsername: os.Getenv("REDIS_SENTINEL_USERNAME"),
+		SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+		TLS: RedisTLSConfig{
+			CAFile:     os.Getenv("REDIS_TLS_CA"),
+			CertFile:   os.Getenv("REDIS_TLS_CERT"),
+			KeyFile:    os.Getenv("REDIS_TLS_KEY"),
+			ServerName: os.Getenv("REDIS_TLS_SERVER_NAME"),
+		},
+	}
+	for _, addr := range strings.Split(os.Getenv("REDIS_ADDRS"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			cfg.Addrs = append(cfg.Addrs, addr)
+		}
+	}
+	if cfg.Addr == "" && len(cfg.Addrs) == 0 {
+		cfg.Addr = defaultRedisAddr
+	}
+
+	var err error
+	if cfg.ClusterMode, err = envBool("REDIS_CLUSTER_MODE"); err != nil {
+		return RedisConfig{}, err
+	}
+	if cfg.ReadOnly, err = envBool("REDIS_READ_ONLY"); err != nil {
+		return RedisConfig{}, err
+	}
+	if cfg.RouteByLatency, err = envBool("REDIS_ROUTE_BY_LATENCY"); err != nil {
+		return RedisConfig{}, err
+	}
+	if cfg.DB, err = envInt("REDIS_DB"); err != nil {
+		return RedisConfig{}, err
+	}
+	if cfg.TLS.Enabled, err = envBool("REDIS_TLS_ENABLED"); err != nil {
+		return RedisConfig{}, err
+	}
+	if cfg.TLS.InsecureSkipVerify, err = envBool("REDIS_TLS_INSECURE_SKIP_VERIFY"); err != nil {
+		return RedisConfig{}, err
+	}
+	if cfg.PoolSize, err = envInt("REDIS_POOL_SIZE"); err != nil {
+		return RedisConfig{}, err
+	}
+	if cfg.MinIdleConns, err = envInt("REDIS_MIN_IDLE_CONNS"); err != nil {
+		return RedisConfig{}, err
+	}
+	if cfg.MaxIdleConns, err = envInt("REDIS_MAX_IDLE_CONNS"); err != nil {
+		return RedisConfig{}, err
+	}
+	if cfg.DialTimeout, err = envDuration("REDIS_DIAL_TIMEOUT"); err != nil {
+		return RedisConfig{}, err
+	}
+	if cfg.ReadTimeout, err = envDuration("REDIS_READ_TIMEOUT"); err != nil {
+		return RedisConfig{}, err
+	}
+	if cfg.WriteTimeout, err = envDuration("REDIS_WRITE_TIMEOUT"); err != nil {
+		return RedisConfig{}, err
+	}
+	if cfg.PoolTimeout, err = envDuration("REDIS_POOL_TIMEOUT"); err != nil {
+		return RedisConfig{}, err
+	}
+	return cfg, nil
+}
+
+func envInt(key string) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s env variable : %v", key, err)
+	}
+	return i, nil
+}
+
+func envBool(key string) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s env variable : %v", key, err)
+	}
+	return b, nil
+}
+
+func envDuration(key string) (Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s env variable : %v", key, err)
+	}
+	return Duration(d), nil
+}
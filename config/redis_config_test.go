@@ -0,0 +1,96 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisConfigFromEnv(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		t.Setenv("REDIS_ADDR", "")
+		cfg, err := RedisConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, "localhost:6379", cfg.Addr)
+		assert.Equal(t, 0, cfg.DB)
+		assert.False(t, cfg.TLS.Enabled)
+	})
+
+	t.Run("All options", func(t *testing.T) {
+		t.Setenv("REDIS_ADDR", "redis:6380")
+		t.Setenv("REDIS_USERNAME", "usr")
+		t.Setenv("REDIS_PASSWORD", "pass")
+		t.Setenv("REDIS_DB", "3")
+		t.Setenv("REDIS_TLS_ENABLED", "true")
+		t.Setenv("REDIS_TLS_CA", "ca.pem")
+		t.Setenv("REDIS_POOL_SIZE", "50")
+		t.Setenv("REDIS_DIAL_TIMEOUT", "2s")
+		t.Setenv("REDIS_READ_TIMEOUT", "500ms")
+
+		cfg, err := RedisConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, "redis:6380", cfg.Addr)
+		assert.Equal(t, "usr", cfg.Username)
+		assert.Equal(t, "pass", cfg.Password)
+		assert.Equal(t, 3, cfg.DB)
+		assert.True(t, cfg.TLS.Enabled)
+		assert.Equal(t, "ca.pem", cfg.TLS.CAFile)
+		assert.Equal(t, 50, cfg.PoolSize)
+		assert.Equal(t, Duration(2*time.Second), cfg.DialTimeout)
+		assert.Equal(t, Duration(500*time.Millisecond), cfg.ReadTimeout)
+	})
+
+	t.Run("Sentinel and cluster", func(t *testing.T) {
+		t.Setenv("REDIS_ADDR", "")
+		t.Setenv("REDIS_ADDRS", "node1:26379, node2:26379,")
+		t.Setenv("REDIS_MASTER_NAME", "mymaster")
+		t.Setenv("REDIS_SENTINEL_PASSWORD", "secret")
+		t.Setenv("REDIS_CLUSTER_MODE", "false")
+		t.Setenv("REDIS_READ_ONLY", "true")
+		t.Setenv("REDIS_ROUTE_BY_LATENCY", "true")
+
+		cfg, err := RedisConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Empty(t, cfg.Addr)
+		assert.Equal(t, []string{"node1:26379", "node2:26379"}, cfg.Addrs)
+		assert.Equal(t, "mymaster", cfg.MasterName)
+		assert.Equal(t, "secret", cfg.SentinelPassword)
+		assert.False(t, cfg.ClusterMode)
+		assert.True(t, cfg.ReadOnly)
+		assert.True(t, cfg.RouteByLatency)
+	})
+
+	t.Run("Invalid values", func(t *testing.T) {
+		for key, value := range map[string]string{
+			"REDIS_DB":               "zero",
+			"REDIS_TLS_ENABLED":      "maybe",
+			"REDIS_DIAL_TIMEOUT":     "5",
+			"REDIS_CLUSTER_MODE":     "yes please",
+			"REDIS_ROUTE_BY_LATENCY": "fast",
+			"REDIS_POOL_TIMEOUT":     "4",
+		} {
+			t.Run(key, func(t *testing.T) {
+				t.Setenv(key, value)
+				_, err := RedisConfigFromEnv()
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), key)
+			})
+		}
+	})
+}
+
+func TestDurationJSON(t *testing.T) {
+	var cfg RedisConfig
+	err := json.Unmarshal([]byte(`{"addr":"localhost:6379","dial_timeout":"1m30s"}`), &cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, Duration(90*time.Second), cfg.DialTimeout)
+
+	b, err := json.Marshal(cfg.DialTimeout)
+	assert.NoError(t, err)
+	assert.Equal(t, `"1m30s"`, string(b))
+
+	err = json.Unmarshal([]byte(`{"dial_timeout":5}`), &cfg)
+	assert.Error(t, err)
+}
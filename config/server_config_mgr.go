@@ -1 +1,23 @@
 package config
+
+// DefaultAdminListenAddress keeps the admin endpoints local unless configured otherwise.
+const DefaultAdminListenAddress = "127.0.0.1:9901"
+
+// AdminConfig configures the admin listener. Token protects the management
+// endpoints, the ADMIN_TOKEN env variable is used when it is empty.
+type AdminConfig struct {
+	// Enabled defaults to true when omitted
+	Enabled       *bool        `json:"enabled"`
+	ListenAddress string       `json:"listen_address"`
+	Token         string       `json:"token"`
+	Health        HealthConfig `json:"health"`
+}
+
+// HealthConfig configures the readiness checks, Redis is always checked.
+type HealthConfig struct {
+	CheckTimeout Duration `json:"check_timeout"`
+	// the TLS certificate check fails once the certificate expires within CertMinValidity
+	CertMinValidity Duration `json:"cert_min_validity"`
+	// Upstreams are host:port addresses that must accept TCP connections, e.g. upstream proxies
+	Upstreams []string `json:"upstreams"`
+}
@@ -0,0 +1,12 @@
+package config
+
+// TracingConfig configures the export of the request traces to an OTLP/HTTP
+// collector, Endpoint is the full traces URL (e.g. http://localhost:4318/v1/traces).
+type TracingConfig struct {
+	Enabled       bool              `json:"enabled"`
+	Endpoint      string            `json:"endpoint"`
+	ServiceName   string            `json:"service_name"`
+	Headers       map[string]string `json:"headers"`
+	BatchSize     int               `json:"batch_size"`
+	FlushInterval Duration          `json:"flush_interval"`
+}
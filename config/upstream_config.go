@@ -0,0 +1,51 @@
+package config
+
+// UpstreamConfig tunes the connections of the HttpsConnector to the
+// upstreams, zero values keep the connector defaults. RequestTimeout bounds
+// the whole upstream request, response body included, 0 disables it.
+type UpstreamConfig struct {
+	DialTimeout           Duration    `json:"dial_timeout"`
+	KeepAlive             Duration    `json:"keep_alive"`
+	TLSHandshakeTimeout   Duration    `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout Duration    `json:"response_header_timeout"`
+	IdleConnTimeout       Duration    `json:"idle_conn_timeout"`
+	RequestTimeout        Duration    `json:"request_timeout"`
+	MaxIdleConns          int         `json:"max_idle_conns"`
+	MaxIdleConnsPerHost   int         `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int         `json:"max_conns_per_host"`
+	HTTP2                 *bool       `json:"http2"`
+	Retry                 RetryConfig `json:"retry"`
+	// TLS settings by destination host, "api.example.com" or "*.example.com"
+	TLS map[string]UpstreamTLSConfig `json:"tls"`
+}
+
+// UpstreamTLSConfig sets how the upstreams of a host are verified and
+// authenticated to. CAFiles are trusted in addition to the system roots
+// unless SystemRoots is false, CertFile and KeyFile are the client
+// certificate for mTLS, ServerName overrides the SNI and the name verified,
+// PinnedSPKI are the base64 SHA-256 hashes of the public keys one of the
+// certificates of the chain must have.
+type UpstreamTLSConfig struct {
+	CAFiles      []string `json:"ca_files"`
+	SystemRoots  *bool    `json:"system_roots"`
+	CertFile     string   `json:"cert_file"`
+	KeyFile      string   `json:"key_file"`
+	MinVersion   string   `json:"min_version"`
+	CipherSuites []string `json:"cipher_suites"`
+	ServerName   string   `json:"server_name"`
+	PinnedSPKI   []string `json:"pinned_spki"`
+}
+
+// RetryConfig sets the retries of idempotent upstream requests failing at
+// the connection level or answering one of the RetryOn statuses. The
+// retries of the last 10 seconds are capped at BudgetRatio times the
+// requests plus BudgetMinPerSecond per second.
+type RetryConfig struct {
+	Enabled            bool     `json:"enabled"`
+	MaxAttempts        int      `json:"max_attempts"`
+	InitialBackoff     Duration `json:"initial_backoff"`
+	MaxBackoff         Duration `json:"max_backoff"`
+	RetryOn            []int    `json:"retry_on"`
+	BudgetRatio        *float64 `json:"budget_ratio"`
+	BudgetMinPerSecond *int     `json:"budget_min_per_second"`
+}
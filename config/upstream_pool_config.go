@@ -0,0 +1,37 @@
+package config
+
+// proxy modes
+const (
+	ProxyModeForward = "forward"
+	ProxyModeReverse = "reverse"
+)
+
+// UpstreamPoolConfig is a named set of servers the routes with this pool as
+// upstream are balanced on. Balancer is round_robin (the default),
+// least_conn or consistent_hash, the latter hashing HashKey: client_ip (the
+// default), path, header:<name> or cookie:<name>.
+type UpstreamPoolConfig struct {
+	Targets          []string                `json:"targets"`
+	Balancer         string                  `json:"balancer"`
+	HashKey          string                  `json:"hash_key"`
+	HealthCheck      *PoolHealthCheckConfig  `json:"health_check"`
+	OutlierDetection *OutlierDetectionConfig `json:"outlier_detection"`
+}
+
+// PoolHealthCheckConfig probes each target with GET Path, zero values use
+// the filters.DefaultHealthCheck* values.
+type PoolHealthCheckConfig struct {
+	Path               string   `json:"path"`
+	Interval           Duration `json:"interval"`
+	Timeout            Duration `json:"timeout"`
+	HealthyThreshold   int      `json:"healthy_threshold"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold"`
+}
+
+// OutlierDetectionConfig ejects the targets failing in a row, zero values
+// use the filters.DefaultOutlier* values.
+type OutlierDetectionConfig struct {
+	ConsecutiveFailures int      `json:"consecutive_failures"`
+	EjectionTime        Duration `json:"ejection_time"`
+	MaxEjectionPercent  int      `json:"max_ejection_percent"`
+}
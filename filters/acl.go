@@ -0,0 +1,290 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/LamineKouissi/LHP/util"
+)
+
+// ACL actions
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// SSRFBlockedPrefixes are the ranges the SSRF protection keeps the proxy
+// from reaching: loopback, private, link-local (the cloud metadata
+// services among them), shared, benchmark, multicast and reserved ones,
+// and the NAT64 ones, which reach any IPv4 address. The IPv4-mapped IPv6
+// addresses are checked as their IPv4 address.
+var SSRFBlockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fec0::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// ACLRule matches the requests meeting all its non-empty conditions:
+// Domains are MatchHost patterns, CIDRs match the target's IP addresses,
+// Users and Groups the authenticated user, see WithPrincipal.
+type ACLRule struct {
+	Name    string
+	Action  string
+	Domains []string
+	CIDRs   []netip.Prefix
+	Ports   []int
+	Methods []string
+	Users   []string
+	Groups  []string
+}
+
+// ACLTarget is what a request reaches: a host, without brackets for IPv6,
+// and a port.
+type ACLTarget struct {
+	Host   string
+	Port   int
+	Method string
+}
+
+// ACL decides which targets the clients may reach. The first matching rule
+// wins, the default action applies when none matches. With the SSRF
+// protection on, the targets resolving to SSRFBlockedPrefixes are denied
+// whatever the rules, and so are the connections to them, see DialControl.
+type ACL struct {
+	rules        []ACLRule
+	defaultAllow bool
+	ssrf         bool
+	// ranges exempted from the SSRF protection, e.g. the upstream pools'
+	ssrfAllowed []netip.Prefix
+	lookup      func(ctx context.Context, host string) ([]netip.Addr, error)
+}
+
+func NewACL(rules []ACLRule, defaultAction string) (*ACL, error) {
+	acl := &ACL{lookup: lookupHost}
+	switch defaultAction {
+	case "", ACLAllow:
+		acl.defaultAllow = true
+	case ACLDeny:
+	default:
+		return nil, errors.New("invalid ACL default action : " + defaultAction)
+	}
+	acl.rules = append([]ACLRule(nil), rules...)
+	for i, rule := range acl.rules {
+		if rule.Action != ACLAllow && rule.Action != ACLDeny {
+			return nil, fmt.Errorf("ACL rule %d : invalid action %q", i, rule.Action)
+		}
+		for _, port := range rule.Ports {
+			if port < 1 || port > 65535 {
+				return nil, fmt.Errorf("ACL rule %d : invalid port %d", i, port)
+			}
+		}
+		if rule.Name == "" {
+			acl.rules[i].Name = "rule-" + strconv.Itoa(i)
+		}
+	}
+	return acl, nil
+}
+
+// SetSSRFProtection turns the SSRF protection on, allowed lists the ranges
+// it does not apply to.
+func (acl *ACL) SetSSRFProtection(allowed []netip.Prefix) {
+	acl.ssrf = true
+	acl.ssrfAllowed = allowed
+}
+
+func lookupHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
+
+// Check returns a 403 ProxyError when the ACL denies the request of the
+// user in ctx to target.
+func (acl *ACL) Check(ctx context.Context, target ACLTarget) error {
+	var addrs []netip.Addr
+	if acl.ssrf || acl.hasCIDRs() {
+		if addr, err := netip.ParseAddr(target.Host); err == nil {
+			addrs = []netip.Addr{addr}
+		} else if addrs, err = acl.lookup(ctx, target.Host); err != nil {
+			// the connection fails later on, DialControl has the last word
+			util.Debugln("ACL : resolving", target.Host, ":", err)
+		}
+	}
+
+	if acl.ssrf {
+		for _, addr := range addrs {
+			if acl.ssrfBlocked(addr) {
+				return acl.deny(ctx, target, "ssrf_protection : "+addr.String())
+			}
+		}
+	}
+	for _, rule := range acl.rules {
+		if acl.matches(ctx, rule, target, addrs) {
+			if rule.Action == ACLAllow {
+				return nil
+			}
+			return acl.deny(ctx, target, rule.Name)
+		}
+	}
+	if acl.defaultAllow {
+		return nil
+	}
+	return acl.deny(ctx, target, "default")
+}
+
+func (acl *ACL) deny(ctx context.Context, target ACLTarget, reason string) error {
+	principal, _ := AuthFromCtx(ctx)
+	util.Warnln("ACL : denied", target.Method, net.JoinHostPort(target.Host, strconv.Itoa(target.Port)), "principal="+principal, "rule="+reason)
+	return NewPolicyError(http.StatusForbidden, "Access to "+target.Host+" is denied by the proxy policy.")
+}
+
+func (acl *ACL) hasCIDRs() bool {
+	for _, rule := range acl.rules {
+		if len(rule.CIDRs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (acl *ACL) matches(ctx context.Context, rule ACLRule, target ACLTarget, addrs []netip.Addr) bool {
+	if len(rule.Domains) > 0 && !anyMatch(rule.Domains, func(d string) bool { return MatchHost(d, target.Host) }) {
+		return false
+	}
+	if len(rule.CIDRs) > 0 && !anyMatch(rule.CIDRs, func(p netip.Prefix) bool {
+		return anyMatch(addrs, func(a netip.Addr) bool { return p.Contains(a.Unmap()) })
+	}) {
+		return false
+	}
+	if len(rule.Ports) > 0 && !anyMatch(rule.Ports, func(p int) bool { return p == target.Port }) {
+		return false
+	}
+	if len(rule.Methods) > 0 && !anyMatch(rule.Methods, func(m string) bool { return strings.EqualFold(m, target.Method) }) {
+		return false
+	}
+	if len(rule.Users) > 0 {
+		principal, ok := AuthFromCtx(ctx)
+		if !ok || !anyMatch(rule.Users, func(u string) bool { return u == principal }) {
+			return false
+		}
+	}
+	if len(rule.Groups) > 0 {
+		groups := GroupsFromCtx(ctx)
+		if !anyMatch(rule.Groups, func(g string) bool { return anyMatch(groups, func(ug string) bool { return ug == g }) }) {
+			return false
+		}
+	}
+	return true
+}
+
+func anyMatch[T any](items []T, match func(T) bool) bool {
+	for _, item := range items {
+		if match(item) {
+			return true
+		}
+	}
+	return false
+}
+
+func (acl *ACL) ssrfBlocked(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range acl.ssrfAllowed {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	for _, p := range SSRFBlockedPrefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// DialControl is a net.Dialer Control function refusing the connections to
+// the ranges of the SSRF protection. It runs on the address actually dialed,
+// so a host resolving to another address since Check cannot get around it.
+func (acl *ACL) DialControl(network, address string, c syscall.RawConn) error {
+	if !acl.ssrf {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if acl.ssrfBlocked(addrPort.Addr()) {
+		util.Warnln("ACL : refused connecting to", address, "rule=ssrf_protection")
+		return NewPolicyError(http.StatusForbidden, "Access to "+addrPort.Addr().String()+" is denied by the proxy policy.")
+	}
+	return nil
+}
+
+// TargetOf returns the ACLTarget of a proxied request.
+func TargetOf(req *http.Request) ACLTarget {
+	target := ACLTarget{Host: RequestHost(req), Method: req.Method}
+	hostPort := req.Host
+	if req.URL != nil && req.URL.Host != "" {
+		hostPort = req.URL.Host
+	}
+	if _, port, err := net.SplitHostPort(hostPort); err == nil {
+		target.Port, _ = strconv.Atoi(port)
+	} else if req.URL != nil && req.URL.Scheme == "https" {
+		target.Port = 443
+	} else {
+		target.Port = 80
+	}
+	return target
+}
+
+// ACLFilter denies the HTTP requests the ACL does not allow, the CONNECT
+// requests are checked by routes.HttpsRoute.
+type ACLFilter struct {
+	acl        *ACL
+	nextFilter Filter
+}
+
+func NewACLFilter(acl *ACL) (*ACLFilter, error) {
+	if acl == nil {
+		return nil, errors.New("ACL = <nil>")
+	}
+	return &ACLFilter{acl: acl}, nil
+}
+
+func (af *ACLFilter) SetNextFilter(f Filter) error {
+	if f == nil {
+		return errors.New("nextFilter = <nil>")
+	}
+	af.nextFilter = f
+	return nil
+}
+
+func (af *ACLFilter) Process(ctx context.Context, req *http.Request, res *http.Response) error {
+	if af.nextFilter == nil {
+		return ErrNoNextFilter("ACLFilter")
+	}
+	if err := af.acl.Check(ctx, TargetOf(req)); err != nil {
+		return err
+	}
+	return af.nextFilter.Process(ctx, req, res)
+}
@@ -0,0 +1,150 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestACL resolves the hosts with the addrs map instead of the DNS.
+func newTestACL(t *testing.T, rules []ACLRule, defaultAction string, addrs map[string][]netip.Addr) *ACL {
+	acl, err := NewACL(rules, defaultAction)
+	assert.NoError(t, err)
+	acl.lookup = func(ctx context.Context, host string) ([]netip.Addr, error) {
+		if a, ok := addrs[host]; ok {
+			return a, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	return acl
+}
+
+func TestACLCheck(t *testing.T) {
+	addrs := map[string][]netip.Addr{
+		"intranet.example.com": {netip.MustParseAddr("10.1.2.3")},
+		"www.example.com":      {netip.MustParseAddr("93.184.216.34")},
+		"metadata.example.com": {netip.MustParseAddr("169.254.169.254")},
+		"mapped.example.com":   {netip.MustParseAddr("::ffff:127.0.0.1")},
+	}
+	rules := []ACLRule{
+		{Name: "admins-anywhere", Action: ACLAllow, Groups: []string{"admins"}},
+		{Name: "no-smtp", Action: ACLDeny, Ports: []int{25}},
+		{Name: "no-intranet", Action: ACLDeny, CIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+		{Name: "read-only-example", Action: ACLAllow, Domains: []string{"*.example.com"}, Methods: []string{"GET", "HEAD"}},
+		{Name: "bob-posts", Action: ACLAllow, Domains: []string{"api.example.org"}, Users: []string{"bob"}},
+	}
+	alice := WithPrincipal(context.Background(), "alice", []string{"staff"})
+	bob := WithPrincipal(context.Background(), "bob", nil)
+	admin := WithPrincipal(context.Background(), "root", []string{"staff", "admins"})
+
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		target    ACLTarget
+		ssrf      bool
+		wantAllow bool
+	}{
+		{name: "Domain and method allowed", ctx: alice, target: ACLTarget{Host: "www.example.com", Port: 443, Method: "GET"}, wantAllow: true},
+		{name: "Method not allowed", ctx: alice, target: ACLTarget{Host: "www.example.com", Port: 443, Method: "POST"}},
+		{name: "Wildcard excludes the apex", ctx: alice, target: ACLTarget{Host: "example.com", Port: 443, Method: "GET"}},
+		{name: "Port denied", ctx: alice, target: ACLTarget{Host: "www.example.com", Port: 25, Method: "GET"}},
+		{name: "CIDR denied after resolution", ctx: alice, target: ACLTarget{Host: "intranet.example.com", Port: 80, Method: "GET"}},
+		{name: "CIDR denied on an address", ctx: alice, target: ACLTarget{Host: "10.0.0.1", Port: 80, Method: "GET"}},
+		{name: "User allowed", ctx: bob, target: ACLTarget{Host: "api.example.org", Port: 443, Method: "POST"}, wantAllow: true},
+		{name: "Other user", ctx: alice, target: ACLTarget{Host: "api.example.org", Port: 443, Method: "POST"}},
+		{name: "Anonymous", ctx: context.Background(), target: ACLTarget{Host: "api.example.org", Port: 443, Method: "POST"}},
+		{name: "Group allowed first", ctx: admin, target: ACLTarget{Host: "mail.example.net", Port: 25, Method: "CONNECT"}, wantAllow: true},
+		{name: "SSRF metadata", ctx: admin, target: ACLTarget{Host: "metadata.example.com", Port: 80, Method: "GET"}, ssrf: true},
+		{name: "SSRF loopback address", ctx: admin, target: ACLTarget{Host: "127.0.0.1", Port: 8080, Method: "GET"}, ssrf: true},
+		{name: "SSRF IPv6 loopback", ctx: admin, target: ACLTarget{Host: "::1", Port: 8080, Method: "GET"}, ssrf: true},
+		{name: "SSRF IPv4-mapped", ctx: admin, target: ACLTarget{Host: "mapped.example.com", Port: 80, Method: "GET"}, ssrf: true},
+		{name: "SSRF IPv4-mapped metadata address", ctx: admin, target: ACLTarget{Host: "::ffff:169.254.169.254", Port: 80, Method: "GET"}, ssrf: true},
+		{name: "SSRF NAT64 metadata address", ctx: admin, target: ACLTarget{Host: "64:ff9b::a9fe:a9fe", Port: 80, Method: "GET"}, ssrf: true},
+		{name: "SSRF public", ctx: admin, target: ACLTarget{Host: "www.example.com", Port: 443, Method: "GET"}, ssrf: true, wantAllow: true},
+		{name: "SSRF allowed range", ctx: admin, target: ACLTarget{Host: "10.9.0.1", Port: 80, Method: "GET"}, ssrf: true, wantAllow: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl := newTestACL(t, rules, ACLDeny, addrs)
+			if tt.ssrf {
+				acl.SetSSRFProtection([]netip.Prefix{netip.MustParsePrefix("10.9.0.0/16")})
+			}
+			err := acl.Check(tt.ctx, tt.target)
+			if tt.wantAllow {
+				assert.NoError(t, err)
+				return
+			}
+			pe, ok := AsProxyError(err)
+			assert.True(t, ok)
+			assert.Equal(t, http.StatusForbidden, pe.Status)
+			assert.Equal(t, ErrorCategoryPolicy, pe.Category)
+		})
+	}
+}
+
+func TestNewACLErrors(t *testing.T) {
+	_, err := NewACL(nil, "maybe")
+	assert.Error(t, err)
+	_, err = NewACL([]ACLRule{{Action: "block"}}, "")
+	assert.Error(t, err)
+	_, err = NewACL([]ACLRule{{Action: ACLDeny, Ports: []int{70000}}}, "")
+	assert.Error(t, err)
+}
+
+func TestACLDialControl(t *testing.T) {
+	acl := newTestACL(t, nil, ACLAllow, nil)
+	assert.NoError(t, acl.DialControl("tcp", "127.0.0.1:80", nil), "without SSRF protection")
+
+	acl.SetSSRFProtection([]netip.Prefix{netip.MustParsePrefix("10.9.0.0/16")})
+	assert.Equal(t, http.StatusForbidden, StatusForError(acl.DialControl("tcp", "127.0.0.1:80", nil)))
+	assert.Equal(t, http.StatusForbidden, StatusForError(acl.DialControl("tcp6", "[fe80::1]:443", nil)))
+	assert.Equal(t, http.StatusForbidden, StatusForError(acl.DialControl("tcp6", "[::ffff:169.254.169.254]:80", nil)))
+	for _, addr := range []string{"[64:ff9b::a9fe:a9fe]:80", "[fec0::1]:80", "0.1.2.3:80", "192.0.0.8:80", "198.18.0.1:80"} {
+		assert.Equal(t, http.StatusForbidden, StatusForError(acl.DialControl("tcp", addr, nil)), addr)
+	}
+	assert.NoError(t, acl.DialControl("tcp", "10.9.1.1:80", nil))
+	assert.NoError(t, acl.DialControl("tcp", "93.184.216.34:443", nil))
+}
+
+func TestTargetOf(t *testing.T) {
+	tests := []struct {
+		method string
+		url    string
+		want   ACLTarget
+	}{
+		{method: http.MethodGet, url: "http://example.com/a", want: ACLTarget{Host: "example.com", Port: 80, Method: http.MethodGet}},
+		{method: http.MethodGet, url: "https://example.com/a", want: ACLTarget{Host: "example.com", Port: 443, Method: http.MethodGet}},
+		{method: http.MethodPost, url: "http://[::1]:8080/", want: ACLTarget{Host: "::1", Port: 8080, Method: http.MethodPost}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			assert.Equal(t, tt.want, TargetOf(httptest.NewRequest(tt.method, tt.url, nil)))
+		})
+	}
+}
+
+func TestACLFilter(t *testing.T) {
+	calls := 0
+	next := &MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		calls++
+		res.StatusCode = http.StatusOK
+		return nil
+	}}
+	acl := newTestACL(t, []ACLRule{{Action: ACLDeny, Domains: []string{"blocked.example.com"}}}, ACLAllow, nil)
+	af, err := NewACLFilter(acl)
+	assert.NoError(t, err)
+	assert.NoError(t, af.SetNextFilter(next))
+
+	err = af.Process(context.Background(), httptest.NewRequest(http.MethodGet, "http://blocked.example.com/", nil), &http.Response{})
+	assert.Equal(t, http.StatusForbidden, StatusForError(err))
+	assert.Equal(t, 0, calls)
+
+	err = af.Process(context.Background(), httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil), &http.Response{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+}
@@ -12,12 +12,28 @@ type contextKey int
 
 const (
 	authKey contextKey = iota
+	routeKey
+	requestInfoKey
+	spanKey
+	groupsKey
 )
 
+// WithPrincipal records the authenticated user of the request and its groups.
+func WithPrincipal(ctx context.Context, principal string, groups []string) context.Context {
+	ctx = context.WithValue(ctx, authKey, principal)
+	return context.WithValue(ctx, groupsKey, groups)
+}
+
 func AuthFromCtx(ctx context.Context) (string, bool) {
 	auth, ok := ctx.Value(authKey).(string)
 	return auth, ok
 }
+
+// GroupsFromCtx returns the groups of the authenticated user, see WithPrincipal.
+func GroupsFromCtx(ctx context.Context) []string {
+	groups, _ := ctx.Value(groupsKey).([]string)
+	return groups
+}
 func (au *Auth) Process(req *http.Request, res *http.Response) error {
 	return nil
 }
@@ -0,0 +1,165 @@
+package filters
+
+import (
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// load balancing algorithms of the upstream pools
+const (
+	BalancerRoundRobin     = "round_robin"
+	BalancerLeastConn      = "least_conn"
+	BalancerConsistentHash = "consistent_hash"
+)
+
+// Balancer picks the target of a request among the targets of a pool.
+type Balancer interface {
+	// Init is called once with all the targets of the pool.
+	Init(targets []*UpstreamTarget)
+	// Pick returns a target for which available is true, nil when there is none.
+	Pick(req *http.Request, targets []*UpstreamTarget, available func(*UpstreamTarget) bool) *UpstreamTarget
+}
+
+// NewBalancer builds the balancer named algorithm, hashKey selects what the
+// consistent hash balancer hashes, see NewHashKeyFunc.
+func NewBalancer(algorithm, hashKey string) (Balancer, error) {
+	switch algorithm {
+	case "", BalancerRoundRobin:
+		return &roundRobinBalancer{}, nil
+	case BalancerLeastConn:
+		return &leastConnBalancer{}, nil
+	case BalancerConsistentHash:
+		key, err := NewHashKeyFunc(hashKey)
+		if err != nil {
+			return nil, err
+		}
+		return &consistentHashBalancer{key: key}, nil
+	default:
+		return nil, errors.New("unknown balancer : " + algorithm)
+	}
+}
+
+type roundRobinBalancer struct {
+	next atomic.Uint64
+}
+
+func (rr *roundRobinBalancer) Init(targets []*UpstreamTarget) {}
+
+func (rr *roundRobinBalancer) Pick(req *http.Request, targets []*UpstreamTarget, available func(*UpstreamTarget) bool) *UpstreamTarget {
+	start := rr.next.Add(1) - 1
+	for i := range targets {
+		t := targets[(start+uint64(i))%uint64(len(targets))]
+		if available(t) {
+			return t
+		}
+	}
+	return nil
+}
+
+// leastConnBalancer picks the target with the fewest requests in flight,
+// the first one in round robin order among the ties.
+type leastConnBalancer struct {
+	next atomic.Uint64
+}
+
+func (lc *leastConnBalancer) Init(targets []*UpstreamTarget) {}
+
+func (lc *leastConnBalancer) Pick(req *http.Request, targets []*UpstreamTarget, available func(*UpstreamTarget) bool) *UpstreamTarget {
+	start := lc.next.Add(1) - 1
+	var best *UpstreamTarget
+	for i := range targets {
+		t := targets[(start+uint64(i))%uint64(len(targets))]
+		if available(t) && (best == nil || t.Active() < best.Active()) {
+			best = t
+		}
+	}
+	return best
+}
+
+// hash ring points per target, more points spread the keys more evenly
+const consistentHashReplicas = 100
+
+// consistentHashBalancer sends the requests with the same key to the same
+// target; when a target is unavailable its keys move to the next targets
+// of the ring and only them.
+type consistentHashBalancer struct {
+	key  HashKeyFunc
+	ring []ringPoint
+}
+
+type ringPoint struct {
+	hash   uint64
+	target *UpstreamTarget
+}
+
+func (ch *consistentHashBalancer) Init(targets []*UpstreamTarget) {
+	ch.ring = ch.ring[:0]
+	for _, t := range targets {
+		for i := 0; i < consistentHashReplicas; i++ {
+			ch.ring = append(ch.ring, ringPoint{hash: hashString(t.URL.String() + "#" + strconv.Itoa(i)), target: t})
+		}
+	}
+	sort.Slice(ch.ring, func(i, j int) bool { return ch.ring[i].hash < ch.ring[j].hash })
+}
+
+func (ch *consistentHashBalancer) Pick(req *http.Request, targets []*UpstreamTarget, available func(*UpstreamTarget) bool) *UpstreamTarget {
+	if len(ch.ring) == 0 {
+		return nil
+	}
+	h := hashString(ch.key(req))
+	start := sort.Search(len(ch.ring), func(i int) bool { return ch.ring[i].hash >= h })
+	for i := range ch.ring {
+		p := ch.ring[(start+i)%len(ch.ring)]
+		if available(p.target) {
+			return p.target
+		}
+	}
+	return nil
+}
+
+// hashString hashes s with FNV-1a and mixes the result, the FNV hashes of
+// keys which only differ by their last bytes are close to one another and
+// would land on the same arc of the ring.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// HashKeyFunc returns the key a request is hashed on.
+type HashKeyFunc func(req *http.Request) string
+
+// NewHashKeyFunc parses a hash key: "client_ip" (the default), "path",
+// "header:<name>" or "cookie:<name>".
+func NewHashKeyFunc(key string) (HashKeyFunc, error) {
+	switch {
+	case key == "" || key == "client_ip":
+		return clientIP, nil
+	case key == "path":
+		return func(req *http.Request) string { return req.URL.Path }, nil
+	case strings.HasPrefix(key, "header:") && len(key) > len("header:"):
+		name := http.CanonicalHeaderKey(key[len("header:"):])
+		return func(req *http.Request) string { return req.Header.Get(name) }, nil
+	case strings.HasPrefix(key, "cookie:") && len(key) > len("cookie:"):
+		name := key[len("cookie:"):]
+		return func(req *http.Request) string {
+			if c, err := req.Cookie(name); err == nil {
+				return c.Value
+			}
+			return ""
+		}, nil
+	default:
+		return nil, errors.New("invalid hash key : " + key)
+	}
+}
@@ -0,0 +1,129 @@
+package filters
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTargets(t *testing.T, n int) []*UpstreamTarget {
+	pool, err := NewUpstreamPool("test", testTargetURLs(n), &roundRobinBalancer{})
+	assert.NoError(t, err)
+	return pool.Targets()
+}
+
+func testTargetURLs(n int) []string {
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://10.0.0.%d:8080", i+1)
+	}
+	return urls
+}
+
+func allAvailable(*UpstreamTarget) bool { return true }
+
+func TestRoundRobinBalancer(t *testing.T) {
+	targets := newTestTargets(t, 3)
+	b, err := NewBalancer(BalancerRoundRobin, "")
+	assert.NoError(t, err)
+	b.Init(targets)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+
+	var picked []*UpstreamTarget
+	for i := 0; i < 6; i++ {
+		picked = append(picked, b.Pick(req, targets, allAvailable))
+	}
+	assert.Equal(t, []*UpstreamTarget{targets[0], targets[1], targets[2], targets[0], targets[1], targets[2]}, picked)
+
+	skipSecond := func(tg *UpstreamTarget) bool { return tg != targets[1] }
+	for i := 0; i < 6; i++ {
+		assert.NotEqual(t, targets[1], b.Pick(req, targets, skipSecond))
+	}
+	assert.Nil(t, b.Pick(req, targets, func(*UpstreamTarget) bool { return false }))
+}
+
+func TestLeastConnBalancer(t *testing.T) {
+	targets := newTestTargets(t, 3)
+	b, err := NewBalancer(BalancerLeastConn, "")
+	assert.NoError(t, err)
+	b.Init(targets)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+
+	targets[0].active.Store(4)
+	targets[1].active.Store(1)
+	targets[2].active.Store(2)
+	assert.Equal(t, targets[1], b.Pick(req, targets, allAvailable))
+	assert.Equal(t, targets[2], b.Pick(req, targets, func(tg *UpstreamTarget) bool { return tg != targets[1] }))
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	targets := newTestTargets(t, 4)
+	b, err := NewBalancer(BalancerConsistentHash, "header:X-User")
+	assert.NoError(t, err)
+	b.Init(targets)
+
+	reqFor := func(user string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("X-User", user)
+		return req
+	}
+	first := map[string]*UpstreamTarget{}
+	used := map[*UpstreamTarget]bool{}
+	for i := 0; i < 100; i++ {
+		user := fmt.Sprint("user-", i)
+		tg := b.Pick(reqFor(user), targets, allAvailable)
+		assert.Equal(t, tg, b.Pick(reqFor(user), targets, allAvailable), "same key, same target")
+		first[user] = tg
+		used[tg] = true
+	}
+	assert.Len(t, used, 4, "the keys are spread over the targets")
+
+	// without targets[0] only its keys move
+	notFirst := func(tg *UpstreamTarget) bool { return tg != targets[0] }
+	for user, tg := range first {
+		got := b.Pick(reqFor(user), targets, notFirst)
+		if tg == targets[0] {
+			assert.NotEqual(t, targets[0], got)
+		} else {
+			assert.Equal(t, tg, got)
+		}
+	}
+}
+
+func TestNewBalancerErrors(t *testing.T) {
+	_, err := NewBalancer("random", "")
+	assert.Error(t, err)
+	_, err = NewBalancer(BalancerConsistentHash, "query:id")
+	assert.Error(t, err)
+	_, err = NewBalancer(BalancerConsistentHash, "header:")
+	assert.Error(t, err)
+}
+
+func TestNewHashKeyFunc(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/a/b", nil)
+	req.RemoteAddr = "192.0.2.7:5000"
+	req.Header.Set("X-Tenant", "acme")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "", want: "192.0.2.7"},
+		{key: "client_ip", want: "192.0.2.7"},
+		{key: "path", want: "/a/b"},
+		{key: "header:x-tenant", want: "acme"},
+		{key: "cookie:session", want: "s1"},
+		{key: "cookie:missing", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			f, err := NewHashKeyFunc(tt.key)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, f(req))
+		})
+	}
+}
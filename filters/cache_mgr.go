@@ -3,9 +3,12 @@ package filters
 import (
 	"context"
 	"errors"
-	"log"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/LamineKouissi/LHP/util"
 )
 
 type ErrCacheMiss struct {
@@ -25,13 +28,37 @@ type CacheService interface {
 type cacheMgrFilter struct {
 	cs         CacheService
 	nextFilter Filter
+	// read on every request, it can be replaced on config reload
+	breaker atomic.Pointer[CircuitBreaker]
+	// policiesMu guards the policies, they can be replaced on config reload
+	policiesMu    sync.RWMutex
+	defaultPolicy *CachePolicy
+	routePolicies map[string]CachePolicy
 }
 
+// default circuit breaker around the CacheService
+const (
+	DefaultBreakerFailureThreshold = 5
+	DefaultBreakerOpenTimeout      = 30 * time.Second
+	DefaultBreakerHalfOpenProbes   = 1
+)
+
 func NewCacheMgrFilter(cacheSrvs CacheService) (*cacheMgrFilter, error) {
 	if cacheSrvs == nil {
 		return nil, errors.New("CacheService = <nil>")
 	}
-	return &cacheMgrFilter{cs: cacheSrvs}, nil
+	breaker, err := NewCircuitBreaker(DefaultBreakerFailureThreshold, DefaultBreakerOpenTimeout, DefaultBreakerHalfOpenProbes)
+	if err != nil {
+		return nil, err
+	}
+	breaker.SetOnStateChange(logBreakerTransition)
+	cm := &cacheMgrFilter{cs: cacheSrvs}
+	cm.breaker.Store(breaker)
+	return cm, nil
+}
+
+func logBreakerTransition(from, to BreakerState) {
+	util.Warnln("cacheMgrFilter : cache backend circuit breaker", from, "->", to)
 }
 
 func (cm *cacheMgrFilter) SetNextFilter(f Filter) error {
@@ -50,24 +77,178 @@ func (cm *cacheMgrFilter) SetCacheService(cacheSrvs CacheService) error {
 	return nil
 }
 
+// SetCircuitBreaker replaces the breaker guarding the CacheService.
+func (cm *cacheMgrFilter) SetCircuitBreaker(cb *CircuitBreaker) error {
+	if cb == nil {
+		return errors.New("CircuitBreaker = <nil>")
+	}
+	cb.SetOnStateChange(logBreakerTransition)
+	cm.breaker.Store(cb)
+	return nil
+}
+
+// CircuitBreaker returns the breaker guarding the CacheService.
+func (cm *cacheMgrFilter) CircuitBreaker() *CircuitBreaker {
+	return cm.breaker.Load()
+}
+
+// SetDefaultPolicy sets the policy of requests outside any route with a policy.
+func (cm *cacheMgrFilter) SetDefaultPolicy(p CachePolicy) {
+	cm.policiesMu.Lock()
+	defer cm.policiesMu.Unlock()
+	cm.defaultPolicy = &p
+}
+
+// SetRoutePolicy sets the policy of the requests of route, see WithRoute.
+func (cm *cacheMgrFilter) SetRoutePolicy(route string, p CachePolicy) error {
+	if route == "" {
+		return errors.New("invalid input : empty route name")
+	}
+	cm.policiesMu.Lock()
+	defer cm.policiesMu.Unlock()
+	if cm.routePolicies == nil {
+		cm.routePolicies = map[string]CachePolicy{}
+	}
+	cm.routePolicies[route] = p
+	return nil
+}
+
+// SetPolicies replaces the default policy, DefaultCachePolicy when nil, and
+// the route policies at once, e.g. on config reload.
+func (cm *cacheMgrFilter) SetPolicies(defaultPolicy *CachePolicy, routePolicies map[string]CachePolicy) error {
+	for route := range routePolicies {
+		if route == "" {
+			return errors.New("invalid input : empty route name")
+		}
+	}
+	if defaultPolicy != nil {
+		p := *defaultPolicy
+		defaultPolicy = &p
+	}
+	cm.policiesMu.Lock()
+	defer cm.policiesMu.Unlock()
+	cm.defaultPolicy, cm.routePolicies = defaultPolicy, routePolicies
+	return nil
+}
+
+// ResetPolicies drops the default and route policies, back to DefaultCachePolicy.
+func (cm *cacheMgrFilter) ResetPolicies() {
+	cm.policiesMu.Lock()
+	defer cm.policiesMu.Unlock()
+	cm.defaultPolicy = nil
+	cm.routePolicies = nil
+}
+
+func (cm *cacheMgrFilter) policyFor(ctx context.Context) CachePolicy {
+	cm.policiesMu.RLock()
+	defer cm.policiesMu.RUnlock()
+	if route, ok := RouteFromCtx(ctx); ok {
+		if p, ok := cm.routePolicies[route]; ok {
+			return p
+		}
+	}
+	if cm.defaultPolicy != nil {
+		return *cm.defaultPolicy
+	}
+	return DefaultCachePolicy()
+}
+
+// CacheBreakerState returns the state of the breaker guarding the CacheService.
+func (cm *cacheMgrFilter) CacheBreakerState() BreakerState {
+	breaker := cm.breaker.Load()
+	if breaker == nil {
+		return BreakerClosed
+	}
+	return breaker.State()
+}
+
 // See HTTP Caching - RFC 9111
 func (cm *cacheMgrFilter) Process(ctx context.Context, req *http.Request, res *http.Response) error {
+	policy := cm.policyFor(ctx)
+	if !policy.Enabled || IsUpgradeRequest(req) {
+		setCacheStatus(ctx, CacheStatusBypass)
+		return cm.processNext(ctx, req, res)
+	}
+	if breaker := cm.breaker.Load(); breaker != nil && !breaker.Allow() {
+		// the cache backend is failing, go straight to the origin
+		setCacheStatus(ctx, CacheStatusBypass)
+		return cm.processNext(ctx, req, res)
+	}
 
-	cachedRes, err := cm.cs.Get(ctx, req)
-	if err != nil {
-		err = cm.nextFilter.Process(ctx, req, res)
-		if err != nil {
-			*res = http.Response{StatusCode: http.StatusInternalServerError}
-			return err
-		} else {
-			err = cm.cs.Set(ctx, req, res, 0)
-			if err != nil {
-				log.Println("cacheMgrFilter.Process(){cm.cs.Set()}: ", err)
-			}
-		}
-	} else {
+	keyReq := policy.keyRequest(req)
+	cachedRes, err := cm.cs.Get(ctx, keyReq)
+	if err == nil {
+		cm.recordBackendResult(nil)
+		setCacheStatus(ctx, CacheStatusHit)
 		*res = *cachedRes
+		return nil
+	}
+
+	var cacheMiss ErrCacheMiss
+	if !errors.As(err, &cacheMiss) {
+		cm.recordBackendResult(err)
+		setCacheStatus(ctx, CacheStatusBypass)
+		util.Errorln("cacheMgrFilter.Process(){cm.cs.Get()}: ", err)
+		return cm.processNext(ctx, req, res)
+	}
+	setCacheStatus(ctx, CacheStatusMiss)
+
+	// the breaker gets one result per request: the Set's when the response
+	// is stored, the Get's otherwise, so that each half-open probe counts once
+	err = cm.processNext(ctx, req, res)
+	if err != nil {
+		cm.recordBackendResult(nil)
+		return err
+	}
+	cm.recordBackendResult(cm.store(ctx, keyReq, res, policy))
+	return nil
+}
+
+// store saves res when the policy allows it, it returns the error of the
+// CacheService. The request already went through the breaker, it only
+// skips the Set when another request opened it meanwhile.
+func (cm *cacheMgrFilter) store(ctx context.Context, keyReq *http.Request, res *http.Response, policy CachePolicy) error {
+	ttl, ok := policy.ttl(res, time.Now())
+	if !ok || !policy.fitsObjectSize(res) {
+		return nil
+	}
+	if breaker := cm.breaker.Load(); breaker != nil && breaker.State() == BreakerOpen {
+		return nil
+	}
+	policy.addKeyHeaders(res)
+	err := cm.cs.Set(ctx, keyReq, res, ttl)
+	if err != nil {
+		util.Errorln("cacheMgrFilter.Process(){cm.cs.Set()}: ", err)
 	}
+	return err
+}
 
+func (cm *cacheMgrFilter) processNext(ctx context.Context, req *http.Request, res *http.Response) error {
+	if cm.nextFilter == nil {
+		return ErrNoNextFilter("cacheMgrFilter")
+	}
+	err := cm.nextFilter.Process(ctx, req, res)
+	if err != nil {
+		*res = http.Response{StatusCode: StatusForError(err)}
+		return err
+	}
 	return nil
 }
+
+func setCacheStatus(ctx context.Context, status string) {
+	if info, ok := RequestInfoFromCtx(ctx); ok {
+		info.CacheStatus = status
+	}
+}
+
+func (cm *cacheMgrFilter) recordBackendResult(err error) {
+	breaker := cm.breaker.Load()
+	if breaker == nil {
+		return
+	}
+	if err != nil {
+		breaker.Failure()
+		return
+	}
+	breaker.Success()
+}
@@ -249,3 +249,147 @@ func TestCacheMgrFilter_SetCacheService(t *testing.T) {
 		})
 	}
 }
+
+func TestCacheMgrFilterCircuitBreaker(t *testing.T) {
+	getCalls, setCalls := 0, 0
+	cs := &MockCacheService{
+		getFunc: func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			getCalls++
+			return nil, errors.New("dial tcp: connection refused")
+		},
+		setFunc: func(ctx context.Context, req *http.Request, res *http.Response, expr time.Duration) error {
+			setCalls++
+			return nil
+		},
+	}
+	nf := &MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		res.StatusCode = http.StatusOK
+		return nil
+	}}
+
+	cm, err := NewCacheMgrFilter(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.SetNextFilter(nf)
+	breaker, clock := newTestBreaker(t, 2, time.Minute, 1)
+	if err := cm.SetCircuitBreaker(breaker); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		res := &http.Response{}
+		err := cm.Process(context.Background(), httptest.NewRequest(http.MethodGet, "http://example.com", nil), res)
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("Process() = %v, status %d, want the origin response", err, res.StatusCode)
+		}
+	}
+	if getCalls != 2 {
+		t.Errorf("CacheService.Get() called %d times, want 2 before the breaker opens", getCalls)
+	}
+	if setCalls != 0 {
+		t.Errorf("CacheService.Set() called %d times, want 0 on backend errors", setCalls)
+	}
+	if cm.CacheBreakerState() != BreakerOpen {
+		t.Errorf("CacheBreakerState() = %v, want open", cm.CacheBreakerState())
+	}
+
+	// the backend recovers, the half-open probe closes the breaker
+	cs.getFunc = func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		getCalls++
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}
+	clock.t = clock.t.Add(time.Minute)
+	cm.Process(context.Background(), httptest.NewRequest(http.MethodGet, "http://example.com", nil), &http.Response{})
+	if getCalls != 3 {
+		t.Errorf("CacheService.Get() called %d times, want the half-open probe", getCalls)
+	}
+	if cm.CacheBreakerState() != BreakerClosed {
+		t.Errorf("CacheBreakerState() = %v, want closed", cm.CacheBreakerState())
+	}
+
+	if err := cm.SetCircuitBreaker(nil); err == nil {
+		t.Errorf("SetCircuitBreaker(nil) expected an error")
+	}
+}
+
+// run with -race: the breaker is replaced on config reload while requests use it
+func TestCacheMgrFilterSetCircuitBreakerConcurrently(t *testing.T) {
+	cs := &MockCacheService{
+		getFunc: func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			return nil, errors.New("dial tcp: connection refused")
+		},
+	}
+	cm, _ := NewCacheMgrFilter(cs)
+	cm.SetNextFilter(&MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		res.StatusCode = http.StatusOK
+		return nil
+	}})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			cm.Process(context.Background(), httptest.NewRequest(http.MethodGet, "http://example.com", nil), &http.Response{})
+			cm.CacheBreakerState()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		breaker, _ := NewCircuitBreaker(DefaultBreakerFailureThreshold, DefaultBreakerOpenTimeout, DefaultBreakerHalfOpenProbes)
+		cm.SetCircuitBreaker(breaker)
+	}
+	<-done
+	if cm.CircuitBreaker() == nil {
+		t.Errorf("CircuitBreaker() = <nil>, want the last breaker set")
+	}
+}
+
+func TestCacheMgrFilterBreakerOneResultPerRequest(t *testing.T) {
+	setCalls := 0
+	cs := &MockCacheService{
+		getFunc: func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			return nil, ErrCacheMiss{Msg: "miss"}
+		},
+		setFunc: func(ctx context.Context, req *http.Request, res *http.Response, expr time.Duration) error {
+			setCalls++
+			return nil
+		},
+	}
+	var during func()
+	nf := &MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		if during != nil {
+			during()
+		}
+		res.StatusCode = http.StatusOK
+		res.Header = http.Header{"Cache-Control": {"max-age=60"}}
+		return nil
+	}}
+	cm, _ := NewCacheMgrFilter(cs)
+	cm.SetNextFilter(nf)
+	breaker, clock := newTestBreaker(t, 1, time.Minute, 2)
+	cm.SetCircuitBreaker(breaker)
+	process := func() {
+		cm.Process(context.Background(), httptest.NewRequest(http.MethodGet, "http://example.com", nil), &http.Response{})
+	}
+
+	breaker.Failure()
+	clock.t = clock.t.Add(time.Minute)
+	process()
+	if setCalls != 1 {
+		t.Fatalf("CacheService.Set() called %d times, want 1", setCalls)
+	}
+	if cm.CacheBreakerState() != BreakerHalfOpen {
+		t.Errorf("CacheBreakerState() = %v after one of two probes, want half-open", cm.CacheBreakerState())
+	}
+	process()
+	if cm.CacheBreakerState() != BreakerClosed {
+		t.Errorf("CacheBreakerState() = %v after two probes, want closed", cm.CacheBreakerState())
+	}
+
+	// the breaker opens while the origin answers, the response is not stored
+	during = breaker.Failure
+	process()
+	if setCalls != 2 {
+		t.Errorf("CacheService.Set() called %d more times, want none once the breaker is open", setCalls-2)
+	}
+}
@@ -0,0 +1,182 @@
+package filters
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCacheTTL is used when neither the origin nor the policy give a lifetime.
+const defaultCacheTTL = 5 * time.Minute
+
+// CachePolicy controls how cacheMgrFilter caches the responses of a route.
+type CachePolicy struct {
+	Enabled bool
+	// TTL is the lifetime of responses without freshness information, or of
+	// every response when IgnoreOriginHeaders is set.
+	TTL    time.Duration
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// IgnoreOriginHeaders stores responses regardless of their Cache-Control
+	// and Expires headers.
+	IgnoreOriginHeaders bool
+	// StripQueryParams are removed from the URL before it is used as a key,
+	// SortQueryParams makes the key independent of the parameters order.
+	StripQueryParams []string
+	SortQueryParams  bool
+	// KeyHeaders are request headers the cache varies on in addition to the
+	// origin Vary header.
+	KeyHeaders []string
+	// MaxObjectSize is the largest body stored in bytes, 0 means no limit.
+	MaxObjectSize int64
+}
+
+func DefaultCachePolicy() CachePolicy {
+	return CachePolicy{Enabled: true}
+}
+
+// keyRequest returns req with its URL normalized according to the policy.
+// Only the URL is copied, the header is shared with req.
+func (cp CachePolicy) keyRequest(req *http.Request) *http.Request {
+	if len(cp.StripQueryParams) == 0 && !cp.SortQueryParams {
+		return req
+	}
+	u := *req.URL
+	u.RawQuery = cp.normalizeQuery(req.URL.RawQuery)
+	keyReq := *req
+	keyReq.URL = &u
+	return &keyReq
+}
+
+func (cp CachePolicy) normalizeQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	strip := make(map[string]bool, len(cp.StripQueryParams))
+	for _, p := range cp.StripQueryParams {
+		strip[p] = true
+	}
+	var params []string
+	for _, p := range strings.Split(rawQuery, "&") {
+		if p == "" {
+			continue
+		}
+		name := p
+		if i := strings.IndexByte(p, '='); i >= 0 {
+			name = p[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if strip[name] {
+			continue
+		}
+		params = append(params, p)
+	}
+	if cp.SortQueryParams {
+		sort.Strings(params)
+	}
+	return strings.Join(params, "&")
+}
+
+// ttl returns the lifetime to store res with, and false when the policy or
+// the origin forbid storing it.
+func (cp CachePolicy) ttl(res *http.Response, now time.Time) (time.Duration, bool) {
+	ttl := cp.TTL
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+	if !cp.IgnoreOriginHeaders {
+		directives := cacheControlDirectives(res.Header)
+		if _, ok := directives["no-store"]; ok {
+			return 0, false
+		}
+		if _, ok := directives["private"]; ok {
+			return 0, false
+		}
+		if originTTL, ok := originFreshness(directives, res.Header, now); ok {
+			ttl = originTTL
+		}
+	}
+	if cp.MinTTL > 0 && ttl < cp.MinTTL {
+		ttl = cp.MinTTL
+	}
+	if cp.MaxTTL > 0 && ttl > cp.MaxTTL {
+		ttl = cp.MaxTTL
+	}
+	return ttl, ttl > 0
+}
+
+// originFreshness returns the freshness lifetime given by the origin, s-maxage
+// first, then max-age, then Expires (RFC 9111 section 4.2.1).
+func originFreshness(directives map[string]string, h http.Header, now time.Time) (time.Duration, bool) {
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := directives[d]; ok {
+			if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return time.Duration(secs) * time.Second, true
+			}
+		}
+	}
+	if expires := h.Get("Expires"); expires != "" {
+		expiresTime, err := http.ParseTime(expires)
+		if err != nil {
+			// invalid Expires means already expired
+			return 0, true
+		}
+		return expiresTime.Sub(now), true
+	}
+	return 0, false
+}
+
+func cacheControlDirectives(h http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(d, "=")
+			directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return directives
+}
+
+// fitsObjectSize reports whether the body of res is within MaxObjectSize. A
+// body of unknown length is buffered up to the limit and res.Body is replaced
+// so that it can still be read in full.
+func (cp CachePolicy) fitsObjectSize(res *http.Response) bool {
+	if cp.MaxObjectSize <= 0 {
+		return true
+	}
+	if res.ContentLength >= 0 {
+		return res.ContentLength <= cp.MaxObjectSize
+	}
+	if res.Body == nil {
+		return true
+	}
+	head, err := ioutil.ReadAll(io.LimitReader(res.Body, cp.MaxObjectSize+1))
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), res.Body), res.Body}
+	return err == nil && int64(len(head)) <= cp.MaxObjectSize
+}
+
+// addKeyHeaders makes the stored response vary on KeyHeaders.
+func (cp CachePolicy) addKeyHeaders(res *http.Response) {
+	if len(cp.KeyHeaders) == 0 {
+		return
+	}
+	if res.Header == nil {
+		res.Header = http.Header{}
+	}
+	res.Header.Add("Vary", strings.Join(cp.KeyHeaders, ", "))
+}
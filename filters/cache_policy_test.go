@@ -0,0 +1,244 @@
+package filters
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachePolicyKeyRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy CachePolicy
+		url    string
+		want   string
+	}{
+		{
+			name:   "No normalization",
+			policy: DefaultCachePolicy(),
+			url:    "http://example.com/a?b=2&a=1",
+			want:   "http://example.com/a?b=2&a=1",
+		},
+		{
+			name:   "Strip tracking params",
+			policy: CachePolicy{Enabled: true, StripQueryParams: []string{"utm_source", "fbclid"}},
+			url:    "http://example.com/a?utm_source=x&id=7&fbclid=y",
+			want:   "http://example.com/a?id=7",
+		},
+		{
+			name:   "Sort params",
+			policy: CachePolicy{Enabled: true, SortQueryParams: true},
+			url:    "http://example.com/a?b=2&a=1&a=0",
+			want:   "http://example.com/a?a=0&a=1&b=2",
+		},
+		{
+			name:   "Strip and sort",
+			policy: CachePolicy{Enabled: true, SortQueryParams: true, StripQueryParams: []string{"session id"}},
+			url:    "http://example.com/a?z=1&session%20id=3&c=2",
+			want:   "http://example.com/a?c=2&z=1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			keyReq := tt.policy.keyRequest(req)
+			assert.Equal(t, tt.want, keyReq.URL.String())
+			assert.Equal(t, tt.url, req.URL.String(), "the original request is left untouched")
+		})
+	}
+}
+
+func TestCachePolicyTTL(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		policy    CachePolicy
+		header    http.Header
+		wantTTL   time.Duration
+		wantStore bool
+	}{
+		{
+			name:      "Default lifetime",
+			policy:    DefaultCachePolicy(),
+			header:    http.Header{},
+			wantTTL:   defaultCacheTTL,
+			wantStore: true,
+		},
+		{
+			name:      "Origin max-age",
+			policy:    DefaultCachePolicy(),
+			header:    http.Header{"Cache-Control": []string{"public, max-age=120"}},
+			wantTTL:   2 * time.Minute,
+			wantStore: true,
+		},
+		{
+			name:      "s-maxage wins over max-age",
+			policy:    DefaultCachePolicy(),
+			header:    http.Header{"Cache-Control": []string{"max-age=120, s-maxage=60"}},
+			wantTTL:   time.Minute,
+			wantStore: true,
+		},
+		{
+			name:      "Origin no-store",
+			policy:    DefaultCachePolicy(),
+			header:    http.Header{"Cache-Control": []string{"no-store"}},
+			wantStore: false,
+		},
+		{
+			name:      "Origin private",
+			policy:    DefaultCachePolicy(),
+			header:    http.Header{"Cache-Control": []string{"private, max-age=60"}},
+			wantStore: false,
+		},
+		{
+			name:      "Policy TTL used without origin freshness",
+			policy:    CachePolicy{Enabled: true, TTL: time.Hour},
+			header:    http.Header{},
+			wantTTL:   time.Hour,
+			wantStore: true,
+		},
+		{
+			name:      "Ignore origin headers",
+			policy:    CachePolicy{Enabled: true, TTL: time.Hour, IgnoreOriginHeaders: true},
+			header:    http.Header{"Cache-Control": []string{"no-store"}},
+			wantTTL:   time.Hour,
+			wantStore: true,
+		},
+		{
+			name:      "Clamped to min",
+			policy:    CachePolicy{Enabled: true, MinTTL: time.Minute},
+			header:    http.Header{"Cache-Control": []string{"max-age=0"}},
+			wantTTL:   time.Minute,
+			wantStore: true,
+		},
+		{
+			name:      "Clamped to max",
+			policy:    CachePolicy{Enabled: true, MaxTTL: time.Minute},
+			header:    http.Header{"Expires": []string{now.Add(time.Hour).UTC().Format(http.TimeFormat)}},
+			wantTTL:   time.Minute,
+			wantStore: true,
+		},
+		{
+			name:      "Already expired",
+			policy:    DefaultCachePolicy(),
+			header:    http.Header{"Cache-Control": []string{"max-age=0"}},
+			wantStore: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, store := tt.policy.ttl(&http.Response{Header: tt.header}, now)
+			assert.Equal(t, tt.wantStore, store)
+			if tt.wantStore {
+				assert.Equal(t, tt.wantTTL, ttl)
+			}
+		})
+	}
+}
+
+func TestCachePolicyFitsObjectSize(t *testing.T) {
+	policy := CachePolicy{Enabled: true, MaxObjectSize: 5}
+
+	assert.True(t, policy.fitsObjectSize(&http.Response{ContentLength: 5}))
+	assert.False(t, policy.fitsObjectSize(&http.Response{ContentLength: 6}))
+
+	for body, fits := range map[string]bool{"12345": true, "123456789": false} {
+		res := &http.Response{ContentLength: -1, Body: ioutil.NopCloser(strings.NewReader(body))}
+		assert.Equal(t, fits, policy.fitsObjectSize(res), body)
+		read, err := ioutil.ReadAll(res.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, body, string(read), "the body is still readable in full")
+	}
+}
+
+func TestCacheMgrFilterRoutePolicies(t *testing.T) {
+	var gotKey string
+	var gotTTL time.Duration
+	getCalls := 0
+	cs := &MockCacheService{
+		getFunc: func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			getCalls++
+			gotKey = req.URL.String()
+			return nil, ErrCacheMiss{"Cache miss"}
+		},
+		setFunc: func(ctx context.Context, req *http.Request, res *http.Response, expr time.Duration) error {
+			gotTTL = expr
+			return nil
+		},
+	}
+	nf := &MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		*res = http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": []string{"max-age=10"}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString("ok")),
+		}
+		return nil
+	}}
+	cm, _ := NewCacheMgrFilter(cs)
+	cm.SetNextFilter(nf)
+	assert.NoError(t, cm.SetRoutePolicy("api", CachePolicy{
+		Enabled:          true,
+		MinTTL:           time.Minute,
+		StripQueryParams: []string{"ts"},
+		KeyHeaders:       []string{"Authorization"},
+	}))
+	assert.NoError(t, cm.SetRoutePolicy("nocache", CachePolicy{Enabled: false}))
+	assert.Error(t, cm.SetRoutePolicy("", DefaultCachePolicy()))
+
+	t.Run("Route policy", func(t *testing.T) {
+		res := &http.Response{}
+		ctx := WithRoute(context.Background(), "api")
+		err := cm.Process(ctx, httptest.NewRequest(http.MethodGet, "http://example.com/v1?ts=1&q=go", nil), res)
+		assert.NoError(t, err)
+		assert.Equal(t, "http://example.com/v1?q=go", gotKey)
+		assert.Equal(t, time.Minute, gotTTL)
+		assert.Equal(t, "Authorization", res.Header.Get("Vary"))
+	})
+
+	t.Run("Disabled route", func(t *testing.T) {
+		getCalls = 0
+		res := &http.Response{}
+		ctx := WithRoute(context.Background(), "nocache")
+		err := cm.Process(ctx, httptest.NewRequest(http.MethodGet, "http://example.com/", nil), res)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, 0, getCalls)
+	})
+
+	t.Run("Default policy", func(t *testing.T) {
+		cm.SetDefaultPolicy(CachePolicy{Enabled: true, IgnoreOriginHeaders: true, TTL: time.Hour})
+		res := &http.Response{}
+		ctx := WithRoute(context.Background(), "unknown")
+		err := cm.Process(ctx, httptest.NewRequest(http.MethodGet, "http://example.com/?ts=1", nil), res)
+		assert.NoError(t, err)
+		assert.Equal(t, "http://example.com/?ts=1", gotKey)
+		assert.Equal(t, time.Hour, gotTTL)
+	})
+
+	t.Run("Reset policies", func(t *testing.T) {
+		cm.ResetPolicies()
+		assert.Equal(t, DefaultCachePolicy(), cm.policyFor(WithRoute(context.Background(), "nocache")))
+	})
+
+	t.Run("Set policies", func(t *testing.T) {
+		cm.SetRoutePolicy("old", CachePolicy{Enabled: true})
+		defaultPolicy := CachePolicy{Enabled: true, TTL: time.Hour}
+		assert.NoError(t, cm.SetPolicies(&defaultPolicy, map[string]CachePolicy{"api": {Enabled: false}}))
+		assert.False(t, cm.policyFor(WithRoute(context.Background(), "api")).Enabled)
+		assert.Equal(t, defaultPolicy, cm.policyFor(WithRoute(context.Background(), "old")), "the previous route policies are dropped")
+
+		assert.Error(t, cm.SetPolicies(nil, map[string]CachePolicy{"": {}}))
+		assert.Equal(t, defaultPolicy, cm.policyFor(context.Background()), "a failed call sets nothing")
+		assert.NoError(t, cm.SetPolicies(nil, nil))
+		assert.Equal(t, DefaultCachePolicy(), cm.policyFor(context.Background()))
+	})
+}
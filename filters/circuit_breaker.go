@@ -0,0 +1,152 @@
+package filters
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreaker stops calls to a failing backend. It opens after
+// failureThreshold consecutive failures, rejects every call for openTimeout,
+// then lets up to halfOpenProbes calls through: the breaker closes once they
+// all succeed and opens again on the first failure.
+type CircuitBreaker struct {
+	mu               sync.Mutex
+	failureThreshold int
+	openTimeout      time.Duration
+	halfOpenProbes   int
+	state            BreakerState
+	failures         int
+	openedAt         time.Time
+	probes           int
+	successes        int
+	onStateChange    func(from, to BreakerState)
+	now              func() time.Time
+}
+
+func NewCircuitBreaker(failureThreshold int, openTimeout time.Duration, halfOpenProbes int) (*CircuitBreaker, error) {
+	if failureThreshold <= 0 {
+		return nil, errors.New("invalid input : failureThreshold <= 0")
+	}
+	if openTimeout <= 0 {
+		return nil, errors.New("invalid input : openTimeout <= 0")
+	}
+	if halfOpenProbes <= 0 {
+		return nil, errors.New("invalid input : halfOpenProbes <= 0")
+	}
+	return &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		halfOpenProbes:   halfOpenProbes,
+		now:              time.Now,
+	}, nil
+}
+
+// SameSettings reports whether other opens, waits and probes as cb does.
+func (cb *CircuitBreaker) SameSettings(other *CircuitBreaker) bool {
+	return other != nil && cb.failureThreshold == other.failureThreshold &&
+		cb.openTimeout == other.openTimeout && cb.halfOpenProbes == other.halfOpenProbes
+}
+
+// SetOnStateChange registers fn to be called, with the breaker lock held, on every transition.
+func (cb *CircuitBreaker) SetOnStateChange(fn func(from, to BreakerState)) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.onStateChange = fn
+}
+
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.refresh()
+	return cb.state
+}
+
+// Allow reports whether a call may be made to the backend.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.refresh()
+	switch cb.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if cb.probes >= cb.halfOpenProbes {
+			return false
+		}
+		cb.probes++
+		return true
+	default:
+		return true
+	}
+}
+
+func (cb *CircuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case BreakerHalfOpen:
+		cb.successes++
+		if cb.successes >= cb.halfOpenProbes {
+			cb.setState(BreakerClosed)
+		}
+	case BreakerClosed:
+		cb.failures = 0
+	}
+}
+
+func (cb *CircuitBreaker) Failure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case BreakerHalfOpen:
+		cb.setState(BreakerOpen)
+	case BreakerClosed:
+		cb.failures++
+		if cb.failures >= cb.failureThreshold {
+			cb.setState(BreakerOpen)
+		}
+	}
+}
+
+// refresh moves an open breaker to half-open once openTimeout has elapsed.
+func (cb *CircuitBreaker) refresh() {
+	if cb.state == BreakerOpen && cb.now().Sub(cb.openedAt) >= cb.openTimeout {
+		cb.setState(BreakerHalfOpen)
+	}
+}
+
+func (cb *CircuitBreaker) setState(to BreakerState) {
+	from := cb.state
+	cb.state = to
+	cb.failures = 0
+	cb.probes = 0
+	cb.successes = 0
+	if to == BreakerOpen {
+		cb.openedAt = cb.now()
+	}
+	if cb.onStateChange != nil && from != to {
+		cb.onStateChange(from, to)
+	}
+}
@@ -0,0 +1,108 @@
+package filters
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func newTestBreaker(t *testing.T, threshold int, openTimeout time.Duration, probes int) (*CircuitBreaker, *fakeClock) {
+	cb, err := NewCircuitBreaker(threshold, openTimeout, probes)
+	assert.NoError(t, err)
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	cb.now = clock.now
+	return cb, clock
+}
+
+func TestNewCircuitBreaker(t *testing.T) {
+	tests := []struct {
+		name        string
+		threshold   int
+		openTimeout time.Duration
+		probes      int
+		wantErr     bool
+	}{
+		{name: "Valid", threshold: 3, openTimeout: time.Second, probes: 1},
+		{name: "Zero threshold", threshold: 0, openTimeout: time.Second, probes: 1, wantErr: true},
+		{name: "Zero open timeout", threshold: 3, openTimeout: 0, probes: 1, wantErr: true},
+		{name: "Zero probes", threshold: 3, openTimeout: time.Second, probes: 0, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb, err := NewCircuitBreaker(tt.threshold, tt.openTimeout, tt.probes)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Nil(t, cb)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, BreakerClosed, cb.State())
+		})
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	cb, clock := newTestBreaker(t, 3, 10*time.Second, 2)
+	var transitions []string
+	cb.SetOnStateChange(func(from, to BreakerState) {
+		transitions = append(transitions, from.String()+">"+to.String())
+	})
+
+	// a success resets the consecutive failure count
+	cb.Failure()
+	cb.Failure()
+	cb.Success()
+	cb.Failure()
+	cb.Failure()
+	assert.Equal(t, BreakerClosed, cb.State())
+	assert.True(t, cb.Allow())
+
+	cb.Failure()
+	assert.Equal(t, BreakerOpen, cb.State())
+	assert.False(t, cb.Allow())
+
+	clock.t = clock.t.Add(10 * time.Second)
+	assert.Equal(t, BreakerHalfOpen, cb.State())
+	assert.True(t, cb.Allow())
+	assert.True(t, cb.Allow())
+	assert.False(t, cb.Allow(), "only halfOpenProbes calls go through")
+
+	// a failing probe opens the breaker again
+	cb.Failure()
+	assert.Equal(t, BreakerOpen, cb.State())
+
+	clock.t = clock.t.Add(10 * time.Second)
+	assert.True(t, cb.Allow())
+	assert.True(t, cb.Allow())
+	cb.Success()
+	assert.Equal(t, BreakerHalfOpen, cb.State())
+	cb.Success()
+	assert.Equal(t, BreakerClosed, cb.State())
+
+	assert.Equal(t, []string{
+		"closed>open",
+		"open>half-open",
+		"half-open>open",
+		"open>half-open",
+		"half-open>closed",
+	}, transitions)
+}
+
+func TestCircuitBreakerSameSettings(t *testing.T) {
+	cb, _ := NewCircuitBreaker(3, time.Second, 1)
+	same, _ := NewCircuitBreaker(3, time.Second, 1)
+	other, _ := NewCircuitBreaker(3, time.Minute, 1)
+	assert.True(t, cb.SameSettings(same))
+	assert.False(t, cb.SameSettings(other))
+	assert.False(t, cb.SameSettings(nil))
+}
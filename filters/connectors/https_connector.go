@@ -5,35 +5,138 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
-	"log"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/LamineKouissi/LHP/config"
+	"github.com/LamineKouissi/LHP/filters"
+)
+
+// defaults of the upstream connections
+const (
+	DefaultDialTimeout           = 10 * time.Second
+	DefaultKeepAlive             = 30 * time.Second
+	DefaultTLSHandshakeTimeout   = 10 * time.Second
+	DefaultResponseHeaderTimeout = 30 * time.Second
+	DefaultIdleConnTimeout       = 90 * time.Second
+	DefaultMaxIdleConns          = 100
+	DefaultMaxIdleConnsPerHost   = 10
 )
 
 type HttpsConnector struct {
+	// shared by the transports, see SetDialControl
+	dialer *net.Dialer
 	client *http.Client
+	// clients of the hosts with their own TLS settings, first match wins
+	hostClients []hostClient
+	// bounds each upstream request, response body included, 0 means no limit
+	requestTimeout time.Duration
+}
+
+type hostClient struct {
+	pattern string
+	client  *http.Client
+}
+
+// clientFor returns the client of the upstreams of host.
+func (usc *HttpsConnector) clientFor(host string) *http.Client {
+	for _, hc := range usc.hostClients {
+		if filters.MatchHost(hc.pattern, host) {
+			return hc.client
+		}
+	}
+	return usc.client
 }
 
 func (usc *HttpsConnector) Process(ctx context.Context, req *http.Request, res *http.Response) error {
-	trgtRes, err := usc.client.Do(req)
+	if req.URL.Scheme == "" || req.URL.Host == "" {
+		return filters.NewClientError(http.StatusBadRequest, "The request URL must be absolute.",
+			fmt.Errorf("HttpsConnector : not a proxy request : %q", req.URL.String()))
+	}
+	ctx, span := filters.StartSpan(ctx, "upstream "+req.Method, filters.SpanKindClient)
+	defer span.End()
+	span.SetAttribute("server.address", filters.RequestHost(req))
+	filters.InjectTraceContext(ctx, req.Header)
+
+	// the chain's ctx derives from the client request, an aborted client cancels the upstream request
+	// an upgraded connection outlives the request, the request timeout does not apply
+	clientCtx := ctx
+	cancel := context.CancelFunc(func() {})
+	if usc.requestTimeout > 0 && !filters.IsUpgradeRequest(req) {
+		ctx, cancel = context.WithTimeout(ctx, usc.requestTimeout)
+	}
+	start := time.Now()
+	host := filters.RequestHost(req)
+	trgtRes, err := usc.clientFor(host).Do(req.WithContext(ctx))
+	if info, ok := filters.RequestInfoFromCtx(ctx); ok {
+		info.UpstreamLatency += time.Since(start)
+	}
+	span.SetError(err)
 	if err != nil {
-		log.Fatal("Err: Faild to Fire Req to Target through: HttpsConnector.Process() : ", err)
-		return err
+		cancel()
+		// the client's context, cancel just canceled the timeout's
+		if errors.Is(clientCtx.Err(), context.Canceled) {
+			return filters.NewClientError(filters.StatusClientClosedRequest, "The client closed the request.", err)
+		}
+		if pe, ok := filters.AsProxyError(err); ok {
+			// e.g. the ACL refusing the upstream's address
+			return pe
+		}
+		if isTLSVerificationError(err) {
+			return filters.NewUpstreamTLSError(host, err)
+		}
+		return filters.NewUpstreamError(host, err)
 	}
 
+	span.SetAttribute("http.response.status_code", trgtRes.StatusCode)
 	*res = *trgtRes
+	res.Body = &cancelOnClose{ReadCloser: trgtRes.Body, cancel: cancel}
 	return nil
 }
 
+// cancelOnClose releases the request context once the response body is done with.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Write writes to the upstream connection, the body of a 101 Switching Protocols response.
+func (c *cancelOnClose) Write(p []byte) (int, error) {
+	if w, ok := c.ReadCloser.(io.Writer); ok {
+		return w.Write(p)
+	}
+	return 0, errors.New("response body is not writable")
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
 func NewHttpsConnector() (*HttpsConnector, error) {
+	return NewHttpsConnectorFromConfig(config.UpstreamConfig{})
+}
 
+// NewHttpsConnectorFromConfig builds a connector with the timeouts and
+// connection pool limits of cfg, the zero values use the Default* values.
+// The hosts of cfg.TLS get their own connection pool with their TLS settings.
+func NewHttpsConnectorFromConfig(cfg config.UpstreamConfig) (*HttpsConnector, error) {
+	if cfg.RequestTimeout < 0 {
+		return nil, errors.New("invalid upstream config : negative request_timeout")
+	}
 	rootCertPool, err := x509.SystemCertPool()
 	if err != nil {
-		log.Fatalf("Failed to read system certificates: %v", err)
-		return nil, err
+		return nil, errors.Join(errors.New("Failed to read system certificates"), err)
 	}
 
 	if rootCertPool == nil {
-		log.Fatal("Failed to read system certificates: rootCertPool == nil")
 		return nil, errors.New("Failed to read system certificates: rootCertPool == nil")
 	}
 
@@ -41,9 +144,76 @@ func NewHttpsConnector() (*HttpsConnector, error) {
 		RootCAs: rootCertPool,
 	}
 
+	dialer := &net.Dialer{
+		Timeout:   durationOr(cfg.DialTimeout, DefaultDialTimeout),
+		KeepAlive: durationOr(cfg.KeepAlive, DefaultKeepAlive),
+	}
+	usc := &HttpsConnector{dialer: dialer, client: &http.Client{Transport: newTransport(cfg, tlsConfig, dialer)}, requestTimeout: time.Duration(cfg.RequestTimeout)}
+
+	// exact hosts before wildcards, then in a stable order
+	patterns := make([]string, 0, len(cfg.TLS))
+	for pattern := range cfg.TLS {
+		patterns = append(patterns, pattern)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		wi, wj := strings.HasPrefix(patterns[i], "*"), strings.HasPrefix(patterns[j], "*")
+		if wi != wj {
+			return wj
+		}
+		if wi && len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	for _, pattern := range patterns {
+		hostTLSConfig, err := upstreamTLSConfig(cfg.TLS[pattern])
+		if err != nil {
+			return nil, fmt.Errorf("upstream TLS config of %s : %w", pattern, err)
+		}
+		usc.hostClients = append(usc.hostClients, hostClient{pattern: pattern, client: &http.Client{Transport: newTransport(cfg, hostTLSConfig, dialer)}})
+	}
+	return usc, nil
+}
+
+func newTransport(cfg config.UpstreamConfig, tlsConfig *tls.Config, dialer *net.Dialer) *http.Transport {
 	tr := &http.Transport{
-		TLSClientConfig: tlsConfig,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   durationOr(cfg.TLSHandshakeTimeout, DefaultTLSHandshakeTimeout),
+		ResponseHeaderTimeout: durationOr(cfg.ResponseHeaderTimeout, DefaultResponseHeaderTimeout),
+		IdleConnTimeout:       durationOr(cfg.IdleConnTimeout, DefaultIdleConnTimeout),
+		MaxIdleConns:          intOr(cfg.MaxIdleConns, DefaultMaxIdleConns),
+		MaxIdleConnsPerHost:   intOr(cfg.MaxIdleConnsPerHost, DefaultMaxIdleConnsPerHost),
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		ForceAttemptHTTP2:     true,
+	}
+	if cfg.HTTP2 != nil && !*cfg.HTTP2 {
+		tr.ForceAttemptHTTP2 = false
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
 	}
+	return tr
+}
+
+// SetDialControl sets the function checking the upstream addresses before
+// connecting, e.g. filters.ACL.DialControl. It is set before the first request.
+func (usc *HttpsConnector) SetDialControl(control func(network, address string, c syscall.RawConn) error) error {
+	if control == nil {
+		return errors.New("dial control = <nil>")
+	}
+	usc.dialer.Control = control
+	return nil
+}
 
-	return &HttpsConnector{client: &http.Client{Transport: tr}}, nil
+func durationOr(d config.Duration, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return time.Duration(d)
+}
+
+func intOr(n, def int) int {
+	if n <= 0 {
+		return def
+	}
+	return n
 }
@@ -0,0 +1,163 @@
+package connectors
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/LamineKouissi/LHP/config"
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHttpsConnectorProcess(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	cnx, err := NewHttpsConnectorFromConfig(config.UpstreamConfig{ResponseHeaderTimeout: config.Duration(100 * time.Millisecond)})
+	assert.NoError(t, err)
+
+	t.Run("Ok", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, upstream.URL+"/", nil)
+		res := &http.Response{}
+		assert.NoError(t, cnx.Process(context.Background(), req, res))
+		body, _ := io.ReadAll(res.Body)
+		assert.NoError(t, res.Body.Close())
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "hello", string(body))
+	})
+
+	t.Run("Response header timeout", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, upstream.URL+"/slow", nil)
+		err := cnx.Process(context.Background(), req, &http.Response{})
+		pe, ok := filters.AsProxyError(err)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusGatewayTimeout, pe.Status)
+		assert.Equal(t, filters.ErrorCategoryUpstream, pe.Category)
+	})
+
+	t.Run("Client gone", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		req, _ := http.NewRequest(http.MethodGet, upstream.URL+"/slow", nil)
+		err := cnx.Process(ctx, req, &http.Response{})
+		assert.Equal(t, filters.StatusClientClosedRequest, filters.StatusForError(err))
+	})
+
+	t.Run("Not a proxy request", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		err := cnx.Process(context.Background(), req, &http.Response{})
+		assert.Equal(t, http.StatusBadRequest, filters.StatusForError(err))
+	})
+
+	t.Run("Upstream down", func(t *testing.T) {
+		down := httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+		req, _ := http.NewRequest(http.MethodGet, down.URL+"/", nil)
+		err := cnx.Process(context.Background(), req, &http.Response{})
+		assert.Equal(t, http.StatusBadGateway, filters.StatusForError(err))
+		assert.True(t, filters.IsRetryable(err))
+	})
+}
+
+func TestHttpsConnectorRequestTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	_, err := NewHttpsConnectorFromConfig(config.UpstreamConfig{RequestTimeout: config.Duration(-time.Second)})
+	assert.Error(t, err)
+
+	http2 := false
+	cnx, err := NewHttpsConnectorFromConfig(config.UpstreamConfig{RequestTimeout: config.Duration(50 * time.Millisecond), HTTP2: &http2})
+	assert.NoError(t, err)
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL+"/", nil)
+	start := time.Now()
+	err = cnx.Process(context.Background(), req, &http.Response{})
+	assert.Equal(t, http.StatusGatewayTimeout, filters.StatusForError(err))
+	assert.True(t, time.Since(start) < DefaultResponseHeaderTimeout)
+}
+
+func TestHttpsConnectorErrorsWithRequestTimeout(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	refusedURL := "http://" + closed.Addr().String() + "/"
+	closed.Close()
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer internal.Close()
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name          string
+		ctx           context.Context
+		url           string
+		ssrf          bool
+		wantStatus    int
+		wantCategory  filters.ErrorCategory
+		wantRetryable bool
+	}{
+		{name: "Connection refused", ctx: context.Background(), url: refusedURL,
+			wantStatus: http.StatusBadGateway, wantCategory: filters.ErrorCategoryUpstream, wantRetryable: true},
+		{name: "Refused by the dial control", ctx: context.Background(), url: internal.URL + "/", ssrf: true,
+			wantStatus: http.StatusForbidden, wantCategory: filters.ErrorCategoryPolicy},
+		{name: "Client gone", ctx: canceled, url: internal.URL + "/",
+			wantStatus: filters.StatusClientClosedRequest, wantCategory: filters.ErrorCategoryClient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cnx, err := NewHttpsConnectorFromConfig(config.UpstreamConfig{RequestTimeout: config.Duration(time.Second)})
+			assert.NoError(t, err)
+			if tt.ssrf {
+				acl, _ := filters.NewACL(nil, filters.ACLAllow)
+				acl.SetSSRFProtection(nil)
+				assert.NoError(t, cnx.SetDialControl(acl.DialControl))
+			}
+			req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			err = cnx.Process(tt.ctx, req, &http.Response{})
+			pe, ok := filters.AsProxyError(err)
+			if assert.True(t, ok, "%v", err) {
+				assert.Equal(t, tt.wantStatus, pe.Status)
+				assert.Equal(t, tt.wantCategory, pe.Category)
+				assert.Equal(t, tt.wantRetryable, filters.IsRetryable(err))
+			}
+		})
+	}
+}
+
+func TestHttpsConnectorDialControl(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "internal")
+	}))
+	defer upstream.Close()
+
+	cnx, err := NewHttpsConnector()
+	assert.NoError(t, err)
+	acl, err := filters.NewACL(nil, filters.ACLAllow)
+	assert.NoError(t, err)
+	acl.SetSSRFProtection(nil)
+	assert.Error(t, cnx.SetDialControl(nil))
+	assert.NoError(t, cnx.SetDialControl(acl.DialControl))
+
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL+"/", nil)
+	err = cnx.Process(context.Background(), req, &http.Response{})
+	pe, ok := filters.AsProxyError(err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusForbidden, pe.Status)
+	assert.Equal(t, filters.ErrorCategoryPolicy, pe.Category)
+}
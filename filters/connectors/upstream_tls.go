@@ -0,0 +1,132 @@
+package connectors
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/LamineKouissi/LHP/config"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// upstreamTLSConfig builds the client TLS config of the upstreams of a host.
+func upstreamTLSConfig(cfg config.UpstreamTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: cfg.ServerName}
+
+	if cfg.SystemRoots == nil || *cfg.SystemRoots {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, errors.Join(errors.New("Failed to read system certificates"), err)
+		}
+		tlsConfig.RootCAs = roots
+	} else {
+		if len(cfg.CAFiles) == 0 {
+			return nil, errors.New("invalid upstream TLS config : system_roots is false and no ca_files")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+	}
+	for _, caFile := range cfg.CAFiles {
+		caPem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading upstream CA file: %v", err)
+		}
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificate found in upstream CA file %s", caFile)
+		}
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading upstream client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.MinVersion != "" {
+		v, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid upstream TLS min_version : %q", cfg.MinVersion)
+		}
+		tlsConfig.MinVersion = v
+	}
+
+	if len(cfg.CipherSuites) > 0 {
+		ids := map[string]uint16{}
+		for _, cs := range tls.CipherSuites() {
+			ids[cs.Name] = cs.ID
+		}
+		for _, name := range cfg.CipherSuites {
+			id, ok := ids[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure upstream TLS cipher suite : %q", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+
+	if len(cfg.PinnedSPKI) > 0 {
+		pins := map[[sha256.Size]byte]bool{}
+		for _, pin := range cfg.PinnedSPKI {
+			b, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid upstream TLS pinned_spki %q : expected a base64 SHA-256 hash", pin)
+			}
+			pins[[sha256.Size]byte(b)] = true
+		}
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPinnedSPKI(cs, pins)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// ErrSPKIPinMismatch is returned when no certificate of the upstream's chain has a pinned public key.
+type ErrSPKIPinMismatch struct {
+	ServerName string
+}
+
+func (e ErrSPKIPinMismatch) Error() string {
+	return "no certificate of " + e.ServerName + " matches the pinned SPKI hashes"
+}
+
+// verifyPinnedSPKI runs after the chain is verified, one of its
+// certificates must have a pinned public key.
+func verifyPinnedSPKI(cs tls.ConnectionState, pins map[[sha256.Size]byte]bool) error {
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+				return nil
+			}
+		}
+	}
+	return ErrSPKIPinMismatch{ServerName: cs.ServerName}
+}
+
+// SPKIHash is the pinned_spki value of cert's public key.
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// isTLSVerificationError reports whether err is the upstream's certificate
+// failing verification, as opposed to the connection failing.
+func isTLSVerificationError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var pinMismatch ErrSPKIPinMismatch
+	return errors.As(err, &verifyErr) || errors.As(err, &unknownAuthority) || errors.As(err, &invalid) ||
+		errors.As(err, &hostname) || errors.As(err, &pinMismatch)
+}
@@ -0,0 +1,166 @@
+package connectors
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/LamineKouissi/LHP/config"
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func writePEM(t *testing.T, path, typ string, b []byte) string {
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0o600))
+	return path
+}
+
+// writeClientCert writes a self-signed client certificate and its key.
+func writeClientCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "lhp-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return writePEM(t, filepath.Join(dir, "client.crt"), "CERTIFICATE", der), writePEM(t, filepath.Join(dir, "client.key"), "EC PRIVATE KEY", keyDer)
+}
+
+func get(cnx *HttpsConnector, url string) (*http.Response, error) {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	res := &http.Response{}
+	err := cnx.Process(context.Background(), req, res)
+	if err == nil {
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+	return res, err
+}
+
+func TestHttpsConnectorUpstreamTLS(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	caFile := writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", upstream.Certificate().Raw)
+	pin := SPKIHash(upstream.Certificate())
+	noSystemRoots := false
+
+	tests := []struct {
+		name    string
+		tls     map[string]config.UpstreamTLSConfig
+		wantErr bool
+	}{
+		{name: "Unknown CA", wantErr: true},
+		{name: "Private CA", tls: map[string]config.UpstreamTLSConfig{"127.0.0.1": {CAFiles: []string{caFile}}}},
+		{name: "Private CA only", tls: map[string]config.UpstreamTLSConfig{"127.0.0.1": {CAFiles: []string{caFile}, SystemRoots: &noSystemRoots, MinVersion: "1.3"}}},
+		{name: "Other host", tls: map[string]config.UpstreamTLSConfig{"*.example.com": {CAFiles: []string{caFile}}}, wantErr: true},
+		{name: "SNI override", tls: map[string]config.UpstreamTLSConfig{"127.0.0.1": {CAFiles: []string{caFile}, ServerName: "example.com"}}},
+		{name: "Wrong SNI", tls: map[string]config.UpstreamTLSConfig{"127.0.0.1": {CAFiles: []string{caFile}, ServerName: "other.test"}}, wantErr: true},
+		{name: "Pinned", tls: map[string]config.UpstreamTLSConfig{"127.0.0.1": {CAFiles: []string{caFile}, PinnedSPKI: []string{pin}}}},
+		{name: "Pin mismatch", tls: map[string]config.UpstreamTLSConfig{"127.0.0.1": {CAFiles: []string{caFile},
+			PinnedSPKI: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cnx, err := NewHttpsConnectorFromConfig(config.UpstreamConfig{TLS: tt.tls})
+			assert.NoError(t, err)
+			res, err := get(cnx, upstream.URL)
+			if !tt.wantErr {
+				assert.NoError(t, err)
+				assert.Equal(t, http.StatusOK, res.StatusCode)
+				return
+			}
+			pe, ok := filters.AsProxyError(err)
+			if assert.True(t, ok) {
+				assert.Equal(t, http.StatusBadGateway, pe.Status)
+				assert.False(t, pe.Retryable)
+				assert.Equal(t, "The upstream server's TLS certificate could not be verified.", pe.Message)
+			}
+		})
+	}
+}
+
+func TestHttpsConnectorClientCertificate(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	upstream.StartTLS()
+	defer upstream.Close()
+	dir := t.TempDir()
+	caFile := writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", upstream.Certificate().Raw)
+	certFile, keyFile := writeClientCert(t, dir)
+
+	cnx, _ := NewHttpsConnectorFromConfig(config.UpstreamConfig{TLS: map[string]config.UpstreamTLSConfig{
+		"127.0.0.1": {CAFiles: []string{caFile}},
+	}})
+	_, err := get(cnx, upstream.URL)
+	assert.Error(t, err, "no client certificate")
+
+	cnx, _ = NewHttpsConnectorFromConfig(config.UpstreamConfig{TLS: map[string]config.UpstreamTLSConfig{
+		"127.0.0.1": {CAFiles: []string{caFile}, CertFile: certFile, KeyFile: keyFile},
+	}})
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	res := &http.Response{}
+	assert.NoError(t, cnx.Process(context.Background(), req, res))
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "lhp-client", string(body))
+}
+
+func TestUpstreamTLSConfigErrors(t *testing.T) {
+	noSystemRoots := false
+	for name, cfg := range map[string]config.UpstreamTLSConfig{
+		"No roots":        {SystemRoots: &noSystemRoots},
+		"Missing CA file": {CAFiles: []string{"missing.crt"}},
+		"Missing cert":    {CertFile: "missing.crt", KeyFile: "missing.key"},
+		"Bad min version": {MinVersion: "1.4"},
+		"Bad cipher":      {CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		"Bad pin":         {PinnedSPKI: []string{"not-a-hash"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewHttpsConnectorFromConfig(config.UpstreamConfig{TLS: map[string]config.UpstreamTLSConfig{"example.com": cfg}})
+			assert.Error(t, err)
+		})
+	}
+	_, err := upstreamTLSConfig(config.UpstreamTLSConfig{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}})
+	assert.NoError(t, err)
+}
+
+func TestHttpsConnectorHostClients(t *testing.T) {
+	cnx, _ := NewHttpsConnectorFromConfig(config.UpstreamConfig{TLS: map[string]config.UpstreamTLSConfig{
+		"*.example.com":     {},
+		"*.api.example.com": {},
+		"api.example.com":   {},
+	}})
+	var patterns []string
+	for _, hc := range cnx.hostClients {
+		patterns = append(patterns, hc.pattern)
+	}
+	assert.Equal(t, []string{"api.example.com", "*.api.example.com", "*.example.com"}, patterns)
+	assert.Equal(t, cnx.client, cnx.clientFor("example.org"))
+	assert.Equal(t, cnx.hostClients[2].client, cnx.clientFor("www.example.com"))
+	assert.Equal(t, cnx.hostClients[1].client, cnx.clientFor("v1.api.example.com"))
+}
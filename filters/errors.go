@@ -0,0 +1,163 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// StatusClientClosedRequest is logged for the requests the client aborted
+// before the response was ready, as nginx does.
+const StatusClientClosedRequest = 499
+
+// ErrorCategory tells who a failed request is to blame on.
+type ErrorCategory string
+
+const (
+	// the request itself is invalid
+	ErrorCategoryClient ErrorCategory = "client"
+	// the upstream could not be reached or did not answer
+	ErrorCategoryUpstream ErrorCategory = "upstream"
+	// the request was refused by the proxy's rules, e.g. an ACL or a rate limit
+	ErrorCategoryPolicy ErrorCategory = "policy"
+	// the proxy failed or is misconfigured
+	ErrorCategoryInternal ErrorCategory = "internal"
+)
+
+// ProxyError is a failed request as the client is told about it: the
+// status it is answered, the category of the failure, whether sending the
+// request again may succeed and a message safe to show the client. The
+// error causing it, which may hold internal details, is only logged.
+type ProxyError struct {
+	Status    int
+	Category  ErrorCategory
+	Retryable bool
+	Message   string
+	Err       error
+	// RetryAfter is sent as the Retry-After header when set, e.g. with a 429
+	RetryAfter time.Duration
+}
+
+func (e ProxyError) Error() string {
+	msg := string(e.Category) + " error " + strconv.Itoa(e.Status)
+	if e.Message != "" {
+		msg += " : " + e.Message
+	}
+	if e.Err != nil {
+		msg += " : " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the error is a timeout, e.g. an upstream which did not answer in time.
+func (e ProxyError) Timeout() bool {
+	return isTimeout(e.Err)
+}
+
+// NewUpstreamError is returned when the request to host fails: 504 Gateway
+// Timeout when the upstream did not answer in time, 502 Bad Gateway otherwise.
+func NewUpstreamError(host string, err error) ProxyError {
+	pe := ProxyError{
+		Status:    http.StatusBadGateway,
+		Category:  ErrorCategoryUpstream,
+		Retryable: true,
+		Message:   "The upstream server could not be reached.",
+		Err:       fmt.Errorf("upstream %s : %w", host, err),
+	}
+	if isTimeout(err) {
+		pe.Status = http.StatusGatewayTimeout
+		pe.Message = "The upstream server did not answer in time."
+	}
+	return pe
+}
+
+// NewUpstreamTLSError is returned when the upstream's certificate fails
+// verification, sending the request again will not fix it.
+func NewUpstreamTLSError(host string, err error) ProxyError {
+	return ProxyError{
+		Status:   http.StatusBadGateway,
+		Category: ErrorCategoryUpstream,
+		Message:  "The upstream server's TLS certificate could not be verified.",
+		Err:      fmt.Errorf("upstream %s : TLS verification failed : %w", host, err),
+	}
+}
+
+// NewClientError is returned for invalid requests, status is a 4xx status.
+func NewClientError(status int, msg string, err error) ProxyError {
+	return ProxyError{Status: status, Category: ErrorCategoryClient, Message: msg, Err: err}
+}
+
+// NewPolicyError is returned when the proxy refuses a request, e.g. 403 Forbidden or 429 Too Many Requests.
+func NewPolicyError(status int, msg string) ProxyError {
+	return ProxyError{Status: status, Category: ErrorCategoryPolicy, Message: msg}
+}
+
+// NewRateLimitError is returned when a client is over a rate limit, it may
+// send the request again after retryAfter.
+func NewRateLimitError(retryAfter time.Duration) ProxyError {
+	return ProxyError{
+		Status:     http.StatusTooManyRequests,
+		Category:   ErrorCategoryPolicy,
+		Message:    "Too many requests, retry later.",
+		RetryAfter: retryAfter,
+	}
+}
+
+// NewInternalError is returned when the proxy itself fails, the client is answered 500.
+func NewInternalError(err error) ProxyError {
+	return ProxyError{
+		Status:   http.StatusInternalServerError,
+		Category: ErrorCategoryInternal,
+		Message:  "The proxy failed to handle the request.",
+		Err:      err,
+	}
+}
+
+// ErrNoNextFilter is returned by a filter of a chain without connector, the client is answered 503.
+func ErrNoNextFilter(filterName string) ProxyError {
+	return ProxyError{
+		Status:   http.StatusServiceUnavailable,
+		Category: ErrorCategoryInternal,
+		Message:  "The service is unavailable.",
+		Err:      errors.New(filterName + " : nextFilter = <nil>"),
+	}
+}
+
+// AsProxyError finds the first ProxyError in err's chain.
+func AsProxyError(err error) (ProxyError, bool) {
+	var pe ProxyError
+	ok := errors.As(err, &pe)
+	return pe, ok
+}
+
+// ToProxyError is the ProxyError in err's chain, or an internal error wrapping err when there is none.
+func ToProxyError(err error) ProxyError {
+	if pe, ok := AsProxyError(err); ok {
+		return pe
+	}
+	return NewInternalError(err)
+}
+
+// StatusForError is the status a client is answered when the filter chain returns err.
+func StatusForError(err error) int {
+	return ToProxyError(err).Status
+}
+
+// IsRetryable reports whether the request failing with err may succeed if sent again.
+func IsRetryable(err error) bool {
+	pe, ok := AsProxyError(err)
+	return ok && pe.Retryable
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
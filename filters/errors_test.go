@@ -0,0 +1,68 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+var _ net.Error = timeoutErr{}
+
+func TestProxyError(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantStatus    int
+		wantCategory  ErrorCategory
+		wantRetryable bool
+	}{
+		{name: "Upstream refused", err: NewUpstreamError("example.com", errors.New("connection refused")),
+			wantStatus: http.StatusBadGateway, wantCategory: ErrorCategoryUpstream, wantRetryable: true},
+		{name: "Upstream timeout", err: NewUpstreamError("example.com", &url.Error{Op: "Get", URL: "http://example.com", Err: timeoutErr{}}),
+			wantStatus: http.StatusGatewayTimeout, wantCategory: ErrorCategoryUpstream, wantRetryable: true},
+		{name: "Upstream deadline", err: NewUpstreamError("example.com", context.DeadlineExceeded),
+			wantStatus: http.StatusGatewayTimeout, wantCategory: ErrorCategoryUpstream, wantRetryable: true},
+		{name: "Wrapped upstream timeout", err: fmt.Errorf("cache : %w", NewUpstreamError("example.com", context.DeadlineExceeded)),
+			wantStatus: http.StatusGatewayTimeout, wantCategory: ErrorCategoryUpstream, wantRetryable: true},
+		{name: "Client", err: NewClientError(http.StatusBadRequest, "bad request", nil),
+			wantStatus: http.StatusBadRequest, wantCategory: ErrorCategoryClient},
+		{name: "Policy", err: NewPolicyError(http.StatusForbidden, "denied"),
+			wantStatus: http.StatusForbidden, wantCategory: ErrorCategoryPolicy},
+		{name: "No next filter", err: ErrNoNextFilter("MetricsFilter"),
+			wantStatus: http.StatusServiceUnavailable, wantCategory: ErrorCategoryInternal},
+		{name: "Other", err: errors.New("boom"),
+			wantStatus: http.StatusInternalServerError, wantCategory: ErrorCategoryInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pe := ToProxyError(tt.err)
+			assert.Equal(t, tt.wantStatus, pe.Status)
+			assert.Equal(t, tt.wantStatus, StatusForError(tt.err))
+			assert.Equal(t, tt.wantCategory, pe.Category)
+			assert.Equal(t, tt.wantRetryable, IsRetryable(tt.err))
+			assert.True(t, errors.Is(pe, pe.Err) || pe.Err == nil)
+		})
+	}
+}
+
+func TestProxyErrorUnwrap(t *testing.T) {
+	err := NewUpstreamError("example.com", context.DeadlineExceeded)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, err.Timeout())
+	assert.Equal(t, "upstream error 504 : The upstream server did not answer in time. : upstream example.com : context deadline exceeded", err.Error())
+
+	_, ok := AsProxyError(errors.New("boom"))
+	assert.False(t, ok)
+}
@@ -2,7 +2,9 @@ package filters
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"strings"
 )
 
 func ConstructFilterChain(cnx context.Context, filters []HasNextFilter, connector Filter) (Filter, error) {
@@ -16,6 +18,35 @@ func ConstructFilterChain(cnx context.Context, filters []HasNextFilter, connecto
 	return headFilter, nil
 }
 
+// FilterWrapper decorates the filters of a chain, e.g. Tracer.Wrap.
+type FilterWrapper func(f Filter) Filter
+
+// ConstructWrappedFilterChain builds the chain like ConstructFilterChain, each
+// filter after the head being wrapped before it is set as the next filter.
+func ConstructWrappedFilterChain(cnx context.Context, filters []HasNextFilter, connector Filter, wrap FilterWrapper) (Filter, error) {
+	if wrap == nil {
+		return ConstructFilterChain(cnx, filters, connector)
+	}
+	headFilter := wrap(connector)
+
+	for i := len(filters) - 1; i >= 0; i-- {
+		if err := filters[i].SetNextFilter(headFilter); err != nil {
+			return nil, err
+		}
+		headFilter = filters[i].(Filter)
+		if i > 0 {
+			headFilter = wrap(headFilter)
+		}
+	}
+	return headFilter, nil
+}
+
+// FilterName names f after its type, e.g. "cacheMgrFilter".
+func FilterName(f Filter) string {
+	name := fmt.Sprintf("%T", f)
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
 type Filter interface {
 	Process(ctx context.Context, req *http.Request, res *http.Response) error
 }
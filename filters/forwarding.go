@@ -0,0 +1,164 @@
+package filters
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultViaPseudonym names the proxy in Via when the host name is no token.
+const DefaultViaPseudonym = "lhp"
+
+// the forwarding headers of the previous hops
+var forwardingHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"}
+
+// Forwarding sets how the proxy tells the upstreams who the requests come
+// from. It appends itself to the Forwarded (RFC 7239) and X-Forwarded-For
+// headers of the requests, and to the Via header of the requests and of the
+// responses as Pseudonym; a request whose Via already holds Pseudonym went
+// round in a loop and is answered 508, so each proxy of a chain needs its own.
+// The forwarding headers of the requests are kept when they come from
+// TrustedProxies, or from anyone with TrustAll, and removed otherwise: a
+// client could claim any origin with them. With
+// Privacy the client IPs are left out: the requests go upstream with
+// "for=unknown" and without the forwarding headers of the previous hops.
+type Forwarding struct {
+	Pseudonym      string
+	TrustAll       bool
+	TrustedProxies []netip.Prefix
+	Privacy        bool
+}
+
+// DefaultForwarding trusts the forwarding headers of no client and names
+// the proxy after its host.
+func DefaultForwarding() Forwarding {
+	return Forwarding{Pseudonym: defaultPseudonym()}
+}
+
+func defaultPseudonym() string {
+	if host, err := os.Hostname(); err == nil && validHeaderName(host) {
+		return host
+	}
+	return DefaultViaPseudonym
+}
+
+// Validate returns the error SetForwarding would, without setting anything.
+func (f Forwarding) Validate() error {
+	if !validHeaderName(f.Pseudonym) {
+		return errors.New("invalid Via pseudonym : " + strconv.Quote(f.Pseudonym))
+	}
+	return nil
+}
+
+func (f Forwarding) trusted(peer netip.Addr) bool {
+	if f.TrustAll {
+		return true
+	}
+	for _, p := range f.TrustedProxies {
+		if p.Contains(peer.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// forward checks req for a loop, then sets its forwarding and Via headers.
+func (hmt *HttpMsgTransformerFilter) forward(f Forwarding, req *http.Request) error {
+	if f.Pseudonym != "" && viaContains(req.Header, f.Pseudonym) {
+		return ProxyError{
+			Status:   http.StatusLoopDetected,
+			Category: ErrorCategoryInternal,
+			Message:  "The request went round in a loop through the proxy.",
+			Err:      errors.New("loop detected : Via holds " + f.Pseudonym + " for " + req.Host),
+		}
+	}
+
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	peerIP := clientIP(req)
+	peer, err := netip.ParseAddr(peerIP)
+	if f.Privacy || !(f.TrustAll || (err == nil && f.trusted(peer))) {
+		for _, h := range forwardingHeaders {
+			req.Header.Del(h)
+		}
+	}
+
+	node := "unknown"
+	if !f.Privacy && err == nil {
+		hmt.appendHostToXForwardHeader(req.Header, peerIP)
+		node = peerIP
+		if peer.Is6() && !peer.Is4In6() {
+			node = "[" + peerIP + "]"
+		}
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	element := "for=" + forwardedValue(node)
+	if req.Host != "" {
+		element += ";host=" + forwardedValue(req.Host)
+	}
+	element += ";proto=" + proto
+	appendListHeader(req.Header, "Forwarded", element)
+
+	if f.Pseudonym != "" {
+		appendListHeader(req.Header, "Via", viaProtocol(req.ProtoMajor, req.ProtoMinor)+" "+f.Pseudonym)
+	}
+	return nil
+}
+
+// forwardResponse appends the proxy to the Via header of res.
+func (f Forwarding) forwardResponse(res *http.Response) {
+	if f.Pseudonym == "" {
+		return
+	}
+	if res.Header == nil {
+		res.Header = http.Header{}
+	}
+	appendListHeader(res.Header, "Via", viaProtocol(res.ProtoMajor, res.ProtoMinor)+" "+f.Pseudonym)
+}
+
+// viaProtocol is the protocol version of a message as Via has it, RFC 9110 7.6.3.
+func viaProtocol(major, minor int) string {
+	switch {
+	case major == 0:
+		return "1.1"
+	case major >= 2 && minor == 0:
+		return strconv.Itoa(major)
+	}
+	return strconv.Itoa(major) + "." + strconv.Itoa(minor)
+}
+
+// viaContains reports whether one of the Via entries of h was received by pseudonym.
+func viaContains(h http.Header, pseudonym string) bool {
+	for _, v := range h.Values("Via") {
+		for _, entry := range strings.Split(v, ",") {
+			// protocol received-by [comment]
+			fields := strings.Fields(entry)
+			if len(fields) >= 2 && strings.EqualFold(fields[1], pseudonym) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func appendListHeader(h http.Header, name, value string) {
+	if prior := h.Values(name); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	h.Set(name, value)
+}
+
+// forwardedValue quotes v when it is no token, as "[2001:db8::1]" or "example.com:8080" have to be.
+func forwardedValue(v string) string {
+	if validHeaderName(v) {
+		return v
+	}
+	return strconv.Quote(v)
+}
@@ -0,0 +1,139 @@
+package filters
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardingRequestHeaders(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		name          string
+		forwarding    Forwarding
+		remoteAddr    string
+		tls           bool
+		header        http.Header
+		wantXFF       string
+		wantForwarded string
+		wantXFHost    string
+		wantVia       string
+	}{
+		{
+			name:          "Trust all",
+			forwarding:    Forwarding{Pseudonym: "proxy-a", TrustAll: true},
+			remoteAddr:    "192.0.2.1:1234",
+			header:        http.Header{"X-Forwarded-For": {"198.51.100.7"}, "Forwarded": {"for=198.51.100.7"}, "Via": {"1.1 edge"}},
+			wantXFF:       "198.51.100.7, 192.0.2.1",
+			wantForwarded: "for=198.51.100.7, for=192.0.2.1;host=example.com;proto=http",
+			wantVia:       "1.1 edge, 1.1 proxy-a",
+		},
+		{
+			name:          "Untrusted client",
+			forwarding:    Forwarding{Pseudonym: "proxy-a", TrustedProxies: trusted},
+			remoteAddr:    "192.0.2.1:1234",
+			header:        http.Header{"X-Forwarded-For": {"127.0.0.1"}, "Forwarded": {"for=127.0.0.1"}, "X-Forwarded-Host": {"admin"}},
+			wantXFF:       "192.0.2.1",
+			wantForwarded: "for=192.0.2.1;host=example.com;proto=http",
+			wantVia:       "1.1 proxy-a",
+		},
+		{
+			name:          "Trusted proxy",
+			forwarding:    Forwarding{Pseudonym: "proxy-a", TrustedProxies: trusted},
+			remoteAddr:    "10.1.2.3:1234",
+			header:        http.Header{"X-Forwarded-For": {"192.0.2.1"}, "X-Forwarded-Host": {"www.example.com"}},
+			wantXFF:       "192.0.2.1, 10.1.2.3",
+			wantForwarded: "for=10.1.2.3;host=example.com;proto=http",
+			wantXFHost:    "www.example.com",
+			wantVia:       "1.1 proxy-a",
+		},
+		{
+			name:          "Privacy",
+			forwarding:    Forwarding{Pseudonym: "proxy-a", TrustAll: true, Privacy: true},
+			remoteAddr:    "192.0.2.1:1234",
+			header:        http.Header{"X-Forwarded-For": {"198.51.100.7"}},
+			wantForwarded: "for=unknown;host=example.com;proto=http",
+			wantVia:       "1.1 proxy-a",
+		},
+		{
+			name:          "IPv6 client over TLS",
+			forwarding:    Forwarding{Pseudonym: "proxy-a", TrustAll: true},
+			remoteAddr:    "[2001:db8::1]:1234",
+			tls:           true,
+			header:        http.Header{},
+			wantXFF:       "2001:db8::1",
+			wantForwarded: `for="[2001:db8::1]";host=example.com;proto=https`,
+			wantVia:       "1.1 proxy-a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header = tt.header
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			hmt := &HttpMsgTransformerFilter{}
+			assert.NoError(t, hmt.forward(tt.forwarding, req))
+			assert.Equal(t, tt.wantXFF, req.Header.Get("X-Forwarded-For"))
+			assert.Equal(t, tt.wantForwarded, req.Header.Get("Forwarded"))
+			assert.Equal(t, tt.wantXFHost, req.Header.Get("X-Forwarded-Host"))
+			assert.Equal(t, tt.wantVia, req.Header.Get("Via"))
+		})
+	}
+}
+
+func TestDefaultForwardingStripsUntrustedHeaders(t *testing.T) {
+	var got *http.Request
+	hmt, _ := NewHttpMsgTransformerFilter(&MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		got = req
+		return nil
+	}})
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Forwarded", "for=127.0.0.1")
+	req.Header.Set("X-Forwarded-For", "127.0.0.1")
+	assert.NoError(t, hmt.Process(context.Background(), req, &http.Response{}))
+	assert.Equal(t, "for=192.0.2.1;host=example.com;proto=http", got.Header.Get("Forwarded"))
+	assert.Equal(t, "192.0.2.1", got.Header.Get("X-Forwarded-For"))
+}
+
+func TestForwardingLoop(t *testing.T) {
+	var called bool
+	hmt, _ := NewHttpMsgTransformerFilter(&MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		called = true
+		res.StatusCode = http.StatusOK
+		res.ProtoMajor, res.ProtoMinor = 2, 0
+		return nil
+	}})
+	assert.NoError(t, hmt.SetForwarding(Forwarding{Pseudonym: "proxy-a", TrustAll: true}))
+	rh, _ := NewResponseHeadersFilter(hmt)
+	rh.SetNextFilter(hmt)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Via", "1.1 proxy-b, 1.0 Proxy-A (lhp)")
+	err := rh.Process(context.Background(), req, &http.Response{})
+	assert.Equal(t, http.StatusLoopDetected, StatusForError(err))
+	assert.False(t, called)
+
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Via", "1.1 proxy-b")
+	res := &http.Response{}
+	assert.NoError(t, rh.Process(context.Background(), req, res))
+	assert.True(t, called)
+	assert.Equal(t, "2 proxy-a", res.Header.Get("Via"))
+}
+
+func TestSetForwarding(t *testing.T) {
+	hmt, _ := NewHttpMsgTransformerFilter(&mockFilter{})
+	assert.NotEmpty(t, hmt.forwarding.Pseudonym)
+	assert.False(t, hmt.forwarding.TrustAll)
+	assert.Empty(t, hmt.forwarding.TrustedProxies)
+	assert.Error(t, hmt.SetForwarding(Forwarding{}))
+	assert.Error(t, hmt.SetForwarding(Forwarding{Pseudonym: "proxy a"}))
+}
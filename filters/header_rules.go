@@ -0,0 +1,234 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// what a HeaderRule does to its header
+const (
+	HeaderActionAdd    = "add"
+	HeaderActionSet    = "set"
+	HeaderActionRemove = "remove"
+	HeaderActionRename = "rename"
+)
+
+// HeaderRule adds a value to the header Name, sets it, removes it or
+// renames it NewName, keeping its values. Value is a template in which
+// ${client_ip}, ${principal}, ${request_id}, ${time} (RFC 3339, UTC),
+// ${host}, ${path} and ${method} stand for those of the request.
+// The rule only applies to the requests to Host (see MatchHost) under
+// PathPrefix and, for response rules, to the responses with one of Statuses;
+// empty conditions match everything.
+type HeaderRule struct {
+	Action     string
+	Name       string
+	Value      string
+	NewName    string
+	Host       string
+	PathPrefix string
+	Statuses   []int
+}
+
+// HeaderRules are the rules applied in order to the requests before they
+// are sent upstream, and to the responses, cache hits included, before they
+// go back to the client.
+type HeaderRules struct {
+	Request  []HeaderRule
+	Response []HeaderRule
+}
+
+type compiledHeaderRule struct {
+	HeaderRule
+	value headerTemplate
+}
+
+type compiledHeaderRules struct {
+	request  []compiledHeaderRule
+	response []compiledHeaderRule
+}
+
+func compileHeaderRules(hr HeaderRules) (compiledHeaderRules, error) {
+	var compiled compiledHeaderRules
+	for i, r := range hr.Request {
+		if len(r.Statuses) > 0 {
+			return compiled, fmt.Errorf("request header rule %d : statuses only apply to responses", i)
+		}
+		cr, err := compileHeaderRule(r)
+		if err != nil {
+			return compiled, fmt.Errorf("request header rule %d : %w", i, err)
+		}
+		compiled.request = append(compiled.request, cr)
+	}
+	for i, r := range hr.Response {
+		cr, err := compileHeaderRule(r)
+		if err != nil {
+			return compiled, fmt.Errorf("response header rule %d : %w", i, err)
+		}
+		compiled.response = append(compiled.response, cr)
+	}
+	return compiled, nil
+}
+
+func compileHeaderRule(r HeaderRule) (compiledHeaderRule, error) {
+	if !validHeaderName(r.Name) {
+		return compiledHeaderRule{}, fmt.Errorf("invalid header name %q", r.Name)
+	}
+	cr := compiledHeaderRule{HeaderRule: r}
+	switch r.Action {
+	case HeaderActionAdd, HeaderActionSet:
+		value, err := parseHeaderTemplate(r.Value)
+		if err != nil {
+			return cr, err
+		}
+		cr.value = value
+	case HeaderActionRemove:
+	case HeaderActionRename:
+		if !validHeaderName(r.NewName) {
+			return cr, fmt.Errorf("invalid new header name %q", r.NewName)
+		}
+	default:
+		return cr, errors.New("invalid header action : " + r.Action)
+	}
+	return cr, nil
+}
+
+// validHeaderName reports whether name is an RFC 9110 token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c >= 0x7f || c <= ' ' || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cr compiledHeaderRule) match(req *http.Request, status int) bool {
+	if cr.Host != "" && !MatchHost(cr.Host, RequestHost(req)) {
+		return false
+	}
+	if cr.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, cr.PathPrefix) {
+		return false
+	}
+	if len(cr.Statuses) == 0 {
+		return true
+	}
+	for _, s := range cr.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (cr compiledHeaderRule) apply(ctx context.Context, req *http.Request, h http.Header) {
+	switch cr.Action {
+	case HeaderActionAdd:
+		h.Add(cr.Name, cr.value.expand(ctx, req))
+	case HeaderActionSet:
+		h.Set(cr.Name, cr.value.expand(ctx, req))
+	case HeaderActionRemove:
+		h.Del(cr.Name)
+	case HeaderActionRename:
+		values := h.Values(cr.Name)
+		if len(values) == 0 {
+			return
+		}
+		values = append([]string(nil), values...)
+		h.Del(cr.Name)
+		h[http.CanonicalHeaderKey(cr.NewName)] = values
+	}
+}
+
+// applyHeaderRules applies the matching rules to h, the header of req or of
+// its response with status.
+func applyHeaderRules(ctx context.Context, rules []compiledHeaderRule, req *http.Request, status int, h http.Header) {
+	for _, cr := range rules {
+		if cr.match(req, status) {
+			cr.apply(ctx, req, h)
+		}
+	}
+}
+
+// headerTemplate is a header value made of literal parts and variables.
+type headerTemplate []templatePart
+
+type templatePart struct {
+	literal  string
+	variable string
+}
+
+var headerTemplateVariables = map[string]func(ctx context.Context, req *http.Request) string{
+	"client_ip": func(ctx context.Context, req *http.Request) string {
+		if info, ok := RequestInfoFromCtx(ctx); ok {
+			return info.ClientIP
+		}
+		return clientIP(req)
+	},
+	"principal": func(ctx context.Context, req *http.Request) string {
+		principal, _ := AuthFromCtx(ctx)
+		return principal
+	},
+	"request_id": func(ctx context.Context, req *http.Request) string {
+		if info, ok := RequestInfoFromCtx(ctx); ok {
+			return info.ID
+		}
+		return ""
+	},
+	"time": func(ctx context.Context, req *http.Request) string {
+		return time.Now().UTC().Format(time.RFC3339)
+	},
+	"host":   func(ctx context.Context, req *http.Request) string { return RequestHost(req) },
+	"path":   func(ctx context.Context, req *http.Request) string { return req.URL.Path },
+	"method": func(ctx context.Context, req *http.Request) string { return req.Method },
+}
+
+func parseHeaderTemplate(s string) (headerTemplate, error) {
+	var t headerTemplate
+	for s != "" {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			t = append(t, templatePart{literal: s})
+			break
+		}
+		if i > 0 {
+			t = append(t, templatePart{literal: s[:i]})
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated variable in header value %q", s)
+		}
+		name := s[i+2 : i+end]
+		if _, ok := headerTemplateVariables[name]; !ok {
+			return nil, fmt.Errorf("unknown variable ${%s} in header value", name)
+		}
+		t = append(t, templatePart{variable: name})
+		s = s[i+end+1:]
+	}
+	return t, nil
+}
+
+func (t headerTemplate) expand(ctx context.Context, req *http.Request) string {
+	var b strings.Builder
+	for _, p := range t {
+		if p.variable == "" {
+			b.WriteString(p.literal)
+			continue
+		}
+		// a variable, e.g. the principal, must not split the header
+		b.WriteString(strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, headerTemplateVariables[p.variable](ctx, req)))
+	}
+	return b.String()
+}
@@ -0,0 +1,181 @@
+package filters
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderRulesApply(t *testing.T) {
+	tests := []struct {
+		name       string
+		rule       HeaderRule
+		url        string
+		status     int
+		header     http.Header
+		wantHeader http.Header
+	}{
+		{
+			name:       "Add",
+			rule:       HeaderRule{Action: HeaderActionAdd, Name: "X-Tag", Value: "b"},
+			header:     http.Header{"X-Tag": {"a"}},
+			wantHeader: http.Header{"X-Tag": {"a", "b"}},
+		},
+		{
+			name:       "Set with variables",
+			rule:       HeaderRule{Action: HeaderActionSet, Name: "X-Client", Value: "${client_ip} as ${principal} (${request_id}) ${method} ${host}${path}"},
+			header:     http.Header{"X-Client": {"forged"}},
+			wantHeader: http.Header{"X-Client": {"192.0.2.1 as alice (req-1) GET example.com/api/users"}},
+		},
+		{
+			name:       "Remove",
+			rule:       HeaderRule{Action: HeaderActionRemove, Name: "x-secret"},
+			header:     http.Header{"X-Secret": {"a"}, "Accept": {"*/*"}},
+			wantHeader: http.Header{"Accept": {"*/*"}},
+		},
+		{
+			name:       "Rename",
+			rule:       HeaderRule{Action: HeaderActionRename, Name: "X-Old", NewName: "x-new"},
+			header:     http.Header{"X-Old": {"a", "b"}, "X-New": {"c"}},
+			wantHeader: http.Header{"X-New": {"a", "b"}},
+		},
+		{
+			name:       "Rename a missing header",
+			rule:       HeaderRule{Action: HeaderActionRename, Name: "X-Old", NewName: "X-New"},
+			header:     http.Header{"X-New": {"c"}},
+			wantHeader: http.Header{"X-New": {"c"}},
+		},
+		{
+			name:       "Host matches",
+			rule:       HeaderRule{Action: HeaderActionSet, Name: "X-Tag", Value: "a", Host: "*.example.com"},
+			url:        "http://www.example.com/",
+			header:     http.Header{},
+			wantHeader: http.Header{"X-Tag": {"a"}},
+		},
+		{
+			name:       "Host does not match",
+			rule:       HeaderRule{Action: HeaderActionSet, Name: "X-Tag", Value: "a", Host: "*.example.com"},
+			header:     http.Header{},
+			wantHeader: http.Header{},
+		},
+		{
+			name:       "Path does not match",
+			rule:       HeaderRule{Action: HeaderActionSet, Name: "X-Tag", Value: "a", PathPrefix: "/static"},
+			header:     http.Header{},
+			wantHeader: http.Header{},
+		},
+		{
+			name:       "Status matches",
+			rule:       HeaderRule{Action: HeaderActionSet, Name: "Cache-Control", Value: "no-store", Statuses: []int{404, 500}},
+			status:     404,
+			header:     http.Header{},
+			wantHeader: http.Header{"Cache-Control": {"no-store"}},
+		},
+		{
+			name:       "Status does not match",
+			rule:       HeaderRule{Action: HeaderActionSet, Name: "Cache-Control", Value: "no-store", Statuses: []int{404, 500}},
+			status:     200,
+			header:     http.Header{},
+			wantHeader: http.Header{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := tt.url
+			if url == "" {
+				url = "http://example.com/api/users"
+			}
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			ctx := WithPrincipal(context.Background(), "alice", nil)
+			ctx = WithRequestInfo(ctx, &RequestInfo{ID: "req-1", ClientIP: "192.0.2.1"})
+
+			cr, err := compileHeaderRule(tt.rule)
+			assert.NoError(t, err)
+			applyHeaderRules(ctx, []compiledHeaderRule{cr}, req, tt.status, tt.header)
+			assert.Equal(t, tt.wantHeader, tt.header)
+		})
+	}
+}
+
+func TestHeaderTemplate(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	tmpl, err := parseHeaderTemplate("at ${time}")
+	assert.NoError(t, err)
+	got := tmpl.expand(context.Background(), req)
+	_, err = time.Parse(time.RFC3339, got[len("at "):])
+	assert.NoError(t, err)
+
+	tmpl, _ = parseHeaderTemplate("${client_ip}/${principal}")
+	assert.Equal(t, "192.0.2.1/", tmpl.expand(context.Background(), req), "anonymous and without RequestInfo")
+
+	tmpl, _ = parseHeaderTemplate("${principal}")
+	ctx := WithPrincipal(context.Background(), "eve\r\nX-Admin: 1", nil)
+	assert.Equal(t, "eveX-Admin: 1", tmpl.expand(ctx, req))
+
+	for _, invalid := range []string{"${nope}", "${client_ip", "a ${} b"} {
+		_, err := parseHeaderTemplate(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestSetHeaderRules(t *testing.T) {
+	var got *http.Request
+	hmt, _ := NewHttpMsgTransformerFilter(&MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		got = req
+		res.StatusCode = http.StatusOK
+		res.Header = http.Header{"Server": {"nginx"}}
+		return nil
+	}})
+	assert.NoError(t, hmt.SetHeaderRules(
+		HeaderRules{
+			Request:  []HeaderRule{{Action: HeaderActionSet, Name: "X-Default", Value: "1"}},
+			Response: []HeaderRule{{Action: HeaderActionRemove, Name: "Server"}},
+		},
+		map[string]HeaderRules{
+			"api": {Request: []HeaderRule{{Action: HeaderActionSet, Name: "X-Route", Value: "api"}}},
+		},
+	))
+	rh, _ := NewResponseHeadersFilter(hmt)
+	rh.SetNextFilter(hmt)
+
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		wantDefault string
+		wantRoute   string
+		wantServer  string
+	}{
+		{name: "Default rules", ctx: WithRoute(context.Background(), "web"), wantDefault: "1"},
+		{name: "No route", ctx: context.Background(), wantDefault: "1"},
+		{name: "Route rules replace the defaults", ctx: WithRoute(context.Background(), "api"), wantRoute: "api", wantServer: "nginx"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+			res := &http.Response{}
+			assert.NoError(t, rh.Process(tt.ctx, req, res))
+			assert.Equal(t, tt.wantDefault, got.Header.Get("X-Default"))
+			assert.Equal(t, tt.wantRoute, got.Header.Get("X-Route"))
+			assert.Equal(t, tt.wantServer, res.Header.Get("Server"))
+		})
+	}
+
+	invalid := []HeaderRules{
+		{Request: []HeaderRule{{Action: "append", Name: "X-A"}}},
+		{Request: []HeaderRule{{Action: HeaderActionSet, Name: "X A"}}},
+		{Request: []HeaderRule{{Action: HeaderActionRename, Name: "X-A"}}},
+		{Request: []HeaderRule{{Action: HeaderActionSet, Name: "X-A", Statuses: []int{200}}}},
+		{Response: []HeaderRule{{Action: HeaderActionSet, Name: "X-A", Value: "${nope}"}}},
+	}
+	for _, rules := range invalid {
+		assert.Error(t, hmt.SetHeaderRules(rules, nil))
+		assert.Error(t, hmt.SetHeaderRules(HeaderRules{}, map[string]HeaderRules{"api": rules}))
+		assert.Error(t, ValidateHeaderRules(HeaderRules{}, map[string]HeaderRules{"api": rules}))
+	}
+}
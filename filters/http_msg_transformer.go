@@ -3,21 +3,26 @@ package filters
 import (
 	"context"
 	"errors"
-	"log"
-	"net"
+	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 )
 
 type HttpMsgTransformerFilter struct {
 	nextFilter Filter
+	mu         sync.RWMutex
+	forwarding Forwarding
+	// header rules, the routes with rules of their own do not get the defaults
+	headerDefaults compiledHeaderRules
+	headerRoutes   map[string]compiledHeaderRules
 }
 
 func NewHttpMsgTransformerFilter(nextF Filter) (*HttpMsgTransformerFilter, error) {
 	if nextF == nil {
 		return nil, errors.New("invalid input : nextFilter <nil>")
 	}
-	return &HttpMsgTransformerFilter{nextFilter: nextF}, nil
+	return &HttpMsgTransformerFilter{nextFilter: nextF, forwarding: DefaultForwarding()}, nil
 }
 
 func (hmt *HttpMsgTransformerFilter) SetNextFilter(nextF Filter) error {
@@ -28,23 +33,93 @@ func (hmt *HttpMsgTransformerFilter) SetNextFilter(nextF Filter) error {
 	return nil
 }
 
+// SetForwarding sets how the requests tell where they come from, it can be
+// called again on config reload.
+func (hmt *HttpMsgTransformerFilter) SetForwarding(f Forwarding) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	hmt.mu.Lock()
+	defer hmt.mu.Unlock()
+	hmt.forwarding = f
+	return nil
+}
+
+// SetHeaderRules sets the default header rules and those of the routes, it
+// can be called again on config reload.
+func (hmt *HttpMsgTransformerFilter) SetHeaderRules(defaults HeaderRules, routes map[string]HeaderRules) error {
+	compiledDefaults, compiledRoutes, err := compileHeaderRuleSets(defaults, routes)
+	if err != nil {
+		return err
+	}
+	hmt.mu.Lock()
+	defer hmt.mu.Unlock()
+	hmt.headerDefaults, hmt.headerRoutes = compiledDefaults, compiledRoutes
+	return nil
+}
+
+// ValidateHeaderRules returns the error SetHeaderRules would, without setting anything.
+func ValidateHeaderRules(defaults HeaderRules, routes map[string]HeaderRules) error {
+	_, _, err := compileHeaderRuleSets(defaults, routes)
+	return err
+}
+
+func compileHeaderRuleSets(defaults HeaderRules, routes map[string]HeaderRules) (compiledHeaderRules, map[string]compiledHeaderRules, error) {
+	compiledDefaults, err := compileHeaderRules(defaults)
+	if err != nil {
+		return compiledHeaderRules{}, nil, err
+	}
+	compiledRoutes := make(map[string]compiledHeaderRules, len(routes))
+	for route, rules := range routes {
+		compiled, err := compileHeaderRules(rules)
+		if err != nil {
+			return compiledHeaderRules{}, nil, fmt.Errorf("route %s : %w", route, err)
+		}
+		compiledRoutes[route] = compiled
+	}
+	return compiledDefaults, compiledRoutes, nil
+}
+
+func (hmt *HttpMsgTransformerFilter) settingsFor(ctx context.Context) (Forwarding, compiledHeaderRules) {
+	hmt.mu.RLock()
+	defer hmt.mu.RUnlock()
+	if route, ok := RouteFromCtx(ctx); ok {
+		if rules, ok := hmt.headerRoutes[route]; ok {
+			return hmt.forwarding, rules
+		}
+	}
+	return hmt.forwarding, hmt.headerDefaults
+}
+
 func (hmt *HttpMsgTransformerFilter) Process(ctx context.Context, req *http.Request, res *http.Response) error {
 
+	if hmt.nextFilter == nil {
+		return ErrNoNextFilter("HttpMsgTransformerFilter")
+	}
+
 	req, err := hmt.transformReqFromSourceToTarget(req)
 	if err != nil {
-		log.Fatal("Err: Faild to Transform Req From Source To Target: ", err)
 		return err
 	}
+	// the response side of the settings is applied by a ResponseHeadersFilter
+	forwarding, rules := hmt.settingsFor(ctx)
+	if err := hmt.forward(forwarding, req); err != nil {
+		return err
+	}
+	if len(rules.request) > 0 {
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+		applyHeaderRules(ctx, rules.request, req, 0, req.Header)
+	}
 
-	hmt.nextFilter.Process(ctx, req, res)
+	err = hmt.nextFilter.Process(ctx, req, res)
 	if err != nil {
-		log.Fatal("Err: Faild to Call Process() on HttpMsgTransformer.nextFilter", err)
 		return err
 	}
 
 	res, err = hmt.transformResFromTargetToSource(res)
 	if err != nil {
-		log.Fatal("Err: Faild to Transform Res From Target To Source: ", err)
 		return err
 	}
 
@@ -53,19 +128,22 @@ func (hmt *HttpMsgTransformerFilter) Process(ctx context.Context, req *http.Requ
 
 func (hmt *HttpMsgTransformerFilter) transformReqFromSourceToTarget(sourceReq *http.Request) (trgtReq *http.Request, trsfrmErr error) {
 	sourceReq.RequestURI = ""
-	hmt.removeHopHeaders(sourceReq.Header)
+	upgrade := UpgradeType(sourceReq.Header)
 	hmt.removeConnectionHeaders(sourceReq.Header)
-
-	if clientIP, _, err := net.SplitHostPort(sourceReq.RemoteAddr); err == nil {
-		hmt.appendHostToXForwardHeader(sourceReq.Header, clientIP)
-	}
+	hmt.removeHopHeaders(sourceReq.Header)
+	setUpgradeHeaders(sourceReq.Header, upgrade)
 	trgtReq = sourceReq
 	return trgtReq, nil
 }
 
 func (hmt *HttpMsgTransformerFilter) transformResFromTargetToSource(targetRes *http.Response) (sourceRes *http.Response, trnsfrmError error) {
-	hmt.removeHopHeaders(targetRes.Header)
+	var upgrade string
+	if targetRes.StatusCode == http.StatusSwitchingProtocols {
+		upgrade = UpgradeType(targetRes.Header)
+	}
 	hmt.removeConnectionHeaders(targetRes.Header)
+	hmt.removeHopHeaders(targetRes.Header)
+	setUpgradeHeaders(targetRes.Header, upgrade)
 	sourceRes = targetRes
 	return sourceRes, nil
 }
@@ -97,6 +175,34 @@ func (hmt *HttpMsgTransformerFilter) removeConnectionHeaders(h http.Header) {
 	}
 }
 
+// UpgradeType returns the protocol a request asks to switch to, or a 101
+// response switches to, e.g. "websocket"; "" when the message is no upgrade.
+func UpgradeType(h http.Header) string {
+	for _, f := range h["Connection"] {
+		for _, sf := range strings.Split(f, ",") {
+			if strings.EqualFold(strings.TrimSpace(sf), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// IsUpgradeRequest reports whether req asks to switch protocols, see UpgradeType.
+func IsUpgradeRequest(req *http.Request) bool {
+	return UpgradeType(req.Header) != ""
+}
+
+// setUpgradeHeaders puts back the hop-by-hop headers of an upgrade, the
+// upgrade has to go through to the upstream and its 101 back to the client.
+func setUpgradeHeaders(h http.Header, upgrade string) {
+	if upgrade == "" {
+		return
+	}
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", upgrade)
+}
+
 func (hmt *HttpMsgTransformerFilter) appendHostToXForwardHeader(header http.Header, host string) {
 	if prior, ok := header["X-Forwarded-For"]; ok {
 		host = strings.Join(prior, ", ") + ", " + host
@@ -353,3 +353,82 @@ func TestAppendHostToXForwardHeader(t *testing.T) {
 		})
 	}
 }
+
+type errFilter struct {
+	err error
+}
+
+func (ef *errFilter) Process(ctx context.Context, req *http.Request, res *http.Response) error {
+	return ef.err
+}
+
+func TestHttpMsgTransformerFilterProcessError(t *testing.T) {
+	upstreamErr := NewUpstreamError("example.com", errors.New("connection reset by peer"))
+	transformer, _ := NewHttpMsgTransformerFilter(&errFilter{err: upstreamErr})
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+
+	err := transformer.Process(context.Background(), req, &http.Response{})
+	assert.Equal(t, upstreamErr, err)
+
+	err = (&HttpMsgTransformerFilter{}).Process(context.Background(), req, &http.Response{})
+	assert.Equal(t, http.StatusServiceUnavailable, StatusForError(err))
+}
+
+func TestHttpMsgTransformerFilterUpgradeHeaders(t *testing.T) {
+	tests := []struct {
+		name           string
+		reqHeader      http.Header
+		resStatus      int
+		resHeader      http.Header
+		wantReqUpgrade string
+		wantResUpgrade string
+	}{
+		{
+			name:           "WebSocket",
+			reqHeader:      http.Header{"Connection": {"keep-alive, Upgrade"}, "Upgrade": {"websocket"}, "Keep-Alive": {"timeout=5"}},
+			resStatus:      http.StatusSwitchingProtocols,
+			resHeader:      http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}},
+			wantReqUpgrade: "websocket",
+			wantResUpgrade: "websocket",
+		},
+		{
+			name:      "Upgrade not listed in Connection",
+			reqHeader: http.Header{"Connection": {"keep-alive"}, "Upgrade": {"websocket"}},
+			resStatus: http.StatusOK,
+			resHeader: http.Header{},
+		},
+		{
+			name:           "Upgrade refused",
+			reqHeader:      http.Header{"Connection": {"Upgrade"}, "Upgrade": {"h2c"}},
+			resStatus:      http.StatusOK,
+			resHeader:      http.Header{"Connection": {"Upgrade"}, "Upgrade": {"h2c"}},
+			wantReqUpgrade: "h2c",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			hmt, _ := NewHttpMsgTransformerFilter(&MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+				got = req
+				res.StatusCode = tt.resStatus
+				res.Header = tt.resHeader
+				return nil
+			}})
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+			req.Header = tt.reqHeader
+			res := &http.Response{}
+			assert.NoError(t, hmt.Process(context.Background(), req, res))
+
+			assert.Equal(t, tt.wantReqUpgrade, UpgradeType(got.Header))
+			assert.Empty(t, got.Header.Get("Keep-Alive"))
+			if tt.wantReqUpgrade == "" {
+				assert.Empty(t, got.Header.Get("Upgrade"))
+				assert.Empty(t, got.Header.Get("Connection"))
+			}
+			assert.Equal(t, tt.wantResUpgrade, UpgradeType(res.Header))
+			if tt.wantResUpgrade == "" {
+				assert.Empty(t, res.Header.Get("Upgrade"))
+			}
+		})
+	}
+}
@@ -1 +1,184 @@
 package filters
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AccessLogRecord is the structured access log entry written once per request.
+type AccessLogRecord struct {
+	Time            time.Time
+	RequestID       string
+	TraceID         string
+	ClientIP        string
+	Principal       string
+	Method          string
+	URL             string
+	Host            string
+	Proto           string
+	Status          int
+	BytesIn         int64
+	BytesOut        int64
+	Duration        time.Duration
+	UpstreamLatency time.Duration
+	CacheStatus     string
+	Route           string
+	Referer         string
+	UserAgent       string
+	Error           string
+}
+
+// AccessLogger writes access log records, see adapters.NewAccessLogAdapter.
+type AccessLogger interface {
+	LogAccess(rec AccessLogRecord)
+}
+
+type AccessLogFilter struct {
+	logger     AccessLogger
+	nextFilter Filter
+}
+
+func NewAccessLogFilter(logger AccessLogger) (*AccessLogFilter, error) {
+	if logger == nil {
+		return nil, errors.New("AccessLogger = <nil>")
+	}
+	return &AccessLogFilter{logger: logger}, nil
+}
+
+func (al *AccessLogFilter) SetNextFilter(f Filter) error {
+	if f == nil {
+		return errors.New("nextFilter = <nil>")
+	}
+	al.nextFilter = f
+	return nil
+}
+
+// Process passes the request down the chain and logs it once the response
+// body has been sent to the client, so BytesOut and Duration cover the whole exchange.
+func (al *AccessLogFilter) Process(ctx context.Context, req *http.Request, res *http.Response) error {
+	info, ok := RequestInfoFromCtx(ctx)
+	if !ok {
+		info = NewRequestInfo(req)
+		ctx = WithRequestInfo(ctx, info)
+	}
+	in := &countingReadCloser{rc: req.Body}
+	if req.Body != nil {
+		req.Body = in
+	}
+
+	rec := AccessLogRecord{
+		Time:      info.Start,
+		RequestID: info.ID,
+		ClientIP:  info.ClientIP,
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Host:      RequestHost(req),
+		Proto:     req.Proto,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	}
+	if principal, ok := AuthFromCtx(ctx); ok {
+		rec.Principal = principal
+	}
+	if route, ok := RouteFromCtx(ctx); ok {
+		rec.Route = route
+	}
+
+	var err error
+	if al.nextFilter == nil {
+		err = ErrNoNextFilter("AccessLogFilter")
+	} else {
+		err = al.nextFilter.Process(ctx, req, res)
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	rec.Status = res.StatusCode
+	if rec.Status == 0 && err != nil {
+		rec.Status = StatusForError(err)
+	}
+
+	finish := func(out int64) {
+		rec.BytesIn = in.n
+		rec.BytesOut = out
+		rec.Duration = time.Since(info.Start)
+		rec.UpstreamLatency = info.UpstreamLatency
+		rec.CacheStatus = info.CacheStatus
+		rec.TraceID = info.TraceID
+		al.logger.LogAccess(rec)
+	}
+	// the body of a 101 is the tunnel, logged on its own when it closes
+	if res.Body == nil || res.StatusCode == http.StatusSwitchingProtocols {
+		finish(0)
+		return err
+	}
+	res.Body = &countingReadCloser{rc: res.Body, onClose: finish}
+	return err
+}
+
+var errBodyNotWritable = errors.New("response body is not writable")
+
+// countingReadCloser counts the bytes read through it and reports the count
+// to onClose, once.
+type countingReadCloser struct {
+	rc      io.ReadCloser
+	n       int64
+	onClose func(n int64)
+	once    sync.Once
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.rc.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Write writes to rc, the body of a 101 Switching Protocols response is the
+// upstream connection and the client's bytes are written to it.
+func (c *countingReadCloser) Write(p []byte) (int, error) {
+	if w, ok := c.rc.(io.Writer); ok {
+		return w.Write(p)
+	}
+	return 0, errBodyNotWritable
+}
+
+func (c *countingReadCloser) Close() error {
+	err := c.rc.Close()
+	if c.onClose != nil {
+		c.once.Do(func() { c.onClose(c.n) })
+	}
+	return err
+}
+
+// tunnel close reasons recorded in TunnelLogRecord.CloseReason
+const (
+	TunnelClosedClientEOF   = "client_eof"
+	TunnelClosedUpstreamEOF = "upstream_eof"
+	TunnelClosedIdleTimeout = "idle_timeout"
+	TunnelClosedError       = "error"
+	TunnelClosedKilled      = "killed"
+)
+
+// TunnelLogRecord is the log entry written when a CONNECT tunnel closes.
+type TunnelLogRecord struct {
+	Time      time.Time
+	RequestID string
+	ClientIP  string
+	Principal string
+	Target    string
+	Duration  time.Duration
+	// BytesUpstream were sent by the client to the target, BytesClient by the target to the client
+	BytesUpstream int64
+	BytesClient   int64
+	CloseReason   string
+	Error         string
+}
+
+// TunnelLogger writes tunnel log records, see adapters.NewAccessLogAdapter.
+type TunnelLogger interface {
+	LogTunnel(rec TunnelLogRecord)
+}
@@ -0,0 +1,96 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingAccessLogger struct {
+	records []AccessLogRecord
+}
+
+func (r *recordingAccessLogger) LogAccess(rec AccessLogRecord) {
+	r.records = append(r.records, rec)
+}
+
+func TestAccessLogFilter(t *testing.T) {
+	_, err := NewAccessLogFilter(nil)
+	assert.Error(t, err)
+
+	t.Run("Logged when the body is closed", func(t *testing.T) {
+		logger := &recordingAccessLogger{}
+		al, _ := NewAccessLogFilter(logger)
+		al.SetNextFilter(&MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+			ioutil.ReadAll(req.Body)
+			info, _ := RequestInfoFromCtx(ctx)
+			info.CacheStatus = CacheStatusMiss
+			info.UpstreamLatency = 5 * time.Millisecond
+			*res = http.Response{StatusCode: http.StatusCreated, Body: ioutil.NopCloser(strings.NewReader("hello"))}
+			return nil
+		}})
+
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/items", strings.NewReader("abc"))
+		req.Header.Set("User-Agent", "test-agent")
+		ctx := WithRoute(context.WithValue(context.Background(), authKey, "alice"), "api")
+		res := &http.Response{}
+		assert.NoError(t, al.Process(ctx, req, res))
+		assert.Empty(t, logger.records, "nothing is logged before the response is sent")
+
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		res.Body.Close()
+		if assert.Len(t, logger.records, 1) {
+			rec := logger.records[0]
+			assert.NotEmpty(t, rec.RequestID)
+			assert.Equal(t, "192.0.2.1", rec.ClientIP)
+			assert.Equal(t, "alice", rec.Principal)
+			assert.Equal(t, "api", rec.Route)
+			assert.Equal(t, http.MethodPost, rec.Method)
+			assert.Equal(t, "example.com", rec.Host)
+			assert.Equal(t, http.StatusCreated, rec.Status)
+			assert.Equal(t, int64(3), rec.BytesIn)
+			assert.Equal(t, int64(5), rec.BytesOut)
+			assert.Equal(t, CacheStatusMiss, rec.CacheStatus)
+			assert.Equal(t, 5*time.Millisecond, rec.UpstreamLatency)
+			assert.Equal(t, "test-agent", rec.UserAgent)
+		}
+	})
+
+	t.Run("Logged when the 101 is sent", func(t *testing.T) {
+		logger := &recordingAccessLogger{}
+		al, _ := NewAccessLogFilter(logger)
+		al.SetNextFilter(&MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+			*res = http.Response{StatusCode: http.StatusSwitchingProtocols, Body: ioutil.NopCloser(strings.NewReader(""))}
+			return nil
+		}})
+		res := &http.Response{}
+		assert.NoError(t, al.Process(context.Background(), httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil), res))
+		if assert.Len(t, logger.records, 1, "the tunnel is logged on its own") {
+			assert.Equal(t, http.StatusSwitchingProtocols, logger.records[0].Status)
+		}
+		res.Body.Close()
+		assert.Len(t, logger.records, 1)
+	})
+
+	t.Run("Error without response", func(t *testing.T) {
+		logger := &recordingAccessLogger{}
+		al, _ := NewAccessLogFilter(logger)
+		al.SetNextFilter(&MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+			return NewUpstreamError("example.com", errors.New("dial failed"))
+		}})
+		err := al.Process(context.Background(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil), &http.Response{})
+		assert.Error(t, err)
+		if assert.Len(t, logger.records, 1) {
+			assert.Equal(t, http.StatusBadGateway, logger.records[0].Status)
+			assert.Contains(t, logger.records[0].Error, "dial failed")
+		}
+	})
+}
@@ -1 +1,350 @@
 package filters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the latency histogram upper bounds, in seconds.
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics holds the proxy metrics and renders them in the Prometheus text
+// exposition format, see WritePrometheus.
+type Metrics struct {
+	requests        *metricVec
+	latency         *metricVec
+	upstreamLatency *metricVec
+	inFlight        *metricVec
+	cacheRequests   *metricVec
+	activeTunnels   *metricVec
+	tunnels         *metricVec
+	tunnelBytes     *metricVec
+	// read at scrape time, nil without a cache breaker
+	cacheBreakerState func() BreakerState
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: newMetricVec("lhp_http_requests_total", "HTTP requests handled, by route, method and status class.",
+			"counter", nil, "route", "method", "status_class"),
+		latency: newMetricVec("lhp_http_request_duration_seconds", "Total time spent on HTTP requests, until the response body is sent.",
+			"histogram", DefaultLatencyBuckets, "route", "method"),
+		upstreamLatency: newMetricVec("lhp_http_upstream_duration_seconds", "Time spent waiting for the upstream response headers.",
+			"histogram", DefaultLatencyBuckets, "route", "method"),
+		inFlight: newMetricVec("lhp_http_requests_in_flight", "HTTP requests currently being handled.",
+			"gauge", nil),
+		cacheRequests: newMetricVec("lhp_cache_requests_total", "Cache lookups, by status (HIT, MISS, BYPASS).",
+			"counter", nil, "status"),
+		activeTunnels: newMetricVec("lhp_tunnels_active", "CONNECT tunnels currently open.",
+			"gauge", nil),
+		tunnels: newMetricVec("lhp_tunnels_total", "CONNECT tunnels closed, by close reason.",
+			"counter", nil, "reason"),
+		tunnelBytes: newMetricVec("lhp_tunnel_bytes_total", "Bytes relayed through CONNECT tunnels, by direction.",
+			"counter", nil, "direction"),
+	}
+}
+
+// ObserveRequest records a finished HTTP request.
+func (m *Metrics) ObserveRequest(route, method string, status int, total, upstream time.Duration) {
+	m.requests.add(1, route, method, statusClass(status))
+	m.latency.observe(total.Seconds(), route, method)
+	if upstream > 0 {
+		m.upstreamLatency.observe(upstream.Seconds(), route, method)
+	}
+}
+
+func (m *Metrics) ObserveCache(status string) {
+	if status != "" {
+		m.cacheRequests.add(1, status)
+	}
+}
+
+func (m *Metrics) TunnelOpened() {
+	m.activeTunnels.add(1)
+}
+
+func (m *Metrics) TunnelClosed(rec TunnelLogRecord) {
+	m.activeTunnels.add(-1)
+	m.tunnels.add(1, rec.CloseReason)
+	m.tunnelBytes.add(float64(rec.BytesUpstream), "upstream")
+	m.tunnelBytes.add(float64(rec.BytesClient), "client")
+}
+
+// SetCacheBreakerState sets where the state of the circuit breaker of the
+// cache backend is read from on each scrape.
+func (m *Metrics) SetCacheBreakerState(state func() BreakerState) error {
+	if state == nil {
+		return errors.New("cacheBreakerState = <nil>")
+	}
+	m.cacheBreakerState = state
+	return nil
+}
+
+// CacheHitRatio is the share of cache lookups served from the cache, 0 before any lookup.
+func (m *Metrics) CacheHitRatio() float64 {
+	hits := m.cacheRequests.get(CacheStatusHit)
+	total := hits + m.cacheRequests.get(CacheStatusMiss)
+	if total == 0 {
+		return 0
+	}
+	return hits / total
+}
+
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	for _, mv := range []*metricVec{m.requests, m.latency, m.upstreamLatency, m.inFlight, m.cacheRequests} {
+		if err := mv.write(w); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "# HELP lhp_cache_hit_ratio Share of cache lookups served from the cache.\n# TYPE lhp_cache_hit_ratio gauge\nlhp_cache_hit_ratio %s\n",
+		formatFloat(m.CacheHitRatio()))
+	if err != nil {
+		return err
+	}
+	if err := m.writeCacheBreakerState(w); err != nil {
+		return err
+	}
+	for _, mv := range []*metricVec{m.activeTunnels, m.tunnels, m.tunnelBytes} {
+		if err := mv.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCacheBreakerState writes a series per breaker state, 1 for the current one.
+func (m *Metrics) writeCacheBreakerState(w io.Writer) error {
+	if m.cacheBreakerState == nil {
+		return nil
+	}
+	current := m.cacheBreakerState()
+	var b strings.Builder
+	b.WriteString("# HELP lhp_cache_breaker_state State of the circuit breaker of the cache backend, 1 for the current state.\n# TYPE lhp_cache_breaker_state gauge\n")
+	for _, state := range []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen} {
+		v := 0
+		if state == current {
+			v = 1
+		}
+		fmt.Fprintf(&b, "lhp_cache_breaker_state{state=%q} %d\n", state.String(), v)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ServeHTTP exposes the metrics to Prometheus scrapes.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := m.WritePrometheus(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type MetricsFilter struct {
+	metrics    *Metrics
+	nextFilter Filter
+}
+
+func NewMetricsFilter(m *Metrics) (*MetricsFilter, error) {
+	if m == nil {
+		return nil, errors.New("Metrics = <nil>")
+	}
+	return &MetricsFilter{metrics: m}, nil
+}
+
+func (mf *MetricsFilter) SetNextFilter(f Filter) error {
+	if f == nil {
+		return errors.New("nextFilter = <nil>")
+	}
+	mf.nextFilter = f
+	return nil
+}
+
+// Process records the request once its response body has been sent, an
+// upgrade once its 101 has.
+func (mf *MetricsFilter) Process(ctx context.Context, req *http.Request, res *http.Response) error {
+	info, ok := RequestInfoFromCtx(ctx)
+	if !ok {
+		info = NewRequestInfo(req)
+		ctx = WithRequestInfo(ctx, info)
+	}
+	route, _ := RouteFromCtx(ctx)
+	mf.metrics.inFlight.add(1)
+
+	var err error
+	if mf.nextFilter == nil {
+		err = ErrNoNextFilter("MetricsFilter")
+	} else {
+		err = mf.nextFilter.Process(ctx, req, res)
+	}
+	status := res.StatusCode
+	if status == 0 && err != nil {
+		status = StatusForError(err)
+	}
+
+	finish := func(int64) {
+		mf.metrics.inFlight.add(-1)
+		mf.metrics.ObserveRequest(route, metricMethod(req.Method), status, time.Since(info.Start), info.UpstreamLatency)
+		mf.metrics.ObserveCache(info.CacheStatus)
+	}
+	// the body of a 101 is the tunnel, counted by the tunnel metrics
+	if res.Body == nil || res.StatusCode == http.StatusSwitchingProtocols {
+		finish(0)
+		return err
+	}
+	res.Body = &countingReadCloser{rc: res.Body, onClose: finish}
+	return err
+}
+
+// metricMethod bounds the method label: the clients choose the method, a
+// series per made-up method would grow without limit.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// metricVec is a metric family: a counter, gauge or histogram per label values.
+type metricVec struct {
+	name       string
+	help       string
+	typ        string
+	buckets    []float64
+	labelNames []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	count       uint64
+}
+
+func newMetricVec(name, help, typ string, buckets []float64, labelNames ...string) *metricVec {
+	return &metricVec{name: name, help: help, typ: typ, buckets: buckets, labelNames: labelNames, series: map[string]*series{}}
+}
+
+func (mv *metricVec) seriesFor(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := mv.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues, counts: make([]uint64, len(mv.buckets))}
+		mv.series[key] = s
+	}
+	return s
+}
+
+func (mv *metricVec) add(v float64, labelValues ...string) {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+	mv.seriesFor(labelValues).value += v
+}
+
+func (mv *metricVec) get(labelValues ...string) float64 {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+	if s, ok := mv.series[strings.Join(labelValues, "\xff")]; ok {
+		return s.value
+	}
+	return 0
+}
+
+// observe adds v to a histogram, value holds the sum of the observations.
+func (mv *metricVec) observe(v float64, labelValues ...string) {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+	s := mv.seriesFor(labelValues)
+	s.value += v
+	s.count++
+	for i, upper := range mv.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+}
+
+func (mv *metricVec) write(w io.Writer) error {
+	mv.mu.Lock()
+	keys := make([]string, 0, len(mv.series))
+	for k := range mv.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", mv.name, mv.help, mv.name, mv.typ)
+	if len(keys) == 0 && len(mv.labelNames) == 0 && mv.typ != "histogram" {
+		fmt.Fprintf(&b, "%s 0\n", mv.name)
+	}
+	for _, k := range keys {
+		s := mv.series[k]
+		if mv.typ != "histogram" {
+			fmt.Fprintf(&b, "%s%s %s\n", mv.name, formatLabels(mv.labelNames, s.labelValues, "", ""), formatFloat(s.value))
+			continue
+		}
+		for i, upper := range mv.buckets {
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", mv.name, formatLabels(mv.labelNames, s.labelValues, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(&b, "%s_bucket%s %d\n", mv.name, formatLabels(mv.labelNames, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(&b, "%s_sum%s %s\n", mv.name, formatLabels(mv.labelNames, s.labelValues, "", ""), formatFloat(s.value))
+		fmt.Fprintf(&b, "%s_count%s %d\n", mv.name, formatLabels(mv.labelNames, s.labelValues, "", ""), s.count)
+	}
+	mv.mu.Unlock()
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabelValue(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// TunnelObserver is told when CONNECT tunnels open and close, Metrics implements it.
+type TunnelObserver interface {
+	TunnelOpened()
+	TunnelClosed(rec TunnelLogRecord)
+}
@@ -0,0 +1,156 @@
+package filters
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsFilter(t *testing.T) {
+	m := NewMetrics()
+	mf, err := NewMetricsFilter(m)
+	assert.NoError(t, err)
+	_, err = NewMetricsFilter(nil)
+	assert.Error(t, err)
+
+	status, cacheStatus := http.StatusOK, CacheStatusHit
+	mf.SetNextFilter(&MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		info, _ := RequestInfoFromCtx(ctx)
+		info.CacheStatus = cacheStatus
+		info.UpstreamLatency = 20 * time.Millisecond
+		*res = http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader("ok"))}
+		return nil
+	}})
+
+	serve := func() *http.Response {
+		res := &http.Response{}
+		ctx := WithRoute(context.Background(), "api")
+		assert.NoError(t, mf.Process(ctx, httptest.NewRequest(http.MethodGet, "http://example.com/", nil), res))
+		return res
+	}
+
+	res := serve()
+	assert.Equal(t, float64(1), m.inFlight.get(), "in flight until the body is closed")
+	res.Body.Close()
+	assert.Equal(t, float64(0), m.inFlight.get())
+
+	status, cacheStatus = http.StatusNotFound, CacheStatusMiss
+	serve().Body.Close()
+	serve().Body.Close()
+
+	assert.Equal(t, float64(1), m.requests.get("api", "GET", "2xx"))
+	assert.Equal(t, float64(2), m.requests.get("api", "GET", "4xx"))
+	assert.InDelta(t, 1.0/3, m.CacheHitRatio(), 1e-9)
+
+	buf := &strings.Builder{}
+	assert.NoError(t, m.WritePrometheus(buf))
+	out := buf.String()
+	assert.Contains(t, out, "# TYPE lhp_http_requests_total counter\n")
+	assert.Contains(t, out, `lhp_http_requests_total{route="api",method="GET",status_class="4xx"} 2`)
+	assert.Contains(t, out, `lhp_http_upstream_duration_seconds_bucket{route="api",method="GET",le="0.025"} 3`)
+	assert.Contains(t, out, `lhp_http_upstream_duration_seconds_bucket{route="api",method="GET",le="0.01"} 0`)
+	assert.Contains(t, out, `lhp_http_upstream_duration_seconds_count{route="api",method="GET"} 3`)
+	assert.Contains(t, out, "lhp_http_requests_in_flight 0\n")
+	assert.Contains(t, out, `lhp_cache_requests_total{status="MISS"} 2`)
+	assert.Contains(t, out, "lhp_tunnels_active 0\n")
+}
+
+func TestMetricsFilterUpgrade(t *testing.T) {
+	m := NewMetrics()
+	mf, _ := NewMetricsFilter(m)
+	mf.SetNextFilter(&MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		*res = http.Response{StatusCode: http.StatusSwitchingProtocols, Body: ioutil.NopCloser(strings.NewReader(""))}
+		return nil
+	}})
+	res := &http.Response{}
+	assert.NoError(t, mf.Process(context.Background(), httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil), res))
+	assert.Equal(t, float64(0), m.inFlight.get(), "the tunnel is not a request in flight")
+	assert.Equal(t, float64(1), m.requests.get("", "GET", "1xx"))
+	_, wrapped := res.Body.(*countingReadCloser)
+	assert.False(t, wrapped, "the tunnel's connection is left as is")
+}
+
+func TestMetricsTunnels(t *testing.T) {
+	m := NewMetrics()
+	m.TunnelOpened()
+	m.TunnelOpened()
+	m.TunnelClosed(TunnelLogRecord{CloseReason: TunnelClosedClientEOF, BytesUpstream: 10, BytesClient: 300})
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+	out := rec.Body.String()
+	assert.Contains(t, out, "lhp_tunnels_active 1\n")
+	assert.Contains(t, out, `lhp_tunnels_total{reason="client_eof"} 1`)
+	assert.Contains(t, out, `lhp_tunnel_bytes_total{direction="client"} 300`)
+	assert.Contains(t, out, `lhp_tunnel_bytes_total{direction="upstream"} 10`)
+}
+
+func TestMetricsCacheBreakerState(t *testing.T) {
+	m := NewMetrics()
+	buf := &strings.Builder{}
+	assert.NoError(t, m.WritePrometheus(buf))
+	assert.NotContains(t, buf.String(), "lhp_cache_breaker_state")
+
+	breaker, clock := newTestBreaker(t, 1, time.Minute, 1)
+	cm, _ := NewCacheMgrFilter(&MockCacheService{})
+	cm.SetCircuitBreaker(breaker)
+	assert.NoError(t, m.SetCacheBreakerState(cm.CacheBreakerState))
+	assert.Error(t, m.SetCacheBreakerState(nil))
+
+	tests := []struct {
+		name  string
+		step  func()
+		state string
+	}{
+		{name: "Closed", step: func() {}, state: "closed"},
+		{name: "Open", step: breaker.Failure, state: "open"},
+		{name: "Half-open", step: func() { clock.t = clock.t.Add(time.Minute) }, state: "half-open"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.step()
+			buf := &strings.Builder{}
+			assert.NoError(t, m.WritePrometheus(buf))
+			out := buf.String()
+			assert.Contains(t, out, "# TYPE lhp_cache_breaker_state gauge\n")
+			for _, state := range []string{"closed", "open", "half-open"} {
+				want := "0"
+				if state == tt.state {
+					want = "1"
+				}
+				assert.Contains(t, out, `lhp_cache_breaker_state{state="`+state+`"} `+want+"\n")
+			}
+		})
+	}
+}
+
+func TestMetricMethod(t *testing.T) {
+	tests := []struct {
+		method string
+		want   string
+	}{
+		{method: http.MethodGet, want: "GET"},
+		{method: http.MethodPatch, want: "PATCH"},
+		{method: http.MethodConnect, want: "CONNECT"},
+		{method: "get", want: "OTHER"},
+		{method: "PROPFIND", want: "OTHER"},
+		{method: "X-RANDOM-1234", want: "OTHER"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			assert.Equal(t, tt.want, metricMethod(tt.method))
+		})
+	}
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	assert.Equal(t, `a\"b\\c\nd`, escapeLabelValue("a\"b\\c\nd"))
+}
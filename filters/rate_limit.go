@@ -0,0 +1,240 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/LamineKouissi/LHP/util"
+)
+
+// what the requests are counted by
+const (
+	RateLimitKeyClientIP  = "client_ip"
+	RateLimitKeyPrincipal = "principal"
+	RateLimitKeyHost      = "host"
+)
+
+// the memory store drops the buckets which are full again this often
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit is a token bucket: it lets Requests through per Per, in bursts
+// of up to Burst requests (Requests when zero), for each value of Key.
+type RateLimit struct {
+	Key      string
+	Requests int
+	Per      time.Duration
+	Burst    int
+}
+
+func (rl RateLimit) validate() error {
+	switch rl.Key {
+	case RateLimitKeyClientIP, RateLimitKeyPrincipal, RateLimitKeyHost:
+	default:
+		return errors.New("invalid rate limit key : " + rl.Key)
+	}
+	if rl.Requests <= 0 || rl.Per <= 0 || rl.Burst < 0 {
+		return fmt.Errorf("invalid rate limit : %d requests per %s, burst %d", rl.Requests, rl.Per, rl.Burst)
+	}
+	return nil
+}
+
+// Rate is the number of tokens added to the bucket per second.
+func (rl RateLimit) Rate() float64 {
+	return float64(rl.Requests) / rl.Per.Seconds()
+}
+
+// Capacity is the number of tokens the bucket holds when full.
+func (rl RateLimit) Capacity() int {
+	if rl.Burst > 0 {
+		return rl.Burst
+	}
+	return rl.Requests
+}
+
+// RateLimitStore keeps the token buckets, see NewMemoryRateLimitStore and
+// adapters.NewRedisRateLimitStore for limits shared across instances.
+type RateLimitStore interface {
+	// Take takes a token of the bucket of key, or tells how long until there is one.
+	Take(ctx context.Context, key string, limit RateLimit) (allowed bool, retryAfter time.Duration, err error)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// how long the bucket takes to fill up from empty
+	fill time.Duration
+}
+
+// MemoryRateLimitStore keeps the buckets in memory, the limits apply per instance.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*tokenBucket{}, now: time.Now}
+}
+
+func (ms *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := ms.now()
+	ms.sweep(now)
+
+	capacity, rate := float64(limit.Capacity()), limit.Rate()
+	b, ok := ms.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now, fill: time.Duration(capacity / rate * float64(time.Second))}
+		ms.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second)), nil
+}
+
+// sweep drops the buckets untouched for longer than it takes to fill them,
+// a new bucket is full anyway.
+func (ms *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(ms.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	ms.lastSweep = now
+	for key, b := range ms.buckets {
+		if now.Sub(b.last) > b.fill {
+			delete(ms.buckets, key)
+		}
+	}
+}
+
+// RateLimitFilter answers 429 Too Many Requests, with a Retry-After, to the
+// requests over one of the limits of their route, or the default limits for
+// the routes without their own. A failing store lets the requests through.
+type RateLimitFilter struct {
+	store      RateLimitStore
+	mu         sync.RWMutex
+	defaults   []RateLimit
+	routes     map[string][]RateLimit
+	nextFilter Filter
+}
+
+func NewRateLimitFilter(store RateLimitStore) (*RateLimitFilter, error) {
+	if store == nil {
+		return nil, errors.New("RateLimitStore = <nil>")
+	}
+	return &RateLimitFilter{store: store, routes: map[string][]RateLimit{}}, nil
+}
+
+func (rf *RateLimitFilter) SetNextFilter(f Filter) error {
+	if f == nil {
+		return errors.New("nextFilter = <nil>")
+	}
+	rf.nextFilter = f
+	return nil
+}
+
+// SetLimits sets the default limits and those of the routes, it can be
+// called again on config reload.
+func (rf *RateLimitFilter) SetLimits(defaults []RateLimit, routes map[string][]RateLimit) error {
+	if err := ValidateRateLimits(defaults, routes); err != nil {
+		return err
+	}
+	if routes == nil {
+		routes = map[string][]RateLimit{}
+	}
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.defaults, rf.routes = defaults, routes
+	return nil
+}
+
+// ValidateRateLimits returns the error SetLimits would, without setting anything.
+func ValidateRateLimits(defaults []RateLimit, routes map[string][]RateLimit) error {
+	for _, rl := range defaults {
+		if err := rl.validate(); err != nil {
+			return err
+		}
+	}
+	for route, limits := range routes {
+		for _, rl := range limits {
+			if err := rl.validate(); err != nil {
+				return fmt.Errorf("route %s : %w", route, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (rf *RateLimitFilter) limitsFor(ctx context.Context) (string, []RateLimit) {
+	rf.mu.RLock()
+	defer rf.mu.RUnlock()
+	if route, ok := RouteFromCtx(ctx); ok {
+		if limits, ok := rf.routes[route]; ok {
+			return route, limits
+		}
+	}
+	return "", rf.defaults
+}
+
+func (rf *RateLimitFilter) Process(ctx context.Context, req *http.Request, res *http.Response) error {
+	if rf.nextFilter == nil {
+		return ErrNoNextFilter("RateLimitFilter")
+	}
+	if err := rf.Check(ctx, req); err != nil {
+		return err
+	}
+	return rf.nextFilter.Process(ctx, req, res)
+}
+
+// Check takes a token of each limit req is subject to and returns a rate
+// limit error, with its Retry-After, when one of them has none left. The
+// CONNECT requests, outside the filter chain, are checked with it too.
+func (rf *RateLimitFilter) Check(ctx context.Context, req *http.Request) error {
+	route, limits := rf.limitsFor(ctx)
+	for i, rl := range limits {
+		value := rateLimitKeyValue(ctx, req, rl.Key)
+		if value == "" {
+			// e.g. a per-principal limit and an anonymous request
+			continue
+		}
+		// the buckets of a limit are its own, the routes with the same limits do not share them
+		key := route + "/" + strconv.Itoa(i) + "/" + rl.Key + "=" + value
+		allowed, retryAfter, err := rf.store.Take(ctx, key, rl)
+		if err != nil {
+			util.Errorln("RateLimitFilter : store :", err)
+			continue
+		}
+		if !allowed {
+			util.Warnln("RateLimitFilter : over the limit of", rl.Requests, "requests per", rl.Per, ":", rl.Key+"="+value, req.Method, req.URL)
+			return NewRateLimitError(retryAfter)
+		}
+	}
+	return nil
+}
+
+func rateLimitKeyValue(ctx context.Context, req *http.Request, key string) string {
+	switch key {
+	case RateLimitKeyClientIP:
+		if info, ok := RequestInfoFromCtx(ctx); ok {
+			return info.ClientIP
+		}
+		return clientIP(req)
+	case RateLimitKeyPrincipal:
+		principal, _ := AuthFromCtx(ctx)
+		return principal
+	case RateLimitKeyHost:
+		return RequestHost(req)
+	}
+	return ""
+}
@@ -0,0 +1,176 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	now := time.Unix(1700000000, 0)
+	store.now = func() time.Time { return now }
+	ctx := context.Background()
+	limit := RateLimit{Key: RateLimitKeyClientIP, Requests: 10, Per: time.Second, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		allowed, _, err := store.Take(ctx, "k", limit)
+		assert.NoError(t, err)
+		assert.True(t, allowed, "within the burst")
+	}
+	allowed, retryAfter, err := store.Take(ctx, "k", limit)
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 100*time.Millisecond, retryAfter)
+
+	now = now.Add(100 * time.Millisecond)
+	allowed, _, _ = store.Take(ctx, "k", limit)
+	assert.True(t, allowed, "a token per 100ms")
+	allowed, _, _ = store.Take(ctx, "k", limit)
+	assert.False(t, allowed)
+
+	// the bucket is full again after 200ms, the sweep drops it
+	now = now.Add(2 * rateLimitSweepInterval)
+	store.Take(ctx, "other", limit)
+	assert.Len(t, store.buckets, 1)
+}
+
+// failingRateLimitStore fails every Take.
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	return false, 0, errors.New("store down")
+}
+
+func TestRateLimitFilter(t *testing.T) {
+	next := &MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		res.StatusCode = http.StatusOK
+		return nil
+	}}
+	newFilter := func(store RateLimitStore) *RateLimitFilter {
+		rf, err := NewRateLimitFilter(store)
+		assert.NoError(t, err)
+		assert.NoError(t, rf.SetNextFilter(next))
+		assert.NoError(t, rf.SetLimits(
+			[]RateLimit{{Key: RateLimitKeyClientIP, Requests: 1, Per: time.Minute}},
+			map[string][]RateLimit{
+				"api":     {{Key: RateLimitKeyPrincipal, Requests: 2, Per: time.Minute}},
+				"uploads": {{Key: RateLimitKeyHost, Requests: 1, Per: time.Minute}},
+			}))
+		return rf
+	}
+	request := func(ip string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = ip + ":40000"
+		return req
+	}
+	alice := WithPrincipal(context.Background(), "alice", nil)
+	bob := WithPrincipal(context.Background(), "bob", nil)
+
+	tests := []struct {
+		name     string
+		store    RateLimitStore
+		requests []func(rf *RateLimitFilter) error
+		want     []int
+	}{
+		{
+			name:  "Default limit per client IP",
+			store: NewMemoryRateLimitStore(),
+			requests: []func(rf *RateLimitFilter) error{
+				func(rf *RateLimitFilter) error {
+					return rf.Process(context.Background(), request("192.0.2.1"), &http.Response{})
+				},
+				func(rf *RateLimitFilter) error {
+					return rf.Process(context.Background(), request("192.0.2.1"), &http.Response{})
+				},
+				func(rf *RateLimitFilter) error {
+					return rf.Process(context.Background(), request("192.0.2.2"), &http.Response{})
+				},
+			},
+			want: []int{http.StatusOK, http.StatusTooManyRequests, http.StatusOK},
+		},
+		{
+			name:  "Route limit per principal",
+			store: NewMemoryRateLimitStore(),
+			requests: []func(rf *RateLimitFilter) error{
+				func(rf *RateLimitFilter) error {
+					return rf.Process(WithRoute(alice, "api"), request("192.0.2.1"), &http.Response{})
+				},
+				func(rf *RateLimitFilter) error {
+					return rf.Process(WithRoute(alice, "api"), request("192.0.2.1"), &http.Response{})
+				},
+				func(rf *RateLimitFilter) error {
+					return rf.Process(WithRoute(alice, "api"), request("192.0.2.1"), &http.Response{})
+				},
+				func(rf *RateLimitFilter) error {
+					return rf.Process(WithRoute(bob, "api"), request("192.0.2.1"), &http.Response{})
+				},
+				// anonymous requests are not counted per principal
+				func(rf *RateLimitFilter) error {
+					return rf.Process(WithRoute(context.Background(), "api"), request("192.0.2.1"), &http.Response{})
+				},
+			},
+			want: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusOK, http.StatusOK},
+		},
+		{
+			name:  "Route limit per host",
+			store: NewMemoryRateLimitStore(),
+			requests: []func(rf *RateLimitFilter) error{
+				func(rf *RateLimitFilter) error {
+					return rf.Process(WithRoute(alice, "uploads"), request("192.0.2.1"), &http.Response{})
+				},
+				func(rf *RateLimitFilter) error {
+					return rf.Process(WithRoute(bob, "uploads"), request("192.0.2.2"), &http.Response{})
+				},
+			},
+			want: []int{http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:  "Failing store lets requests through",
+			store: failingRateLimitStore{},
+			requests: []func(rf *RateLimitFilter) error{
+				func(rf *RateLimitFilter) error {
+					return rf.Process(context.Background(), request("192.0.2.1"), &http.Response{})
+				},
+				func(rf *RateLimitFilter) error {
+					return rf.Process(context.Background(), request("192.0.2.1"), &http.Response{})
+				},
+			},
+			want: []int{http.StatusOK, http.StatusOK},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rf := newFilter(tt.store)
+			for i, request := range tt.requests {
+				err := request(rf)
+				if tt.want[i] == http.StatusOK {
+					assert.NoError(t, err, "request %d", i)
+					continue
+				}
+				pe, ok := AsProxyError(err)
+				assert.True(t, ok, "request %d", i)
+				assert.Equal(t, tt.want[i], pe.Status)
+				assert.Equal(t, ErrorCategoryPolicy, pe.Category)
+				assert.True(t, pe.RetryAfter > 0)
+			}
+		})
+	}
+}
+
+func TestRateLimitFilterSetLimitsErrors(t *testing.T) {
+	rf, err := NewRateLimitFilter(NewMemoryRateLimitStore())
+	assert.NoError(t, err)
+	assert.Error(t, rf.SetLimits([]RateLimit{{Key: "cookie", Requests: 1, Per: time.Second}}, nil))
+	assert.Error(t, rf.SetLimits([]RateLimit{{Key: RateLimitKeyHost, Requests: 0, Per: time.Second}}, nil))
+	assert.Error(t, rf.SetLimits(nil, map[string][]RateLimit{"r": {{Key: RateLimitKeyHost, Requests: 1}}}))
+	assert.Error(t, ValidateRateLimits(nil, map[string][]RateLimit{"r": {{Key: RateLimitKeyHost, Requests: 1}}}))
+	assert.NoError(t, ValidateRateLimits([]RateLimit{{Key: RateLimitKeyHost, Requests: 1, Per: time.Second}}, nil))
+	_, err = NewRateLimitFilter(nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,57 @@
+package filters
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"time"
+)
+
+// cache statuses recorded in RequestInfo.CacheStatus
+const (
+	CacheStatusHit    = "HIT"
+	CacheStatusMiss   = "MISS"
+	CacheStatusBypass = "BYPASS"
+)
+
+// RequestInfo collects what the filters learn about one request, for the
+// access log and metrics. It is shared down the chain through the context.
+type RequestInfo struct {
+	ID              string
+	TraceID         string
+	Start           time.Time
+	ClientIP        string
+	CacheStatus     string
+	UpstreamLatency time.Duration
+}
+
+func NewRequestInfo(req *http.Request) *RequestInfo {
+	return &RequestInfo{ID: newRequestID(), Start: time.Now(), ClientIP: clientIP(req)}
+}
+
+// clientIP is the address req comes from, without its port.
+func clientIP(req *http.Request) string {
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return ip
+	}
+	return req.RemoteAddr
+}
+
+func WithRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey, info)
+}
+
+func RequestInfoFromCtx(ctx context.Context) (*RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey).(*RequestInfo)
+	return info, ok && info != nil
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "0000000000000000"
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,52 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ResponseHeadersFilter appends the proxy to the Via header of the responses
+// and applies the response header rules, with the settings of its
+// HttpMsgTransformerFilter. It goes before the cache filter: the cache keeps
+// the responses as the upstreams sent them, the hits get their own Via and
+// rules, and no value of one request, e.g. ${request_id}, is replayed to the
+// others.
+type ResponseHeadersFilter struct {
+	transformer *HttpMsgTransformerFilter
+	nextFilter  Filter
+}
+
+func NewResponseHeadersFilter(hmt *HttpMsgTransformerFilter) (*ResponseHeadersFilter, error) {
+	if hmt == nil {
+		return nil, errors.New("HttpMsgTransformerFilter = <nil>")
+	}
+	return &ResponseHeadersFilter{transformer: hmt}, nil
+}
+
+func (rh *ResponseHeadersFilter) SetNextFilter(f Filter) error {
+	if f == nil {
+		return errors.New("nextFilter = <nil>")
+	}
+	rh.nextFilter = f
+	return nil
+}
+
+func (rh *ResponseHeadersFilter) Process(ctx context.Context, req *http.Request, res *http.Response) error {
+	if rh.nextFilter == nil {
+		return ErrNoNextFilter("ResponseHeadersFilter")
+	}
+	if err := rh.nextFilter.Process(ctx, req, res); err != nil {
+		return err
+	}
+
+	forwarding, rules := rh.transformer.settingsFor(ctx)
+	forwarding.forwardResponse(res)
+	if len(rules.response) > 0 {
+		if res.Header == nil {
+			res.Header = http.Header{}
+		}
+		applyHeaderRules(ctx, rules.response, req, res.StatusCode, res.Header)
+	}
+	return nil
+}
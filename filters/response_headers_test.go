@@ -0,0 +1,73 @@
+package filters
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewResponseHeadersFilter(t *testing.T) {
+	_, err := NewResponseHeadersFilter(nil)
+	assert.Error(t, err)
+
+	hmt, _ := NewHttpMsgTransformerFilter(&mockFilter{})
+	rh, err := NewResponseHeadersFilter(hmt)
+	assert.NoError(t, err)
+	assert.Error(t, rh.SetNextFilter(nil))
+	err = rh.Process(context.Background(), &http.Request{}, &http.Response{})
+	assert.Equal(t, ErrNoNextFilter("ResponseHeadersFilter"), err)
+}
+
+// the chain of main.go: the response rules and Via go before the cache
+func TestResponseHeadersFilterCacheHit(t *testing.T) {
+	var cached *http.Response
+	cs := &MockCacheService{
+		getFunc: func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			if cached == nil {
+				return nil, ErrCacheMiss{Msg: "miss"}
+			}
+			res := *cached
+			res.Header = cached.Header.Clone()
+			return &res, nil
+		},
+		setFunc: func(ctx context.Context, req *http.Request, res *http.Response, expr time.Duration) error {
+			stored := *res
+			stored.Header = res.Header.Clone()
+			cached = &stored
+			return nil
+		},
+	}
+	upstreamCalls := 0
+	hmt, _ := NewHttpMsgTransformerFilter(&MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		upstreamCalls++
+		res.StatusCode = http.StatusOK
+		res.ProtoMajor, res.ProtoMinor = 1, 1
+		res.Header = http.Header{"Cache-Control": {"max-age=60"}}
+		return nil
+	}})
+	assert.NoError(t, hmt.SetForwarding(Forwarding{Pseudonym: "proxy-a", TrustAll: true}))
+	assert.NoError(t, hmt.SetHeaderRules(HeaderRules{
+		Response: []HeaderRule{{Action: HeaderActionSet, Name: "X-Request-Id", Value: "${request_id}"}},
+	}, nil))
+	cm, _ := NewCacheMgrFilter(cs)
+	cm.SetNextFilter(hmt)
+	rh, _ := NewResponseHeadersFilter(hmt)
+	rh.SetNextFilter(cm)
+
+	for _, id := range []string{"req-1", "req-2"} {
+		info := &RequestInfo{ID: id, ClientIP: "192.0.2.1"}
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		res := &http.Response{}
+		assert.NoError(t, rh.Process(WithRequestInfo(context.Background(), info), req, res))
+		assert.Equal(t, id, res.Header.Get("X-Request-Id"))
+		assert.Equal(t, []string{"1.1 proxy-a"}, res.Header.Values("Via"))
+	}
+	assert.Equal(t, 1, upstreamCalls, "the second request is a hit")
+	if assert.NotNil(t, cached) {
+		assert.Empty(t, cached.Header.Get("X-Request-Id"), "the cache keeps the upstream's headers")
+		assert.Empty(t, cached.Header.Get("Via"))
+	}
+}
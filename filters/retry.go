@@ -0,0 +1,259 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/LamineKouissi/LHP/util"
+)
+
+// retry defaults
+const (
+	DefaultRetryMaxAttempts     = 3
+	DefaultRetryInitialBackoff  = 100 * time.Millisecond
+	DefaultRetryMaxBackoff      = 2 * time.Second
+	DefaultRetryBudgetRatio     = 0.2
+	DefaultRetryBudgetMinPerSec = 10
+	// the budget counts the requests and retries of the last retryBudgetWindow seconds
+	retryBudgetWindow       = 10
+	retryBudgetBucketLength = time.Second
+	retryAfterHeader        = "Retry-After"
+)
+
+// DefaultRetryStatuses are the upstream statuses retried when none are configured.
+var DefaultRetryStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// RetryPolicy sets when and how often RetryFilter sends a request again.
+// MaxAttempts counts the first attempt, the backoff before the nth retry is
+// a random duration up to InitialBackoff*2^(n-1), capped at MaxBackoff.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	RetryOn        []int
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    DefaultRetryMaxAttempts,
+		InitialBackoff: DefaultRetryInitialBackoff,
+		MaxBackoff:     DefaultRetryMaxBackoff,
+		RetryOn:        DefaultRetryStatuses,
+	}
+}
+
+// RetryBudget caps the retries to a share of the requests over the last
+// ten seconds, plus a few retries per second, so that retries cannot
+// multiply the load on an upstream which is already failing.
+type RetryBudget struct {
+	ratio        float64
+	minPerSecond int
+
+	mu      sync.Mutex
+	buckets [retryBudgetWindow]retryBudgetBucket
+	now     func() time.Time
+}
+
+type retryBudgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+func NewRetryBudget(ratio float64, minPerSecond int) (*RetryBudget, error) {
+	if ratio < 0 {
+		return nil, errors.New("invalid input : ratio < 0")
+	}
+	if minPerSecond < 0 {
+		return nil, errors.New("invalid input : minPerSecond < 0")
+	}
+	return &RetryBudget{ratio: ratio, minPerSecond: minPerSecond, now: time.Now}, nil
+}
+
+func (rb *RetryBudget) bucket() *retryBudgetBucket {
+	second := rb.now().Truncate(retryBudgetBucketLength).Unix()
+	b := &rb.buckets[second%retryBudgetWindow]
+	if b.second != second {
+		*b = retryBudgetBucket{second: second}
+	}
+	return b
+}
+
+// Request records a request sent for the first time.
+func (rb *RetryBudget) Request() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.bucket().requests++
+}
+
+// TryRetry reports whether a retry is within the budget and, if so, records it.
+func (rb *RetryBudget) TryRetry() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	current := rb.bucket()
+	oldest := current.second - retryBudgetWindow + 1
+	var requests, retries int
+	for _, b := range rb.buckets {
+		if b.second >= oldest {
+			requests += b.requests
+			retries += b.retries
+		}
+	}
+	if float64(retries) >= float64(rb.minPerSecond*retryBudgetWindow)+rb.ratio*float64(requests) {
+		return false
+	}
+	current.retries++
+	return true
+}
+
+// RetryFilter sends idempotent requests again when the next filter fails
+// with a retryable error (see ProxyError) or answers one of the retried
+// statuses. It goes right before the connector.
+type RetryFilter struct {
+	policy     RetryPolicy
+	budget     *RetryBudget
+	nextFilter Filter
+	sleep      func(ctx context.Context, d time.Duration) error
+}
+
+func NewRetryFilter(policy RetryPolicy, budget *RetryBudget) (*RetryFilter, error) {
+	if budget == nil {
+		return nil, errors.New("RetryBudget = <nil>")
+	}
+	if policy.MaxAttempts < 1 {
+		return nil, errors.New("invalid input : MaxAttempts < 1")
+	}
+	if policy.InitialBackoff <= 0 || policy.MaxBackoff < policy.InitialBackoff {
+		return nil, errors.New("invalid input : InitialBackoff <= 0 or MaxBackoff < InitialBackoff")
+	}
+	return &RetryFilter{policy: policy, budget: budget, sleep: sleepCtx}, nil
+}
+
+func (rf *RetryFilter) SetNextFilter(f Filter) error {
+	if f == nil {
+		return errors.New("nextFilter = <nil>")
+	}
+	rf.nextFilter = f
+	return nil
+}
+
+func (rf *RetryFilter) Process(ctx context.Context, req *http.Request, res *http.Response) error {
+	if rf.nextFilter == nil {
+		return ErrNoNextFilter("RetryFilter")
+	}
+	rf.budget.Request()
+	replayable := isIdempotent(req.Method) && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+
+	for attempt := 1; ; attempt++ {
+		*res = http.Response{}
+		err := rf.nextFilter.Process(ctx, req, res)
+		if !replayable || attempt >= rf.policy.MaxAttempts {
+			return err
+		}
+
+		backoff := rf.backoff(attempt)
+		switch {
+		case err != nil:
+			if !IsRetryable(err) {
+				return err
+			}
+		case rf.retryStatus(res.StatusCode):
+			retryAfter, ok := parseRetryAfter(res.Header.Get(retryAfterHeader), time.Now())
+			if ok && retryAfter > rf.policy.MaxBackoff {
+				// the upstream will not be back in time, the client gets the response
+				return nil
+			}
+			if ok {
+				backoff = retryAfter
+			}
+		default:
+			return nil
+		}
+
+		if !rf.budget.TryRetry() {
+			util.Debugln("RetryFilter : retry budget exhausted,", req.Method, req.URL)
+			return err
+		}
+		if req.GetBody != nil {
+			body, gerr := req.GetBody()
+			if gerr != nil {
+				return err
+			}
+			req.Body = body
+		}
+		if res.Body != nil {
+			res.Body.Close()
+		}
+		if serr := rf.sleep(ctx, backoff); serr != nil {
+			return NewClientError(StatusClientClosedRequest, "The client closed the request.", serr)
+		}
+		util.Debugln("RetryFilter : attempt", attempt+1, "of", req.Method, req.URL, "after", backoff)
+	}
+}
+
+// backoff is a random duration up to the exponential backoff of attempt, "full jitter".
+func (rf *RetryFilter) backoff(attempt int) time.Duration {
+	d := rf.policy.MaxBackoff
+	if shift := attempt - 1; shift < 32 {
+		if exp := rf.policy.InitialBackoff << shift; exp > 0 && exp < d {
+			d = exp
+		}
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+func (rf *RetryFilter) retryStatus(status int) bool {
+	for _, s := range rf.policy.RetryOn {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// isIdempotent reports whether sending a request with method twice has the
+// same effect as sending it once, RFC 9110 9.2.2.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter reads a Retry-After value, in seconds or as an HTTP date.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,183 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestRetryFilter records the backoffs instead of sleeping.
+func newTestRetryFilter(t *testing.T, budget *RetryBudget, next Filter) (*RetryFilter, *[]time.Duration) {
+	if budget == nil {
+		budget, _ = NewRetryBudget(DefaultRetryBudgetRatio, DefaultRetryBudgetMinPerSec)
+	}
+	rf, err := NewRetryFilter(DefaultRetryPolicy(), budget)
+	assert.NoError(t, err)
+	assert.NoError(t, rf.SetNextFilter(next))
+	var sleeps []time.Duration
+	rf.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return ctx.Err()
+	}
+	return rf, &sleeps
+}
+
+// upstreamSequence answers each attempt with the next of results, a status or an error.
+func upstreamSequence(attempts *int, results ...interface{}) Filter {
+	return &MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		r := results[*attempts]
+		*attempts++
+		switch r := r.(type) {
+		case error:
+			return r
+		case int:
+			res.StatusCode = r
+			res.Header = http.Header{}
+			res.Body = io.NopCloser(strings.NewReader(http.StatusText(r)))
+		case http.Header:
+			res.StatusCode = http.StatusServiceUnavailable
+			res.Header = r
+			res.Body = http.NoBody
+		}
+		return nil
+	}}
+}
+
+func TestRetryFilter(t *testing.T) {
+	reset := NewUpstreamError("example.com", errors.New("connection reset by peer"))
+	tests := []struct {
+		name         string
+		method       string
+		body         io.Reader
+		results      []interface{}
+		wantAttempts int
+		wantStatus   int
+		wantErr      bool
+	}{
+		{name: "Success", method: http.MethodGet, results: []interface{}{200}, wantAttempts: 1, wantStatus: 200},
+		{name: "Connection reset then success", method: http.MethodGet, results: []interface{}{reset, 200}, wantAttempts: 2, wantStatus: 200},
+		{name: "Retried status", method: http.MethodGet, results: []interface{}{503, 502, 200}, wantAttempts: 3, wantStatus: 200},
+		{name: "Max attempts", method: http.MethodGet, results: []interface{}{503, 503, 504}, wantAttempts: 3, wantStatus: 504},
+		{name: "Max attempts on errors", method: http.MethodGet, results: []interface{}{reset, reset, reset}, wantAttempts: 3, wantErr: true},
+		{name: "Not retried status", method: http.MethodGet, results: []interface{}{500}, wantAttempts: 1, wantStatus: 500},
+		{name: "Not retryable error", method: http.MethodGet, results: []interface{}{errors.New("boom")}, wantAttempts: 1, wantErr: true},
+		{name: "Not idempotent", method: http.MethodPost, results: []interface{}{reset}, wantAttempts: 1, wantErr: true},
+		{name: "Body not replayable", method: http.MethodPut, body: io.MultiReader(strings.NewReader("x")), results: []interface{}{503}, wantAttempts: 1, wantStatus: 503},
+		{name: "Retry-After too long", method: http.MethodGet, results: []interface{}{http.Header{"Retry-After": {"120"}}}, wantAttempts: 1, wantStatus: 503},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			rf, _ := newTestRetryFilter(t, nil, upstreamSequence(&attempts, tt.results...))
+			req := httptest.NewRequest(tt.method, "http://example.com/", tt.body)
+			if tt.body != nil {
+				req.GetBody = nil
+			}
+			res := &http.Response{}
+			err := rf.Process(context.Background(), req, res)
+			assert.Equal(t, tt.wantAttempts, attempts)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+		})
+	}
+}
+
+func TestRetryFilterBackoff(t *testing.T) {
+	attempts := 0
+	rf, sleeps := newTestRetryFilter(t, nil, upstreamSequence(&attempts, 503, http.Header{"Retry-After": {"1"}}, 200))
+	err := rf.Process(context.Background(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil), &http.Response{})
+	assert.NoError(t, err)
+	if assert.Len(t, *sleeps, 2) {
+		assert.True(t, (*sleeps)[0] <= DefaultRetryInitialBackoff)
+		assert.Equal(t, time.Second, (*sleeps)[1], "Retry-After is honored")
+	}
+
+	for attempt := 1; attempt < 40; attempt++ {
+		assert.True(t, rf.backoff(attempt) <= DefaultRetryMaxBackoff)
+	}
+
+	// the request body is sent again
+	var bodies []string
+	rf, _ = newTestRetryFilter(t, nil, &MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		b, _ := io.ReadAll(req.Body)
+		bodies = append(bodies, string(b))
+		res.StatusCode = http.StatusBadGateway
+		return nil
+	}})
+	req, _ := http.NewRequest(http.MethodPut, "http://example.com/", strings.NewReader("payload"))
+	rf.Process(context.Background(), req, &http.Response{})
+	assert.Equal(t, []string{"payload", "payload", "payload"}, bodies)
+}
+
+func TestRetryFilterClientGone(t *testing.T) {
+	attempts := 0
+	rf, _ := newTestRetryFilter(t, nil, upstreamSequence(&attempts, 503, 200))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := rf.Process(ctx, httptest.NewRequest(http.MethodGet, "http://example.com/", nil), &http.Response{})
+	assert.Equal(t, StatusClientClosedRequest, StatusForError(err))
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryBudget(t *testing.T) {
+	_, err := NewRetryBudget(-1, 0)
+	assert.Error(t, err)
+
+	now := time.Unix(1000, 0)
+	rb, _ := NewRetryBudget(0.5, 0)
+	rb.now = func() time.Time { return now }
+	for i := 0; i < 4; i++ {
+		rb.Request()
+	}
+	assert.True(t, rb.TryRetry())
+	assert.True(t, rb.TryRetry())
+	assert.False(t, rb.TryRetry(), "2 retries for 4 requests")
+
+	// the window moves on
+	now = now.Add(retryBudgetWindow * time.Second)
+	assert.False(t, rb.TryRetry())
+	rb.Request()
+	rb.Request()
+	assert.True(t, rb.TryRetry())
+
+	// the minimum is allowed without requests
+	rb, _ = NewRetryBudget(0, 1)
+	rb.now = func() time.Time { return now }
+	for i := 0; i < retryBudgetWindow; i++ {
+		assert.True(t, rb.TryRetry())
+	}
+	assert.False(t, rb.TryRetry())
+
+	// an exhausted budget returns the last response
+	attempts := 0
+	rf, _ := newTestRetryFilter(t, rb, upstreamSequence(&attempts, 503, 200))
+	res := &http.Response{}
+	assert.NoError(t, rf.Process(context.Background(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil), res))
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	d, ok := parseRetryAfter("3", now)
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, d)
+	d, ok = parseRetryAfter(now.Add(5*time.Second).Format(http.TimeFormat), now)
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Second, d)
+	_, ok = parseRetryAfter("soon", now)
+	assert.False(t, ok)
+	_, ok = parseRetryAfter("", now)
+	assert.False(t, ok)
+}
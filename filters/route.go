@@ -0,0 +1,71 @@
+package filters
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RouteMatcher selects the requests belonging to a named route. Empty fields
+// match everything, Host may start with "*." to match any subdomain.
+type RouteMatcher struct {
+	Name       string
+	Host       string
+	PathPrefix string
+	Method     string
+}
+
+func (rm RouteMatcher) Match(req *http.Request) bool {
+	if rm.Method != "" && rm.Method != "ANY" && !strings.EqualFold(rm.Method, req.Method) {
+		return false
+	}
+	if rm.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, rm.PathPrefix) {
+		return false
+	}
+	if rm.Host != "" && !MatchHost(rm.Host, RequestHost(req)) {
+		return false
+	}
+	return true
+}
+
+// MatchRoute returns the name of the first route matching req.
+func MatchRoute(routes []RouteMatcher, req *http.Request) (string, bool) {
+	for _, rm := range routes {
+		if rm.Match(req) {
+			return rm.Name, true
+		}
+	}
+	return "", false
+}
+
+// MatchHost reports whether host matches pattern, an exact host name or a
+// "*.example.com" wildcard matching example.com subdomains.
+func MatchHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// RequestHost returns the target host of req without its port.
+func RequestHost(req *http.Request) string {
+	if req.URL != nil && req.URL.Host != "" {
+		return req.URL.Hostname()
+	}
+	if h, _, err := net.SplitHostPort(req.Host); err == nil {
+		return h
+	}
+	return strings.Trim(req.Host, "[]")
+}
+
+func WithRoute(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, routeKey, name)
+}
+
+func RouteFromCtx(ctx context.Context) (string, bool) {
+	route, ok := ctx.Value(routeKey).(string)
+	return route, ok
+}
@@ -0,0 +1,60 @@
+package filters
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteMatcherMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		matcher RouteMatcher
+		method  string
+		url     string
+		want    bool
+	}{
+		{name: "Match all", matcher: RouteMatcher{}, method: "GET", url: "http://example.com/", want: true},
+		{name: "Exact host", matcher: RouteMatcher{Host: "example.com"}, method: "GET", url: "http://EXAMPLE.com:8080/", want: true},
+		{name: "Other host", matcher: RouteMatcher{Host: "example.com"}, method: "GET", url: "http://example.org/", want: false},
+		{name: "Wildcard host", matcher: RouteMatcher{Host: "*.example.com"}, method: "GET", url: "http://api.example.com/", want: true},
+		{name: "Wildcard excludes apex", matcher: RouteMatcher{Host: "*.example.com"}, method: "GET", url: "http://example.com/", want: false},
+		{name: "Wildcard suffix only", matcher: RouteMatcher{Host: "*.example.com"}, method: "GET", url: "http://badexample.com/", want: false},
+		{name: "Path prefix", matcher: RouteMatcher{PathPrefix: "/api/"}, method: "GET", url: "http://example.com/api/v1", want: true},
+		{name: "Other path", matcher: RouteMatcher{PathPrefix: "/api/"}, method: "GET", url: "http://example.com/static", want: false},
+		{name: "Method", matcher: RouteMatcher{Method: "POST"}, method: "GET", url: "http://example.com/", want: false},
+		{name: "Any method", matcher: RouteMatcher{Method: "ANY"}, method: "PATCH", url: "http://example.com/", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			assert.Equal(t, tt.want, tt.matcher.Match(req))
+		})
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	routes := []RouteMatcher{
+		{Name: "api", Host: "api.example.com"},
+		{Name: "fallback"},
+	}
+	name, ok := MatchRoute(routes, httptest.NewRequest(http.MethodGet, "http://api.example.com/", nil))
+	assert.True(t, ok)
+	assert.Equal(t, "api", name)
+
+	name, ok = MatchRoute(routes, httptest.NewRequest(http.MethodGet, "http://other.com/", nil))
+	assert.True(t, ok)
+	assert.Equal(t, "fallback", name)
+
+	_, ok = MatchRoute(nil, httptest.NewRequest(http.MethodGet, "http://other.com/", nil))
+	assert.False(t, ok)
+
+	ctx := WithRoute(context.Background(), "api")
+	route, ok := RouteFromCtx(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "api", route)
+}
@@ -0,0 +1,337 @@
+package filters
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// W3C trace context headers, https://www.w3.org/TR/trace-context/
+const (
+	TraceparentHeader = "Traceparent"
+	TracestateHeader  = "Tracestate"
+)
+
+type SpanKind int
+
+// values of the OTLP span kinds
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// SpanContext identifies a span within its trace.
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Flags      byte
+	TraceState string
+}
+
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&0x01 == 0x01
+}
+
+func (sc SpanContext) TraceIDString() string {
+	return hex.EncodeToString(sc.TraceID[:])
+}
+
+func (sc SpanContext) SpanIDString() string {
+	return hex.EncodeToString(sc.SpanID[:])
+}
+
+// Traceparent formats sc as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceIDString(), sc.SpanIDString(), sc.Flags)
+}
+
+// ParseTraceparent parses a traceparent header value, it returns false for
+// malformed values and all-zero ids so the caller starts a new trace instead.
+func ParseTraceparent(v string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if !decodeHexID(sc.TraceID[:], parts[1]) || !decodeHexID(sc.SpanID[:], parts[2]) {
+		return sc, false
+	}
+	var flags [1]byte
+	if !decodeHexID(flags[:], parts[3]) {
+		return sc, false
+	}
+	sc.Flags = flags[0]
+	return sc, true
+}
+
+// decodeHexID decodes a lowercase hex id into dst, all-zero ids are invalid.
+func decodeHexID(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	if _, err := hex.Decode(dst, []byte(s)); err != nil {
+		return false
+	}
+	for _, b := range dst {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// SpanData is a finished span handed to the SpanExporter.
+type SpanData struct {
+	Name         string
+	Kind         SpanKind
+	SpanContext  SpanContext
+	ParentSpanID [8]byte
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]interface{}
+	Error        string
+}
+
+func (sd SpanData) HasParent() bool {
+	return sd.ParentSpanID != [8]byte{}
+}
+
+// SpanExporter ships finished spans to a collector, see adapters.NewOTLPHTTPExporter.
+type SpanExporter interface {
+	ExportSpan(span SpanData)
+}
+
+type Tracer struct {
+	exporter SpanExporter
+}
+
+func NewTracer(exporter SpanExporter) (*Tracer, error) {
+	if exporter == nil {
+		return nil, errors.New("SpanExporter = <nil>")
+	}
+	return &Tracer{exporter: exporter}, nil
+}
+
+// Shutdown sends the spans the exporter still holds, for the exporters
+// which batch them; it is called once on exit.
+func (t *Tracer) Shutdown() error {
+	if s, ok := t.exporter.(interface{ Shutdown() error }); ok {
+		return s.Shutdown()
+	}
+	return nil
+}
+
+// Span is an operation being traced. A nil *Span is a valid no-op span, so
+// code can trace unconditionally whether or not a tracer is installed.
+type Span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// Start starts a span, child of the span in ctx or of parent when ctx holds
+// none; a zero parent starts a new trace.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind, parent SpanContext) (context.Context, *Span) {
+	if ps := SpanFromCtx(ctx); ps != nil {
+		parent = ps.SpanContext()
+	}
+	sc := SpanContext{TraceID: parent.TraceID, Flags: parent.Flags, TraceState: parent.TraceState}
+	if sc.TraceID == [16]byte{} {
+		rand.Read(sc.TraceID[:])
+		sc.Flags = 0x01
+	}
+	rand.Read(sc.SpanID[:])
+
+	span := &Span{tracer: t, data: SpanData{
+		Name:         name,
+		Kind:         kind,
+		SpanContext:  sc,
+		ParentSpanID: parent.SpanID,
+		Start:        time.Now(),
+		Attributes:   map[string]interface{}{},
+	}}
+	return context.WithValue(ctx, spanKey, span), span
+}
+
+// StartSpan starts a child of the span in ctx, it returns a nil span when
+// ctx is not traced.
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	ps := SpanFromCtx(ctx)
+	if ps == nil {
+		return ctx, nil
+	}
+	return ps.tracer.Start(ctx, name, kind, SpanContext{})
+}
+
+func SpanFromCtx(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+// SetAttribute sets an attribute of the span, it is a no-op once the span ended.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.data.Attributes[key] = value
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.data.Error = err.Error()
+}
+
+// End finishes the span and exports it if its trace is sampled, only the first call counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	// the exporter may read the attributes after End returns
+	data.Attributes = make(map[string]interface{}, len(s.data.Attributes))
+	for k, v := range s.data.Attributes {
+		data.Attributes[k] = v
+	}
+	s.mu.Unlock()
+
+	if data.SpanContext.Sampled() {
+		s.tracer.exporter.ExportSpan(data)
+	}
+}
+
+// InjectTraceContext sets the traceparent and tracestate headers of an
+// outgoing request to the span in ctx.
+func InjectTraceContext(ctx context.Context, h http.Header) {
+	span := SpanFromCtx(ctx)
+	if span == nil {
+		return
+	}
+	sc := span.SpanContext()
+	h.Set(TraceparentHeader, sc.Traceparent())
+	if sc.TraceState != "" {
+		h.Set(TracestateHeader, sc.TraceState)
+	} else {
+		h.Del(TracestateHeader)
+	}
+}
+
+// TracingFilter starts the server span of each request, continuing the
+// client's trace when the request carries a valid traceparent.
+type TracingFilter struct {
+	tracer     *Tracer
+	nextFilter Filter
+}
+
+func NewTracingFilter(t *Tracer) (*TracingFilter, error) {
+	if t == nil {
+		return nil, errors.New("Tracer = <nil>")
+	}
+	return &TracingFilter{tracer: t}, nil
+}
+
+func (tf *TracingFilter) SetNextFilter(f Filter) error {
+	if f == nil {
+		return errors.New("nextFilter = <nil>")
+	}
+	tf.nextFilter = f
+	return nil
+}
+
+func (tf *TracingFilter) Process(ctx context.Context, req *http.Request, res *http.Response) error {
+	parent, ok := ParseTraceparent(req.Header.Get(TraceparentHeader))
+	if ok {
+		parent.TraceState = req.Header.Get(TracestateHeader)
+	}
+	ctx, span := tf.tracer.Start(ctx, "HTTP "+req.Method, SpanKindServer, parent)
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("url.full", req.URL.String())
+	span.SetAttribute("server.address", RequestHost(req))
+	info, ok := RequestInfoFromCtx(ctx)
+	if ok {
+		info.TraceID = span.SpanContext().TraceIDString()
+		span.SetAttribute("lhp.request_id", info.ID)
+	}
+	if route, ok := RouteFromCtx(ctx); ok {
+		span.SetAttribute("lhp.route", route)
+	}
+
+	var err error
+	if tf.nextFilter == nil {
+		err = ErrNoNextFilter("TracingFilter")
+	} else {
+		err = tf.nextFilter.Process(ctx, req, res)
+	}
+	span.SetError(err)
+	if res.StatusCode != 0 {
+		span.SetAttribute("http.response.status_code", res.StatusCode)
+	}
+	if info != nil && info.CacheStatus != "" {
+		span.SetAttribute("lhp.cache_status", info.CacheStatus)
+	}
+
+	if res.Body == nil {
+		span.End()
+		return err
+	}
+	res.Body = &countingReadCloser{rc: res.Body, onClose: func(n int64) {
+		span.SetAttribute("http.response.body.size", n)
+		span.End()
+	}}
+	return err
+}
+
+// Wrap traces every invocation of f in its own span, named after f's type.
+// It is a FilterWrapper for ConstructWrappedFilterChain.
+func (t *Tracer) Wrap(f Filter) Filter {
+	return &tracedFilter{name: FilterName(f), f: f}
+}
+
+type tracedFilter struct {
+	name string
+	f    Filter
+}
+
+func (tf *tracedFilter) Process(ctx context.Context, req *http.Request, res *http.Response) error {
+	ctx, span := StartSpan(ctx, tf.name, SpanKindInternal)
+	err := tf.f.Process(ctx, req, res)
+	span.SetError(err)
+	span.End()
+	return err
+}
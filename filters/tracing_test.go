@@ -0,0 +1,213 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingSpanExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (r *recordingSpanExporter) ExportSpan(span SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func (r *recordingSpanExporter) byName(name string) (SpanData, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.spans {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return SpanData{}, false
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{name: "Valid", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ok: true},
+		{name: "Future version with extra field", value: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", ok: true},
+		{name: "Empty", value: "", ok: false},
+		{name: "Version ff", value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ok: false},
+		{name: "Zero trace id", value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", ok: false},
+		{name: "Zero span id", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", ok: false},
+		{name: "Uppercase", value: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", ok: false},
+		{name: "Short trace id", value: "00-4bf92f35-00f067aa0ba902b7-01", ok: false},
+		{name: "Extra field in version 00", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x", ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(tt.value)
+			assert.Equal(t, tt.ok, ok)
+			if ok && strings.HasPrefix(tt.value, "00-") {
+				assert.Equal(t, tt.value, sc.Traceparent())
+			}
+		})
+	}
+}
+
+func newTracedChain(t *testing.T, exp *recordingSpanExporter, connector Filter) Filter {
+	tracer, err := NewTracer(exp)
+	assert.NoError(t, err)
+	tf, _ := NewTracingFilter(tracer)
+	transformer, _ := NewHttpMsgTransformerFilter(connector)
+	chain, err := ConstructWrappedFilterChain(context.Background(), []HasNextFilter{tf, transformer}, connector, tracer.Wrap)
+	assert.NoError(t, err)
+	return chain
+}
+
+func TestTracingFilter(t *testing.T) {
+	var upstreamHeader http.Header
+	connector := &MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		ctx, span := StartSpan(ctx, "upstream GET", SpanKindClient)
+		defer span.End()
+		InjectTraceContext(ctx, req.Header)
+		upstreamHeader = req.Header.Clone()
+		*res = http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("ok"))}
+		return nil
+	}}
+
+	t.Run("Continues the client trace", func(t *testing.T) {
+		exp := &recordingSpanExporter{}
+		chain := newTracedChain(t, exp, connector)
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		req.Header.Set(TracestateHeader, "vendor=1")
+		info := NewRequestInfo(req)
+		res := &http.Response{}
+
+		assert.NoError(t, chain.Process(WithRequestInfo(context.Background(), info), req, res))
+		res.Body.Close()
+
+		server, ok := exp.byName("HTTP GET")
+		assert.True(t, ok)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext.TraceIDString())
+		assert.Equal(t, "00f067aa0ba902b7", SpanContext{SpanID: server.ParentSpanID}.SpanIDString())
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", info.TraceID)
+		assert.Equal(t, http.StatusOK, server.Attributes["http.response.status_code"])
+
+		transformer, ok := exp.byName("HttpMsgTransformerFilter")
+		assert.True(t, ok)
+		assert.Equal(t, server.SpanContext.SpanID, transformer.ParentSpanID)
+		mock, ok := exp.byName("MockFilter")
+		assert.True(t, ok)
+		assert.Equal(t, transformer.SpanContext.SpanID, mock.ParentSpanID)
+		upstream, ok := exp.byName("upstream GET")
+		assert.True(t, ok)
+		assert.Equal(t, mock.SpanContext.SpanID, upstream.ParentSpanID)
+
+		assert.Equal(t, upstream.SpanContext.Traceparent(), upstreamHeader.Get(TraceparentHeader))
+		assert.Equal(t, "vendor=1", upstreamHeader.Get(TracestateHeader))
+	})
+
+	t.Run("Starts a new trace", func(t *testing.T) {
+		exp := &recordingSpanExporter{}
+		chain := newTracedChain(t, exp, connector)
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set(TraceparentHeader, "garbage")
+		res := &http.Response{}
+		assert.NoError(t, chain.Process(context.Background(), req, res))
+		res.Body.Close()
+
+		server, ok := exp.byName("HTTP GET")
+		assert.True(t, ok)
+		assert.False(t, server.HasParent())
+		assert.True(t, server.SpanContext.Sampled())
+		sc, ok := ParseTraceparent(upstreamHeader.Get(TraceparentHeader))
+		assert.True(t, ok)
+		assert.Equal(t, server.SpanContext.TraceID, sc.TraceID)
+	})
+
+	t.Run("Unsampled trace is not exported", func(t *testing.T) {
+		exp := &recordingSpanExporter{}
+		chain := newTracedChain(t, exp, connector)
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+		res := &http.Response{}
+		assert.NoError(t, chain.Process(context.Background(), req, res))
+		res.Body.Close()
+		assert.Empty(t, exp.spans)
+		assert.True(t, strings.HasSuffix(upstreamHeader.Get(TraceparentHeader), "-00"))
+	})
+}
+
+func TestSpanError(t *testing.T) {
+	exp := &recordingSpanExporter{}
+	tracer, _ := NewTracer(exp)
+	wrapped := tracer.Wrap(&MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		return errors.New("boom")
+	}})
+	ctx, root := tracer.Start(context.Background(), "root", SpanKindServer, SpanContext{})
+	assert.Error(t, wrapped.Process(ctx, httptest.NewRequest(http.MethodGet, "/", nil), &http.Response{}))
+	root.End()
+	root.End()
+
+	assert.Len(t, exp.spans, 2, "ending a span twice exports it once")
+	span, _ := exp.byName("MockFilter")
+	assert.Equal(t, "boom", span.Error)
+
+	// untraced contexts get no-op spans
+	_, span2 := StartSpan(context.Background(), "noop", SpanKindInternal)
+	assert.Nil(t, span2)
+	span2.SetAttribute("k", "v")
+	span2.End()
+}
+
+func TestSpanEndedAttributes(t *testing.T) {
+	exp := &recordingSpanExporter{}
+	tracer, _ := NewTracer(exp)
+	_, span := tracer.Start(context.Background(), "root", SpanKindServer, SpanContext{})
+	span.SetAttribute("k", "v")
+	span.End()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		span.SetAttribute("late", "v")
+		span.SetError(errors.New("late"))
+	}()
+	// the exporter reads the attributes while the span is still in use
+	exported, _ := exp.byName("root")
+	assert.Equal(t, map[string]interface{}{"k": "v"}, exported.Attributes)
+	wg.Wait()
+
+	assert.Empty(t, exported.Error)
+	assert.NotContains(t, span.data.Attributes, "late", "the span is read-only once ended")
+}
+
+type batchingSpanExporter struct {
+	recordingSpanExporter
+	shutdowns int
+}
+
+func (b *batchingSpanExporter) Shutdown() error {
+	b.shutdowns++
+	return errors.New("collector unreachable")
+}
+
+func TestTracerShutdown(t *testing.T) {
+	batching := &batchingSpanExporter{}
+	tracer, _ := NewTracer(batching)
+	assert.EqualError(t, tracer.Shutdown(), "collector unreachable")
+	assert.Equal(t, 1, batching.shutdowns)
+
+	tracer, _ = NewTracer(&recordingSpanExporter{})
+	assert.NoError(t, tracer.Shutdown(), "an exporter without buffer has nothing to send")
+}
@@ -0,0 +1,278 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/LamineKouissi/LHP/util"
+)
+
+// active health check and outlier detection defaults
+const (
+	DefaultHealthCheckInterval           = 10 * time.Second
+	DefaultHealthCheckTimeout            = 2 * time.Second
+	DefaultHealthCheckHealthyThreshold   = 2
+	DefaultHealthCheckUnhealthyThreshold = 3
+	DefaultOutlierConsecutiveFailures    = 5
+	DefaultOutlierEjectionTime           = 30 * time.Second
+	DefaultOutlierMaxEjectionPercent     = 50
+)
+
+// UpstreamTarget is a server of an UpstreamPool. A target takes requests
+// while its active health check passes and it is not ejected.
+type UpstreamTarget struct {
+	URL *url.URL
+
+	active              atomic.Int64
+	unhealthy           atomic.Bool
+	ejectedUntil        atomic.Int64
+	consecutiveFailures atomic.Int64
+	// updated by the health check goroutine only
+	checkSuccesses int
+	checkFailures  int
+}
+
+// Active is the number of requests in flight to t.
+func (t *UpstreamTarget) Active() int64 {
+	return t.active.Load()
+}
+
+func (t *UpstreamTarget) Healthy() bool {
+	return !t.unhealthy.Load()
+}
+
+func (t *UpstreamTarget) Ejected(now time.Time) bool {
+	return now.UnixNano() < t.ejectedUntil.Load()
+}
+
+// HealthCheck probes each target of a pool with GET Path every Interval. A
+// target is marked unhealthy after UnhealthyThreshold failed probes in a
+// row and healthy again after HealthyThreshold successful ones; a probe
+// succeeds when the target answers a 2xx or 3xx status within Timeout.
+type HealthCheck struct {
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+// OutlierDetection ejects a target for EjectionTime after
+// ConsecutiveFailures upstream errors or gateway error statuses (502, 503,
+// 504) in a row, never ejecting more than MaxEjectionPercent of the pool.
+type OutlierDetection struct {
+	ConsecutiveFailures int
+	EjectionTime        time.Duration
+	MaxEjectionPercent  int
+}
+
+func DefaultOutlierDetection() OutlierDetection {
+	return OutlierDetection{
+		ConsecutiveFailures: DefaultOutlierConsecutiveFailures,
+		EjectionTime:        DefaultOutlierEjectionTime,
+		MaxEjectionPercent:  DefaultOutlierMaxEjectionPercent,
+	}
+}
+
+// UpstreamPool is a named set of targets serving the same service, the
+// Balancer picks the target of each request among the available ones.
+type UpstreamPool struct {
+	name     string
+	targets  []*UpstreamTarget
+	balancer Balancer
+	outlier  *OutlierDetection
+	check    *HealthCheck
+	client   *http.Client
+	now      func() time.Time
+	// serializes the ejections so MaxEjectionPercent holds
+	ejectMu sync.Mutex
+}
+
+// NewUpstreamPool builds a pool of the targets, base URLs like "http://10.0.0.1:8080".
+func NewUpstreamPool(name string, targets []string, balancer Balancer) (*UpstreamPool, error) {
+	if name == "" {
+		return nil, errors.New("invalid input : empty pool name")
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("upstream pool %s : no targets", name)
+	}
+	if balancer == nil {
+		return nil, errors.New("Balancer = <nil>")
+	}
+	p := &UpstreamPool{name: name, balancer: balancer, now: time.Now}
+	for _, target := range targets {
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("upstream pool %s : invalid target %q, expected http(s)://host[:port][/path]", name, target)
+		}
+		p.targets = append(p.targets, &UpstreamTarget{URL: u})
+	}
+	balancer.Init(p.targets)
+	return p, nil
+}
+
+func (p *UpstreamPool) Name() string {
+	return p.name
+}
+
+func (p *UpstreamPool) Targets() []*UpstreamTarget {
+	return p.targets
+}
+
+func (p *UpstreamPool) SetOutlierDetection(od OutlierDetection) error {
+	if od.ConsecutiveFailures <= 0 || od.EjectionTime <= 0 || od.MaxEjectionPercent < 0 || od.MaxEjectionPercent > 100 {
+		return errors.New("invalid input : OutlierDetection")
+	}
+	p.outlier = &od
+	return nil
+}
+
+func (p *UpstreamPool) SetHealthCheck(hc HealthCheck) error {
+	if hc.Path == "" || hc.Interval <= 0 || hc.Timeout <= 0 || hc.HealthyThreshold <= 0 || hc.UnhealthyThreshold <= 0 {
+		return errors.New("invalid input : HealthCheck")
+	}
+	p.check = &hc
+	p.client = &http.Client{Timeout: hc.Timeout}
+	return nil
+}
+
+func (p *UpstreamPool) available(t *UpstreamTarget) bool {
+	return t.Healthy() && !t.Ejected(p.now())
+}
+
+// Pick chooses the target of req, it fails with a 503 when no target is available.
+func (p *UpstreamPool) Pick(req *http.Request) (*UpstreamTarget, error) {
+	t := p.balancer.Pick(req, p.targets, p.available)
+	if t == nil {
+		return nil, ProxyError{
+			Status:   http.StatusServiceUnavailable,
+			Category: ErrorCategoryUpstream,
+			Message:  "No healthy upstream server is available.",
+			Err:      fmt.Errorf("upstream pool %s : no available target", p.name),
+		}
+	}
+	return t, nil
+}
+
+// Report records the outcome of a request to t for the outlier detection.
+func (p *UpstreamPool) Report(t *UpstreamTarget, err error, status int) {
+	if p.outlier == nil {
+		return
+	}
+	pe, isProxyErr := AsProxyError(err)
+	failed := (isProxyErr && pe.Category == ErrorCategoryUpstream) ||
+		status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+	if !failed {
+		t.consecutiveFailures.Store(0)
+		return
+	}
+	if t.consecutiveFailures.Add(1) < int64(p.outlier.ConsecutiveFailures) {
+		return
+	}
+
+	p.ejectMu.Lock()
+	defer p.ejectMu.Unlock()
+	now := p.now()
+	if t.Ejected(now) {
+		return
+	}
+	ejected := 0
+	for _, other := range p.targets {
+		if other.Ejected(now) {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > p.outlier.MaxEjectionPercent*len(p.targets) {
+		return
+	}
+	t.ejectedUntil.Store(now.Add(p.outlier.EjectionTime).UnixNano())
+	t.consecutiveFailures.Store(0)
+	util.Warnln("upstream pool", p.name, ": ejected", t.URL, "for", p.outlier.EjectionTime)
+}
+
+// RunHealthChecks probes the targets until ctx is done, it returns at once
+// without health check.
+func (p *UpstreamPool) RunHealthChecks(ctx context.Context) {
+	if p.check == nil {
+		return
+	}
+	ticker := time.NewTicker(p.check.Interval)
+	defer ticker.Stop()
+	for {
+		p.checkTargets(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *UpstreamPool) checkTargets(ctx context.Context) {
+	var wg sync.WaitGroup
+	results := make([]error, len(p.targets))
+	for i, t := range p.targets {
+		wg.Add(1)
+		go func(i int, t *UpstreamTarget) {
+			defer wg.Done()
+			results[i] = p.probe(ctx, t)
+		}(i, t)
+	}
+	wg.Wait()
+
+	for i, t := range p.targets {
+		if results[i] == nil {
+			t.checkFailures = 0
+			t.checkSuccesses++
+			if !t.Healthy() && t.checkSuccesses >= p.check.HealthyThreshold {
+				t.unhealthy.Store(false)
+				util.Infoln("upstream pool", p.name, ":", t.URL, "is healthy")
+			}
+			continue
+		}
+		t.checkSuccesses = 0
+		t.checkFailures++
+		if t.Healthy() && t.checkFailures >= p.check.UnhealthyThreshold {
+			t.unhealthy.Store(true)
+			util.Warnln("upstream pool", p.name, ":", t.URL, "is unhealthy :", results[i])
+		}
+	}
+}
+
+func (p *UpstreamPool) probe(ctx context.Context, t *UpstreamTarget) error {
+	u := *t.URL
+	u.Path = singleJoiningSlash(t.URL.Path, p.check.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 400 {
+		return fmt.Errorf("health check answered %s", res.Status)
+	}
+	return nil
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := len(a) > 0 && a[len(a)-1] == '/'
+	bslash := len(b) > 0 && b[0] == '/'
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash && a != "" && b != "":
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,141 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// UpstreamPoolFilter sends the requests of the routes mapped to an upstream
+// pool to a target of the pool, rewriting the request URL to the target's.
+// It goes right before the connector, after the RetryFilter so that a
+// retry may go to another target.
+type UpstreamPoolFilter struct {
+	pools      map[string]*UpstreamPool
+	mu         sync.RWMutex
+	routePools map[string]string
+	// forward the requests of the other routes to their own URL instead of answering 404
+	passThrough bool
+	nextFilter  Filter
+}
+
+func NewUpstreamPoolFilter(pools []*UpstreamPool) (*UpstreamPoolFilter, error) {
+	if len(pools) == 0 {
+		return nil, errors.New("invalid input : no upstream pools")
+	}
+	upf := &UpstreamPoolFilter{pools: map[string]*UpstreamPool{}, routePools: map[string]string{}}
+	for _, p := range pools {
+		if p == nil {
+			return nil, errors.New("UpstreamPool = <nil>")
+		}
+		if _, ok := upf.pools[p.Name()]; ok {
+			return nil, errors.New("duplicate upstream pool : " + p.Name())
+		}
+		upf.pools[p.Name()] = p
+	}
+	return upf, nil
+}
+
+func (upf *UpstreamPoolFilter) SetNextFilter(f Filter) error {
+	if f == nil {
+		return errors.New("nextFilter = <nil>")
+	}
+	upf.nextFilter = f
+	return nil
+}
+
+// SetRoutePools maps route names to pool names, it can be called again on config reload.
+func (upf *UpstreamPoolFilter) SetRoutePools(routePools map[string]string) error {
+	if err := upf.ValidateRoutePools(routePools); err != nil {
+		return err
+	}
+	upf.mu.Lock()
+	defer upf.mu.Unlock()
+	upf.routePools = routePools
+	return nil
+}
+
+// ValidateRoutePools returns the error SetRoutePools would, without setting anything.
+func (upf *UpstreamPoolFilter) ValidateRoutePools(routePools map[string]string) error {
+	for route, pool := range routePools {
+		if _, ok := upf.pools[pool]; !ok {
+			return errors.New("route " + route + " : unknown upstream pool " + pool)
+		}
+	}
+	return nil
+}
+
+// SetPassThrough forwards the requests of the routes without pool to their
+// own URL, as a forward proxy does, instead of answering 404.
+func (upf *UpstreamPoolFilter) SetPassThrough(passThrough bool) {
+	upf.passThrough = passThrough
+}
+
+// Pools lists the pools by name.
+func (upf *UpstreamPoolFilter) Pools() map[string]*UpstreamPool {
+	return upf.pools
+}
+
+func (upf *UpstreamPoolFilter) poolFor(ctx context.Context) (*UpstreamPool, bool) {
+	route, ok := RouteFromCtx(ctx)
+	if !ok {
+		return nil, false
+	}
+	upf.mu.RLock()
+	name, ok := upf.routePools[route]
+	upf.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return upf.pools[name], true
+}
+
+func (upf *UpstreamPoolFilter) Process(ctx context.Context, req *http.Request, res *http.Response) error {
+	if upf.nextFilter == nil {
+		return ErrNoNextFilter("UpstreamPoolFilter")
+	}
+	pool, ok := upf.poolFor(ctx)
+	if !ok {
+		if upf.passThrough {
+			return upf.nextFilter.Process(ctx, req, res)
+		}
+		return NewClientError(http.StatusNotFound, "No route matches the request.", errors.New("no upstream pool for "+req.Host+req.URL.Path))
+	}
+
+	target, err := pool.Pick(req)
+	if err != nil {
+		return err
+	}
+	target.active.Add(1)
+
+	// the retries send req again, it is left as it came
+	outReq := *req
+	u := *req.URL
+	u.Scheme, u.Host = target.URL.Scheme, target.URL.Host
+	u.Path = singleJoiningSlash(target.URL.Path, req.URL.Path)
+	if u.RawPath != "" {
+		u.RawPath = singleJoiningSlash(target.URL.EscapedPath(), req.URL.EscapedPath())
+	}
+	outReq.URL = &u
+	outReq.Host = ""
+	outReq.Header = req.Header.Clone()
+	if outReq.Header == nil {
+		outReq.Header = http.Header{}
+	}
+	outReq.Header.Set("X-Forwarded-Host", req.Host)
+	if req.TLS != nil {
+		outReq.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		outReq.Header.Set("X-Forwarded-Proto", "http")
+	}
+
+	err = upf.nextFilter.Process(ctx, &outReq, res)
+	pool.Report(target, err, res.StatusCode)
+	if err != nil || res.Body == nil {
+		target.active.Add(-1)
+		return err
+	}
+	res.Body = &countingReadCloser{rc: res.Body, onClose: func(int64) { target.active.Add(-1) }}
+	return nil
+}
@@ -0,0 +1,112 @@
+package filters
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPoolFilter(t *testing.T, next Filter, targets ...string) *UpstreamPoolFilter {
+	pool, err := NewUpstreamPool("api", targets, &roundRobinBalancer{})
+	assert.NoError(t, err)
+	upf, err := NewUpstreamPoolFilter([]*UpstreamPool{pool})
+	assert.NoError(t, err)
+	assert.NoError(t, upf.SetNextFilter(next))
+	assert.NoError(t, upf.SetRoutePools(map[string]string{"api-route": "api"}))
+	return upf
+}
+
+func TestUpstreamPoolFilter(t *testing.T) {
+	var got *http.Request
+	next := &MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		got = req
+		res.StatusCode = http.StatusOK
+		res.Body = io.NopCloser(strings.NewReader("ok"))
+		return nil
+	}}
+	upf := newTestPoolFilter(t, next, "http://10.0.0.1:8080/v1", "https://10.0.0.2")
+
+	tests := []struct {
+		name    string
+		url     string
+		wantURL string
+	}{
+		{name: "First target with base path", url: "http://api.example.com/users?id=1", wantURL: "http://10.0.0.1:8080/v1/users?id=1"},
+		{name: "Second target", url: "http://api.example.com/users", wantURL: "https://10.0.0.2/users"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			req.Header.Set("Accept", "text/plain")
+			res := &http.Response{}
+			err := upf.Process(WithRoute(context.Background(), "api-route"), req, res)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantURL, got.URL.String())
+			assert.Equal(t, "", got.Host)
+			assert.Equal(t, "api.example.com", got.Header.Get("X-Forwarded-Host"))
+			assert.Equal(t, "http", got.Header.Get("X-Forwarded-Proto"))
+			assert.Equal(t, "text/plain", got.Header.Get("Accept"))
+			// the request is left as it came for the retries
+			assert.Equal(t, tt.url, req.URL.String())
+			assert.Empty(t, req.Header.Get("X-Forwarded-Host"))
+			assert.NoError(t, res.Body.Close())
+		})
+	}
+}
+
+func TestUpstreamPoolFilterActiveRequests(t *testing.T) {
+	next := &MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		res.StatusCode = http.StatusOK
+		res.Body = io.NopCloser(strings.NewReader("ok"))
+		return nil
+	}}
+	upf := newTestPoolFilter(t, next, "http://10.0.0.1")
+	target := upf.Pools()["api"].Targets()[0]
+
+	res := &http.Response{}
+	err := upf.Process(WithRoute(context.Background(), "api-route"), httptest.NewRequest(http.MethodGet, "http://example.com/", nil), res)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), target.Active(), "in flight until the body is closed")
+	assert.NoError(t, res.Body.Close())
+	assert.Equal(t, int64(0), target.Active())
+}
+
+func TestUpstreamPoolFilterNoPool(t *testing.T) {
+	calls := 0
+	next := &MockFilter{processFunc: func(ctx context.Context, req *http.Request, res *http.Response) error {
+		calls++
+		assert.Equal(t, "http://other.example.com/", req.URL.String())
+		res.StatusCode = http.StatusOK
+		return nil
+	}}
+	upf := newTestPoolFilter(t, next, "http://10.0.0.1")
+	ctx := WithRoute(context.Background(), "other-route")
+
+	err := upf.Process(ctx, httptest.NewRequest(http.MethodGet, "http://other.example.com/", nil), &http.Response{})
+	assert.Equal(t, http.StatusNotFound, StatusForError(err))
+	assert.Equal(t, 0, calls)
+
+	upf.SetPassThrough(true)
+	res := &http.Response{}
+	err = upf.Process(ctx, httptest.NewRequest(http.MethodGet, "http://other.example.com/", nil), res)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestUpstreamPoolFilterErrors(t *testing.T) {
+	_, err := NewUpstreamPoolFilter(nil)
+	assert.Error(t, err)
+	_, err = NewUpstreamPoolFilter([]*UpstreamPool{nil})
+	assert.Error(t, err)
+
+	upf := newTestPoolFilter(t, &MockFilter{}, "http://10.0.0.1")
+	assert.Error(t, upf.SetRoutePools(map[string]string{"r": "unknown"}))
+	assert.Error(t, upf.ValidateRoutePools(map[string]string{"r": "unknown"}))
+	assert.Error(t, upf.SetNextFilter(nil))
+}
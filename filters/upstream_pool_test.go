@@ -0,0 +1,140 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewUpstreamPoolErrors(t *testing.T) {
+	rr := &roundRobinBalancer{}
+	tests := []struct {
+		name     string
+		pool     string
+		targets  []string
+		balancer Balancer
+	}{
+		{name: "No name", targets: []string{"http://10.0.0.1"}, balancer: rr},
+		{name: "No targets", pool: "api", balancer: rr},
+		{name: "No balancer", pool: "api", targets: []string{"http://10.0.0.1"}},
+		{name: "Not http", pool: "api", targets: []string{"ftp://10.0.0.1"}, balancer: rr},
+		{name: "No host", pool: "api", targets: []string{"10.0.0.1:8080"}, balancer: rr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewUpstreamPool(tt.pool, tt.targets, tt.balancer)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestUpstreamPoolOutlierDetection(t *testing.T) {
+	pool, err := NewUpstreamPool("api", testTargetURLs(4), &roundRobinBalancer{})
+	assert.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	pool.now = func() time.Time { return now }
+	assert.NoError(t, pool.SetOutlierDetection(OutlierDetection{ConsecutiveFailures: 2, EjectionTime: 30 * time.Second, MaxEjectionPercent: 50}))
+	targets := pool.Targets()
+	reset := NewUpstreamError("10.0.0.1", errors.New("connection refused"))
+
+	// a success resets the count
+	pool.Report(targets[0], reset, 0)
+	pool.Report(targets[0], nil, http.StatusOK)
+	pool.Report(targets[0], nil, http.StatusBadGateway)
+	assert.False(t, targets[0].Ejected(now))
+	// client errors are not the upstream's failures
+	pool.Report(targets[0], NewClientError(http.StatusBadRequest, "", nil), 0)
+	pool.Report(targets[0], nil, http.StatusInternalServerError)
+	assert.False(t, targets[0].Ejected(now))
+
+	pool.Report(targets[0], reset, 0)
+	pool.Report(targets[0], nil, http.StatusServiceUnavailable)
+	assert.True(t, targets[0].Ejected(now))
+	pool.Report(targets[1], nil, http.StatusGatewayTimeout)
+	pool.Report(targets[1], nil, http.StatusGatewayTimeout)
+	assert.True(t, targets[1].Ejected(now))
+	// 50% of the pool is ejected already
+	pool.Report(targets[2], reset, 0)
+	pool.Report(targets[2], reset, 0)
+	assert.False(t, targets[2].Ejected(now))
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	for i := 0; i < 4; i++ {
+		picked, err := pool.Pick(req)
+		assert.NoError(t, err)
+		assert.Contains(t, []*UpstreamTarget{targets[2], targets[3]}, picked)
+	}
+
+	now = now.Add(31 * time.Second)
+	assert.False(t, targets[0].Ejected(now))
+	assert.False(t, targets[1].Ejected(now))
+}
+
+func TestUpstreamPoolPickNoTarget(t *testing.T) {
+	pool, err := NewUpstreamPool("api", testTargetURLs(2), &roundRobinBalancer{})
+	assert.NoError(t, err)
+	for _, tg := range pool.Targets() {
+		tg.unhealthy.Store(true)
+	}
+	_, err = pool.Pick(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	pe, ok := AsProxyError(err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusServiceUnavailable, pe.Status)
+	assert.Equal(t, ErrorCategoryUpstream, pe.Category)
+}
+
+func TestUpstreamPoolHealthChecks(t *testing.T) {
+	var failing atomic.Bool
+	var probes atomic.Int64
+	unstable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		assert.Equal(t, "/base/healthz", r.URL.Path)
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer unstable.Close()
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer stable.Close()
+
+	pool, err := NewUpstreamPool("api", []string{unstable.URL + "/base", stable.URL + "/base/"}, &roundRobinBalancer{})
+	assert.NoError(t, err)
+	assert.Error(t, pool.SetHealthCheck(HealthCheck{Path: "/healthz"}))
+	assert.NoError(t, pool.SetHealthCheck(HealthCheck{Path: "/healthz", Interval: time.Hour, Timeout: time.Second, HealthyThreshold: 2, UnhealthyThreshold: 2}))
+	target := pool.Targets()[0]
+	ctx := context.Background()
+
+	failing.Store(true)
+	pool.checkTargets(ctx)
+	assert.True(t, target.Healthy(), "one failure is below the threshold")
+	pool.checkTargets(ctx)
+	assert.False(t, target.Healthy())
+	assert.True(t, pool.Targets()[1].Healthy())
+
+	failing.Store(false)
+	pool.checkTargets(ctx)
+	assert.False(t, target.Healthy())
+	pool.checkTargets(ctx)
+	assert.True(t, target.Healthy())
+	assert.Equal(t, int64(4), probes.Load())
+
+	// RunHealthChecks returns with its context
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		pool.RunHealthChecks(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunHealthChecks did not return")
+	}
+}
@@ -0,0 +1,39 @@
+package listeners
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/LamineKouissi/LHP/util"
+)
+
+// AdminListener serves the admin router over plain HTTP, it should be bound
+// to a loopback or otherwise private address.
+type AdminListener struct {
+	address string
+	cnx     context.Context
+	server  *http.Server
+}
+
+func NewAdminListener(cntx context.Context, adrs string, router http.Handler) (*AdminListener, error) {
+	if adrs == "" || router == nil {
+		return nil, errors.New("invalid arg : address or router")
+	}
+	srv := &http.Server{
+		Addr:              adrs,
+		Handler:           router,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return &AdminListener{address: adrs, cnx: cntx, server: srv}, nil
+}
+
+func (al *AdminListener) Listen() error {
+	util.Infoln("AdminServer Listening on", al.address)
+	err := al.server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
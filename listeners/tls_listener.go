@@ -3,6 +3,7 @@ package listeners
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"log"
 	"net/http"
 )
@@ -16,13 +17,19 @@ type TLSListener struct {
 func (srv *TLSListener) Listen() error {
 	log.Printf("TLSServer Listening on %s...", srv.address)
 	err := srv.server.ListenAndServeTLS("", "")
-	if err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Failed to start server: %v", err)
 		return err
 	}
 	return nil
 }
 
+// Shutdown stops accepting connections and waits for the requests in
+// flight until ctx is done; Listen then returns nil.
+func (srv *TLSListener) Shutdown(ctx context.Context) error {
+	return srv.server.Shutdown(ctx)
+}
+
 func NewTLSListener(cntx context.Context, adrs string, router http.Handler, crtFilePath string, keyFilePath string) (*TLSListener, error) {
 	cert, err := tls.LoadX509KeyPair(crtFilePath, keyFilePath)
 	if err != nil {
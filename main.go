@@ -2,25 +2,51 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/LamineKouissi/LHP/adapters"
+	"github.com/LamineKouissi/LHP/config"
 	"github.com/LamineKouissi/LHP/filters"
 	"github.com/LamineKouissi/LHP/filters/connectors"
 	"github.com/LamineKouissi/LHP/listeners"
 	"github.com/LamineKouissi/LHP/routers"
 	"github.com/LamineKouissi/LHP/routers/routes"
+	"github.com/LamineKouissi/LHP/util"
 )
 
 var (
+	proxyConfig         *config.ProxyConfig
 	httpFilterChaine    filters.Filter
 	httpFilterChaineErr error
 	httpRoute           *routes.HttpRoute
 	httpsRoute          *routes.HttpsRoute
-	mainHttpRouter      *routers.ForwardProxyRouter
+	mainHttpRouter      http.Handler
+	metrics             *filters.Metrics
+	adminRouter         *routers.AdminRouter
+	// proxyConfigMu guards proxyConfig, replaced on config reload
+	proxyConfigMu   sync.RWMutex
+	redisConfig     config.RedisConfig
+	cacheFilter     cachePolicySetter
+	httpFilterNames []string
+	// poolFilter is nil without upstream pools
+	poolFilter *filters.UpstreamPoolFilter
+	// rateLimitFilter is nil without rate limits
+	rateLimitFilter   *filters.RateLimitFilter
+	transformerFilter *filters.HttpMsgTransformerFilter
+	// tracer is nil without tracing
+	tracer *filters.Tracer
 )
 
+// shutdownTimeout bounds the wait for the requests in flight on exit
+const shutdownTimeout = 10 * time.Second
+
 func getEnv(key string) string {
 	value := os.Getenv(key)
 	if value == "" {
@@ -30,31 +56,200 @@ func getEnv(key string) string {
 }
 
 func init() {
-	//test httpFilterChaine : cacheFilter(imp : HasNextFilter & Filter ) > transformerFilter(imp : HasNextFilter & Filter ) > httpsCnx(imp : Filter )
+	//test httpFilterChaine : [tracingFilter(imp : HasNextFilter & Filter ) >] metricsFilter(imp : HasNextFilter & Filter ) > accessLogFilter(imp : HasNextFilter & Filter ) [> rateLimitFilter(imp : HasNextFilter & Filter )] [> aclFilter(imp : HasNextFilter & Filter )] > responseHeadersFilter(imp : HasNextFilter & Filter ) > cacheFilter(imp : HasNextFilter & Filter ) > transformerFilter(imp : HasNextFilter & Filter ) [> retryFilter(imp : HasNextFilter & Filter )] [> upstreamPoolFilter(imp : HasNextFilter & Filter )] > httpsCnx(imp : Filter )
 	cnx := context.Background()
-	httpsCnxFilter, err := connectors.NewHttpsConnector()
+	var err error
+	proxyConfig, err = loadProxyConfig(os.Getenv("PROXY_CONFIG"))
+	if err != nil {
+		panic(err)
+	}
+
+	var upstreamConfig config.UpstreamConfig
+	if proxyConfig != nil {
+		upstreamConfig = proxyConfig.Upstream
+	}
+	httpsCnxFilter, err := connectors.NewHttpsConnectorFromConfig(upstreamConfig)
+	if err != nil {
+		panic(err)
+	}
+
+	transformerFilter, err = filters.NewHttpMsgTransformerFilter(httpsCnxFilter)
+	if err != nil {
+		panic(err)
+	}
+	// the response side of the transformer's settings, outside the cache
+	responseHeadersFilter, err := filters.NewResponseHeadersFilter(transformerFilter)
+	if err != nil {
+		panic(err)
+	}
+
+	redisConfig, err = config.RedisConfigFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	if proxyConfig != nil && (proxyConfig.Redis.Addr != "" || len(proxyConfig.Redis.Addrs) > 0) {
+		redisConfig = proxyConfig.Redis
+	}
+
+	redisCacheAdapter, err := adapters.NewRedisCacheAdapterFromConfig(redisConfig)
+	if err != nil {
+		panic(err)
+	}
+
+	cacheMgrFilter, err := filters.NewCacheMgrFilter(redisCacheAdapter)
 	if err != nil {
 		panic(err)
 	}
+	cacheFilter = cacheMgrFilter
 
-	transformerFilter, err := filters.NewHttpMsgTransformerFilter(httpsCnxFilter)
+	var routeMatchers []filters.RouteMatcher
+	if proxyConfig != nil {
+		routeMatchers = routeMatchersFromConfig(proxyConfig.Routes)
+		err = applyCacheConfig(cacheFilter, proxyConfig.Cache, routeMatchers, proxyConfig.Routes)
+		if err != nil {
+			panic(err)
+		}
+		err = transformerFilter.SetHeaderRules(headerRulesFromConfig(proxyConfig.Headers, proxyConfig.Routes, routeMatchers))
+		if err != nil {
+			panic(err)
+		}
+		forwarding, err := forwardingFromConfig(proxyConfig.Forwarding)
+		if err != nil {
+			panic(err)
+		}
+		err = transformerFilter.SetForwarding(forwarding)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	hasNextFilterChaine := []filters.HasNextFilter{responseHeadersFilter, cacheMgrFilter, transformerFilter}
+
+	retryFilter, err := retryFilterFromConfig(upstreamConfig.Retry)
+	if err != nil {
+		panic(err)
+	}
+	if retryFilter != nil {
+		hasNextFilterChaine = append(hasNextFilterChaine, retryFilter)
+	}
+
+	reverseMode := proxyConfig != nil && proxyConfig.Mode == config.ProxyModeReverse
+	if proxyConfig != nil && len(proxyConfig.UpstreamPools) > 0 {
+		pools, err := upstreamPoolsFromConfig(proxyConfig.UpstreamPools)
+		if err != nil {
+			panic(err)
+		}
+		poolFilter, err = filters.NewUpstreamPoolFilter(pools)
+		if err != nil {
+			panic(err)
+		}
+		err = poolFilter.SetRoutePools(routePoolsFromConfig(proxyConfig.Routes, routeMatchers))
+		if err != nil {
+			panic(err)
+		}
+		poolFilter.SetPassThrough(!reverseMode)
+		hasNextFilterChaine = append(hasNextFilterChaine, poolFilter)
+	} else if reverseMode {
+		panic(errors.New("reverse proxy mode needs upstream_pools"))
+	}
+
+	var aclConfig config.ACLConfig
+	if proxyConfig != nil {
+		aclConfig = proxyConfig.ACL
+	}
+	acl, err := aclFromConfig(aclConfig)
+	if err != nil {
+		panic(err)
+	}
+	if acl != nil {
+		aclFilter, err := filters.NewACLFilter(acl)
+		if err != nil {
+			panic(err)
+		}
+		hasNextFilterChaine = append([]filters.HasNextFilter{aclFilter}, hasNextFilterChaine...)
+		err = httpsCnxFilter.SetDialControl(acl.DialControl)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if proxyConfig != nil {
+		defaultLimits, routeLimits := rateLimitsFromConfig(proxyConfig.RateLimit, proxyConfig.Routes, routeMatchers)
+		if len(defaultLimits) > 0 || len(routeLimits) > 0 {
+			var store filters.RateLimitStore = filters.NewMemoryRateLimitStore()
+			if proxyConfig.RateLimit.Store == "redis" {
+				client, err := redisCacheAdapter.GetClient()
+				if err != nil {
+					panic(err)
+				}
+				store, err = adapters.NewRedisRateLimitStore(client)
+				if err != nil {
+					panic(err)
+				}
+			}
+			rateLimitFilter, err = filters.NewRateLimitFilter(store)
+			if err != nil {
+				panic(err)
+			}
+			err = rateLimitFilter.SetLimits(defaultLimits, routeLimits)
+			if err != nil {
+				panic(err)
+			}
+			hasNextFilterChaine = append([]filters.HasNextFilter{rateLimitFilter}, hasNextFilterChaine...)
+		}
+	}
+
+	var accessLogConfig config.AccessLogConfig
+	if proxyConfig != nil {
+		accessLogConfig = proxyConfig.AccessLog
+	}
+	accessLogger, err := accessLoggerFromConfig(accessLogConfig)
 	if err != nil {
 		panic(err)
 	}
+	if accessLogger != nil {
+		accessLogFilter, err := filters.NewAccessLogFilter(accessLogger)
+		if err != nil {
+			panic(err)
+		}
+		hasNextFilterChaine = append([]filters.HasNextFilter{accessLogFilter}, hasNextFilterChaine...)
+	}
 
-	redisCacheAdapter, err := adapters.NewRedisCacheAdapter("localhost:6379", "", "", "0")
+	metrics = filters.NewMetrics()
+	err = metrics.SetCacheBreakerState(cacheMgrFilter.CacheBreakerState)
 	if err != nil {
 		panic(err)
 	}
+	metricsFilter, err := filters.NewMetricsFilter(metrics)
+	if err != nil {
+		panic(err)
+	}
+	hasNextFilterChaine = append([]filters.HasNextFilter{metricsFilter}, hasNextFilterChaine...)
 
-	cacheFilter, err := filters.NewCacheMgrFilter(redisCacheAdapter)
+	var tracingConfig config.TracingConfig
+	if proxyConfig != nil {
+		tracingConfig = proxyConfig.Tracing
+	}
+	tracer, err = tracerFromConfig(tracingConfig)
 	if err != nil {
 		panic(err)
 	}
+	var wrapFilter filters.FilterWrapper
+	if tracer != nil {
+		tracingFilter, err := filters.NewTracingFilter(tracer)
+		if err != nil {
+			panic(err)
+		}
+		hasNextFilterChaine = append([]filters.HasNextFilter{tracingFilter}, hasNextFilterChaine...)
+		wrapFilter = tracer.Wrap
+	}
 
-	hasNextFilterChaine := []filters.HasNextFilter{cacheFilter, transformerFilter}
+	for _, f := range hasNextFilterChaine {
+		httpFilterNames = append(httpFilterNames, filters.FilterName(f.(filters.Filter)))
+	}
+	httpFilterNames = append(httpFilterNames, filters.FilterName(httpsCnxFilter))
 
-	httpFilterChaine, httpFilterChaineErr = filters.ConstructFilterChain(cnx, hasNextFilterChaine, httpsCnxFilter)
+	httpFilterChaine, httpFilterChaineErr = filters.ConstructWrappedFilterChain(cnx, hasNextFilterChaine, httpsCnxFilter, wrapFilter)
 	if httpFilterChaineErr != nil {
 		log.Fatal(httpFilterChaineErr)
 	}
@@ -63,12 +258,87 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+	httpRoute.SetRouteMatchers(routeMatchers)
+
+	var errorPagesConfig config.ErrorPagesConfig
+	if proxyConfig != nil {
+		errorPagesConfig = proxyConfig.ErrorPages
+	}
+	errorPages, err := errorPagesFromConfig(errorPagesConfig)
+	if err != nil {
+		panic(err)
+	}
+	err = httpRoute.SetErrorPages(errorPages)
+	if err != nil {
+		panic(err)
+	}
 
 	httpsRoute, err = routes.NewHttspRoute()
 	if err != nil {
 		panic(err)
 	}
-	mainHttpRouter, err = routers.NewForwardProxyRouter(*httpsRoute, *httpRoute)
+	if tunnelLogger, ok := accessLogger.(filters.TunnelLogger); ok {
+		err = httpsRoute.SetTunnelLogger(tunnelLogger)
+		if err != nil {
+			panic(err)
+		}
+	}
+	err = httpsRoute.SetTunnelObserver(metrics)
+	if err != nil {
+		panic(err)
+	}
+	err = httpsRoute.SetErrorPages(errorPages)
+	if err != nil {
+		panic(err)
+	}
+	var connectConfig config.ConnectConfig
+	if proxyConfig != nil {
+		connectConfig = proxyConfig.Connect
+	}
+	err = applyConnectConfig(httpsRoute, connectConfig)
+	if err != nil {
+		panic(err)
+	}
+	if acl != nil {
+		err = httpsRoute.SetACL(acl)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if rateLimitFilter != nil {
+		// the CONNECT requests do not go through the filter chain
+		err = httpsRoute.SetRateLimiter(rateLimitFilter)
+		if err != nil {
+			panic(err)
+		}
+	}
+	// the upgraded HTTP connections, e.g. WebSockets, are tunnels of the HTTPS route
+	err = httpRoute.SetTunneler(httpsRoute)
+	if err != nil {
+		panic(err)
+	}
+	if reverseMode {
+		mainHttpRouter, err = routers.NewReverseProxyRouter(*httpRoute)
+	} else {
+		mainHttpRouter, err = routers.NewForwardProxyRouter(*httpsRoute, *httpRoute)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	var adminConfig config.AdminConfig
+	if proxyConfig != nil {
+		adminConfig = proxyConfig.Admin
+	}
+	adminRouter, err = newAdminRouter(adminConfig, redisCacheAdapter)
+	if err != nil {
+		panic(err)
+	}
+	redisCheck, err := adapters.NewRedisPingCheck(redisCacheAdapter)
+	if err != nil {
+		panic(err)
+	}
+	err = addReadinessChecks(adminRouter, adminConfig.Health, redisCheck)
 	if err != nil {
 		panic(err)
 	}
@@ -78,14 +348,71 @@ func init() {
 func main() {
 	//StartTLSServer()
 	address := ":7000"
-	ctx := context.Background()
-	tlsListener, err := listeners.NewTLSListener(ctx, address, mainHttpRouter, getEnv("TLS_SERVER"), getEnv("TLS_KEY"))
+	if proxyConfig != nil && proxyConfig.ListenAddress != "" {
+		address = proxyConfig.ListenAddress
+	}
+	var crtFilePath, keyFilePath string
+	if proxyConfig != nil && proxyConfig.TLSCert.Crt != "" {
+		crtFilePath, keyFilePath = proxyConfig.TLSCert.Crt, proxyConfig.TLSCert.Key
+	} else {
+		crtFilePath, keyFilePath = getEnv("TLS_SERVER"), getEnv("TLS_KEY")
+	}
+	// SIGINT and SIGTERM stop the listeners, then the buffered spans are sent
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if poolFilter != nil {
+		for _, pool := range poolFilter.Pools() {
+			go pool.RunHealthChecks(ctx)
+		}
+	}
+
+	var adminConfig config.AdminConfig
+	if proxyConfig != nil {
+		adminConfig = proxyConfig.Admin
+	}
+	certCheck, err := adapters.NewTLSCertCheck(crtFilePath, keyFilePath, time.Duration(adminConfig.Health.CertMinValidity))
 	if err != nil {
 		panic(err)
 	}
-	err = tlsListener.Listen()
+	err = adminRouter.AddReadinessCheck(certCheck)
 	if err != nil {
 		panic(err)
 	}
+	if adminAddress, ok := adminAddressFromConfig(adminConfig); ok {
+		adminListener, err := listeners.NewAdminListener(ctx, adminAddress, adminRouter)
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			if err := adminListener.Listen(); err != nil {
+				log.Println("AdminListener.Listen(): ", err)
+			}
+		}()
+	}
 
+	tlsListener, err := listeners.NewTLSListener(ctx, address, mainHttpRouter, crtFilePath, keyFilePath)
+	if err != nil {
+		panic(err)
+	}
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- tlsListener.Listen()
+	}()
+	select {
+	case err = <-listenErr:
+	case <-ctx.Done():
+		util.Infoln("shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err = tlsListener.Shutdown(shutdownCtx)
+		cancel()
+	}
+	if tracer != nil {
+		if terr := tracer.Shutdown(); terr != nil {
+			log.Println("Tracer.Shutdown(): ", terr)
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
 }
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/LamineKouissi/LHP/adapters"
+	"github.com/LamineKouissi/LHP/config"
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/LamineKouissi/LHP/routers/routes"
+)
+
+// loadProxyConfig reads and validates the JSON config file at path, it
+// returns nil without error when no path is given.
+func loadProxyConfig(path string) (*config.ProxyConfig, error) {
+	if path == "" {
+		return nil, nil
+	}
+	cm, err := config.NewConfigMgr(nil)
+	if err != nil {
+		return nil, err
+	}
+	configData, err := cm.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	validator, err := adapters.NewjsonValidator(configData)
+	if err != nil {
+		return nil, err
+	}
+	return validator.ValidateConfig()
+}
+
+func routeMatchersFromConfig(routes []config.RouteConfig) []filters.RouteMatcher {
+	var rms []filters.RouteMatcher
+	for i, rc := range routes {
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("route-%d", i)
+		}
+		rms = append(rms, filters.RouteMatcher{
+			Name:       name,
+			Host:       rc.Host,
+			PathPrefix: rc.Path,
+			Method:     rc.Method,
+		})
+	}
+	return rms
+}
+
+func cachePolicyFromConfig(pc config.CachePolicyConfig) filters.CachePolicy {
+	p := filters.DefaultCachePolicy()
+	if pc.Enabled != nil {
+		p.Enabled = *pc.Enabled
+	}
+	p.TTL = time.Duration(pc.TTL)
+	p.MinTTL = time.Duration(pc.MinTTL)
+	p.MaxTTL = time.Duration(pc.MaxTTL)
+	p.IgnoreOriginHeaders = pc.IgnoreOriginHeaders
+	p.StripQueryParams = pc.StripQueryParams
+	p.SortQueryParams = pc.SortQueryParams
+	p.KeyHeaders = pc.KeyHeaders
+	p.MaxObjectSize = pc.MaxObjectSize
+	return p
+}
+
+type cachePolicySetter interface {
+	SetPolicies(defaultPolicy *filters.CachePolicy, routePolicies map[string]filters.CachePolicy) error
+	SetCircuitBreaker(cb *filters.CircuitBreaker) error
+	CircuitBreaker() *filters.CircuitBreaker
+}
+
+// cacheSettings are the cache policies and the breaker of a config.
+type cacheSettings struct {
+	defaultPolicy *filters.CachePolicy
+	routePolicies map[string]filters.CachePolicy
+	breaker       *filters.CircuitBreaker
+}
+
+// cacheSettingsFromConfig builds the settings of the cache section and the route policies.
+func cacheSettingsFromConfig(cacheConfig config.CacheConfig, routes []filters.RouteMatcher, routeConfigs []config.RouteConfig) (cacheSettings, error) {
+	var cs cacheSettings
+	if cacheConfig.Default != nil {
+		p := cachePolicyFromConfig(*cacheConfig.Default)
+		cs.defaultPolicy = &p
+	}
+	for i, rc := range routeConfigs {
+		if rc.Cache == nil {
+			continue
+		}
+		if cs.routePolicies == nil {
+			cs.routePolicies = map[string]filters.CachePolicy{}
+		}
+		cs.routePolicies[routes[i].Name] = cachePolicyFromConfig(*rc.Cache)
+	}
+
+	// without breaker settings the default breaker applies, as at startup
+	bc := cacheConfig.Breaker
+	threshold, openTimeout, probes := bc.FailureThreshold, time.Duration(bc.OpenTimeout), bc.HalfOpenProbes
+	if threshold == 0 {
+		threshold = filters.DefaultBreakerFailureThreshold
+	}
+	if openTimeout == 0 {
+		openTimeout = filters.DefaultBreakerOpenTimeout
+	}
+	if probes == 0 {
+		probes = filters.DefaultBreakerHalfOpenProbes
+	}
+	breaker, err := filters.NewCircuitBreaker(threshold, openTimeout, probes)
+	if err != nil {
+		return cacheSettings{}, err
+	}
+	cs.breaker = breaker
+	return cs, nil
+}
+
+// apply sets the policies and the breaker of the cache filter.
+func (cs cacheSettings) apply(cacheFilter cachePolicySetter) error {
+	if err := cacheFilter.SetPolicies(cs.defaultPolicy, cs.routePolicies); err != nil {
+		return err
+	}
+	// a new breaker starts closed, keep the current one, open or not, when unchanged
+	if cs.breaker.SameSettings(cacheFilter.CircuitBreaker()) {
+		return nil
+	}
+	return cacheFilter.SetCircuitBreaker(cs.breaker)
+}
+
+// applyCacheConfig configures the cache filter from the cache section and the route policies.
+func applyCacheConfig(cacheFilter cachePolicySetter, cacheConfig config.CacheConfig, routes []filters.RouteMatcher, routeConfigs []config.RouteConfig) error {
+	cs, err := cacheSettingsFromConfig(cacheConfig, routes, routeConfigs)
+	if err != nil {
+		return err
+	}
+	return cs.apply(cacheFilter)
+}
+
+const defaultAccessLogTag = "lhp"
+
+// accessLoggerFromConfig builds the access log sink, it returns nil when the
+// access log is disabled. Without config the log is written as JSON to stdout.
+func accessLoggerFromConfig(alc config.AccessLogConfig) (filters.AccessLogger, error) {
+	if alc.Enabled != nil && !*alc.Enabled {
+		return nil, nil
+	}
+	var w io.Writer
+	switch alc.Output {
+	case "", "stdout":
+		w = os.Stdout
+	case "file":
+		rw, err := adapters.NewRotatingFileWriter(alc.File.Path, int64(alc.File.MaxSizeMB)<<20, alc.File.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		w = rw
+	case "syslog":
+		tag := alc.Syslog.Tag
+		if tag == "" {
+			tag = defaultAccessLogTag
+		}
+		sw, err := adapters.NewSyslogWriter(alc.Syslog.Network, alc.Syslog.Address, tag)
+		if err != nil {
+			return nil, err
+		}
+		w = sw
+	default:
+		return nil, fmt.Errorf("unknown access log output : %q", alc.Output)
+	}
+	return adapters.NewAccessLogAdapter(alc.Format, w)
+}
+
+// adminAddressFromConfig returns the admin listener address, false when the
+// admin listener is disabled.
+func adminAddressFromConfig(ac config.AdminConfig) (string, bool) {
+	if ac.Enabled != nil && !*ac.Enabled {
+		return "", false
+	}
+	if ac.ListenAddress == "" {
+		return config.DefaultAdminListenAddress, true
+	}
+	return ac.ListenAddress, true
+}
+
+const defaultTracingServiceName = "lhp"
+
+// tracerFromConfig builds the tracer exporting to the configured collector,
+// it returns nil when tracing is disabled.
+func tracerFromConfig(tc config.TracingConfig) (*filters.Tracer, error) {
+	if !tc.Enabled {
+		return nil, nil
+	}
+	serviceName := tc.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTracingServiceName
+	}
+	exporter, err := adapters.NewOTLPHTTPExporter(tc.Endpoint, serviceName, tc.Headers, tc.BatchSize, time.Duration(tc.FlushInterval))
+	if err != nil {
+		return nil, err
+	}
+	return filters.NewTracer(exporter)
+}
+
+// errorPagesFromConfig reads the configured error page templates.
+func errorPagesFromConfig(epc config.ErrorPagesConfig) (*routes.ErrorPages, error) {
+	var page string
+	if epc.Template != "" {
+		b, err := os.ReadFile(epc.Template)
+		if err != nil {
+			return nil, err
+		}
+		page = string(b)
+	}
+	byStatus := map[int]string{}
+	for code, path := range epc.Templates {
+		status, err := strconv.Atoi(code)
+		if err != nil {
+			return nil, fmt.Errorf("invalid error page status : %q", code)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		byStatus[status] = string(b)
+	}
+	return routes.NewErrorPages(page, byStatus)
+}
+
+// aclFromConfig builds the ACL, it returns nil when nothing is restricted.
+func aclFromConfig(ac config.ACLConfig) (*filters.ACL, error) {
+	ssrf := ac.SSRFProtection != nil && ac.SSRFProtection.Enabled
+	if len(ac.Rules) == 0 && !ssrf && ac.Default != filters.ACLDeny {
+		return nil, nil
+	}
+	rules := make([]filters.ACLRule, 0, len(ac.Rules))
+	for i, rc := range ac.Rules {
+		cidrs, err := prefixesFromConfig(rc.CIDRs)
+		if err != nil {
+			return nil, fmt.Errorf("ACL rule %d : %w", i, err)
+		}
+		rules = append(rules, filters.ACLRule{
+			Name:    rc.Name,
+			Action:  rc.Action,
+			Domains: rc.Domains,
+			CIDRs:   cidrs,
+			Ports:   rc.Ports,
+			Methods: rc.Methods,
+			Users:   rc.Users,
+			Groups:  rc.Groups,
+		})
+	}
+	acl, err := filters.NewACL(rules, ac.Default)
+	if err != nil {
+		return nil, err
+	}
+	if ssrf {
+		allowed, err := prefixesFromConfig(ac.SSRFProtection.AllowCIDRs)
+		if err != nil {
+			return nil, fmt.Errorf("ACL ssrf_protection : %w", err)
+		}
+		acl.SetSSRFProtection(allowed)
+	}
+	return acl, nil
+}
+
+// prefixesFromConfig parses CIDRs, a bare address is a range of its own.
+func prefixesFromConfig(cidrs []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range cidrs {
+		if addr, err := netip.ParseAddr(cidr); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR : %q", cidr)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// applyConnectConfig sets the ports the CONNECT tunnels may reach, their
+// quotas and idle timeout; the route keeps its default ports when none are
+// configured.
+func applyConnectConfig(hs *routes.HttpsRoute, cc config.ConnectConfig) error {
+	err := hs.SetTunnelQuotas(routes.TunnelQuotas{
+		MaxTunnels:        cc.MaxTunnels,
+		MaxTunnelsPerUser: cc.MaxTunnelsPerUser,
+		TunnelBandwidth:   cc.BandwidthPerTunnel,
+		UserBandwidth:     cc.BandwidthPerUser,
+	})
+	if err != nil {
+		return err
+	}
+	if err := hs.SetIdleTimeout(time.Duration(cc.IdleTimeout)); err != nil {
+		return err
+	}
+	if len(cc.AllowedPorts) == 0 && len(cc.PortExceptions) == 0 {
+		return nil
+	}
+	ports := cc.AllowedPorts
+	if len(ports) == 0 {
+		ports = routes.DefaultConnectPorts
+	}
+	exceptions := make([]routes.PortException, 0, len(cc.PortExceptions))
+	for _, pe := range cc.PortExceptions {
+		exceptions = append(exceptions, routes.PortException{Users: pe.Users, Groups: pe.Groups, Ports: pe.Ports})
+	}
+	return hs.SetConnectPorts(ports, exceptions)
+}
+
+// rateLimitsFromConfig returns the default rate limits and those of the
+// routes, named as by routeMatchersFromConfig.
+func rateLimitsFromConfig(rlc config.RateLimitConfig, routes []config.RouteConfig, routeMatchers []filters.RouteMatcher) ([]filters.RateLimit, map[string][]filters.RateLimit) {
+	byRoute := map[string][]filters.RateLimit{}
+	for i, rc := range routes {
+		if len(rc.RateLimits) > 0 && i < len(routeMatchers) {
+			byRoute[routeMatchers[i].Name] = rateLimitRulesFromConfig(rc.RateLimits)
+		}
+	}
+	return rateLimitRulesFromConfig(rlc.Limits), byRoute
+}
+
+func rateLimitRulesFromConfig(rules []config.RateLimitRuleConfig) []filters.RateLimit {
+	limits := make([]filters.RateLimit, 0, len(rules))
+	for _, r := range rules {
+		per := time.Duration(r.Per)
+		if per <= 0 {
+			per = time.Second
+		}
+		limits = append(limits, filters.RateLimit{Key: r.Key, Requests: r.Requests, Per: per, Burst: r.Burst})
+	}
+	return limits
+}
+
+// retryFilterFromConfig builds the filter retrying the upstream requests, it
+// returns nil when retries are disabled.
+func retryFilterFromConfig(rc config.RetryConfig) (*filters.RetryFilter, error) {
+	if !rc.Enabled {
+		return nil, nil
+	}
+	policy := filters.DefaultRetryPolicy()
+	if rc.MaxAttempts > 0 {
+		policy.MaxAttempts = rc.MaxAttempts
+	}
+	if rc.InitialBackoff > 0 {
+		policy.InitialBackoff = time.Duration(rc.InitialBackoff)
+	}
+	if rc.MaxBackoff > 0 {
+		policy.MaxBackoff = time.Duration(rc.MaxBackoff)
+	}
+	if len(rc.RetryOn) > 0 {
+		policy.RetryOn = rc.RetryOn
+	}
+	ratio, minPerSecond := filters.DefaultRetryBudgetRatio, filters.DefaultRetryBudgetMinPerSec
+	if rc.BudgetRatio != nil {
+		ratio = *rc.BudgetRatio
+	}
+	if rc.BudgetMinPerSecond != nil {
+		minPerSecond = *rc.BudgetMinPerSecond
+	}
+	budget, err := filters.NewRetryBudget(ratio, minPerSecond)
+	if err != nil {
+		return nil, err
+	}
+	return filters.NewRetryFilter(policy, budget)
+}
+
+// upstreamPoolsFromConfig builds the upstream pools, sorted by name.
+func upstreamPoolsFromConfig(poolConfigs map[string]config.UpstreamPoolConfig) ([]*filters.UpstreamPool, error) {
+	names := make([]string, 0, len(poolConfigs))
+	for name := range poolConfigs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pools []*filters.UpstreamPool
+	for _, name := range names {
+		pc := poolConfigs[name]
+		balancer, err := filters.NewBalancer(pc.Balancer, pc.HashKey)
+		if err != nil {
+			return nil, fmt.Errorf("upstream pool %s : %w", name, err)
+		}
+		pool, err := filters.NewUpstreamPool(name, pc.Targets, balancer)
+		if err != nil {
+			return nil, err
+		}
+		if hc := pc.HealthCheck; hc != nil {
+			check := filters.HealthCheck{
+				Path:               hc.Path,
+				Interval:           filters.DefaultHealthCheckInterval,
+				Timeout:            filters.DefaultHealthCheckTimeout,
+				HealthyThreshold:   filters.DefaultHealthCheckHealthyThreshold,
+				UnhealthyThreshold: filters.DefaultHealthCheckUnhealthyThreshold,
+			}
+			if hc.Interval > 0 {
+				check.Interval = time.Duration(hc.Interval)
+			}
+			if hc.Timeout > 0 {
+				check.Timeout = time.Duration(hc.Timeout)
+			}
+			if hc.HealthyThreshold > 0 {
+				check.HealthyThreshold = hc.HealthyThreshold
+			}
+			if hc.UnhealthyThreshold > 0 {
+				check.UnhealthyThreshold = hc.UnhealthyThreshold
+			}
+			if err := pool.SetHealthCheck(check); err != nil {
+				return nil, fmt.Errorf("upstream pool %s : %w", name, err)
+			}
+		}
+		if oc := pc.OutlierDetection; oc != nil {
+			od := filters.DefaultOutlierDetection()
+			if oc.ConsecutiveFailures > 0 {
+				od.ConsecutiveFailures = oc.ConsecutiveFailures
+			}
+			if oc.EjectionTime > 0 {
+				od.EjectionTime = time.Duration(oc.EjectionTime)
+			}
+			if oc.MaxEjectionPercent > 0 {
+				od.MaxEjectionPercent = oc.MaxEjectionPercent
+			}
+			if err := pool.SetOutlierDetection(od); err != nil {
+				return nil, fmt.Errorf("upstream pool %s : %w", name, err)
+			}
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+// routePoolsFromConfig maps the names of the routes with an upstream to
+// their pool, the names are the ones of routeMatchersFromConfig.
+func routePoolsFromConfig(routes []config.RouteConfig, routeMatchers []filters.RouteMatcher) map[string]string {
+	routePools := map[string]string{}
+	for i, rc := range routes {
+		if rc.Upstream != "" && i < len(routeMatchers) {
+			routePools[routeMatchers[i].Name] = rc.Upstream
+		}
+	}
+	return routePools
+}
+
+// headerRulesFromConfig returns the default header rules and those of the
+// routes, named as by routeMatchersFromConfig.
+func headerRulesFromConfig(defaults config.HeaderRulesConfig, routes []config.RouteConfig, routeMatchers []filters.RouteMatcher) (filters.HeaderRules, map[string]filters.HeaderRules) {
+	byRoute := map[string]filters.HeaderRules{}
+	for i, rc := range routes {
+		if rc.Headers != nil && i < len(routeMatchers) {
+			byRoute[routeMatchers[i].Name] = headerRuleSetFromConfig(*rc.Headers)
+		}
+	}
+	return headerRuleSetFromConfig(defaults), byRoute
+}
+
+func headerRuleSetFromConfig(hrc config.HeaderRulesConfig) filters.HeaderRules {
+	convert := func(rules []config.HeaderRuleConfig) []filters.HeaderRule {
+		converted := make([]filters.HeaderRule, 0, len(rules))
+		for _, r := range rules {
+			converted = append(converted, filters.HeaderRule{
+				Action:     r.Action,
+				Name:       r.Name,
+				Value:      r.Value,
+				NewName:    r.NewName,
+				Host:       r.Host,
+				PathPrefix: r.Path,
+				Statuses:   r.Statuses,
+			})
+		}
+		return converted
+	}
+	return filters.HeaderRules{Request: convert(hrc.Request), Response: convert(hrc.Response)}
+}
+
+// forwardingFromConfig trusts every client unless trusted_proxies is set.
+func forwardingFromConfig(fc config.ForwardingConfig) (filters.Forwarding, error) {
+	f := filters.DefaultForwarding()
+	if fc.ViaPseudonym != "" {
+		f.Pseudonym = fc.ViaPseudonym
+	}
+	if fc.TrustAllProxies && len(fc.TrustedProxies) > 0 {
+		return f, errors.New("forwarding : trust_all_proxies and trusted_proxies are exclusive")
+	}
+	prefixes, err := prefixesFromConfig(fc.TrustedProxies)
+	if err != nil {
+		return f, err
+	}
+	f.TrustAll, f.TrustedProxies = fc.TrustAllProxies, prefixes
+	f.Privacy = fc.Privacy
+	return f, nil
+}
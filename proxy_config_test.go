@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LamineKouissi/LHP/config"
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingCacheFilter records what applyCacheConfig sets
+type recordingCacheFilter struct {
+	defaultPolicy *filters.CachePolicy
+	routePolicies map[string]filters.CachePolicy
+	breaker       *filters.CircuitBreaker
+	breakerSets   int
+}
+
+func (rc *recordingCacheFilter) SetPolicies(defaultPolicy *filters.CachePolicy, routePolicies map[string]filters.CachePolicy) error {
+	rc.defaultPolicy, rc.routePolicies = defaultPolicy, routePolicies
+	return nil
+}
+
+func (rc *recordingCacheFilter) SetCircuitBreaker(cb *filters.CircuitBreaker) error {
+	rc.breaker = cb
+	rc.breakerSets++
+	return nil
+}
+
+func (rc *recordingCacheFilter) CircuitBreaker() *filters.CircuitBreaker {
+	return rc.breaker
+}
+
+func TestApplyCacheConfigBreaker(t *testing.T) {
+	defaultBreaker, _ := filters.NewCircuitBreaker(filters.DefaultBreakerFailureThreshold, filters.DefaultBreakerOpenTimeout, filters.DefaultBreakerHalfOpenProbes)
+	rc := &recordingCacheFilter{breaker: defaultBreaker}
+
+	// unchanged settings keep the breaker, e.g. open while redis is down
+	assert.NoError(t, applyCacheConfig(rc, config.CacheConfig{}, nil, nil))
+	assert.Equal(t, 0, rc.breakerSets)
+
+	withBreaker := config.CacheConfig{Breaker: config.CircuitBreakerConfig{FailureThreshold: 3, OpenTimeout: config.Duration(time.Minute)}}
+	assert.NoError(t, applyCacheConfig(rc, withBreaker, nil, nil))
+	assert.Equal(t, 1, rc.breakerSets)
+	assert.NoError(t, applyCacheConfig(rc, withBreaker, nil, nil))
+	assert.Equal(t, 1, rc.breakerSets, "a reload with the same settings keeps the breaker")
+
+	// the breaker section removed, back to the default breaker
+	assert.NoError(t, applyCacheConfig(rc, config.CacheConfig{}, nil, nil))
+	assert.Equal(t, 2, rc.breakerSets)
+	assert.True(t, defaultBreaker.SameSettings(rc.breaker))
+
+	invalid := config.CacheConfig{Breaker: config.CircuitBreakerConfig{FailureThreshold: -1}}
+	assert.Error(t, applyCacheConfig(rc, invalid, nil, nil))
+}
+
+func TestForwardingFromConfig(t *testing.T) {
+	f, err := forwardingFromConfig(config.ForwardingConfig{})
+	assert.NoError(t, err)
+	assert.False(t, f.TrustAll, "no client is trusted by default")
+	assert.Empty(t, f.TrustedProxies)
+
+	f, err = forwardingFromConfig(config.ForwardingConfig{TrustAllProxies: true})
+	assert.NoError(t, err)
+	assert.True(t, f.TrustAll)
+
+	f, err = forwardingFromConfig(config.ForwardingConfig{ViaPseudonym: "proxy-a", TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "proxy-a", f.Pseudonym)
+	assert.False(t, f.TrustAll)
+	assert.Len(t, f.TrustedProxies, 2)
+
+	_, err = forwardingFromConfig(config.ForwardingConfig{TrustAllProxies: true, TrustedProxies: []string{"10.0.0.0/8"}})
+	assert.Error(t, err)
+	_, err = forwardingFromConfig(config.ForwardingConfig{TrustedProxies: []string{"nope"}})
+	assert.Error(t, err)
+}
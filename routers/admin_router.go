@@ -0,0 +1,298 @@
+package routers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LamineKouissi/LHP/routers/routes"
+	"github.com/LamineKouissi/LHP/util"
+)
+
+// TunnelManager lists and closes the open CONNECT tunnels, routes.HttpsRoute implements it.
+type TunnelManager interface {
+	Tunnels() []routes.TunnelInfo
+	CloseTunnel(id string) error
+}
+
+// CachePurger removes cached responses, the redis cache adapter implements it.
+type CachePurger interface {
+	Delete(ctx context.Context, req *http.Request) error
+	PurgeAll(ctx context.Context) (int64, error)
+}
+
+// AdminRouter serves the admin endpoints on the admin listener, apart from
+// the proxied traffic. /healthz (/livez), /readyz and the handlers added with Handle
+// are public, the management endpoints require the admin token as a bearer token.
+type AdminRouter struct {
+	mux          *http.ServeMux
+	token        string
+	configSource func() interface{}
+	routesSource func() interface{}
+	tunnels      TunnelManager
+	cache        CachePurger
+	reload       func() error
+	checksMu     sync.Mutex
+	checks       []ReadinessCheck
+	checkTimeout time.Duration
+}
+
+func NewAdminRouter(token string) (*AdminRouter, error) {
+	a := &AdminRouter{mux: http.NewServeMux(), token: token, checkTimeout: DefaultReadinessCheckTimeout}
+	a.mux.HandleFunc("/healthz", a.handleHealth)
+	a.mux.HandleFunc("/livez", a.handleHealth)
+	a.mux.HandleFunc("/readyz", a.handleReady)
+	a.mux.Handle("/config", a.private(a.handleConfig))
+	a.mux.Handle("/config/reload", a.private(a.handleReload))
+	a.mux.Handle("/routes", a.private(a.handleRoutes))
+	a.mux.Handle("/tunnels", a.private(a.handleTunnels))
+	a.mux.Handle("/tunnels/", a.private(a.handleTunnel))
+	a.mux.Handle("/cache/purge", a.private(a.handleCachePurge))
+	a.mux.Handle("/log-level", a.private(a.handleLogLevel))
+	return a, nil
+}
+
+// Handle adds a public endpoint, e.g. /metrics.
+func (a *AdminRouter) Handle(pattern string, handler http.Handler) error {
+	if pattern == "" || handler == nil {
+		return errors.New("invalid arg : pattern or handler")
+	}
+	a.mux.Handle(pattern, handler)
+	return nil
+}
+
+// SetConfigSource sets the function returning the effective config served
+// on /config, it must not expose secrets.
+func (a *AdminRouter) SetConfigSource(fn func() interface{}) error {
+	if fn == nil {
+		return errors.New("config source = <nil>")
+	}
+	a.configSource = fn
+	return nil
+}
+
+// SetRoutesSource sets the function returning the routes and filter chains served on /routes.
+func (a *AdminRouter) SetRoutesSource(fn func() interface{}) error {
+	if fn == nil {
+		return errors.New("routes source = <nil>")
+	}
+	a.routesSource = fn
+	return nil
+}
+
+func (a *AdminRouter) SetTunnelManager(tm TunnelManager) error {
+	if tm == nil {
+		return errors.New("TunnelManager = <nil>")
+	}
+	a.tunnels = tm
+	return nil
+}
+
+func (a *AdminRouter) SetCachePurger(cp CachePurger) error {
+	if cp == nil {
+		return errors.New("CachePurger = <nil>")
+	}
+	a.cache = cp
+	return nil
+}
+
+// SetReloader sets the function reloading the config on POST /config/reload.
+func (a *AdminRouter) SetReloader(fn func() error) error {
+	if fn == nil {
+		return errors.New("reloader = <nil>")
+	}
+	a.reload = fn
+	return nil
+}
+
+func (a *AdminRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+// private requires the admin token, management is refused while no token is configured.
+func (a *AdminRouter) private(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.token == "" {
+			writeJSONError(w, http.StatusForbidden, errors.New("admin token not configured"))
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="lhp-admin"`)
+			writeJSONError(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+			return
+		}
+		h(w, r)
+	})
+}
+
+func (a *AdminRouter) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	if a.configSource == nil {
+		writeJSONError(w, http.StatusNotImplemented, errors.New("config not available"))
+		return
+	}
+	writeJSON(w, http.StatusOK, a.configSource())
+}
+
+func (a *AdminRouter) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	if a.reload == nil {
+		writeJSONError(w, http.StatusNotImplemented, errors.New("config reload not available"))
+		return
+	}
+	if err := a.reload(); err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+func (a *AdminRouter) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	if a.routesSource == nil {
+		writeJSONError(w, http.StatusNotImplemented, errors.New("routes not available"))
+		return
+	}
+	writeJSON(w, http.StatusOK, a.routesSource())
+}
+
+func (a *AdminRouter) handleTunnels(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	if a.tunnels == nil {
+		writeJSONError(w, http.StatusNotImplemented, errors.New("tunnels not available"))
+		return
+	}
+	writeJSON(w, http.StatusOK, a.tunnels.Tunnels())
+}
+
+// handleTunnel closes a tunnel on DELETE /tunnels/{id}.
+func (a *AdminRouter) handleTunnel(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodDelete) {
+		return
+	}
+	if a.tunnels == nil {
+		writeJSONError(w, http.StatusNotImplemented, errors.New("tunnels not available"))
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/tunnels/")
+	err := a.tunnels.CloseTunnel(id)
+	var notFound routes.ErrTunnelNotFound
+	switch {
+	case errors.As(err, &notFound):
+		writeJSONError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeJSONError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"status": "closed", "id": id})
+	}
+}
+
+type purgeRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	All    bool   `json:"all"`
+}
+
+// handleCachePurge removes one URL ({"method": "GET", "url": "..."}) or
+// every cached response ({"all": true}).
+func (a *AdminRouter) handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	if a.cache == nil {
+		writeJSONError(w, http.StatusNotImplemented, errors.New("cache not available"))
+		return
+	}
+	var pr purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if pr.All {
+		n, err := a.cache.PurgeAll(r.Context())
+		if err != nil {
+			writeJSONError(w, http.StatusBadGateway, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int64{"deleted": n})
+		return
+	}
+	if pr.URL == "" {
+		writeJSONError(w, http.StatusBadRequest, errors.New(`"url" or "all" is required`))
+		return
+	}
+	if pr.Method == "" {
+		pr.Method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(r.Context(), pr.Method, pr.URL, nil)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := a.cache.Delete(r.Context(), req); err != nil {
+		writeJSONError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "purged", "url": pr.URL})
+}
+
+// handleLogLevel reads or, on PUT {"level": "debug"}, changes the log level.
+func (a *AdminRouter) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if r.Method == http.MethodPut {
+		var body struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		level, err := util.ParseLogLevel(body.Level)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		util.SetLogLevel(level)
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"level": util.GetLogLevel().String()})
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		util.Errorln("AdminRouter.writeJSON(){json.Encode()} : ", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
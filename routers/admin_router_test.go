@@ -0,0 +1,129 @@
+package routers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/LamineKouissi/LHP/routers/routes"
+	"github.com/LamineKouissi/LHP/util"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeTunnelManager struct {
+	tunnels []routes.TunnelInfo
+	closed  []string
+}
+
+func (f *fakeTunnelManager) Tunnels() []routes.TunnelInfo {
+	return f.tunnels
+}
+
+func (f *fakeTunnelManager) CloseTunnel(id string) error {
+	for _, t := range f.tunnels {
+		if t.ID == id {
+			f.closed = append(f.closed, id)
+			return nil
+		}
+	}
+	return routes.ErrTunnelNotFound{ID: id}
+}
+
+type fakeCachePurger struct {
+	deleted []string
+}
+
+func (f *fakeCachePurger) Delete(ctx context.Context, req *http.Request) error {
+	f.deleted = append(f.deleted, req.Method+" "+req.URL.String())
+	return nil
+}
+
+func (f *fakeCachePurger) PurgeAll(ctx context.Context) (int64, error) {
+	return 42, nil
+}
+
+func adminRequest(a *AdminRouter, method, path, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminRouterAuth(t *testing.T) {
+	a, _ := NewAdminRouter("secret")
+
+	assert.Equal(t, http.StatusOK, adminRequest(a, http.MethodGet, "/healthz", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(a, http.MethodGet, "/log-level", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(a, http.MethodGet, "/log-level", "", "wrong").Code)
+	assert.Equal(t, http.StatusOK, adminRequest(a, http.MethodGet, "/log-level", "", "secret").Code)
+
+	noToken, _ := NewAdminRouter("")
+	assert.Equal(t, http.StatusForbidden, adminRequest(noToken, http.MethodGet, "/log-level", "", "").Code)
+	assert.Equal(t, http.StatusOK, adminRequest(noToken, http.MethodGet, "/healthz", "", "").Code)
+}
+
+func TestAdminRouterEndpoints(t *testing.T) {
+	a, _ := NewAdminRouter("secret")
+	tm := &fakeTunnelManager{tunnels: []routes.TunnelInfo{{ID: "t1", Target: "example.com:443"}}}
+	cp := &fakeCachePurger{}
+	reloads := 0
+	assert.NoError(t, a.SetTunnelManager(tm))
+	assert.NoError(t, a.SetCachePurger(cp))
+	assert.NoError(t, a.SetConfigSource(func() interface{} { return map[string]string{"listen_address": ":7000"} }))
+	assert.NoError(t, a.SetRoutesSource(func() interface{} { return []string{"api"} }))
+	assert.NoError(t, a.SetReloader(func() error {
+		reloads++
+		if reloads > 1 {
+			return errors.New("invalid config")
+		}
+		return nil
+	}))
+	assert.Error(t, a.SetTunnelManager(nil))
+
+	t.Run("Config and routes", func(t *testing.T) {
+		rec := adminRequest(a, http.MethodGet, "/config", "", "secret")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"listen_address": ":7000"}`, rec.Body.String())
+		rec = adminRequest(a, http.MethodGet, "/routes", "", "secret")
+		assert.JSONEq(t, `["api"]`, rec.Body.String())
+		assert.Equal(t, http.StatusMethodNotAllowed, adminRequest(a, http.MethodPost, "/config", "", "secret").Code)
+	})
+
+	t.Run("Tunnels", func(t *testing.T) {
+		rec := adminRequest(a, http.MethodGet, "/tunnels", "", "secret")
+		assert.Contains(t, rec.Body.String(), `"target":"example.com:443"`)
+		assert.Equal(t, http.StatusOK, adminRequest(a, http.MethodDelete, "/tunnels/t1", "", "secret").Code)
+		assert.Equal(t, []string{"t1"}, tm.closed)
+		assert.Equal(t, http.StatusNotFound, adminRequest(a, http.MethodDelete, "/tunnels/nope", "", "secret").Code)
+	})
+
+	t.Run("Cache purge", func(t *testing.T) {
+		rec := adminRequest(a, http.MethodPost, "/cache/purge", `{"url": "http://example.com/a"}`, "secret")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, []string{"GET http://example.com/a"}, cp.deleted)
+		rec = adminRequest(a, http.MethodPost, "/cache/purge", `{"all": true}`, "secret")
+		assert.JSONEq(t, `{"deleted": 42}`, rec.Body.String())
+		assert.Equal(t, http.StatusBadRequest, adminRequest(a, http.MethodPost, "/cache/purge", `{}`, "secret").Code)
+	})
+
+	t.Run("Log level", func(t *testing.T) {
+		defer util.SetLogLevel(util.GetLogLevel())
+		rec := adminRequest(a, http.MethodPut, "/log-level", `{"level": "debug"}`, "secret")
+		assert.JSONEq(t, `{"level": "debug"}`, rec.Body.String())
+		assert.Equal(t, util.LogLevelDebug, util.GetLogLevel())
+		assert.Equal(t, http.StatusBadRequest, adminRequest(a, http.MethodPut, "/log-level", `{"level": "loud"}`, "secret").Code)
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, adminRequest(a, http.MethodPost, "/config/reload", "", "secret").Code)
+		rec := adminRequest(a, http.MethodPost, "/config/reload", "", "secret")
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+		assert.Contains(t, rec.Body.String(), "invalid config")
+	})
+}
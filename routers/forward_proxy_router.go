@@ -1,7 +1,6 @@
 package routers
 
 import (
-	"context"
 	"errors"
 	"net/http"
 
@@ -25,7 +24,8 @@ func NewForwardProxyRouter(hsRoute routes.HttpsRoute, hRoute routes.HttpRoute) (
 }
 
 func (f *ForwardProxyRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+	// canceled when the client goes away, so upstream requests are aborted with it
+	ctx := r.Context()
 	switch r.Method {
 	case "CONNECT":
 		f.httpsRoute.HandleF(ctx, w, r)
@@ -0,0 +1,118 @@
+package routers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultReadinessCheckTimeout bounds each readiness check.
+const DefaultReadinessCheckTimeout = 2 * time.Second
+
+// ReadinessCheck reports whether a dependency of the proxy is usable, see
+// AdminRouter.AddReadinessCheck.
+type ReadinessCheck interface {
+	Name() string
+	Check(ctx context.Context) error
+}
+
+type readinessCheckFunc struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// NewReadinessCheck makes a ReadinessCheck of fn.
+func NewReadinessCheck(name string, fn func(ctx context.Context) error) (ReadinessCheck, error) {
+	if name == "" || fn == nil {
+		return nil, errors.New("invalid arg : name or check func")
+	}
+	return &readinessCheckFunc{name: name, fn: fn}, nil
+}
+
+func (c *readinessCheckFunc) Name() string {
+	return c.name
+}
+
+func (c *readinessCheckFunc) Check(ctx context.Context) error {
+	return c.fn(ctx)
+}
+
+type checkResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type readinessReport struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks"`
+}
+
+// AddReadinessCheck adds a check run on every /readyz request, the proxy is
+// ready when all checks pass.
+func (a *AdminRouter) AddReadinessCheck(c ReadinessCheck) error {
+	if c == nil {
+		return errors.New("ReadinessCheck = <nil>")
+	}
+	a.checksMu.Lock()
+	defer a.checksMu.Unlock()
+	a.checks = append(a.checks, c)
+	return nil
+}
+
+// SetReadinessCheckTimeout bounds each readiness check to d.
+func (a *AdminRouter) SetReadinessCheckTimeout(d time.Duration) error {
+	if d <= 0 {
+		return errors.New("invalid readiness check timeout")
+	}
+	a.checkTimeout = d
+	return nil
+}
+
+// runReadinessChecks runs the checks concurrently, in the order they were added.
+func (a *AdminRouter) runReadinessChecks(ctx context.Context) readinessReport {
+	a.checksMu.Lock()
+	checks := append([]ReadinessCheck(nil), a.checks...)
+	a.checksMu.Unlock()
+
+	report := readinessReport{Status: "ready", Checks: make([]checkResult, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c ReadinessCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, a.checkTimeout)
+			defer cancel()
+			report.Checks[i] = checkResult{Name: c.Name(), Status: "ok"}
+			if err := c.Check(ctx); err != nil {
+				report.Checks[i].Status = "fail"
+				report.Checks[i].Error = err.Error()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, r := range report.Checks {
+		if r.Status != "ok" {
+			report.Status = "not ready"
+		}
+	}
+	return report
+}
+
+// handleHealth is the liveness probe, the process is up and serving.
+func (a *AdminRouter) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReady is the readiness probe, 503 with the failed checks when a dependency is down.
+func (a *AdminRouter) handleReady(w http.ResponseWriter, r *http.Request) {
+	report := a.runReadinessChecks(r.Context())
+	status := http.StatusOK
+	if report.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
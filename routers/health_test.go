@@ -0,0 +1,54 @@
+package routers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminRouterReadiness(t *testing.T) {
+	a, _ := NewAdminRouter("")
+	assert.NoError(t, a.SetReadinessCheckTimeout(50*time.Millisecond))
+
+	rec := adminRequest(a, http.MethodGet, "/readyz", "", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "ready without checks")
+
+	redisUp := true
+	redis, _ := NewReadinessCheck("redis", func(ctx context.Context) error {
+		if !redisUp {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	slow, _ := NewReadinessCheck("upstream", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	_, err := NewReadinessCheck("", nil)
+	assert.Error(t, err)
+	assert.NoError(t, a.AddReadinessCheck(redis))
+
+	rec = adminRequest(a, http.MethodGet, "/readyz", "", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status": "ready", "checks": [{"name": "redis", "status": "ok"}]}`, rec.Body.String())
+
+	redisUp = false
+	assert.NoError(t, a.AddReadinessCheck(slow))
+	rec = adminRequest(a, http.MethodGet, "/readyz", "", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	var report readinessReport
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal(t, "not ready", report.Status)
+	assert.Equal(t, checkResult{Name: "redis", Status: "fail", Error: "connection refused"}, report.Checks[0])
+	assert.Equal(t, "upstream", report.Checks[1].Name)
+	assert.Equal(t, context.DeadlineExceeded.Error(), report.Checks[1].Error)
+
+	// liveness does not depend on the checks
+	assert.Equal(t, http.StatusOK, adminRequest(a, http.MethodGet, "/livez", "", "").Code)
+	assert.Equal(t, http.StatusOK, adminRequest(a, http.MethodGet, "/healthz", "", "").Code)
+}
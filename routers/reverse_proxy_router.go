@@ -0,0 +1,40 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/LamineKouissi/LHP/routers/routes"
+	"github.com/LamineKouissi/LHP/util"
+)
+
+// ReverseProxyRouter runs the proxy in front of services: the requests,
+// addressed to the proxy itself, go through the HTTP route where the
+// filters.UpstreamPoolFilter sends them to the upstream pool of their route.
+type ReverseProxyRouter struct {
+	httpRoute routes.HttpRoute
+}
+
+func NewReverseProxyRouter(hRoute routes.HttpRoute) (*ReverseProxyRouter, error) {
+	isEmpty, err := util.IsStructEmpty(hRoute)
+	if err != nil || isEmpty {
+		return nil, errors.New("invalid arg : HttpRoute")
+	}
+	return &ReverseProxyRouter{httpRoute: hRoute}, nil
+}
+
+func (rp *ReverseProxyRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		http.Error(w, "CONNECT is not supported in reverse proxy mode", http.StatusMethodNotAllowed)
+		return
+	}
+	// the request URL is made absolute, as a forward proxy gets it, so the
+	// filters see the same URLs in both modes, e.g. for the cache keys
+	r.URL.Host = r.Host
+	r.URL.Scheme = "http"
+	if r.TLS != nil {
+		r.URL.Scheme = "https"
+	}
+	rp.httpRoute.HandleF(r.Context(), w, r)
+}
@@ -0,0 +1,73 @@
+package routers
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/LamineKouissi/LHP/routers/routes"
+	"github.com/stretchr/testify/assert"
+)
+
+type chainFunc func(ctx context.Context, req *http.Request, res *http.Response) error
+
+func (f chainFunc) Process(ctx context.Context, req *http.Request, res *http.Response) error {
+	return f(ctx, req, res)
+}
+
+func TestReverseProxyRouter(t *testing.T) {
+	var gotURL string
+	hr, err := routes.NewHttpRoute(chainFunc(func(ctx context.Context, req *http.Request, res *http.Response) error {
+		gotURL = req.URL.String()
+		res.StatusCode = http.StatusOK
+		res.Header = http.Header{}
+		res.Body = io.NopCloser(strings.NewReader("ok"))
+		return nil
+	}))
+	assert.NoError(t, err)
+	rp, err := NewReverseProxyRouter(*hr)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		req        func() *http.Request
+		wantStatus int
+		wantURL    string
+	}{
+		{
+			name:       "Origin form over HTTP",
+			req:        func() *http.Request { return httptest.NewRequest(http.MethodGet, "/users?id=1", nil) },
+			wantStatus: http.StatusOK,
+			wantURL:    "http://example.com/users?id=1",
+		},
+		{
+			name: "Origin form over TLS",
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/users", nil)
+				req.Host = "api.example.com"
+				req.TLS = &tls.ConnectionState{}
+				return req
+			},
+			wantStatus: http.StatusOK,
+			wantURL:    "https://api.example.com/users",
+		},
+		{
+			name:       "CONNECT",
+			req:        func() *http.Request { return httptest.NewRequest(http.MethodConnect, "example.com:443", nil) },
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotURL = ""
+			w := httptest.NewRecorder()
+			rp.ServeHTTP(w, tt.req())
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantURL, gotURL)
+		})
+	}
+}
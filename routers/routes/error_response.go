@@ -0,0 +1,117 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/LamineKouissi/LHP/util"
+)
+
+// ErrorIDHeader carries the id of a failed request, the same id is logged
+// with the error so a client report can be matched to the logs.
+const ErrorIDHeader = "X-Error-Id"
+
+// DefaultErrorPageTemplate is the HTML error page used when none is configured.
+const DefaultErrorPageTemplate = `<!DOCTYPE html>
+<html><head><title>{{.Status}} {{.StatusText}}</title></head>
+<body><h1>{{.Status}} {{.StatusText}}</h1>
+{{if .Message}}<p>{{.Message}}</p>
+{{end}}<p>Error ID: {{.ErrorID}}</p></body></html>
+`
+
+// ErrorPageData is what the error page templates are executed with, it is
+// also the JSON error body.
+type ErrorPageData struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"error"`
+	Category   string `json:"category"`
+	Message    string `json:"message,omitempty"`
+	Retryable  bool   `json:"retryable"`
+	ErrorID    string `json:"error_id"`
+}
+
+// ErrorPages renders the responses to failed requests: a JSON body for
+// clients accepting JSON, an HTML page from a template otherwise.
+type ErrorPages struct {
+	page     *template.Template
+	byStatus map[int]*template.Template
+}
+
+var defaultErrorPages = &ErrorPages{page: template.Must(template.New("error").Parse(DefaultErrorPageTemplate))}
+
+// NewErrorPages parses the HTML error page templates, page is used for the
+// statuses missing from byStatus; an empty page is DefaultErrorPageTemplate.
+func NewErrorPages(page string, byStatus map[int]string) (*ErrorPages, error) {
+	if page == "" {
+		page = DefaultErrorPageTemplate
+	}
+	ep := &ErrorPages{byStatus: map[int]*template.Template{}}
+	var err error
+	ep.page, err = template.New("error").Parse(page)
+	if err != nil {
+		return nil, errors.Join(errors.New("invalid error page template"), err)
+	}
+	for status, text := range byStatus {
+		if status < 400 || status > 599 {
+			return nil, errors.New("invalid error page status : " + strconv.Itoa(status))
+		}
+		ep.byStatus[status], err = template.New(strconv.Itoa(status)).Parse(text)
+		if err != nil {
+			return nil, errors.Join(errors.New("invalid error page template for status "+strconv.Itoa(status)), err)
+		}
+	}
+	return ep, nil
+}
+
+// Write answers a failed request with pe. The body only tells pe's safe
+// message and the error id, never the underlying error.
+func (ep *ErrorPages) Write(w http.ResponseWriter, req *http.Request, pe filters.ProxyError, errorID string) {
+	if ep == nil {
+		ep = defaultErrorPages
+	}
+	data := ErrorPageData{
+		Status:     pe.Status,
+		StatusText: http.StatusText(pe.Status),
+		Category:   string(pe.Category),
+		Message:    pe.Message,
+		Retryable:  pe.Retryable,
+		ErrorID:    errorID,
+	}
+	h := w.Header()
+	h.Set(ErrorIDHeader, errorID)
+	h.Set("Cache-Control", "no-store")
+	if pe.RetryAfter > 0 {
+		// in whole seconds, rounded up so the client does not come back too early
+		h.Set("Retry-After", strconv.FormatInt(int64((pe.RetryAfter+time.Second-1)/time.Second), 10))
+	}
+
+	if strings.Contains(req.Header.Get("Accept"), "application/json") {
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(pe.Status)
+		if err := json.NewEncoder(w).Encode(data); err != nil {
+			util.Errorln("ErrorPages.Write(){json.Encode()} : ", err)
+		}
+		return
+	}
+
+	tmpl, ok := ep.byStatus[pe.Status]
+	if !ok {
+		tmpl = ep.page
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		util.Errorln("ErrorPages.Write(){tmpl.Execute()} : ", err)
+		buf.Reset()
+		defaultErrorPages.page.Execute(&buf, data)
+	}
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(pe.Status)
+	w.Write(buf.Bytes())
+}
@@ -1,24 +1,46 @@
 package routes
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"io"
-	"log"
+	"mime"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/LamineKouissi/LHP/filters"
+	"github.com/LamineKouissi/LHP/util"
 )
 
 type HttpRoute struct {
 	HttpFilterChaine filters.Filter
+	errorPages       *ErrorPages
+	tunneler         Tunneler
+	// shared by the copies of the route so the routes can be replaced on config reload
+	routeTable *routeTable
+}
+
+type routeTable struct {
+	mu            sync.RWMutex
+	routeMatchers []filters.RouteMatcher
+}
+
+// Tunneler splices the client and upstream connections of the upgraded
+// requests, HttpsRoute implements it. The tunnels are reserved before the
+// upgrade is answered, so that one over the quotas gets the error instead.
+type Tunneler interface {
+	ReserveTunnel(ctx context.Context, info *filters.RequestInfo, target string) (TunnelReservation, error)
+	Tunnel(ctx context.Context, clientConn net.Conn, destConn io.ReadWriteCloser, rec filters.TunnelLogRecord, reservation TunnelReservation)
 }
 
 func NewHttpRoute(filterChaine filters.Filter) (*HttpRoute, error) {
 	if filterChaine == nil {
 		return nil, errors.New("nil filterChaine")
 	}
-	return &HttpRoute{HttpFilterChaine: filterChaine}, nil
+	return &HttpRoute{HttpFilterChaine: filterChaine, tunneler: &HttpsRoute{tunnels: newTunnelRegistry()}, routeTable: &routeTable{}}, nil
 }
 
 func (h *HttpRoute) SetHttpFilterChaine(hfc filters.Filter) error {
@@ -29,18 +51,215 @@ func (h *HttpRoute) SetHttpFilterChaine(hfc filters.Filter) error {
 	return nil
 }
 
+// SetErrorPages sets the pages failed requests are answered with.
+func (h *HttpRoute) SetErrorPages(ep *ErrorPages) error {
+	if ep == nil {
+		return errors.New("ErrorPages = <nil>")
+	}
+	h.errorPages = ep
+	return nil
+}
+
+// SetTunneler sets what splices the upgraded connections, e.g. the
+// HttpsRoute so that they are listed, logged and metered as its tunnels.
+func (h *HttpRoute) SetTunneler(t Tunneler) error {
+	if t == nil {
+		return errors.New("Tunneler = <nil>")
+	}
+	h.tunneler = t
+	return nil
+}
+
+// SetRouteMatchers sets the named routes requests are matched against, the
+// first matching route is passed down the filter chain, see filters.RouteFromCtx.
+func (h *HttpRoute) SetRouteMatchers(rms []filters.RouteMatcher) {
+	h.routeTable.mu.Lock()
+	defer h.routeTable.mu.Unlock()
+	h.routeTable.routeMatchers = rms
+}
+
+func (h *HttpRoute) RouteMatchers() []filters.RouteMatcher {
+	h.routeTable.mu.RLock()
+	defer h.routeTable.mu.RUnlock()
+	return h.routeTable.routeMatchers
+}
+
 func (h *HttpRoute) HandleF(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	info := filters.NewRequestInfo(req)
+	ctx = filters.WithRequestInfo(ctx, info)
+	if name, ok := filters.MatchRoute(h.RouteMatchers(), req); ok {
+		ctx = filters.WithRoute(ctx, name)
+	}
 
 	resp := &http.Response{}
 	err := h.HttpFilterChaine.Process(ctx, req, resp)
+	if err == nil && resp.Body == nil {
+		err = filters.NewInternalError(errors.New("HttpRoute.HandleF() : the filter chain returned no response"))
+	}
 	if err != nil {
-		log.Println(err)
+		pe := filters.ToProxyError(err)
+		util.Errorln("error_id="+info.ID, "category="+string(pe.Category), req.Method, req.URL, ":", err)
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		h.errorPages.Write(w, req, pe, info.ID)
+		return
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		h.upgrade(ctx, w, req, resp, info)
+		return
 	}
 
 	defer resp.Body.Close()
 	h.copyHeader(w.Header(), resp.Header)
+	announcedTrailers := len(resp.Trailer)
+	if announcedTrailers > 0 {
+		trailerKeys := make([]string, 0, announcedTrailers)
+		for k := range resp.Trailer {
+			trailerKeys = append(trailerKeys, k)
+		}
+		w.Header().Add("Trailer", strings.Join(trailerKeys, ", "))
+	}
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	if announcedTrailers > 0 {
+		// chunk the response, net/http would send a Content-Length for a short body and drop the trailers
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+
+	werr, rerr := h.copyBody(w, resp.Body, isStreaming(resp))
+	if werr != nil || (rerr != nil && ctx.Err() != nil) {
+		// closing the body on return cancels the upstream request
+		util.Debugln("request_id="+info.ID, req.Method, req.URL, ": the client went away during the response :", errors.Join(werr, rerr))
+		return
+	}
+	if rerr != nil {
+		util.Errorln("request_id="+info.ID, req.Method, req.URL, ": reading the upstream response :", rerr)
+		// the status is sent already, aborting the connection tells the client the body is truncated
+		panic(http.ErrAbortHandler)
+	}
+
+	if len(resp.Trailer) != announcedTrailers {
+		// trailers the upstream did not announce go out with the TrailerPrefix
+		for k, vv := range resp.Trailer {
+			for _, v := range vv {
+				w.Header().Add(http.TrailerPrefix+k, v)
+			}
+		}
+		return
+	}
+	h.copyHeader(w.Header(), resp.Trailer)
+}
+
+// isStreaming reports whether the body of res has to reach the client as it
+// comes: server-sent events, a body of unknown length such as a chunked
+// long-poll response, or a response with X-Accel-Buffering: no.
+func isStreaming(res *http.Response) bool {
+	if strings.EqualFold(res.Header.Get("X-Accel-Buffering"), "no") {
+		return true
+	}
+	if mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type")); err == nil && mediaType == "text/event-stream" {
+		return true
+	}
+	return res.ContentLength < 0
+}
+
+// copyBody copies body to w, flushing after each write when streaming. werr
+// is the client side failing, rerr the upstream side.
+func (h *HttpRoute) copyBody(w http.ResponseWriter, body io.Reader, streaming bool) (werr, rerr error) {
+	flusher, canFlush := w.(http.Flusher)
+	flush := streaming && canFlush
+	buf := make([]byte, 32*1024)
+	for {
+		nr, err := body.Read(buf)
+		if nr > 0 {
+			if _, werr = w.Write(buf[:nr]); werr != nil {
+				return werr, nil
+			}
+			if flush {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// upgrade answers the client with the upstream's 101 response, then splices
+// the client connection with the upstream connection, the response body.
+func (h *HttpRoute) upgrade(ctx context.Context, w http.ResponseWriter, req *http.Request, resp *http.Response, info *filters.RequestInfo) {
+	upstreamConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		pe := filters.NewUpstreamError(filters.RequestHost(req), errors.New("101 Switching Protocols response without a connection"))
+		util.Errorln("error_id="+info.ID, "category="+string(pe.Category), req.Method, req.URL, ":", pe)
+		h.errorPages.Write(w, req, pe, info.ID)
+		return
+	}
+	reservation, err := h.tunneler.ReserveTunnel(ctx, info, req.URL.Host)
+	if err != nil {
+		upstreamConn.Close()
+		h.errorPages.Write(w, req, filters.ToProxyError(err), info.ID)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		reservation.Release()
+		upstreamConn.Close()
+		pe := filters.NewInternalError(errors.New("HttpRoute.upgrade() : the client connection cannot be hijacked"))
+		util.Errorln("error_id="+info.ID, "category="+string(pe.Category), req.Method, req.URL, ":", pe)
+		h.errorPages.Write(w, req, pe, info.ID)
+		return
+	}
+	clientConn, brw, err := hijacker.Hijack()
+	if err != nil {
+		reservation.Release()
+		upstreamConn.Close()
+		pe := filters.NewInternalError(err)
+		util.Errorln("error_id="+info.ID, "category="+string(pe.Category), req.Method, req.URL, ":", pe)
+		h.errorPages.Write(w, req, pe, info.ID)
+		return
+	}
+
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	resp.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		util.Errorln("error_id="+info.ID, req.Method, req.URL, ": writing the 101 response :", err)
+		reservation.Release()
+		clientConn.Close()
+		upstreamConn.Close()
+		return
+	}
+
+	rec := filters.TunnelLogRecord{
+		Time:      info.Start,
+		RequestID: info.ID,
+		ClientIP:  info.ClientIP,
+		Target:    req.URL.Host,
+	}
+	if principal, ok := filters.AuthFromCtx(ctx); ok {
+		rec.Principal = principal
+	}
+	// the tunnel runs in the handler, the request context ends when it returns
+	h.tunneler.Tunnel(ctx, &hijackedConn{Conn: clientConn, r: brw.Reader}, upstreamConn, rec, reservation)
+}
+
+// hijackedConn reads through the reader of the hijacked connection, which
+// may hold bytes the client sent right after its upgrade request.
+type hijackedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
 }
 
 func (hs *HttpRoute) copyHeader(dst, src http.Header) {
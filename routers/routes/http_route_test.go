@@ -0,0 +1,404 @@
+package routes
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/LamineKouissi/LHP/filters/connectors"
+	"github.com/stretchr/testify/assert"
+)
+
+type chainFunc func(ctx context.Context, req *http.Request, res *http.Response) error
+
+func (f chainFunc) Process(ctx context.Context, req *http.Request, res *http.Response) error {
+	return f(ctx, req, res)
+}
+
+func TestHttpRouteHandleFErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		accept     string
+		wantStatus int
+	}{
+		{name: "Upstream error", err: filters.NewUpstreamError("example.com", errors.New("connection refused")), wantStatus: http.StatusBadGateway},
+		{name: "Upstream timeout", err: filters.NewUpstreamError("example.com", context.DeadlineExceeded), accept: "application/json", wantStatus: http.StatusGatewayTimeout},
+		{name: "No next filter", err: filters.ErrNoNextFilter("MetricsFilter"), accept: "application/json", wantStatus: http.StatusServiceUnavailable},
+		{name: "Policy", err: filters.NewPolicyError(http.StatusForbidden, "Access denied."), accept: "application/json", wantStatus: http.StatusForbidden},
+		{name: "Internal", err: errors.New("secret detail"), wantStatus: http.StatusInternalServerError},
+		{name: "No response", wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requestID string
+			hr, _ := NewHttpRoute(chainFunc(func(ctx context.Context, req *http.Request, res *http.Response) error {
+				info, _ := filters.RequestInfoFromCtx(ctx)
+				requestID = info.ID
+				return tt.err
+			}))
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			hr.HandleF(context.Background(), w, req)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, requestID, w.Header().Get(ErrorIDHeader))
+			assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+			if tt.accept == "application/json" {
+				var body ErrorPageData
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+				pe := filters.ToProxyError(tt.err)
+				assert.Equal(t, ErrorPageData{Status: tt.wantStatus, StatusText: http.StatusText(tt.wantStatus), Category: string(pe.Category),
+					Message: pe.Message, Retryable: pe.Retryable, ErrorID: requestID}, body)
+				return
+			}
+			assert.Contains(t, w.Header().Get("Content-Type"), "text/html")
+			assert.Contains(t, w.Body.String(), requestID)
+			if tt.err != nil {
+				assert.NotContains(t, w.Body.String(), errors.Unwrap(filters.ToProxyError(tt.err)).Error())
+			}
+		})
+	}
+}
+
+func TestHttpRouteHandleF(t *testing.T) {
+	hr, _ := NewHttpRoute(chainFunc(func(ctx context.Context, req *http.Request, res *http.Response) error {
+		res.StatusCode = http.StatusOK
+		res.Header = http.Header{"Content-Type": {"text/plain"}}
+		res.Body = io.NopCloser(strings.NewReader("hello"))
+		return nil
+	}))
+	w := httptest.NewRecorder()
+	hr.HandleF(context.Background(), w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello", w.Body.String())
+	assert.Empty(t, w.Header().Get(ErrorIDHeader))
+}
+
+func TestErrorPages(t *testing.T) {
+	_, err := NewErrorPages("{{.Status", nil)
+	assert.Error(t, err)
+	_, err = NewErrorPages("", map[int]string{200: "ok"})
+	assert.Error(t, err)
+
+	ep, err := NewErrorPages("<p>{{.Status}} {{.Category}} {{.Message}}</p>", map[int]string{
+		http.StatusGatewayTimeout: "<p>too slow, id {{.ErrorID}}</p>",
+		http.StatusBadGateway:     "{{.Missing}}",
+	})
+	assert.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+
+	w := httptest.NewRecorder()
+	ep.Write(w, req, filters.NewPolicyError(http.StatusForbidden, "<b>denied</b>"), "abc")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "<p>403 policy &lt;b&gt;denied&lt;/b&gt;</p>", w.Body.String())
+
+	w = httptest.NewRecorder()
+	ep.Write(w, req, filters.NewUpstreamError("example.com", context.DeadlineExceeded), "abc")
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Equal(t, "<p>too slow, id abc</p>", w.Body.String())
+
+	// a failing template falls back to the default page
+	w = httptest.NewRecorder()
+	ep.Write(w, req, filters.NewUpstreamError("example.com", errors.New("refused")), "abc")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), "<h1>502 Bad Gateway</h1>")
+	assert.Contains(t, w.Body.String(), "Error ID: abc")
+
+	w = httptest.NewRecorder()
+	ep.Write(w, req, filters.NewRateLimitError(1500*time.Millisecond), "abc")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+}
+
+// newUpstreamHttpRoute is a route sending the requests to their upstream.
+func newUpstreamHttpRoute(t *testing.T) *HttpRoute {
+	cnx, err := connectors.NewHttpsConnector()
+	assert.NoError(t, err)
+	transformer, err := filters.NewHttpMsgTransformerFilter(cnx)
+	assert.NoError(t, err)
+	hr, err := NewHttpRoute(transformer)
+	assert.NoError(t, err)
+	return hr
+}
+
+// echoUpgradeServer switches to the "echo" protocol and echoes the lines it reads.
+func echoUpgradeServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if filters.UpgradeType(r.Header) != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			brw.WriteString("echo: " + line)
+			brw.Flush()
+		}
+	}))
+}
+
+func TestHttpRouteUpgrade(t *testing.T) {
+	upstream := echoUpgradeServer(t)
+	defer upstream.Close()
+
+	hr := newUpstreamHttpRoute(t)
+	hs, _ := NewHttspRoute()
+	logger := &recordingTunnelLogger{records: make(chan filters.TunnelLogRecord, 1)}
+	assert.NoError(t, hs.SetTunnelLogger(logger))
+	assert.NoError(t, hr.SetTunneler(hs))
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hr.HandleF(r.Context(), w, r)
+	}))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	// the first line is sent with the upgrade request, before the 101
+	_, err = io.WriteString(conn, "GET "+upstream.URL+"/ws HTTP/1.1\r\nHost: "+upstream.Listener.Addr().String()+
+		"\r\nConnection: keep-alive, Upgrade\r\nUpgrade: echo\r\n\r\nhello\n")
+	assert.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	assert.Equal(t, "echo", res.Header.Get("Upgrade"))
+	assert.Equal(t, "Upgrade", res.Header.Get("Connection"))
+
+	line, err := br.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "echo: hello\n", line)
+	_, err = io.WriteString(conn, "again\n")
+	assert.NoError(t, err)
+	line, err = br.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "echo: again\n", line)
+
+	conn.Close()
+	rec := waitTunnelRecord(t, logger)
+	assert.Equal(t, upstream.Listener.Addr().String(), rec.Target)
+	assert.Equal(t, int64(len("hello\nagain\n")), rec.BytesUpstream)
+	assert.Equal(t, int64(len("echo: hello\necho: again\n")), rec.BytesClient)
+}
+
+func TestHttpRouteUpgradeTunnelQuota(t *testing.T) {
+	upstream := echoUpgradeServer(t)
+	defer upstream.Close()
+
+	hr := newUpstreamHttpRoute(t)
+	hs, _ := NewHttspRoute()
+	assert.NoError(t, hs.SetTunnelQuotas(TunnelQuotas{MaxTunnels: 1}))
+	logger := &recordingTunnelLogger{records: make(chan filters.TunnelLogRecord, 1)}
+	assert.NoError(t, hs.SetTunnelLogger(logger))
+	assert.NoError(t, hr.SetTunneler(hs))
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hr.HandleF(r.Context(), w, r)
+	}))
+	defer proxy.Close()
+
+	upgrade := func() (net.Conn, *http.Response) {
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		assert.NoError(t, err)
+		_, err = io.WriteString(conn, "GET "+upstream.URL+"/ws HTTP/1.1\r\nHost: "+upstream.Listener.Addr().String()+
+			"\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		assert.NoError(t, err)
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		assert.NoError(t, err)
+		return conn, res
+	}
+
+	first, res := upgrade()
+	defer first.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+
+	second, res := upgrade()
+	defer second.Close()
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, 1, openTunnels(hs.quota), "a refused tunnel holds no quota")
+
+	first.Close()
+	waitTunnelRecord(t, logger)
+	// the quota is given back right after the tunnel is logged
+	deadline := time.Now().Add(time.Second)
+	for openTunnels(hs.quota) > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, 0, openTunnels(hs.quota), "a closed tunnel gives its quota back")
+}
+
+func openTunnels(tq *tunnelQuota) int {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	return tq.total
+}
+
+func TestHttpRouteUpgradeRefused(t *testing.T) {
+	upstream := echoUpgradeServer(t)
+	defer upstream.Close()
+	hr := newUpstreamHttpRoute(t)
+
+	req := httptest.NewRequest(http.MethodGet, upstream.URL+"/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	w := httptest.NewRecorder()
+	hr.HandleF(context.Background(), w, req)
+	assert.Equal(t, http.StatusUpgradeRequired, w.Code)
+}
+
+// newTestProxy serves hr and returns a client going through it.
+func newTestProxy(t *testing.T, hr *HttpRoute) (*http.Client, func()) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hr.HandleF(r.Context(), w, r)
+	}))
+	proxyURL, err := url.Parse(proxy.URL)
+	assert.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+	return client, proxy.Close
+}
+
+func TestHttpRouteStreaming(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{name: "Server-sent events", header: http.Header{"Content-Type": {"text/event-stream; charset=utf-8"}}},
+		{name: "Chunked", header: http.Header{"Content-Type": {"application/json"}}},
+		{name: "X-Accel-Buffering", header: http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"12"}, "X-Accel-Buffering": {"no"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, vv := range tt.header {
+					w.Header()[k] = vv
+				}
+				io.WriteString(w, "first\n")
+				w.(http.Flusher).Flush()
+				<-release
+				io.WriteString(w, "second")
+			}))
+			defer upstream.Close()
+			defer close(release)
+			client, closeProxy := newTestProxy(t, newUpstreamHttpRoute(t))
+			defer closeProxy()
+
+			res, err := client.Get(upstream.URL + "/events")
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer res.Body.Close()
+			// the first line arrives while the upstream holds the rest
+			line, err := bufio.NewReader(res.Body).ReadString('\n')
+			assert.NoError(t, err)
+			assert.Equal(t, "first\n", line)
+		})
+	}
+}
+
+func TestIsStreaming(t *testing.T) {
+	assert.True(t, isStreaming(&http.Response{Header: http.Header{"Content-Type": {"text/event-stream"}}, ContentLength: 10}))
+	assert.True(t, isStreaming(&http.Response{Header: http.Header{"X-Accel-Buffering": {"No"}}, ContentLength: 10}))
+	assert.True(t, isStreaming(&http.Response{Header: http.Header{}, ContentLength: -1}))
+	assert.False(t, isStreaming(&http.Response{Header: http.Header{"Content-Type": {"text/html"}}, ContentLength: 10}))
+}
+
+func TestHttpRouteTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		io.WriteString(w, "body")
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "late")
+	}))
+	defer upstream.Close()
+	client, closeProxy := newTestProxy(t, newUpstreamHttpRoute(t))
+	defer closeProxy()
+
+	res, err := client.Get(upstream.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "body", string(body))
+	assert.Equal(t, "abc", res.Trailer.Get("X-Checksum"))
+	assert.Equal(t, "late", res.Trailer.Get("X-Late"))
+}
+
+func TestHttpRouteClientDisconnect(t *testing.T) {
+	upstreamDone := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(upstreamDone)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for {
+			if _, err := io.WriteString(w, "data: tick\n\n"); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}))
+	defer upstream.Close()
+	client, closeProxy := newTestProxy(t, newUpstreamHttpRoute(t))
+	defer closeProxy()
+
+	res, err := client.Get(upstream.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = bufio.NewReader(res.Body).ReadString('\n')
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	select {
+	case <-upstreamDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream request was not canceled")
+	}
+}
+
+func TestHttpRouteUpstreamAbort(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, _ := w.(http.Hijacker).Hijack()
+		brw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\npartial")
+		brw.Flush()
+		conn.Close()
+	}))
+	defer upstream.Close()
+	client, closeProxy := newTestProxy(t, newUpstreamHttpRoute(t))
+	defer closeProxy()
+
+	// the response is cut before or after its header got through
+	res, err := client.Get(upstream.URL)
+	if err == nil {
+		_, err = io.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	assert.Error(t, err, "the client sees the response is truncated")
+}
@@ -2,23 +2,268 @@ package routes
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
 	"time"
+
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/LamineKouissi/LHP/util"
 )
 
 type HttpsRoute struct {
+	tunnelLogger   filters.TunnelLogger
+	tunnelObserver filters.TunnelObserver
+	errorPages     *ErrorPages
+	acl            *filters.ACL
+	rateLimiter    *filters.RateLimitFilter
+	connectPorts   []int
+	portExceptions []PortException
+	idleTimeout    time.Duration
+	// shared by the copies of the route, see Tunnels
+	tunnels *tunnelRegistry
+	// nil without quotas, shared by the copies of the route too
+	quota *tunnelQuota
+}
+
+// DefaultConnectPorts are the ports CONNECT tunnels may reach unless set otherwise.
+var DefaultConnectPorts = []int{443, 8443}
+
+// PortException lets the listed users and the members of the listed groups
+// tunnel to Ports too, to any port when Ports is empty.
+type PortException struct {
+	Users  []string
+	Groups []string
+	Ports  []int
 }
 
 func NewHttspRoute() (*HttpsRoute, error) {
-	return &HttpsRoute{}, nil
+	return &HttpsRoute{tunnels: newTunnelRegistry(), connectPorts: DefaultConnectPorts}, nil
+}
+
+// Tunnels lists the open tunnels, oldest first.
+func (hs *HttpsRoute) Tunnels() []TunnelInfo {
+	return hs.tunnels.list()
+}
+
+// CloseTunnel closes the open tunnel with the given id.
+func (hs *HttpsRoute) CloseTunnel(id string) error {
+	return hs.tunnels.kill(id)
+}
+
+// SetTunnelLogger sets the logger receiving one record per tunnel when it closes.
+func (hs *HttpsRoute) SetTunnelLogger(tl filters.TunnelLogger) error {
+	if tl == nil {
+		return errors.New("TunnelLogger = <nil>")
+	}
+	hs.tunnelLogger = tl
+	return nil
+}
+
+// SetTunnelObserver sets the observer told when tunnels open and close, e.g. the metrics.
+func (hs *HttpsRoute) SetTunnelObserver(to filters.TunnelObserver) error {
+	if to == nil {
+		return errors.New("TunnelObserver = <nil>")
+	}
+	hs.tunnelObserver = to
+	return nil
+}
+
+// SetErrorPages sets the pages failed CONNECT requests are answered with.
+func (hs *HttpsRoute) SetErrorPages(ep *ErrorPages) error {
+	if ep == nil {
+		return errors.New("ErrorPages = <nil>")
+	}
+	hs.errorPages = ep
+	return nil
+}
+
+// SetACL sets the ACL the CONNECT targets are checked against, before and
+// while dialing them.
+func (hs *HttpsRoute) SetACL(acl *filters.ACL) error {
+	if acl == nil {
+		return errors.New("ACL = <nil>")
+	}
+	hs.acl = acl
+	return nil
+}
+
+// SetRateLimiter sets the rate limits the CONNECT requests are subject to,
+// the requests over one of them are refused with a 429.
+func (hs *HttpsRoute) SetRateLimiter(rf *filters.RateLimitFilter) error {
+	if rf == nil {
+		return errors.New("RateLimitFilter = <nil>")
+	}
+	hs.rateLimiter = rf
+	return nil
+}
+
+// SetConnectPorts sets the ports CONNECT tunnels may reach and the users
+// and groups who may reach more, the other tunnels are refused with a 403.
+func (hs *HttpsRoute) SetConnectPorts(ports []int, exceptions []PortException) error {
+	if len(ports) == 0 {
+		return errors.New("invalid input : no CONNECT ports")
+	}
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid CONNECT port : %d", port)
+		}
+	}
+	for _, pe := range exceptions {
+		if len(pe.Users) == 0 && len(pe.Groups) == 0 {
+			return errors.New("invalid CONNECT port exception : no users or groups")
+		}
+	}
+	hs.connectPorts = ports
+	hs.portExceptions = exceptions
+	return nil
+}
+
+// connectPortAllowed reports whether the user in ctx may tunnel to port.
+func (hs *HttpsRoute) connectPortAllowed(ctx context.Context, port int) bool {
+	if containsPort(hs.connectPorts, port) {
+		return true
+	}
+	principal, authenticated := filters.AuthFromCtx(ctx)
+	groups := filters.GroupsFromCtx(ctx)
+	for _, pe := range hs.portExceptions {
+		if len(pe.Ports) > 0 && !containsPort(pe.Ports, port) {
+			continue
+		}
+		for _, user := range pe.Users {
+			if authenticated && user == principal {
+				return true
+			}
+		}
+		for _, group := range pe.Groups {
+			for _, g := range groups {
+				if g == group {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// SetIdleTimeout closes tunnels without traffic in either direction for d, 0 disables it.
+func (hs *HttpsRoute) SetIdleTimeout(d time.Duration) error {
+	if d < 0 {
+		return errors.New("negative idle timeout")
+	}
+	hs.idleTimeout = d
+	return nil
+}
+
+// SetTunnelQuotas caps the number and the bandwidth of the tunnels, CONNECT
+// and upgraded alike, the tunnels over a count cap are refused with a 429.
+func (hs *HttpsRoute) SetTunnelQuotas(q TunnelQuotas) error {
+	if q == (TunnelQuotas{}) {
+		hs.quota = nil
+		return nil
+	}
+	tq, err := newTunnelQuota(q)
+	if err != nil {
+		return err
+	}
+	hs.quota = tq
+	return nil
+}
+
+// quotaUser is who the quotas of the tunnel requested in ctx count against.
+func quotaUser(ctx context.Context, info *filters.RequestInfo) string {
+	if principal, ok := filters.AuthFromCtx(ctx); ok {
+		return "principal=" + principal
+	}
+	return "client_ip=" + info.ClientIP
+}
+
+// ReserveTunnel counts the tunnel requested in ctx to target against the
+// quotas, it returns a 429 policy error when a count cap is reached. The
+// reservation is handed to Tunnel, or released if the tunnel is not run.
+func (hs *HttpsRoute) ReserveTunnel(ctx context.Context, info *filters.RequestInfo, target string) (TunnelReservation, error) {
+	tq := hs.quota
+	if tq == nil {
+		return TunnelReservation{}, nil
+	}
+	user := quotaUser(ctx, info)
+	limiters, ok := tq.acquire(user)
+	if !ok {
+		util.Warnln("tunnel quota reached", "request_id="+info.ID, "client_ip="+info.ClientIP, user, "target="+target)
+		return TunnelReservation{}, filters.NewPolicyError(http.StatusTooManyRequests, "Too many open tunnels.")
+	}
+	return TunnelReservation{limiters: limiters, release: func() { tq.release(user) }}, nil
 }
 
 func (hs *HttpsRoute) HandleF(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	destConn, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+	info, ok := filters.RequestInfoFromCtx(ctx)
+	if !ok {
+		info = filters.NewRequestInfo(r)
+	}
+	target := filters.TargetOf(r)
+	if _, port, err := net.SplitHostPort(r.Host); err != nil || port == "" {
+		pe := filters.NewClientError(http.StatusBadRequest, "The CONNECT target must be host:port.", fmt.Errorf("CONNECT target %q : %v", r.Host, err))
+		hs.errorPages.Write(w, r, pe, info.ID)
+		return
+	}
+	if hs.rateLimiter != nil {
+		if err := hs.rateLimiter.Check(ctx, r); err != nil {
+			hs.errorPages.Write(w, r, filters.ToProxyError(err), info.ID)
+			return
+		}
+	}
+	if !hs.connectPortAllowed(ctx, target.Port) {
+		principal, _ := filters.AuthFromCtx(ctx)
+		util.Warnln("CONNECT : denied port", target.Port, "request_id="+info.ID, "client_ip="+info.ClientIP, "principal="+principal, "target="+r.Host)
+		pe := filters.NewPolicyError(http.StatusForbidden, "Tunnels to port "+strconv.Itoa(target.Port)+" are not allowed.")
+		hs.errorPages.Write(w, r, pe, info.ID)
+		return
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if hs.acl != nil {
+		if err := hs.acl.Check(ctx, target); err != nil {
+			hs.errorPages.Write(w, r, filters.ToProxyError(err), info.ID)
+			return
+		}
+		dialer.Control = hs.acl.DialControl
+	}
+
+	reservation, err := hs.ReserveTunnel(ctx, info, r.Host)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		hs.errorPages.Write(w, r, filters.ToProxyError(err), info.ID)
+		return
+	}
+	// the tunnel outlives HandleF, it gives the quota back itself once closed
+	tunnelling := false
+	defer func() {
+		if !tunnelling {
+			reservation.Release()
+		}
+	}()
+
+	destConn, err := dialer.DialContext(ctx, "tcp", r.Host)
+	if err != nil {
+		pe, ok := filters.AsProxyError(err)
+		if !ok {
+			pe = filters.NewUpstreamError(r.Host, err)
+		}
+		util.Errorln("error_id="+info.ID, "category="+string(pe.Category), r.Method, r.Host, ":", pe)
+		hs.errorPages.Write(w, r, pe, info.ID)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -35,12 +280,135 @@ func (hs *HttpsRoute) HandleF(ctx context.Context, w http.ResponseWriter, r *htt
 		return
 	}
 
-	go hs.transfer(ctx, destConn, clientConn)
-	go hs.transfer(ctx, clientConn, destConn)
+	rec := filters.TunnelLogRecord{
+		Time:      info.Start,
+		RequestID: info.ID,
+		ClientIP:  info.ClientIP,
+		Target:    r.Host,
+	}
+	if principal, ok := filters.AuthFromCtx(ctx); ok {
+		rec.Principal = principal
+	}
+	tunnelling = true
+	go hs.Tunnel(ctx, clientConn, destConn, rec, reservation)
+}
+
+// Tunnel splices the connections of a CONNECT request, or of an upgraded
+// HTTP request, e.g. a WebSocket: the tunnel is listed, logged, metered and
+// throttled alike. It returns once both connections are closed, and the
+// reservation released.
+func (hs *HttpsRoute) Tunnel(ctx context.Context, clientConn net.Conn, destConn io.ReadWriteCloser, rec filters.TunnelLogRecord, reservation TunnelReservation) {
+	defer reservation.Release()
+	hs.tunnel(ctx, clientConn, destConn, rec, reservation.limiters)
+}
+
+type transferResult struct {
+	fromClient bool
+	err        error
+}
+
+// tunnel copies bytes both ways until one side closes, errors or the tunnel
+// goes idle, then closes both connections and logs the tunnel. The writes
+// of both directions wait on the bandwidth limiters.
+func (hs *HttpsRoute) tunnel(ctx context.Context, clientConn net.Conn, destConn io.ReadWriteCloser, rec filters.TunnelLogRecord, limiters []*bandwidthLimiter) {
+	if hs.tunnelObserver != nil {
+		hs.tunnelObserver.TunnelOpened()
+	}
+	at := &activeTunnel{rec: rec, clientConn: clientConn, destConn: destConn}
+	hs.tunnels.add(at)
+	defer hs.tunnels.remove(rec.RequestID)
+
+	var lastActivity atomic.Int64
+	lastActivity.Store(time.Now().UnixNano())
+
+	// closed once a direction ends, a throttled write of the other one gives up
+	done := make(chan struct{})
+	results := make(chan transferResult, 2)
+	go func() {
+		err := hs.transfer(ctx, destConn, clientConn, &lastActivity, &at.bytesUpstream, limiters, done)
+		results <- transferResult{fromClient: true, err: err}
+	}()
+	go func() {
+		err := hs.transfer(ctx, clientConn, destConn, &lastActivity, &at.bytesClient, limiters, done)
+		results <- transferResult{fromClient: false, err: err}
+	}()
+
+	first := <-results
+	close(done)
+	clientConn.Close()
+	destConn.Close()
+	<-results
+
+	rec.CloseReason, rec.Error = closeReason(first)
+	if at.killed.Load() {
+		rec.CloseReason, rec.Error = filters.TunnelClosedKilled, ""
+	}
+	rec.BytesUpstream = at.bytesUpstream.Load()
+	rec.BytesClient = at.bytesClient.Load()
+	rec.Duration = time.Since(rec.Time)
+	if hs.tunnelLogger != nil {
+		hs.tunnelLogger.LogTunnel(rec)
+	}
+	if hs.tunnelObserver != nil {
+		hs.tunnelObserver.TunnelClosed(rec)
+	}
 }
 
-func (hs *HttpsRoute) transfer(cxt context.Context, destination io.WriteCloser, source io.ReadCloser) {
-	defer destination.Close()
-	defer source.Close()
-	io.Copy(destination, source)
+func closeReason(res transferResult) (string, string) {
+	switch {
+	case res.err == nil && res.fromClient:
+		return filters.TunnelClosedClientEOF, ""
+	case res.err == nil:
+		return filters.TunnelClosedUpstreamEOF, ""
+	case errors.Is(res.err, os.ErrDeadlineExceeded):
+		return filters.TunnelClosedIdleTimeout, ""
+	default:
+		return filters.TunnelClosedError, res.err.Error()
+	}
+}
+
+// readDeadliner is a source transfer can time out, the upstream side of an
+// upgraded connection may not be one; the client side always is.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// transfer copies source to destination, adding the bytes written to
+// written; a nil error means source reached EOF. With an idle timeout set,
+// reads give up once neither direction has seen traffic for that long.
+// Each write first waits for the limiters to let its bytes through.
+func (hs *HttpsRoute) transfer(cxt context.Context, destination io.Writer, source io.Reader, lastActivity, written *atomic.Int64, limiters []*bandwidthLimiter, done <-chan struct{}) error {
+	buf := make([]byte, 32*1024)
+	deadliner, canTimeout := source.(readDeadliner)
+	for {
+		if hs.idleTimeout > 0 && canTimeout {
+			deadliner.SetReadDeadline(time.Unix(0, lastActivity.Load()).Add(hs.idleTimeout))
+		}
+		nr, rerr := source.Read(buf)
+		if nr > 0 {
+			lastActivity.Store(time.Now().UnixNano())
+			if len(limiters) > 0 {
+				if !throttle(limiters, nr, done) {
+					return net.ErrClosed
+				}
+				// a throttled tunnel is not idle
+				lastActivity.Store(time.Now().UnixNano())
+			}
+			nw, werr := destination.Write(buf[:nr])
+			written.Add(int64(nw))
+			if werr != nil {
+				return werr
+			}
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+		if rerr != nil {
+			if errors.Is(rerr, os.ErrDeadlineExceeded) && time.Since(time.Unix(0, lastActivity.Load())) < hs.idleTimeout {
+				// the other direction was active meanwhile
+				continue
+			}
+			return rerr
+		}
+	}
 }
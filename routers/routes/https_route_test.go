@@ -0,0 +1,245 @@
+package routes
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingTunnelLogger struct {
+	records chan filters.TunnelLogRecord
+}
+
+func (r *recordingTunnelLogger) LogTunnel(rec filters.TunnelLogRecord) {
+	r.records <- rec
+}
+
+func newTestTunnel(t *testing.T, idleTimeout time.Duration) (client, upstream net.Conn, logger *recordingTunnelLogger) {
+	hs, _ := NewHttspRoute()
+	client, upstream, logger = newTestTunnelOn(t, hs, idleTimeout, "t1")
+	return client, upstream, logger
+}
+
+func newTestTunnelOn(t *testing.T, hs *HttpsRoute, idleTimeout time.Duration, id string) (client, upstream net.Conn, logger *recordingTunnelLogger) {
+	logger = &recordingTunnelLogger{records: make(chan filters.TunnelLogRecord, 1)}
+	assert.NoError(t, hs.SetTunnelLogger(logger))
+	assert.NoError(t, hs.SetIdleTimeout(idleTimeout))
+
+	client, proxyClientSide := net.Pipe()
+	proxyUpstreamSide, upstream := net.Pipe()
+	rec := filters.TunnelLogRecord{Time: time.Now(), RequestID: id, Target: "example.com:443", Principal: "alice"}
+	go hs.tunnel(context.Background(), proxyClientSide, proxyUpstreamSide, rec, nil)
+	return client, upstream, logger
+}
+
+func waitTunnelRecord(t *testing.T, logger *recordingTunnelLogger) filters.TunnelLogRecord {
+	select {
+	case rec := <-logger.records:
+		return rec
+	case <-time.After(2 * time.Second):
+		t.Fatal("no tunnel record logged")
+		return filters.TunnelLogRecord{}
+	}
+}
+
+func TestHttpsRouteTunnelLog(t *testing.T) {
+	t.Run("Client EOF", func(t *testing.T) {
+		client, upstream, logger := newTestTunnel(t, 0)
+		go io.Copy(io.Discard, client)
+		go func() {
+			buf := make([]byte, 5)
+			io.ReadFull(upstream, buf)
+			upstream.Write([]byte("response"))
+		}()
+		client.Write([]byte("hello"))
+		time.Sleep(50 * time.Millisecond)
+		client.Close()
+
+		rec := waitTunnelRecord(t, logger)
+		assert.Equal(t, filters.TunnelClosedClientEOF, rec.CloseReason)
+		assert.Equal(t, int64(5), rec.BytesUpstream)
+		assert.Equal(t, int64(8), rec.BytesClient)
+		assert.Equal(t, "alice", rec.Principal)
+		assert.Equal(t, "example.com:443", rec.Target)
+	})
+
+	t.Run("Upstream EOF", func(t *testing.T) {
+		client, upstream, logger := newTestTunnel(t, 0)
+		defer client.Close()
+		go io.Copy(io.Discard, client)
+		upstream.Close()
+
+		rec := waitTunnelRecord(t, logger)
+		assert.Equal(t, filters.TunnelClosedUpstreamEOF, rec.CloseReason)
+	})
+
+	t.Run("Idle timeout", func(t *testing.T) {
+		client, upstream, logger := newTestTunnel(t, 50*time.Millisecond)
+		defer client.Close()
+		defer upstream.Close()
+
+		rec := waitTunnelRecord(t, logger)
+		assert.Equal(t, filters.TunnelClosedIdleTimeout, rec.CloseReason)
+		assert.True(t, rec.Duration >= 50*time.Millisecond)
+	})
+}
+
+func TestHttpsRouteCloseTunnel(t *testing.T) {
+	hs, _ := NewHttspRoute()
+	client, upstream, logger := newTestTunnelOn(t, hs, 0, "t1")
+	defer client.Close()
+	defer upstream.Close()
+	go io.Copy(io.Discard, upstream)
+	client.Write([]byte("ping"))
+
+	var tunnels []TunnelInfo
+	for i := 0; i < 100 && (len(tunnels) == 0 || tunnels[0].BytesUpstream == 0); i++ {
+		tunnels = hs.Tunnels()
+		time.Sleep(time.Millisecond)
+	}
+	if assert.Len(t, tunnels, 1) {
+		assert.Equal(t, "t1", tunnels[0].ID)
+		assert.Equal(t, "example.com:443", tunnels[0].Target)
+		assert.Equal(t, int64(4), tunnels[0].BytesUpstream)
+	}
+
+	assert.IsType(t, ErrTunnelNotFound{}, hs.CloseTunnel("nope"))
+	assert.NoError(t, hs.CloseTunnel("t1"))
+	rec := waitTunnelRecord(t, logger)
+	assert.Equal(t, filters.TunnelClosedKilled, rec.CloseReason)
+	assert.Empty(t, hs.Tunnels())
+}
+
+func TestHttpsRouteACL(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer upstream.Close()
+
+	tests := []struct {
+		name string
+		acl  func() *filters.ACL
+	}{
+		{
+			name: "Denied by a rule",
+			acl: func() *filters.ACL {
+				acl, _ := filters.NewACL([]filters.ACLRule{{Action: filters.ACLDeny, Domains: []string{"127.0.0.1"}}}, filters.ACLAllow)
+				return acl
+			},
+		},
+		{
+			name: "Denied by the SSRF protection",
+			acl: func() *filters.ACL {
+				acl, _ := filters.NewACL(nil, filters.ACLAllow)
+				acl.SetSSRFProtection(nil)
+				return acl
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hs, _ := NewHttspRoute()
+			assert.NoError(t, hs.SetConnectPorts([]int{upstream.Addr().(*net.TCPAddr).Port}, nil))
+			assert.NoError(t, hs.SetACL(tt.acl()))
+			req := httptest.NewRequest(http.MethodConnect, "http://"+upstream.Addr().String(), nil)
+			req.Host = upstream.Addr().String()
+			req.URL = &url.URL{Host: req.Host}
+			w := httptest.NewRecorder()
+			hs.HandleF(context.Background(), w, req)
+			assert.Equal(t, http.StatusForbidden, w.Code)
+		})
+	}
+	hs, _ := NewHttspRoute()
+	assert.Error(t, hs.SetACL(nil))
+}
+
+func TestHttpsRouteConnectPorts(t *testing.T) {
+	hs, _ := NewHttspRoute()
+	assert.NoError(t, hs.SetConnectPorts([]int{443, 8443}, []PortException{
+		{Users: []string{"alice"}, Ports: []int{22}},
+		{Groups: []string{"ops"}},
+	}))
+	alice := filters.WithPrincipal(context.Background(), "alice", nil)
+	ops := filters.WithPrincipal(context.Background(), "bob", []string{"staff", "ops"})
+	bob := filters.WithPrincipal(context.Background(), "bob", []string{"staff"})
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		port int
+		want bool
+	}{
+		{name: "Allowed port", ctx: context.Background(), port: 443, want: true},
+		{name: "Other allowed port", ctx: bob, port: 8443, want: true},
+		{name: "SMTP", ctx: bob, port: 25},
+		{name: "Anonymous", ctx: context.Background(), port: 22},
+		{name: "User exception", ctx: alice, port: 22, want: true},
+		{name: "User exception other port", ctx: alice, port: 25},
+		{name: "Group exception any port", ctx: ops, port: 25, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, hs.connectPortAllowed(tt.ctx, tt.port))
+		})
+	}
+
+	assert.Error(t, hs.SetConnectPorts(nil, nil))
+	assert.Error(t, hs.SetConnectPorts([]int{0}, nil))
+	assert.Error(t, hs.SetConnectPorts([]int{443}, []PortException{{Ports: []int{22}}}))
+}
+
+func TestHttpsRouteRateLimit(t *testing.T) {
+	hs, _ := NewHttspRoute()
+	rf, _ := filters.NewRateLimitFilter(filters.NewMemoryRateLimitStore())
+	assert.NoError(t, rf.SetLimits([]filters.RateLimit{{Key: filters.RateLimitKeyHost, Requests: 1, Per: time.Minute}}, nil))
+	assert.NoError(t, hs.SetRateLimiter(rf))
+	assert.Error(t, hs.SetRateLimiter(nil))
+
+	connect := func(host string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodConnect, "http://"+host, nil)
+		req.Host = host
+		req.URL = &url.URL{Host: host}
+		w := httptest.NewRecorder()
+		hs.HandleF(context.Background(), w, req)
+		return w
+	}
+	// port 25 is not allowed, the requests within the limit get the 403
+	assert.Equal(t, http.StatusForbidden, connect("mail.example.com:25").Code)
+	w := connect("mail.example.com:25")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusForbidden, connect("other.example.com:25").Code, "the limit is per host")
+}
+
+func TestHttpsRouteConnectPortDenied(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer upstream.Close()
+
+	tests := []struct {
+		name       string
+		host       string
+		wantStatus int
+	}{
+		{name: "Port not allowed", host: upstream.Addr().String(), wantStatus: http.StatusForbidden},
+		{name: "No port", host: "127.0.0.1", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hs, _ := NewHttspRoute()
+			req := httptest.NewRequest(http.MethodConnect, "http://"+tt.host, nil)
+			req.Host = tt.host
+			req.URL = &url.URL{Host: tt.host}
+			w := httptest.NewRecorder()
+			hs.HandleF(context.Background(), w, req)
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package routes
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// TunnelQuotas caps the tunnels: their number, overall and per user, and
+// their throughput in bytes per second, per tunnel and per user over all
+// of its tunnels, both directions counted. Zero values mean no limit. The
+// user is the authenticated principal, or the client IP without one.
+type TunnelQuotas struct {
+	MaxTunnels        int
+	MaxTunnelsPerUser int
+	TunnelBandwidth   int64
+	UserBandwidth     int64
+}
+
+// tunnelQuota keeps the counts and the bandwidth limiters, it is shared by
+// the copies of the route.
+type tunnelQuota struct {
+	quotas TunnelQuotas
+
+	mu    sync.Mutex
+	total int
+	users map[string]*userTunnels
+}
+
+type userTunnels struct {
+	count     int
+	bandwidth *bandwidthLimiter
+}
+
+func newTunnelQuota(q TunnelQuotas) (*tunnelQuota, error) {
+	if q.MaxTunnels < 0 || q.MaxTunnelsPerUser < 0 || q.TunnelBandwidth < 0 || q.UserBandwidth < 0 {
+		return nil, errors.New("invalid input : negative TunnelQuotas")
+	}
+	return &tunnelQuota{quotas: q, users: map[string]*userTunnels{}}, nil
+}
+
+// acquire counts a tunnel of user, it reports false when a cap is reached.
+// The tunnel's limiters are returned, release gives the tunnel back.
+func (tq *tunnelQuota) acquire(user string) ([]*bandwidthLimiter, bool) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	ut := tq.users[user]
+	if tq.quotas.MaxTunnels > 0 && tq.total >= tq.quotas.MaxTunnels {
+		return nil, false
+	}
+	if ut != nil && tq.quotas.MaxTunnelsPerUser > 0 && ut.count >= tq.quotas.MaxTunnelsPerUser {
+		return nil, false
+	}
+	if ut == nil {
+		ut = &userTunnels{}
+		if tq.quotas.UserBandwidth > 0 {
+			ut.bandwidth = newBandwidthLimiter(tq.quotas.UserBandwidth)
+		}
+		tq.users[user] = ut
+	}
+	ut.count++
+	tq.total++
+
+	var limiters []*bandwidthLimiter
+	if tq.quotas.TunnelBandwidth > 0 {
+		limiters = append(limiters, newBandwidthLimiter(tq.quotas.TunnelBandwidth))
+	}
+	if ut.bandwidth != nil {
+		limiters = append(limiters, ut.bandwidth)
+	}
+	return limiters, true
+}
+
+func (tq *tunnelQuota) release(user string) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	tq.total--
+	if ut := tq.users[user]; ut != nil {
+		ut.count--
+		if ut.count <= 0 {
+			delete(tq.users, user)
+		}
+	}
+}
+
+// TunnelReservation is a tunnel counted against the quotas, see
+// HttpsRoute.ReserveTunnel. The zero value holds no quota.
+type TunnelReservation struct {
+	limiters []*bandwidthLimiter
+	release  func()
+}
+
+// Release gives the tunnel back to the quotas. Tunnel releases the
+// reservation once the tunnel closes, Release is for the tunnels never run.
+func (tr TunnelReservation) Release() {
+	if tr.release != nil {
+		tr.release()
+	}
+}
+
+// bandwidthLimiter is a token bucket of bytes holding a second of traffic.
+// A write may take more tokens than there are, the next ones wait for the
+// debt to be paid back, so the rate holds over time whatever the write sizes.
+type bandwidthLimiter struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	return &bandwidthLimiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now(), now: time.Now}
+}
+
+// take takes n bytes of tokens and returns how long to wait before sending them.
+func (bl *bandwidthLimiter) take(n int) time.Duration {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	now := bl.now()
+	bl.tokens += now.Sub(bl.last).Seconds() * bl.rate
+	if bl.tokens > bl.rate {
+		bl.tokens = bl.rate
+	}
+	bl.last = now
+	bl.tokens -= float64(n)
+	if bl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bl.tokens / bl.rate * float64(time.Second))
+}
+
+// throttle waits until n bytes may go through all the limiters, it returns
+// false when done is closed first.
+func throttle(limiters []*bandwidthLimiter, n int, done <-chan struct{}) bool {
+	var wait time.Duration
+	for _, bl := range limiters {
+		if d := bl.take(n); d > wait {
+			wait = d
+		}
+	}
+	if wait <= 0 {
+		return true
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-done:
+		return false
+	case <-t.C:
+		return true
+	}
+}
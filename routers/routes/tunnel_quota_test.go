@@ -0,0 +1,109 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/LamineKouissi/LHP/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTunnelQuotaAcquire(t *testing.T) {
+	tq, err := newTunnelQuota(TunnelQuotas{MaxTunnels: 3, MaxTunnelsPerUser: 2})
+	assert.NoError(t, err)
+
+	steps := []struct {
+		user    string
+		release bool
+		want    bool
+	}{
+		{user: "alice", want: true},
+		{user: "alice", want: true},
+		{user: "alice", want: false},
+		{user: "bob", want: true},
+		{user: "carol", want: false},
+		{user: "alice", release: true},
+		{user: "carol", want: true},
+		{user: "alice", want: false},
+	}
+	for i, s := range steps {
+		if s.release {
+			tq.release(s.user)
+			continue
+		}
+		_, ok := tq.acquire(s.user)
+		assert.Equal(t, s.want, ok, "step %d", i)
+	}
+
+	_, err = newTunnelQuota(TunnelQuotas{MaxTunnels: -1})
+	assert.Error(t, err)
+}
+
+func TestTunnelQuotaLimiters(t *testing.T) {
+	tq, _ := newTunnelQuota(TunnelQuotas{TunnelBandwidth: 1000, UserBandwidth: 1500})
+	a1, _ := tq.acquire("alice")
+	a2, _ := tq.acquire("alice")
+	b1, _ := tq.acquire("bob")
+	if assert.Len(t, a1, 2) && assert.Len(t, a2, 2) && assert.Len(t, b1, 2) {
+		assert.True(t, a1[0] != a2[0], "each tunnel has its own limiter")
+		assert.True(t, a1[1] == a2[1], "the tunnels of a user share theirs")
+		assert.True(t, a1[1] != b1[1])
+	}
+
+	tq.release("alice")
+	tq.release("alice")
+	a3, _ := tq.acquire("alice")
+	assert.True(t, a1[1] != a3[1], "the limiter of a user goes with their last tunnel")
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	bl := newBandwidthLimiter(1000)
+	bl.now = func() time.Time { return now }
+	bl.last = now
+
+	assert.Equal(t, time.Duration(0), bl.take(600))
+	assert.Equal(t, time.Duration(0), bl.take(400))
+	assert.Equal(t, 500*time.Millisecond, bl.take(500))
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, 200*time.Millisecond, bl.take(200))
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, time.Duration(0), bl.take(1000), "the bucket holds a second of traffic")
+	assert.Equal(t, time.Millisecond, bl.take(1))
+}
+
+func TestThrottle(t *testing.T) {
+	assert.True(t, throttle(nil, 1<<20, nil))
+
+	bl := newBandwidthLimiter(1000)
+	assert.True(t, throttle([]*bandwidthLimiter{bl}, 1000, nil))
+	start := time.Now()
+	assert.True(t, throttle([]*bandwidthLimiter{bl}, 50, nil))
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+
+	done := make(chan struct{})
+	close(done)
+	assert.False(t, throttle([]*bandwidthLimiter{bl}, 10000, done))
+}
+
+func TestHttpsRouteTunnelQuota(t *testing.T) {
+	hs, _ := NewHttspRoute()
+	assert.NoError(t, hs.SetTunnelQuotas(TunnelQuotas{MaxTunnelsPerUser: 1}))
+	hs.quota.acquire("principal=alice")
+
+	req := httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	req.Host = "example.com:443"
+	req.URL = &url.URL{Host: req.Host}
+	w := httptest.NewRecorder()
+	hs.HandleF(filters.WithPrincipal(context.Background(), "alice", nil), w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, 1, hs.quota.total, "a refused tunnel holds no quota")
+
+	assert.NoError(t, hs.SetTunnelQuotas(TunnelQuotas{}))
+	assert.Nil(t, hs.quota)
+	assert.Error(t, hs.SetTunnelQuotas(TunnelQuotas{UserBandwidth: -1}))
+}
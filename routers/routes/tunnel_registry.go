@@ -0,0 +1,95 @@
+package routes
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/LamineKouissi/LHP/filters"
+)
+
+// TunnelInfo describes an open CONNECT tunnel or upgraded connection.
+type TunnelInfo struct {
+	ID            string    `json:"id"`
+	ClientIP      string    `json:"client_ip"`
+	Principal     string    `json:"principal,omitempty"`
+	Target        string    `json:"target"`
+	Start         time.Time `json:"start"`
+	BytesUpstream int64     `json:"bytes_upstream"`
+	BytesClient   int64     `json:"bytes_client"`
+}
+
+type activeTunnel struct {
+	rec           filters.TunnelLogRecord
+	clientConn    net.Conn
+	destConn      io.ReadWriteCloser
+	bytesUpstream atomic.Int64
+	bytesClient   atomic.Int64
+	killed        atomic.Bool
+}
+
+type tunnelRegistry struct {
+	mu      sync.Mutex
+	tunnels map[string]*activeTunnel
+}
+
+func newTunnelRegistry() *tunnelRegistry {
+	return &tunnelRegistry{tunnels: map[string]*activeTunnel{}}
+}
+
+func (tr *tunnelRegistry) add(at *activeTunnel) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.tunnels[at.rec.RequestID] = at
+}
+
+func (tr *tunnelRegistry) remove(id string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	delete(tr.tunnels, id)
+}
+
+func (tr *tunnelRegistry) list() []TunnelInfo {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	infos := make([]TunnelInfo, 0, len(tr.tunnels))
+	for id, at := range tr.tunnels {
+		infos = append(infos, TunnelInfo{
+			ID:            id,
+			ClientIP:      at.rec.ClientIP,
+			Principal:     at.rec.Principal,
+			Target:        at.rec.Target,
+			Start:         at.rec.Time,
+			BytesUpstream: at.bytesUpstream.Load(),
+			BytesClient:   at.bytesClient.Load(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Start.Before(infos[j].Start) })
+	return infos
+}
+
+// ErrTunnelNotFound is returned when closing a tunnel that is not open.
+type ErrTunnelNotFound struct {
+	ID string
+}
+
+func (e ErrTunnelNotFound) Error() string {
+	return fmt.Sprintf("no open tunnel with id %q", e.ID)
+}
+
+func (tr *tunnelRegistry) kill(id string) error {
+	tr.mu.Lock()
+	at, ok := tr.tunnels[id]
+	tr.mu.Unlock()
+	if !ok {
+		return ErrTunnelNotFound{ID: id}
+	}
+	at.killed.Store(true)
+	at.clientConn.Close()
+	at.destConn.Close()
+	return nil
+}
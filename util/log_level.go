@@ -0,0 +1,62 @@
+package util
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+type LogLevel int32
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LogLevelDebug || l > LogLevelError {
+		return fmt.Sprintf("LogLevel(%d)", int32(l))
+	}
+	return logLevelNames[l]
+}
+
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(name, n) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level : %q", name)
+}
+
+var logLevel atomic.Int32
+
+func init() {
+	logLevel.Store(int32(LogLevelInfo))
+}
+
+// SetLogLevel changes the level of the leveled logging functions at runtime.
+func SetLogLevel(l LogLevel) {
+	logLevel.Store(int32(l))
+}
+
+func GetLogLevel() LogLevel {
+	return LogLevel(logLevel.Load())
+}
+
+func logAt(l LogLevel, v []any) {
+	if l < GetLogLevel() {
+		return
+	}
+	log.Println(append([]any{strings.ToUpper(l.String())}, v...)...)
+}
+
+func Debugln(v ...any) { logAt(LogLevelDebug, v) }
+func Infoln(v ...any)  { logAt(LogLevelInfo, v) }
+func Warnln(v ...any)  { logAt(LogLevelWarn, v) }
+func Errorln(v ...any) { logAt(LogLevelError, v) }
@@ -0,0 +1,34 @@
+package util
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogLevel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	defer SetLogLevel(GetLogLevel())
+
+	l, err := ParseLogLevel("WARN")
+	assert.NoError(t, err)
+	assert.Equal(t, LogLevelWarn, l)
+	_, err = ParseLogLevel("verbose")
+	assert.Error(t, err)
+
+	SetLogLevel(l)
+	Infoln("hidden")
+	Warnln("shown")
+	assert.NotContains(t, buf.String(), "hidden")
+	assert.Contains(t, buf.String(), "WARN shown")
+
+	SetLogLevel(LogLevelDebug)
+	Debugln("details")
+	assert.Contains(t, buf.String(), "DEBUG details")
+	assert.Equal(t, "debug", GetLogLevel().String())
+}